@@ -2,6 +2,7 @@ package annbench
 
 import (
 	"container/heap"
+	"github.com/gasparian/lsh-search-go/datagen"
 	lsh "github.com/gasparian/lsh-search-go/lsh"
 	"github.com/gasparian/lsh-search-go/store"
 	guuid "github.com/google/uuid"
@@ -15,6 +16,8 @@ import (
 
 const (
 	Tol = 1e-6
+	// blockSize is a number of vectors to calculate distances for at once
+	blockSize = 1024
 )
 
 type BenchDataConfig struct {
@@ -74,8 +77,14 @@ func (nn *NNMock) Train(vecs [][]float64, ids []string) error {
 		return err
 	}
 	for i, vec := range vecs {
-		nn.index.SetVector(ids[i], vec)
-		nn.index.SetHash("0", ids[i])
+		err = nn.index.SetVector(ids[i], vec)
+		if err != nil {
+			return err
+		}
+		err = nn.index.SetHash(0, ids[i])
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -88,34 +97,43 @@ func (nn *NNMock) Search(query []float64, maxNN int, distanceThrsh float64) ([]l
 	closestSet := make(map[string]bool)
 	minHeap := new(lsh.NeighborMinHeap)
 
-	iter, _ := nn.index.GetHashIterator("0")
-	for {
-		if minHeap.Len() >= maxCandidates {
-			break
-		}
-		id, opened := iter.Next()
-		if !opened {
-			break
+	iter, err := nn.index.GetHashIterator(0)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, blockSize)
+	vecs := make([][]float64, 0, blockSize)
+	for opened := true; opened && minHeap.Len() < maxCandidates; {
+		var id string
+		id, opened = iter.Next()
+		if opened && !closestSet[id] {
+			vec, err := nn.index.GetVector(id)
+			if err != nil {
+				return nil, err
+			}
+			closestSet[id] = true
+			ids = append(ids, id)
+			vecs = append(vecs, vec)
 		}
-		if closestSet[id] {
+		if opened && len(vecs) < blockSize {
 			continue
 		}
-		vec, err := nn.index.GetVector(id)
-		if err != nil {
-			return nil, err
-		}
-		dist := nn.distanceMetric.GetDist(vec, query)
-		if dist <= distanceThrsh {
-			closestSet[id] = true
-			heap.Push(
-				minHeap,
-				&lsh.Neighbor{
-					ID:   id,
-					Vec:  vec,
-					Dist: dist,
-				},
-			)
+		// NOTE: distances are calculated for the whole block at once
+		dists := lsh.GetDists(nn.distanceMetric, [][]float64{query}, vecs)[0]
+		for i, dist := range dists {
+			if dist <= distanceThrsh {
+				heap.Push(
+					minHeap,
+					&lsh.Neighbor{
+						ID:   ids[i],
+						Vec:  vecs[i],
+						Dist: dist,
+					},
+				)
+			}
 		}
+		ids = ids[:0]
+		vecs = vecs[:0]
 	}
 	closest := make([]lsh.Neighbor, 0)
 	for i := 0; i < maxNN && minHeap.Len() > 0; i++ {
@@ -291,3 +309,26 @@ func PrepHdf5BenchDataset(config *BenchDataConfig) (*BenchData, error) {
 
 	return data, nil
 }
+
+// PrepGeneratedBenchDataset converts synthetic dataset into the bench data
+func PrepGeneratedBenchDataset(generated *datagen.Dataset, sampleSize int) (*BenchData, error) {
+	data := &BenchData{
+		TrainVecs:    generated.TrainVecs,
+		TrainIds:     generated.TrainIds,
+		Test:         generated.Test,
+		Neighbors:    generated.Neighbors,
+		Distances:    generated.Distances,
+		TrainNorms:   make(map[int]float64),
+		TrainIndices: make(map[string]int),
+	}
+	for i, vec := range data.TrainVecs {
+		data.TrainNorms[i] = blas64.Nrm2(lsh.NewVec(vec))
+		data.TrainIndices[data.TrainIds[i]] = i
+	}
+	var err error
+	data.Mean, data.Std, err = lsh.GetMeanStdSampledRecords(data.TrainVecs, sampleSize)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,235 @@
+// Package datagen generates synthetic datasets with exact ground truth,
+// to test and benchmark the indexes without downloading the real ones
+package datagen
+
+import (
+	"errors"
+	"fmt"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+var (
+	configErr   = errors.New("dims, size and number of queries must be positive")
+	clustersErr = errors.New("number of clusters must be positive")
+	plantedErr  = errors.New("planted distance must be positive")
+)
+
+// Config holds parameters common to all the generators
+type Config struct {
+	Dims    int
+	Size    int
+	Queries int
+	// K is a number of the ground truth neighbors per query, 10 by default
+	K    int
+	Seed int64
+	// Metric is used for the ground truth, L2 by default
+	Metric lsh.Metric
+}
+
+func (c Config) validate() error {
+	if c.Dims <= 0 || c.Size <= 0 || c.Queries <= 0 {
+		return configErr
+	}
+	return nil
+}
+
+func (c Config) getK() int {
+	k := c.K
+	if k <= 0 {
+		k = 10
+	}
+	if k > c.Size {
+		k = c.Size
+	}
+	return k
+}
+
+func (c Config) getMetric() lsh.Metric {
+	if c.Metric == nil {
+		return lsh.NewL2()
+	}
+	return c.Metric
+}
+
+// Dataset holds train vectors, queries and the exact nearest neighbors of each query:
+// Neighbors hold indices of TrainVecs, sorted by distance
+type Dataset struct {
+	TrainVecs [][]float64
+	TrainIds  []string
+	Test      [][]float64
+	Neighbors [][]int
+	Distances [][]float64
+	// Labels hold cluster of each train vector, for the blobs only
+	Labels []int
+	// Planted holds index of the planted neighbor of each query, for the planted dataset only
+	Planted []int
+}
+
+func newDataset(config Config, train, test [][]float64) *Dataset {
+	data := &Dataset{
+		TrainVecs: train,
+		TrainIds:  make([]string, len(train)),
+		Test:      test,
+	}
+	for i := range data.TrainIds {
+		data.TrainIds[i] = strconv.Itoa(i)
+	}
+	data.Neighbors, data.Distances = GroundTruth(config.getMetric(), train, test, config.getK())
+	return data
+}
+
+func gaussian(rnd *rand.Rand, dims int, mean []float64, std float64) []float64 {
+	vec := make([]float64, dims)
+	for i := range vec {
+		vec[i] = rnd.NormFloat64() * std
+		if mean != nil {
+			vec[i] += mean[i]
+		}
+	}
+	return vec
+}
+
+func onSphere(rnd *rand.Rand, dims int) []float64 {
+	for {
+		vec := gaussian(rnd, dims, nil, 1)
+		norm := 0.0
+		for _, val := range vec {
+			norm += val * val
+		}
+		if norm == 0 {
+			continue
+		}
+		norm = math.Sqrt(norm)
+		for i := range vec {
+			vec[i] /= norm
+		}
+		return vec
+	}
+}
+
+// BlobsConfig holds parameters of the clustered dataset
+type BlobsConfig struct {
+	Clusters int
+	// Spread is a std of the cluster centers, 10 by default
+	Spread float64
+	// Std is a std of points around their center, 1 by default
+	Std float64
+}
+
+// Blobs generates isotropic Gaussian clusters; queries are drawn from the same clusters
+func Blobs(config Config, blobs BlobsConfig) (*Dataset, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	if blobs.Clusters <= 0 {
+		return nil, clustersErr
+	}
+	if blobs.Spread <= 0 {
+		blobs.Spread = 10
+	}
+	if blobs.Std <= 0 {
+		blobs.Std = 1
+	}
+	rnd := rand.New(rand.NewSource(config.Seed))
+	centers := make([][]float64, blobs.Clusters)
+	for i := range centers {
+		centers[i] = gaussian(rnd, config.Dims, nil, blobs.Spread)
+	}
+	labels := make([]int, config.Size)
+	train := make([][]float64, config.Size)
+	for i := range train {
+		labels[i] = rnd.Intn(blobs.Clusters)
+		train[i] = gaussian(rnd, config.Dims, centers[labels[i]], blobs.Std)
+	}
+	test := make([][]float64, config.Queries)
+	for i := range test {
+		test[i] = gaussian(rnd, config.Dims, centers[rnd.Intn(blobs.Clusters)], blobs.Std)
+	}
+	data := newDataset(config, train, test)
+	data.Labels = labels
+	return data, nil
+}
+
+// Hypersphere generates points uniformly distributed on the unit hypersphere, queries included
+func Hypersphere(config Config) (*Dataset, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	rnd := rand.New(rand.NewSource(config.Seed))
+	train := make([][]float64, config.Size)
+	for i := range train {
+		train[i] = onSphere(rnd, config.Dims)
+	}
+	test := make([][]float64, config.Queries)
+	for i := range test {
+		test[i] = onSphere(rnd, config.Dims)
+	}
+	return newDataset(config, train, test), nil
+}
+
+// Planted generates unit hypersphere points and plants a neighbor at the given distance
+// from each query, so the nearest neighbor is known by construction: with small distance
+// (comparing to about sqrt(2) between random points) it's also the first ground truth neighbor;
+// planted neighbors are placed at the random positions among the train vectors
+func Planted(config Config, distance float64) (*Dataset, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	if distance <= 0 {
+		return nil, plantedErr
+	}
+	if config.Queries > config.Size {
+		return nil, fmt.Errorf("number of queries %v must not exceed the size %v", config.Queries, config.Size)
+	}
+	rnd := rand.New(rand.NewSource(config.Seed))
+	train := make([][]float64, config.Size)
+	for i := range train {
+		train[i] = onSphere(rnd, config.Dims)
+	}
+	test := make([][]float64, config.Queries)
+	planted := rnd.Perm(config.Size)[:config.Queries]
+	for i := range test {
+		test[i] = onSphere(rnd, config.Dims)
+		direction := onSphere(rnd, config.Dims)
+		vec := make([]float64, config.Dims)
+		for j := range vec {
+			vec[j] = test[i][j] + distance*direction[j]
+		}
+		train[planted[i]] = vec
+	}
+	data := newDataset(config, train, test)
+	data.Planted = planted
+	return data, nil
+}
+
+// GroundTruth returns indices of k closest vectors for each query, along with the distances
+func GroundTruth(metric lsh.Metric, vecs, queries [][]float64, k int) ([][]int, [][]float64) {
+	if k > len(vecs) {
+		k = len(vecs)
+	}
+	neighbors := make([][]int, len(queries))
+	distances := make([][]float64, len(queries))
+	dists := lsh.GetDists(metric, queries, vecs)
+	for i := range queries {
+		idxs := make([]int, len(vecs))
+		for j := range idxs {
+			idxs[j] = j
+		}
+		sort.SliceStable(idxs, func(l, r int) bool {
+			return dists[i][idxs[l]] < dists[i][idxs[r]]
+		})
+		neighbors[i] = idxs[:k]
+		distances[i] = make([]float64, k)
+		for j, idx := range neighbors[i] {
+			distances[i][j] = dists[i][idx]
+		}
+	}
+	return neighbors, distances
+}
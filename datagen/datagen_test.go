@@ -0,0 +1,91 @@
+package datagen
+
+import (
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"math"
+	"testing"
+)
+
+func TestBlobs(t *testing.T) {
+	config := Config{Dims: 8, Size: 500, Queries: 10, K: 5, Seed: 1}
+	data, err := Blobs(config, BlobsConfig{Clusters: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.TrainVecs) != 500 || len(data.TrainIds) != 500 || len(data.Labels) != 500 || len(data.Test) != 10 {
+		t.Fatal("Unexpected dataset size")
+	}
+	if len(data.Neighbors[0]) != 5 || data.Distances[0][0] > data.Distances[0][4] {
+		t.Fatalf("Ground truth must be sorted by distance: %v", data.Distances[0])
+	}
+	// NOTE: neighbors of the query must belong to the same cluster
+	label := data.Labels[data.Neighbors[0][0]]
+	for _, idx := range data.Neighbors[0] {
+		if data.Labels[idx] != label {
+			t.Fatal("Closest neighbors must share the cluster")
+		}
+	}
+	same, _ := Blobs(config, BlobsConfig{Clusters: 4})
+	if same.TrainVecs[42][3] != data.TrainVecs[42][3] {
+		t.Fatal("Datasets generated with the same seed must be equal")
+	}
+	_, err = Blobs(config, BlobsConfig{})
+	if err != clustersErr {
+		t.Fatalf("Expected error %v, got %v", clustersErr, err)
+	}
+}
+
+func TestHypersphere(t *testing.T) {
+	data, err := Hypersphere(Config{Dims: 16, Size: 100, Queries: 5, Seed: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vec := range data.TrainVecs {
+		norm := 0.0
+		for _, val := range vec {
+			norm += val * val
+		}
+		if math.Abs(norm-1) > 1e-9 {
+			t.Fatalf("Points must lie on the unit sphere, got norm %v", norm)
+		}
+	}
+}
+
+func TestPlanted(t *testing.T) {
+	config := Config{Dims: 32, Size: 2000, Queries: 20, K: 1, Seed: 3}
+	data, err := Planted(config, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, planted := range data.Planted {
+		if data.Neighbors[i][0] != planted || math.Abs(data.Distances[i][0]-0.1) > 1e-9 {
+			t.Fatalf("Planted neighbor must be the closest one, got %v at %v", data.Neighbors[i][0], data.Distances[i][0])
+		}
+	}
+
+	index, err := lsh.NewLsh(lsh.Config{
+		IndexConfig:  lsh.IndexConfig{BatchSize: 250, MaxCandidates: 2000},
+		HasherConfig: lsh.HasherConfig{NTrees: 10, KMinVecs: 100, Dims: config.Dims, Seed: 1},
+	}, kv.NewKVStore(), lsh.NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = index.Train(data.TrainVecs, data.TrainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for i, query := range data.Test {
+		nns, err := index.Search(query, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nns) > 0 && nns[0].ID == data.TrainIds[data.Planted[i]] {
+			found++
+		}
+	}
+	if found < len(data.Test)/2 {
+		t.Fatalf("Expected most of the planted neighbors to be found, got %v of %v", found, len(data.Test))
+	}
+}
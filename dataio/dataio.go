@@ -0,0 +1,205 @@
+// Package dataio reads the classic word-embedding datasets: GloVe / word2vec text format
+// and word2vec binary format, token per vector
+package dataio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrMalformed is returned when the input doesn't match the expected format
+	ErrMalformed = errors.New("malformed vectors file")
+)
+
+// Record is a single token along with its' vector
+type Record struct {
+	ID  string
+	Vec []float64
+}
+
+// Reader returns records one by one, io.EOF is returned after the last one
+type Reader interface {
+	Next() (Record, error)
+}
+
+// TextReader reads `word v1 v2 ...` lines; the optional word2vec `count dims` header is skipped,
+// without it, number of dimensions is taken from the first line
+type TextReader struct {
+	scanner *bufio.Scanner
+	dims    int
+	line    int
+}
+
+// NewTextReader creates reader of the text format
+func NewTextReader(r io.Reader) *TextReader {
+	scanner := bufio.NewScanner(r)
+	// NOTE: lines of the high-dimensional vectors exceed default 64KB token limit
+	scanner.Buffer(make([]byte, 0, 1<<16), 1<<26)
+	return &TextReader{scanner: scanner}
+}
+
+func (tr *TextReader) malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: line %v: %v", ErrMalformed, tr.line, fmt.Sprintf(format, args...))
+}
+
+// Next returns the next record
+func (tr *TextReader) Next() (Record, error) {
+	for tr.scanner.Scan() {
+		tr.line++
+		fields := strings.Fields(tr.scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if tr.line == 1 && len(fields) == 2 {
+			_, countErr := strconv.Atoi(fields[0])
+			dims, dimsErr := strconv.Atoi(fields[1])
+			if countErr == nil && dimsErr == nil {
+				if dims <= 0 {
+					return Record{}, tr.malformed("invalid number of dimensions %v", dims)
+				}
+				tr.dims = dims
+				continue
+			}
+		}
+		if tr.dims == 0 {
+			tr.dims = len(fields) - 1
+			if tr.dims <= 0 {
+				return Record{}, tr.malformed("no vector components")
+			}
+		}
+		// NOTE: some GloVe tokens contain spaces, so the token is everything before the components
+		if len(fields) <= tr.dims {
+			return Record{}, tr.malformed("expected %v components, got %v", tr.dims, len(fields)-1)
+		}
+		tokenLen := len(fields) - tr.dims
+		record := Record{
+			ID:  strings.Join(fields[:tokenLen], " "),
+			Vec: make([]float64, tr.dims),
+		}
+		for i, field := range fields[tokenLen:] {
+			val, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return Record{}, tr.malformed("%v", err)
+			}
+			record.Vec[i] = val
+		}
+		return record, nil
+	}
+	if err := tr.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+// BinaryReader reads word2vec binary format: `count dims` header line, then each token
+// terminated by space, followed by dims little-endian float32 values
+type BinaryReader struct {
+	r     *bufio.Reader
+	count int
+	dims  int
+	read  int
+	buf   []byte
+}
+
+// NewBinaryReader creates reader of the word2vec binary format, reading its' header
+func NewBinaryReader(r io.Reader) (*BinaryReader, error) {
+	br := &BinaryReader{r: bufio.NewReader(r)}
+	header, err := br.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't read header: %v", ErrMalformed, err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("%w: invalid header %q", ErrMalformed, header)
+	}
+	br.count, err = strconv.Atoi(fields[0])
+	if err == nil {
+		br.dims, err = strconv.Atoi(fields[1])
+	}
+	if err != nil || br.count < 0 || br.dims <= 0 {
+		return nil, fmt.Errorf("%w: invalid header %q", ErrMalformed, header)
+	}
+	br.buf = make([]byte, 4*br.dims)
+	return br, nil
+}
+
+// Dims returns number of dimensions from the header
+func (br *BinaryReader) Dims() int {
+	return br.dims
+}
+
+// Next returns the next record
+func (br *BinaryReader) Next() (Record, error) {
+	if br.read >= br.count {
+		return Record{}, io.EOF
+	}
+	token, err := br.r.ReadString(' ')
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: record %v: can't read token: %v", ErrMalformed, br.read, err)
+	}
+	// NOTE: records may be separated by the newline, which then precedes the token
+	token = strings.TrimLeft(strings.TrimSuffix(token, " "), "\n")
+	_, err = io.ReadFull(br.r, br.buf)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: record %v: can't read vector: %v", ErrMalformed, br.read, err)
+	}
+	record := Record{ID: token, Vec: make([]float64, br.dims)}
+	for i := range record.Vec {
+		record.Vec[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(br.buf[4*i:])))
+	}
+	br.read++
+	return record, nil
+}
+
+// ReadAll reads all the records
+func ReadAll(r Reader) ([]Record, error) {
+	records := make([]Record, 0)
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// Load reads all the records of the file, files with `.bin` extension are read
+// in word2vec binary format, others in the text format
+func Load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.ToLower(filepath.Ext(path)) == ".bin" {
+		br, err := NewBinaryReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return ReadAll(br)
+	}
+	return ReadAll(NewTextReader(f))
+}
+
+// Split returns tokens and vectors of the records, ready for the index training
+func Split(records []Record) ([]string, [][]float64) {
+	ids := make([]string, len(records))
+	vecs := make([][]float64, len(records))
+	for i, record := range records {
+		ids[i] = record.ID
+		vecs[i] = record.Vec
+	}
+	return ids, vecs
+}
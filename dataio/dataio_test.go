@@ -0,0 +1,80 @@
+package dataio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTextReader(t *testing.T) {
+	for name, data := range map[string]string{
+		"glove":    "the 0.1 -0.2 3\nnew york 1 2 3\n\n",
+		"word2vec": "2 3\nthe 0.1 -0.2 3\nnew york 1 2 3\n",
+	} {
+		records, err := ReadAll(NewTextReader(strings.NewReader(data)))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if len(records) != 2 || records[0].ID != "the" || records[0].Vec[1] != -0.2 || records[1].ID != "new york" {
+			t.Fatalf("%v: unexpected records %+v", name, records)
+		}
+	}
+	_, err := ReadAll(NewTextReader(strings.NewReader("a 1 2\nb 1\n")))
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected error %v, got %v", ErrMalformed, err)
+	}
+}
+
+func writeBinary(records []Record, dims int) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%v %v\n", len(records), dims)
+	for _, record := range records {
+		buf.WriteString(record.ID + " ")
+		for _, val := range record.Vec {
+			binary.Write(buf, binary.LittleEndian, math.Float32bits(float32(val)))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func TestBinaryReader(t *testing.T) {
+	expected := []Record{
+		{ID: "cat", Vec: []float64{0.5, -1}},
+		{ID: "dog", Vec: []float64{2, 0.25}},
+	}
+	data := writeBinary(expected, 2)
+	dir, err := ioutil.TempDir("", "dataio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vectors.bin")
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, vecs := Split(records)
+	if len(ids) != 2 || ids[1] != "dog" || vecs[0][0] != 0.5 || vecs[1][1] != 0.25 {
+		t.Fatalf("Unexpected records %+v", records)
+	}
+	br, err := NewBinaryReader(bytes.NewReader(data[:len(data)-5]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadAll(br)
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected error %v for the truncated file, got %v", ErrMalformed, err)
+	}
+}
@@ -0,0 +1,146 @@
+// Package embed turns texts into vectors with the external embedding model,
+// so the index can be searched and filled by the raw texts
+package embed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrEmbeddingsNumber is returned when the model returns another number of embeddings
+	ErrEmbeddingsNumber = errors.New("number of embeddings differs from the number of texts")
+	textsNumberErr      = errors.New("number of ids and texts must be equal")
+)
+
+// Embedder returns embedding per text, in the same order
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float64, error)
+}
+
+// EmbedderFunc allows to use ordinary function as an Embedder
+type EmbedderFunc func(ctx context.Context, texts []string) ([][]float64, error)
+
+func (f EmbedderFunc) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	return f(ctx, texts)
+}
+
+// HTTPClient calls the OpenAI-compatible embeddings endpoint: POST {BaseURL}/embeddings
+// with {"model", "input"}, responding with {"data": [{"index", "embedding"}]}
+type HTTPClient struct {
+	BaseURL string
+	APIKey  string
+	Model   string
+	// Client is http.DefaultClient when not set
+	Client *http.Client
+}
+
+type embeddingsRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingsResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Embed requests embeddings of all the texts in a single call
+func (c *HTTPClient) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	body, err := json.Marshal(embeddingsRequest{Model: c.Model, Input: texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(c.BaseURL, "/")+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	parsed := embeddingsResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&parsed)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("can't decode embeddings response (status %v): %w", resp.Status, err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		if parsed.Error != nil {
+			return nil, fmt.Errorf("embeddings request failed with status %v: %v", resp.Status, parsed.Error.Message)
+		}
+		return nil, fmt.Errorf("embeddings request failed with status %v", resp.Status)
+	}
+	if len(parsed.Data) != len(texts) {
+		return nil, fmt.Errorf("%w: %v for %v texts", ErrEmbeddingsNumber, len(parsed.Data), len(texts))
+	}
+	embeddings := make([][]float64, len(texts))
+	for _, item := range parsed.Data {
+		if item.Index < 0 || item.Index >= len(texts) || embeddings[item.Index] != nil {
+			return nil, fmt.Errorf("%w: unexpected index %v", ErrEmbeddingsNumber, item.Index)
+		}
+		embeddings[item.Index] = item.Embedding
+	}
+	return embeddings, nil
+}
+
+// Inserter is a part of the lsh.LSHIndex the embedded texts are inserted into
+type Inserter interface {
+	Insert(id string, vec []float64) (uint64, error)
+}
+
+// Search embeds the text and returns its' neighbors
+func Search(ctx context.Context, embedder Embedder, index lsh.Indexer, text string, maxNN int, distanceThrsh float64) ([]lsh.Neighbor, error) {
+	embeddings, err := embedder.Embed(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != 1 {
+		return nil, ErrEmbeddingsNumber
+	}
+	return index.Search(embeddings[0], maxNN, distanceThrsh)
+}
+
+// Insert embeds the texts with a single call and inserts them into the index
+func Insert(ctx context.Context, embedder Embedder, index Inserter, ids, texts []string) error {
+	if len(ids) != len(texts) {
+		return textsNumberErr
+	}
+	embeddings, err := embedder.Embed(ctx, texts)
+	if err != nil {
+		return err
+	}
+	if len(embeddings) != len(texts) {
+		return ErrEmbeddingsNumber
+	}
+	for i, vec := range embeddings {
+		_, err = index.Insert(ids[i], vec)
+		if err != nil {
+			return fmt.Errorf("can't insert %v: %w", ids[i], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package embed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/lshtest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" || r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"message": "bad request"}}`))
+			return
+		}
+		req := embeddingsRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := `{"data": [`
+		// NOTE: embeddings may come in any order
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			embedding, _ := json.Marshal([]float64{float64(len(req.Input[i])), float64(i)})
+			index, _ := json.Marshal(i)
+			resp += `{"index": ` + string(index) + `, "embedding": ` + string(embedding) + `}`
+			if i > 0 {
+				resp += ","
+			}
+		}
+		w.Write([]byte(resp + `]}`))
+	}))
+	defer server.Close()
+
+	client := &HTTPClient{BaseURL: server.URL + "/v1/", APIKey: "key", Model: "test"}
+	embeddings, err := client.Embed(context.Background(), []string{"a", "bbb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embeddings) != 2 || embeddings[0][0] != 1 || embeddings[1][0] != 3 {
+		t.Fatalf("Unexpected embeddings %v", embeddings)
+	}
+	client.APIKey = "wrong"
+	_, err = client.Embed(context.Background(), []string{"a"})
+	if err == nil {
+		t.Fatal("Expected error for the failed request")
+	}
+}
+
+func TestSearchText(t *testing.T) {
+	embedder := EmbedderFunc(func(ctx context.Context, texts []string) ([][]float64, error) {
+		embeddings := make([][]float64, len(texts))
+		for i, text := range texts {
+			embeddings[i] = []float64{float64(len(text)), 1}
+		}
+		return embeddings, nil
+	})
+	index := &lshtest.Indexer{SearchFunc: lshtest.Results(lsh.Neighbor{ID: "a"})}
+	neighbors, err := Search(context.Background(), embedder, index, "text", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := index.SearchCalls()
+	if len(neighbors) != 1 || len(calls) != 1 || calls[0].Query[0] != 4 {
+		t.Fatalf("Expected search by the embedding, got %v, %+v", neighbors, calls)
+	}
+	err = Insert(context.Background(), embedder, nil, []string{"a"}, nil)
+	if !errors.Is(err, textsNumberErr) {
+		t.Fatalf("Expected error %v, got %v", textsNumberErr, err)
+	}
+}
@@ -0,0 +1,74 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/lshtest"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	first := &lshtest.Indexer{SearchFunc: lshtest.Results(
+		lsh.Neighbor{ID: "a", Dist: 10},
+		lsh.Neighbor{ID: "b", Dist: 20},
+		lsh.Neighbor{ID: "c", Dist: 30},
+	)}
+	second := &lshtest.Indexer{SearchFunc: lshtest.Results(
+		lsh.Neighbor{ID: "c", Dist: 0.1},
+		lsh.Neighbor{ID: "d", Dist: 0.5},
+	)}
+	slow := &lshtest.Indexer{SearchFunc: func(query []float64, maxNN int, distanceThrsh float64) ([]lsh.Neighbor, error) {
+		time.Sleep(100 * time.Millisecond)
+		return []lsh.Neighbor{{ID: "slow"}}, nil
+	}}
+	router, err := NewRouter(
+		RouterConfig{Timeout: 20 * time.Millisecond},
+		Source{Name: "first", Index: first, Normalization: MinMax},
+		Source{Name: "second", Index: second, Normalization: MinMax},
+		Source{Name: "slow", Index: slow},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := router.Search(context.Background(), []float64{1, 1}, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Partial || !errors.Is(result.Errors["slow"], ErrTimeout) {
+		t.Fatalf("Slow source must time out, got %+v", result.Errors)
+	}
+	// NOTE: "c" is the worst in the first source, but the best in the second one
+	expected := []string{"a", "c", "b"}
+	if len(result.Neighbors) != len(expected) {
+		t.Fatalf("Expected %v neighbors, got %+v", len(expected), result.Neighbors)
+	}
+	for i, id := range expected {
+		if result.Neighbors[i].ID != id {
+			t.Fatalf("Expected %v at %v, got %+v", id, i, result.Neighbors)
+		}
+	}
+	if result.Neighbors[1].Source != "second" {
+		t.Fatalf("Duplicate must keep the best score, got %+v", result.Neighbors[1])
+	}
+
+	router, _ = NewRouter(
+		RouterConfig{Timeout: 20 * time.Millisecond, RequireAll: true},
+		Source{Name: "first", Index: first},
+		Source{Name: "slow", Index: slow},
+	)
+	_, err = router.Search(context.Background(), []float64{1, 1}, 3, 1)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected error %v, got %v", ErrTimeout, err)
+	}
+	router, _ = NewRouter(RouterConfig{Timeout: 20 * time.Millisecond}, Source{Name: "slow", Index: slow})
+	_, err = router.Search(context.Background(), []float64{1, 1}, 3, 1)
+	if err != ErrAllFailed {
+		t.Fatalf("Expected error %v, got %v", ErrAllFailed, err)
+	}
+	_, err = NewRouter(RouterConfig{}, Source{Name: "a", Index: first}, Source{Name: "a", Index: second})
+	if err != sourceNameErr {
+		t.Fatalf("Expected error %v, got %v", sourceNameErr, err)
+	}
+}
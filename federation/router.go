@@ -0,0 +1,221 @@
+// Package federation fans queries out to several independent indexes
+// and merges their results into a single list
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTimeout is recorded for the sources which didn't respond in time
+	ErrTimeout = errors.New("source timed out")
+	// ErrAllFailed is returned when none of the sources has responded
+	ErrAllFailed = errors.New("all sources failed")
+
+	noSourcesErr   = errors.New("at least one source is needed")
+	sourceNameErr  = errors.New("source names must be unique and non-empty")
+	sourceIndexErr = errors.New("source index must be set")
+)
+
+// Normalization defines how distances of a single source are mapped to the comparable scores
+type Normalization int
+
+const (
+	// RawDistance keeps distances as is, for the sources with the same metric
+	RawDistance Normalization = iota
+	// MinMax maps distances of the source results into [0, 1]
+	MinMax
+	// Rank replaces distance with the position in the source results, divided by their number
+	Rank
+)
+
+// Source is a single index queried by the router
+type Source struct {
+	Name  string
+	Index lsh.Indexer
+	// Timeout overrides RouterConfig.Timeout for the source
+	Timeout       time.Duration
+	Normalization Normalization
+	// Weight multiplies normalized scores of the source, 1 by default;
+	// sources with lower weight are preferred
+	Weight float64
+}
+
+// RouterConfig holds fan-out parameters
+type RouterConfig struct {
+	// Timeout bounds the search of each source, no limit if zero
+	Timeout time.Duration
+	// RequireAll makes search fail if any of the sources fails, otherwise partial results are returned
+	RequireAll bool
+}
+
+// Neighbor is a merged search result
+type Neighbor struct {
+	lsh.Neighbor
+	// Source is a name of the source the neighbor comes from
+	Source string
+	// Score is a normalized and weighted distance results are ordered by
+	Score float64
+}
+
+// Result holds merged neighbors along with the errors of the failed sources
+type Result struct {
+	Neighbors []Neighbor
+	Errors    map[string]error
+	// Partial is true when some of the sources failed
+	Partial bool
+}
+
+// Router searches all the sources concurrently and merges their results; ids are treated
+// as global, so the same id returned by several sources is kept once, with the best score
+type Router struct {
+	config  RouterConfig
+	sources []Source
+}
+
+// NewRouter creates router over the given sources
+func NewRouter(config RouterConfig, sources ...Source) (*Router, error) {
+	if len(sources) == 0 {
+		return nil, noSourcesErr
+	}
+	sources = append([]Source(nil), sources...)
+	names := make(map[string]bool, len(sources))
+	for i, source := range sources {
+		if source.Name == "" || names[source.Name] {
+			return nil, sourceNameErr
+		}
+		names[source.Name] = true
+		if source.Index == nil {
+			return nil, fmt.Errorf("%v: %w", source.Name, sourceIndexErr)
+		}
+		if source.Weight <= 0 {
+			sources[i].Weight = 1
+		}
+	}
+	return &Router{config: config, sources: sources}, nil
+}
+
+type sourceResult struct {
+	neighbors []lsh.Neighbor
+	err       error
+}
+
+// searchSource runs the search, abandoning it after the timeout or context cancellation
+func (r *Router) searchSource(ctx context.Context, source Source, query []float64, maxNN int, distanceThrsh float64) sourceResult {
+	timeout := r.config.Timeout
+	if source.Timeout > 0 {
+		timeout = source.Timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	done := make(chan sourceResult, 1)
+	go func() {
+		neighbors, err := source.Index.Search(query, maxNN, distanceThrsh)
+		done <- sourceResult{neighbors: neighbors, err: err}
+	}()
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return sourceResult{err: ErrTimeout}
+		}
+		return sourceResult{err: ctx.Err()}
+	}
+}
+
+// normalize converts source results into the scored neighbors
+func normalize(source Source, neighbors []lsh.Neighbor) []Neighbor {
+	scored := make([]Neighbor, len(neighbors))
+	minDist, maxDist := 0.0, 0.0
+	for i, nn := range neighbors {
+		if i == 0 || nn.Dist < minDist {
+			minDist = nn.Dist
+		}
+		if i == 0 || nn.Dist > maxDist {
+			maxDist = nn.Dist
+		}
+	}
+	for i, nn := range neighbors {
+		score := nn.Dist
+		switch source.Normalization {
+		case MinMax:
+			score = 0
+			if maxDist > minDist {
+				score = (nn.Dist - minDist) / (maxDist - minDist)
+			}
+		case Rank:
+			score = float64(i) / float64(len(neighbors))
+		}
+		scored[i] = Neighbor{Neighbor: nn, Source: source.Name, Score: score * source.Weight}
+	}
+	return scored
+}
+
+// Search returns up to maxNN merged neighbors; distanceThrsh is passed to every source as is
+func (r *Router) Search(ctx context.Context, query []float64, maxNN int, distanceThrsh float64) (Result, error) {
+	results := make([]sourceResult, len(r.sources))
+	wg := sync.WaitGroup{}
+	for i, source := range r.sources {
+		wg.Add(1)
+		go func(i int, source Source) {
+			defer wg.Done()
+			results[i] = r.searchSource(ctx, source, query, maxNN, distanceThrsh)
+		}(i, source)
+	}
+	wg.Wait()
+
+	result := Result{Errors: make(map[string]error)}
+	// NOTE: lists are merged by score, which is kept as a distance of the merged neighbors
+	lists := make([][]lsh.Neighbor, 0, len(r.sources))
+	scored := make([]map[string]Neighbor, 0, len(r.sources))
+	for i, source := range r.sources {
+		if results[i].err != nil {
+			result.Errors[source.Name] = results[i].err
+			continue
+		}
+		byID := make(map[string]Neighbor, len(results[i].neighbors))
+		list := make([]lsh.Neighbor, 0, len(results[i].neighbors))
+		for _, nn := range normalize(source, results[i].neighbors) {
+			if prev, ok := byID[nn.ID]; ok && prev.Score <= nn.Score {
+				continue
+			}
+			byID[nn.ID] = nn
+			list = append(list, lsh.Neighbor{ID: nn.ID, Dist: nn.Score})
+		}
+		lsh.SortNeighbors(list)
+		lists = append(lists, list)
+		scored = append(scored, byID)
+	}
+	if len(result.Errors) == len(r.sources) {
+		return result, ErrAllFailed
+	}
+	result.Partial = len(result.Errors) > 0
+	if result.Partial && r.config.RequireAll {
+		for _, source := range r.sources {
+			if err, ok := result.Errors[source.Name]; ok {
+				return result, fmt.Errorf("source %v: %w", source.Name, err)
+			}
+		}
+	}
+	merged := lsh.MergeNeighbors(maxNN, lists...)
+	result.Neighbors = make([]Neighbor, len(merged))
+	for i, nn := range merged {
+		// NOTE: equal neighbors are taken from the earliest source
+		for _, byID := range scored {
+			if source, ok := byID[nn.ID]; ok && source.Score == nn.Dist {
+				result.Neighbors[i] = source
+				break
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,146 @@
+// Package imagehash calculates perceptual hashes of images, so near-duplicate
+// images can be found by the Hamming distance between their hashes
+package imagehash
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// HashBits is a length of the dHash and pHash
+	HashBits = 64
+
+	hashSize = 8
+	// pHash takes low frequencies of the DCT over the image downscaled to dctSize x dctSize
+	dctSize = 32
+)
+
+// grayscale downscales the image to w x h with box filter, returns luminance values
+func grayscale(img image.Image, w, h int) [][]float64 {
+	bounds := img.Bounds()
+	pixels := make([][]float64, h)
+	for y := range pixels {
+		pixels[y] = make([]float64, w)
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := range pixels[y] {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			sum := 0.0
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			pixels[y][x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+	return pixels
+}
+
+// DHash is a difference hash: bit is set when the pixel is brighter than its' right
+// neighbor on the 9x8 grayscale thumbnail
+func DHash(img image.Image) uint64 {
+	pixels := grayscale(img, hashSize+1, hashSize)
+	var hash uint64
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			if pixels[y][x] > pixels[y][x+1] {
+				hash |= 1 << uint(y*hashSize+x)
+			}
+		}
+	}
+	return hash
+}
+
+// dct calculates 2D DCT-II of the square matrix, keeping only top-left size x size coefficients
+func dct(pixels [][]float64, size int) [][]float64 {
+	n := len(pixels)
+	cos := make([][]float64, size)
+	for u := range cos {
+		cos[u] = make([]float64, n)
+		for x := range cos[u] {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*n))
+		}
+	}
+	// NOTE: rows are transformed first, then columns
+	rows := make([][]float64, n)
+	for y := range rows {
+		rows[y] = make([]float64, size)
+		for u := 0; u < size; u++ {
+			for x := 0; x < n; x++ {
+				rows[y][u] += pixels[y][x] * cos[u][x]
+			}
+		}
+	}
+	coeffs := make([][]float64, size)
+	for v := range coeffs {
+		coeffs[v] = make([]float64, size)
+		for u := 0; u < size; u++ {
+			for y := 0; y < n; y++ {
+				coeffs[v][u] += rows[y][u] * cos[v][y]
+			}
+		}
+	}
+	return coeffs
+}
+
+// PHash is a perceptual hash: bit is set when the low frequency DCT coefficient of the
+// 32x32 grayscale thumbnail is above the median one; DC term is excluded from the median
+func PHash(img image.Image) uint64 {
+	coeffs := dct(grayscale(img, dctSize, dctSize), hashSize)
+	values := make([]float64, 0, HashBits-1)
+	for v := range coeffs {
+		for u := range coeffs[v] {
+			if u != 0 || v != 0 {
+				values = append(values, coeffs[v][u])
+			}
+		}
+	}
+	sort.Float64s(values)
+	median := values[len(values)/2]
+	var hash uint64
+	for v := range coeffs {
+		for u := range coeffs[v] {
+			if coeffs[v][u] > median {
+				hash |= 1 << uint(v*hashSize+u)
+			}
+		}
+	}
+	return hash
+}
+
+// Distance returns the number of differing bits of two hashes
+func Distance(l, r uint64) int {
+	return bits.OnesCount64(l ^ r)
+}
+
+// Vector returns bits of the hash as 0/1 components, so hashes can be compared with lsh.Hamming metric
+func Vector(hash uint64) []float64 {
+	vec := make([]float64, HashBits)
+	for i := range vec {
+		vec[i] = float64((hash >> uint(i)) & 1)
+	}
+	return vec
+}
+
+// SignedVector returns bits of the hash as -1/1 components: sign random projections
+// of such vectors (SimHash buckets of the lsh.LSHIndex) collide more often for hashes
+// closer in Hamming distance, since cosine between them is 1 - 2*Distance/HashBits
+func SignedVector(hash uint64) []float64 {
+	vec := make([]float64, HashBits)
+	for i := range vec {
+		vec[i] = 2*float64((hash>>uint(i))&1) - 1
+	}
+	return vec
+}
@@ -0,0 +1,57 @@
+package imagehash
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// pattern draws waves, scaled to the image size, with optional bright square in the corner
+func pattern(w, h int, square bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x)/float64(w), float64(y)/float64(h)
+			v := uint8(127 + 127*math.Sin(7*fx+1)*math.Cos(5*fy*fy))
+			if square && x < w/3 && y < h/3 {
+				v = 255
+			}
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+func TestHashes(t *testing.T) {
+	img := pattern(64, 64, false)
+	resized := pattern(150, 150, false)
+	other := pattern(64, 64, true)
+	for name, hash := range map[string]func(image.Image) uint64{"dHash": DHash, "pHash": PHash} {
+		h := hash(img)
+		if h != hash(img) {
+			t.Fatalf("%v must be deterministic", name)
+		}
+		if d := Distance(h, hash(resized)); d > 8 {
+			t.Fatalf("%v of the resized image must be close, got distance %v", name, d)
+		}
+		if d := Distance(h, hash(other)); d <= Distance(h, hash(resized)) {
+			t.Fatalf("%v of the modified image must be farther than of the resized one, got distance %v", name, d)
+		}
+	}
+}
+
+func TestVectors(t *testing.T) {
+	var l, r uint64 = 0xf0, 0x0f
+	vec := Vector(l)
+	if len(vec) != HashBits || vec[4] != 1 || vec[0] != 0 {
+		t.Fatalf("Unexpected vector %v", vec)
+	}
+	signed := SignedVector(r)
+	if signed[0] != 1 || signed[4] != -1 {
+		t.Fatalf("Unexpected signed vector %v", signed)
+	}
+	if Distance(l, r) != 8 {
+		t.Fatalf("Expected distance 8, got %v", Distance(l, r))
+	}
+}
@@ -0,0 +1,113 @@
+// Package importer reads vectors out of the index files of other libraries,
+// so the index can be rebuilt here without re-exporting the data
+package importer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+)
+
+var (
+	// ErrMalformed is returned when the file doesn't match the expected layout
+	ErrMalformed = errors.New("malformed index file")
+	// ErrUnsupported is returned for the index types which can't be imported
+	ErrUnsupported = errors.New("unsupported index type")
+)
+
+// AnnoyMetric defines layout of the Annoy nodes, which depends on the metric the index was built with
+type AnnoyMetric int
+
+const (
+	AnnoyAngular AnnoyMetric = iota
+	AnnoyEuclidean
+	AnnoyManhattan
+	AnnoyDot
+)
+
+// AnnoyOptions describes the Annoy index: neither dimensions nor metric are stored in the file
+type AnnoyOptions struct {
+	Dims   int
+	Metric AnnoyMetric
+	// IDs, when set, maps item index to the record ID, otherwise item index is used as ID
+	IDs []string
+}
+
+// annoyHeader returns size of the node fields which precede the vector
+func annoyHeader(metric AnnoyMetric) (int, error) {
+	switch metric {
+	case AnnoyAngular:
+		// NOTE: n_descendants, children[2]
+		return 12, nil
+	case AnnoyEuclidean, AnnoyManhattan, AnnoyDot:
+		// NOTE: n_descendants, children[2] and the offset (or dot factor)
+		return 16, nil
+	}
+	return 0, fmt.Errorf("%w: annoy metric %v", ErrUnsupported, metric)
+}
+
+// ReadAnnoy reads items of the Annoy index (float32 vectors) into records; items come first
+// in the file, each node holds the number of descendants, which is 1 for items, and the number
+// of items is the number of descendants of the last root node; indices of the deleted
+// (never added) items are skipped
+func ReadAnnoy(r io.Reader, opts AnnoyOptions) ([]lsh.Record, error) {
+	if opts.Dims <= 0 {
+		return nil, fmt.Errorf("%w: dimensions must be > 0", ErrMalformed)
+	}
+	header, err := annoyHeader(opts.Metric)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	nodeSize := header + 4*opts.Dims
+	if len(data) == 0 || len(data)%nodeSize != 0 {
+		return nil, fmt.Errorf("%w: %v bytes can't be split into nodes of %v bytes", ErrMalformed, len(data), nodeSize)
+	}
+	nodes := len(data) / nodeSize
+	descendants := func(node int) int32 {
+		return int32(binary.LittleEndian.Uint32(data[node*nodeSize:]))
+	}
+	nItems := int(descendants(nodes - 1))
+	if nItems <= 0 || nItems > nodes {
+		return nil, fmt.Errorf("%w: root holds %v items of %v nodes", ErrMalformed, nItems, nodes)
+	}
+	records := make([]lsh.Record, 0, nItems)
+	for node := 0; node < nodes && len(records) < nItems; node++ {
+		if descendants(node) != 1 {
+			continue
+		}
+		vec := make([]float64, opts.Dims)
+		offset := node*nodeSize + header
+		for i := range vec {
+			vec[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[offset+4*i:])))
+		}
+		id := strconv.Itoa(node)
+		if opts.IDs != nil {
+			if node >= len(opts.IDs) {
+				return nil, fmt.Errorf("%w: no ID for item %v", ErrMalformed, node)
+			}
+			id = opts.IDs[node]
+		}
+		records = append(records, lsh.Record{ID: id, Vecs: [][]float64{vec}})
+	}
+	return records, nil
+}
+
+// ReadAnnoyFile reads items of the Annoy index file, see ReadAnnoy
+func ReadAnnoyFile(path string, opts AnnoyOptions) ([]lsh.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadAnnoy(f, opts)
+}
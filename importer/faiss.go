@@ -0,0 +1,175 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	// NOTE: limits keep the sizes arithmetic from overflowing; since the number of vectors
+	//       can't be trusted before they're read, slices grow as the data is read
+	maxFaissDims  = 1 << 16
+	maxFaissTotal = 1 << 40
+	// faissIdsChunk is the number of IDs read at once
+	faissIdsChunk = 4096
+)
+
+// faissReader reads little-endian values of the FAISS serialization format,
+// keeping the first error
+type faissReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *faissReader) read(data interface{}) {
+	if r.err != nil {
+		return
+	}
+	r.err = binary.Read(r.r, binary.LittleEndian, data)
+	if r.err == io.EOF || r.err == io.ErrUnexpectedEOF {
+		r.err = fmt.Errorf("%w: unexpected end of file", ErrMalformed)
+	}
+}
+
+func (r *faissReader) fourcc() string {
+	var h [4]byte
+	r.read(&h)
+	return string(h[:])
+}
+
+// header reads fields common for all indexes, returns dimensions and number of vectors
+func (r *faissReader) header() (int, int) {
+	var d int32
+	var ntotal, dummy int64
+	var trained bool
+	var metric int32
+	r.read(&d)
+	r.read(&ntotal)
+	r.read(&dummy)
+	r.read(&dummy)
+	r.read(&trained)
+	r.read(&metric)
+	if metric > 1 {
+		var metricArg float32
+		r.read(&metricArg)
+	}
+	if r.err == nil && (d <= 0 || d > maxFaissDims || ntotal < 0 || ntotal > maxFaissTotal) {
+		r.err = fmt.Errorf("%w: %v vectors of %v dimensions", ErrMalformed, ntotal, d)
+	}
+	return int(d), int(ntotal)
+}
+
+// vectors reads index with the float vectors, flat indexes only
+func (r *faissReader) vectors() ([][]float64, error) {
+	h := r.fourcc()
+	switch h {
+	case "IxFI", "IxF2":
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("%w: faiss index %q, only IndexFlat and IndexIDMap are supported", ErrUnsupported, h)
+		}
+		return nil, r.err
+	}
+	d, ntotal := r.header()
+	var size uint64
+	r.read(&size)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if size != uint64(d)*uint64(ntotal) {
+		return nil, fmt.Errorf("%w: %v values for %v vectors of %v dimensions", ErrMalformed, size, ntotal, d)
+	}
+	vecs := make([][]float64, 0)
+	row := make([]float32, d)
+	for i := 0; i < ntotal; i++ {
+		r.read(row)
+		if r.err != nil {
+			return nil, r.err
+		}
+		vec := make([]float64, d)
+		for j, val := range row {
+			vec[j] = float64(val)
+		}
+		vecs = append(vecs, vec)
+	}
+	return vecs, nil
+}
+
+// ids reads n int64 IDs
+func (r *faissReader) ids(n int) []int64 {
+	ids := make([]int64, 0)
+	chunk := make([]int64, faissIdsChunk)
+	for len(ids) < n && r.err == nil {
+		if n-len(ids) < len(chunk) {
+			chunk = chunk[:n-len(ids)]
+		}
+		r.read(chunk)
+		ids = append(ids, chunk...)
+	}
+	return ids
+}
+
+// ReadFaiss reads vectors of the FAISS IndexFlat (L2 or inner product) into records,
+// item index is used as ID; for IndexIDMap (and IndexIDMap2) wrapping the flat index,
+// IDs are taken from the ID map
+func ReadFaiss(r io.Reader) ([]lsh.Record, error) {
+	fr := &faissReader{r: bufio.NewReader(r)}
+	var h [4]byte
+	fr.read(&h)
+	if fr.err != nil {
+		return nil, fr.err
+	}
+	var ids []int64
+	var vecs [][]float64
+	switch string(h[:]) {
+	case "IxMp", "IxM2":
+		_, ntotal := fr.header()
+		var err error
+		vecs, err = fr.vectors()
+		if err != nil {
+			return nil, err
+		}
+		var size uint64
+		fr.read(&size)
+		if fr.err == nil && (size != uint64(ntotal) || len(vecs) != ntotal) {
+			return nil, fmt.Errorf("%w: %v ids for %v vectors", ErrMalformed, size, len(vecs))
+		}
+		ids = fr.ids(ntotal)
+		if fr.err != nil {
+			return nil, fr.err
+		}
+	default:
+		// NOTE: put the fourcc back, so the flat index is read from the start
+		fr.r = io.MultiReader(bytes.NewReader(h[:]), fr.r)
+		var err error
+		vecs, err = fr.vectors()
+		if err != nil {
+			return nil, err
+		}
+	}
+	records := make([]lsh.Record, len(vecs))
+	for i, vec := range vecs {
+		id := strconv.Itoa(i)
+		if ids != nil {
+			id = strconv.FormatInt(ids[i], 10)
+		}
+		records[i] = lsh.Record{ID: id, Vecs: [][]float64{vec}}
+	}
+	return records, nil
+}
+
+// ReadFaissFile reads vectors of the FAISS index file, see ReadFaiss
+func ReadFaissFile(path string) ([]lsh.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadFaiss(f)
+}
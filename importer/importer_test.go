@@ -0,0 +1,122 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// annoyNode writes a node with the given number of descendants and vector
+func annoyNode(buf *bytes.Buffer, header int, descendants int32, vec []float32) {
+	binary.Write(buf, binary.LittleEndian, descendants)
+	buf.Write(make([]byte, header-4))
+	binary.Write(buf, binary.LittleEndian, vec)
+}
+
+func TestReadAnnoy(t *testing.T) {
+	vecs := [][]float32{{1, 2}, {3, 4}, {0, 0}, {5, 6}}
+	for _, metric := range []AnnoyMetric{AnnoyAngular, AnnoyEuclidean} {
+		header, _ := annoyHeader(metric)
+		buf := &bytes.Buffer{}
+		for i, vec := range vecs {
+			descendants := int32(1)
+			if i == 2 {
+				descendants = 0 // NOTE: item which has never been added
+			}
+			annoyNode(buf, header, descendants, vec)
+		}
+		annoyNode(buf, header, 3, []float32{0.5, 0.5})
+		records, err := ReadAnnoy(bytes.NewReader(buf.Bytes()), AnnoyOptions{Dims: 2, Metric: metric})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 || records[2].ID != "3" || !reflect.DeepEqual(records[2].Vecs, [][]float64{{5, 6}}) {
+			t.Fatalf("Expected 3 items, got %+v", records)
+		}
+		records, err = ReadAnnoy(bytes.NewReader(buf.Bytes()), AnnoyOptions{Dims: 2, Metric: metric, IDs: []string{"a", "b", "c", "d"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if records[1].ID != "b" || records[2].ID != "d" {
+			t.Fatalf("Expected mapped IDs, got %+v", records)
+		}
+	}
+	_, err := ReadAnnoy(bytes.NewReader(make([]byte, 13)), AnnoyOptions{Dims: 2})
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected ErrMalformed, got %v", err)
+	}
+}
+
+// faissFlat writes IndexFlatL2 holding the vectors
+func faissFlat(buf *bytes.Buffer, vecs [][]float32) {
+	buf.WriteString("IxF2")
+	faissHeader(buf, len(vecs[0]), len(vecs))
+	binary.Write(buf, binary.LittleEndian, uint64(len(vecs)*len(vecs[0])))
+	for _, vec := range vecs {
+		binary.Write(buf, binary.LittleEndian, vec)
+	}
+}
+
+func faissHeader(buf *bytes.Buffer, d, ntotal int) {
+	binary.Write(buf, binary.LittleEndian, int32(d))
+	binary.Write(buf, binary.LittleEndian, int64(ntotal))
+	binary.Write(buf, binary.LittleEndian, int64(1<<20))
+	binary.Write(buf, binary.LittleEndian, int64(1<<20))
+	binary.Write(buf, binary.LittleEndian, true)
+	binary.Write(buf, binary.LittleEndian, int32(1))
+}
+
+func TestReadFaiss(t *testing.T) {
+	vecs := [][]float32{{1, 2, 3}, {4, 5, 6}}
+	buf := &bytes.Buffer{}
+	faissFlat(buf, vecs)
+	records, err := ReadFaiss(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].ID != "1" || !reflect.DeepEqual(records[1].Vecs, [][]float64{{4, 5, 6}}) {
+		t.Fatalf("Expected 2 vectors, got %+v", records)
+	}
+
+	buf = &bytes.Buffer{}
+	buf.WriteString("IxMp")
+	faissHeader(buf, 3, 2)
+	faissFlat(buf, vecs)
+	binary.Write(buf, binary.LittleEndian, uint64(2))
+	binary.Write(buf, binary.LittleEndian, []int64{100, 42})
+	records, err = ReadFaiss(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].ID != "100" || records[1].ID != "42" {
+		t.Fatalf("Expected mapped IDs, got %+v", records)
+	}
+
+	_, err = ReadFaiss(bytes.NewReader(buf.Bytes()[:buf.Len()-4]))
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected ErrMalformed, got %v", err)
+	}
+	// NOTE: consistent sizes of the corrupted header must not be trusted
+	buf = &bytes.Buffer{}
+	buf.WriteString("IxF2")
+	faissHeader(buf, 1<<16, 1<<40)
+	binary.Write(buf, binary.LittleEndian, uint64(1<<56))
+	_, err = ReadFaiss(bytes.NewReader(buf.Bytes()))
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected ErrMalformed, got %v", err)
+	}
+	buf = &bytes.Buffer{}
+	buf.WriteString("IxMp")
+	faissHeader(buf, 3, 1<<40)
+	faissFlat(buf, vecs)
+	_, err = ReadFaiss(bytes.NewReader(buf.Bytes()))
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected ErrMalformed, got %v", err)
+	}
+	_, err = ReadFaiss(bytes.NewReader([]byte("IwFl")))
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Expected ErrUnsupported, got %v", err)
+	}
+}
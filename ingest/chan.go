@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"context"
+	"sync"
+)
+
+// ChanSource is an in-memory Source fed by Push, e.g. for tests or in-process producers;
+// acknowledged messages are counted and not redelivered
+type ChanSource struct {
+	mx     sync.Mutex
+	msgs   chan Message
+	closed chan struct{}
+	once   sync.Once
+	acked  int
+}
+
+// NewChanSource creates source which buffers up to size messages
+func NewChanSource(size int) *ChanSource {
+	return &ChanSource{
+		msgs:   make(chan Message, size),
+		closed: make(chan struct{}),
+	}
+}
+
+// Push adds message to the source, blocking when the buffer is full
+func (s *ChanSource) Push(ctx context.Context, msg Message) error {
+	select {
+	case s.msgs <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close makes Next return ErrSourceClosed once the buffered messages are consumed
+func (s *ChanSource) Close() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+}
+
+func (s *ChanSource) Next(ctx context.Context) (Message, error) {
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	default:
+	}
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	case <-s.closed:
+		select {
+		case msg := <-s.msgs:
+			return msg, nil
+		default:
+			return Message{}, ErrSourceClosed
+		}
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (s *ChanSource) Ack(ctx context.Context, msgs []Message) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.acked += len(msgs)
+	return nil
+}
+
+// Acked returns number of acknowledged messages
+func (s *ChanSource) Acked() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.acked
+}
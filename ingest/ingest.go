@@ -0,0 +1,194 @@
+// Package ingest applies a stream of inserts and deletes to the index: messages of the Source
+// are batched, applied in order with retries, and acknowledged only after the whole batch has
+// been applied (and flushed, if the index supports it), so delivery is at-least-once;
+// broker clients (Kafka, NATS, etc.) plug in by implementing Source
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+)
+
+var (
+	// ErrSourceClosed is returned by the Source when there are no more messages
+	ErrSourceClosed = errors.New("source is closed")
+	unknownOpErr    = errors.New("unknown operation")
+)
+
+// Op is an operation requested by the message
+type Op int
+
+const (
+	Insert Op = iota
+	Delete
+)
+
+// Message is a single change of the index; Token is an opaque value of the Source,
+// e.g. partition offset, needed to acknowledge the message
+type Message struct {
+	ID     string
+	Vector []float64
+	Meta   map[string]string
+	Op     Op
+	Token  interface{}
+}
+
+// Source is a stream of messages, implemented over the broker client
+type Source interface {
+	// Next blocks until the next message is available, ctx is done,
+	// or the source is closed (ErrSourceClosed)
+	Next(ctx context.Context) (Message, error)
+	// Ack confirms that the messages, in the order they were received, have been applied
+	Ack(ctx context.Context, msgs []Message) error
+}
+
+// Index is a part of the lsh.LSHIndex the messages are applied to
+type Index interface {
+	Insert(id string, vec []float64) (uint64, error)
+	Delete(id string) error
+	SetMeta(id string, meta map[string]string) error
+}
+
+// Flusher is an optional interface of the Index, which makes applied changes durable;
+// it's called before the batch is acknowledged
+type Flusher interface {
+	Flush() error
+}
+
+// Config holds batching and retry parameters of the Consumer
+type Config struct {
+	// BatchSize is a max number of messages applied before the acknowledgement (100 by default)
+	BatchSize int
+	// FlushInterval is a max time the incomplete batch waits for new messages (1s by default)
+	FlushInterval time.Duration
+	// MaxRetries is a number of retries of the failed message, before Run returns the error
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// Consumer applies messages of the source to the index
+type Consumer struct {
+	source Source
+	index  Index
+	config Config
+}
+
+// NewConsumer creates new consumer
+func NewConsumer(source Source, index Index, config Config) *Consumer {
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultFlushInterval
+	}
+	return &Consumer{
+		source: source,
+		index:  index,
+		config: config,
+	}
+}
+
+// Run consumes messages until ctx is done or the source is closed (then nil is returned);
+// messages of the unfinished batch aren't acknowledged, so they're delivered again
+func (c *Consumer) Run(ctx context.Context) error {
+	batch := make([]Message, 0, c.config.BatchSize)
+	var deadline time.Time
+	for {
+		nextCtx := ctx
+		cancel := func() {}
+		if len(batch) > 0 {
+			nextCtx, cancel = context.WithDeadline(ctx, deadline)
+		}
+		msg, err := c.source.Next(nextCtx)
+		cancel()
+		switch {
+		case err == nil:
+			if len(batch) == 0 {
+				deadline = time.Now().Add(c.config.FlushInterval)
+			}
+			batch = append(batch, msg)
+			if len(batch) < c.config.BatchSize {
+				continue
+			}
+		case errors.Is(err, ErrSourceClosed):
+			return c.commit(ctx, batch)
+		case ctx.Err() != nil:
+			return nil
+		case !errors.Is(err, context.DeadlineExceeded):
+			return err
+		}
+		err = c.commit(ctx, batch)
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
+	}
+}
+
+// commit applies the batch in order, flushes the index and acknowledges the batch
+func (c *Consumer) commit(ctx context.Context, batch []Message) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	for _, msg := range batch {
+		err := c.applyWithRetries(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+	if flusher, ok := c.index.(Flusher); ok {
+		err := flusher.Flush()
+		if err != nil {
+			return fmt.Errorf("can't flush index: %w", err)
+		}
+	}
+	return c.source.Ack(ctx, batch)
+}
+
+func (c *Consumer) applyWithRetries(ctx context.Context, msg Message) error {
+	var err error
+	for attempt := 0; attempt <= c.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.config.RetryBackoff):
+			}
+		}
+		err = c.apply(msg)
+		if err == nil || errors.Is(err, unknownOpErr) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("can't apply message %v: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// apply is idempotent, since the messages may be delivered more than once
+func (c *Consumer) apply(msg Message) error {
+	switch msg.Op {
+	case Insert:
+		_, err := c.index.Insert(msg.ID, msg.Vector)
+		if err != nil || msg.Meta == nil {
+			return err
+		}
+		return c.index.SetMeta(msg.ID, msg.Meta)
+	case Delete:
+		err := c.index.Delete(msg.ID)
+		if errors.Is(err, lsh.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("%w: %v", unknownOpErr, msg.Op)
+}
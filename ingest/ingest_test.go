@@ -0,0 +1,109 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeIndex struct {
+	mx       sync.Mutex
+	ops      []string
+	failures int
+	flushes  int
+}
+
+func (f *fakeIndex) Insert(id string, vec []float64) (uint64, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return 0, errors.New("temporary failure")
+	}
+	f.ops = append(f.ops, "insert "+id)
+	return 1, nil
+}
+
+func (f *fakeIndex) Delete(id string) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.ops = append(f.ops, "delete "+id)
+	if id == "missing" {
+		return lsh.ErrNotFound
+	}
+	return nil
+}
+
+func (f *fakeIndex) SetMeta(id string, meta map[string]string) error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.ops = append(f.ops, "meta "+id)
+	return nil
+}
+
+func (f *fakeIndex) Flush() error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.flushes++
+	return nil
+}
+
+func TestConsumer(t *testing.T) {
+	ctx := context.Background()
+	source := NewChanSource(10)
+	index := &fakeIndex{failures: 2}
+	consumer := NewConsumer(source, index, Config{BatchSize: 2, MaxRetries: 2, FlushInterval: 10 * time.Millisecond})
+	msgs := []Message{
+		{ID: "a", Vector: []float64{1}, Op: Insert},
+		{ID: "b", Vector: []float64{2}, Meta: map[string]string{"k": "v"}, Op: Insert},
+		{ID: "a", Op: Delete},
+		{ID: "missing", Op: Delete},
+		{ID: "c", Vector: []float64{3}, Op: Insert},
+	}
+	for _, msg := range msgs {
+		source.Push(ctx, msg)
+	}
+	source.Close()
+	err := consumer.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"insert a", "insert b", "meta b", "delete a", "delete missing", "insert c"}
+	if !reflect.DeepEqual(index.ops, expected) {
+		t.Fatalf("Expected %v, got %v", expected, index.ops)
+	}
+	if source.Acked() != len(msgs) || index.flushes != 3 {
+		t.Fatalf("Expected 3 flushed batches of %v messages, got %v flushes, %v acked", len(msgs), index.flushes, source.Acked())
+	}
+
+	// NOTE: incomplete batch is committed after FlushInterval
+	source = NewChanSource(10)
+	consumer = NewConsumer(source, index, Config{BatchSize: 10, FlushInterval: 10 * time.Millisecond})
+	source.Push(ctx, Message{ID: "d", Vector: []float64{4}})
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- consumer.Run(runCtx)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for source.Acked() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil || source.Acked() != 1 {
+		t.Fatalf("Expected incomplete batch to be acked, got %v acked, %v", source.Acked(), err)
+	}
+
+	source = NewChanSource(10)
+	consumer = NewConsumer(source, &fakeIndex{failures: 2}, Config{MaxRetries: 1})
+	source.Push(ctx, Message{ID: "e", Vector: []float64{5}})
+	source.Close()
+	err = consumer.Run(ctx)
+	if err == nil || source.Acked() != 0 {
+		t.Fatalf("Failed batch must not be acked, got %v acked, %v", source.Acked(), err)
+	}
+}
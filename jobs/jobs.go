@@ -0,0 +1,217 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/store"
+	guuid "github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrJobNotFound is returned when there is no job with the given ID
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobNotDone is returned when the job result is requested before it finished successfully
+	ErrJobNotDone = errors.New("job is not done")
+	// ErrJobRunning is returned when the job which hasn't finished yet is forgotten
+	ErrJobRunning = errors.New("job is still running")
+)
+
+// State of the build job
+type State string
+
+const (
+	Pending State = "pending"
+	Running State = "running"
+	Done    State = "done"
+	Failed  State = "failed"
+)
+
+// Source loads vectors and their ids to build the index from
+type Source interface {
+	Load(ctx context.Context) ([][]float64, []string, error)
+}
+
+// SourceFunc allows to use ordinary function as a Source
+type SourceFunc func(ctx context.Context) ([][]float64, []string, error)
+
+func (f SourceFunc) Load(ctx context.Context) ([][]float64, []string, error) {
+	return f(ctx)
+}
+
+// BuildConfig holds everything needed to create a new index
+type BuildConfig struct {
+	lsh.Config
+	Store  store.Store
+	Metric lsh.Metric
+}
+
+// Status is a snapshot of the job state, Progress is measured in percents
+type Status struct {
+	ID       string
+	State    State
+	Progress float64
+	Err      error
+	Started  time.Time
+	Finished time.Time
+}
+
+type job struct {
+	mx     sync.RWMutex
+	status Status
+	index  *lsh.LSHIndex
+	done   chan struct{}
+}
+
+func (j *job) update(f func(status *Status)) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	f(&j.status)
+}
+
+func (j *job) getStatus() Status {
+	j.mx.RLock()
+	defer j.mx.RUnlock()
+	return j.status
+}
+
+// Manager runs index build jobs in background and keeps their statuses,
+// along with the built indexes, until they're forgotten
+type Manager struct {
+	mx   sync.RWMutex
+	jobs map[string]*job
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		jobs: make(map[string]*job),
+	}
+}
+
+// StartBuild creates new index by config and starts filling it with data from the source;
+// cancelling the context stops the job before training starts
+func (m *Manager) StartBuild(ctx context.Context, source Source, config BuildConfig) (string, error) {
+	index, err := lsh.NewLsh(config.Config, config.Store, config.Metric)
+	if err != nil {
+		return "", err
+	}
+	j := &job{
+		status: Status{
+			ID:    guuid.NewString(),
+			State: Pending,
+		},
+		index: index,
+		done:  make(chan struct{}),
+	}
+	m.mx.Lock()
+	m.jobs[j.status.ID] = j
+	m.mx.Unlock()
+
+	go func() {
+		defer close(j.done)
+		err := m.run(ctx, j, source)
+		j.update(func(status *Status) {
+			status.Finished = time.Now()
+			if err != nil {
+				status.State = Failed
+				status.Err = err
+				return
+			}
+			status.State = Done
+			status.Progress = 100.0
+		})
+	}()
+	return j.status.ID, nil
+}
+
+func (m *Manager) run(ctx context.Context, j *job, source Source) error {
+	j.update(func(status *Status) {
+		status.State = Running
+		status.Started = time.Now()
+	})
+	vecs, ids, err := source.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return j.index.TrainWithProgress(vecs, ids, func(processed, total int) {
+		j.update(func(status *Status) {
+			status.Progress = getProgress(processed, total)
+		})
+	})
+}
+
+// getProgress returns share of processed entries in percents, nothing is left to process
+// in the empty source
+func getProgress(processed, total int) float64 {
+	if total <= 0 {
+		return 100.0
+	}
+	return 100.0 * float64(processed) / float64(total)
+}
+
+func (m *Manager) getJob(id string) (*job, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return j, nil
+}
+
+// JobStatus returns current status of the job
+func (m *Manager) JobStatus(id string) (Status, error) {
+	j, err := m.getJob(id)
+	if err != nil {
+		return Status{}, err
+	}
+	return j.getStatus(), nil
+}
+
+// Wait blocks until the job is finished or context is done
+func (m *Manager) Wait(ctx context.Context, id string) (Status, error) {
+	j, err := m.getJob(id)
+	if err != nil {
+		return Status{}, err
+	}
+	select {
+	case <-j.done:
+		return j.getStatus(), nil
+	case <-ctx.Done():
+		return j.getStatus(), ctx.Err()
+	}
+}
+
+// Index returns built index of the successfully finished job
+func (m *Manager) Index(id string) (*lsh.LSHIndex, error) {
+	j, err := m.getJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if j.getStatus().State != Done {
+		return nil, ErrJobNotDone
+	}
+	return j.index, nil
+}
+
+// Forget removes the finished job, so its' index can be freed once it's no longer used
+func (m *Manager) Forget(id string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	select {
+	case <-j.done:
+	default:
+		return ErrJobRunning
+	}
+	delete(m.jobs, id)
+	return nil
+}
@@ -0,0 +1,213 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func getTestConfig() BuildConfig {
+	return BuildConfig{
+		Config: lsh.Config{
+			IndexConfig: lsh.IndexConfig{
+				BatchSize:     2,
+				MaxCandidates: 10,
+			},
+			HasherConfig: lsh.HasherConfig{
+				NTrees:   5,
+				KMinVecs: 2,
+				Dims:     2,
+			},
+		},
+		Store:  kv.NewKVStore(),
+		Metric: lsh.NewL2(),
+	}
+}
+
+func TestBuildJob(t *testing.T) {
+	manager := NewManager()
+	source := SourceFunc(func(ctx context.Context) ([][]float64, []string, error) {
+		vecs := [][]float64{
+			[]float64{0.1, 0.1},
+			[]float64{0.1, 0.08},
+			[]float64{-0.1, 0.1},
+		}
+		return vecs, []string{"0", "1", "2"}, nil
+	})
+	id, err := manager.StartBuild(context.Background(), source, getTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := manager.Wait(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != Done || status.Progress != 100.0 || status.Err != nil {
+		t.Fatalf("Job must be finished successfully, got %+v", status)
+	}
+	index, err := manager.Index(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err := index.Search([]float64{0.1, 0.1}, 1, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != "0" {
+		t.Fatalf("Built index must contain the source vectors, got %v", nns)
+	}
+	err = manager.Forget(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.JobStatus(id)
+	if !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("Forgotten job must not be found, got %v", err)
+	}
+	err = manager.Forget(id)
+	if !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("Expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestRunningJob(t *testing.T) {
+	manager := NewManager()
+	release := make(chan struct{})
+	source := SourceFunc(func(ctx context.Context) ([][]float64, []string, error) {
+		<-release
+		return [][]float64{}, []string{}, nil
+	})
+	id, err := manager.StartBuild(context.Background(), source, getTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Forget(id)
+	if !errors.Is(err, ErrJobRunning) {
+		t.Fatalf("Running job must not be forgotten, got %v", err)
+	}
+	close(release)
+	status, err := manager.Wait(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != Done || status.Progress != 100.0 {
+		t.Fatalf("Job must be finished successfully, got %+v", status)
+	}
+	if progress := getProgress(0, 0); math.IsNaN(progress) || progress != 100.0 {
+		t.Fatalf("Progress of the empty source must be 100, got %v", progress)
+	}
+	err = manager.Forget(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedJob(t *testing.T) {
+	manager := NewManager()
+	loadErr := errors.New("source is broken")
+	source := SourceFunc(func(ctx context.Context) ([][]float64, []string, error) {
+		return nil, nil, loadErr
+	})
+	id, err := manager.StartBuild(context.Background(), source, getTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := manager.Wait(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != Failed || !errors.Is(status.Err, loadErr) {
+		t.Fatalf("Job must fail with the source error, got %+v", status)
+	}
+	_, err = manager.Index(id)
+	if !errors.Is(err, ErrJobNotDone) {
+		t.Fatalf("Expected ErrJobNotDone, got %v", err)
+	}
+	_, err = manager.JobStatus("unknown")
+	if !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("Expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	config := getTestConfig()
+	index := lsh.NewVersionedIndex(func() (*lsh.LSHIndex, error) {
+		return lsh.NewLsh(config.Config, kv.NewKVStore(), config.Metric)
+	})
+	loads := 0
+	source := SourceFunc(func(ctx context.Context) ([][]float64, []string, error) {
+		loads++
+		vecs := [][]float64{
+			[]float64{0.1, 0.1},
+			[]float64{0.1, 0.08},
+			[]float64{-0.1, 0.1},
+			[]float64{-0.1, -0.1},
+			[]float64{0.1, -0.1},
+		}
+		return vecs, []string{"0", "1", "2", "3", "4"}, nil
+	})
+	incremental := 0
+	scheduler := NewScheduler(index, SchedulerConfig{
+		Source:       source,
+		FullTriggers: []Trigger{ChangedFraction(0.2), DailyAt(3, 0)},
+		Incremental: func(ctx context.Context, index *lsh.LSHIndex) error {
+			incremental++
+			return nil
+		},
+		IncrementalTriggers: []Trigger{Every(time.Hour)},
+	})
+	ctx := context.Background()
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.Local)
+	err := scheduler.Check(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads != 1 || index.ServingVersion() != 1 {
+		t.Fatalf("Nothing is served, so index must be built, got %v loads, version %v", loads, index.ServingVersion())
+	}
+	err = scheduler.Check(ctx, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads != 1 || incremental != 0 {
+		t.Fatalf("No trigger must fire, got %v loads, %v incremental", loads, incremental)
+	}
+	err = scheduler.Check(ctx, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads != 1 || incremental != 1 {
+		t.Fatalf("Incremental rebuild must be run, got %v loads, %v incremental", loads, incremental)
+	}
+	serving, err := index.Version(index.ServingVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = serving.Insert("5", []float64{0.2, 0.2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = serving.Insert("6", []float64{0.3, 0.3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scheduler.Check(ctx, now.Add(time.Hour+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads != 2 || index.ServingVersion() != 2 || !reflect.DeepEqual(index.Versions(), []int{2}) {
+		t.Fatalf("40%% of changes must trigger full rebuild, got %v loads, versions %v", loads, index.Versions())
+	}
+	err = scheduler.Check(ctx, now.Add(15*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads != 3 {
+		t.Fatalf("Daily rebuild must be run after 3:00, got %v loads", loads)
+	}
+}
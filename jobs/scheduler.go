@@ -0,0 +1,185 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCheckInterval = time.Minute
+)
+
+var (
+	noSourceErr = errors.New("full rebuild needs the source")
+)
+
+// TriggerState is what triggers decide on
+type TriggerState struct {
+	Now time.Time
+	// LastBuild is the time of the last successful rebuild, zero if there were none
+	LastBuild time.Time
+	// Changes of the serving index since its' training
+	Changes lsh.ChangeStats
+}
+
+// Trigger returns true when the rebuild is due
+type Trigger func(state TriggerState) bool
+
+// Every fires when the interval has passed since the last rebuild
+func Every(interval time.Duration) Trigger {
+	return func(state TriggerState) bool {
+		return state.Now.Sub(state.LastBuild) >= interval
+	}
+}
+
+// DailyAt fires once a day, at the first check after hour:minute of the local time
+func DailyAt(hour, minute int) Trigger {
+	return func(state TriggerState) bool {
+		now := state.Now
+		scheduled := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if now.Before(scheduled) {
+			scheduled = scheduled.AddDate(0, 0, -1)
+		}
+		return state.LastBuild.Before(scheduled)
+	}
+}
+
+// ChangedFraction fires when inserts and deletes since the last training exceed
+// the fraction of the trained records, e.g. 0.2 for 20%
+func ChangedFraction(fraction float64) Trigger {
+	return func(state TriggerState) bool {
+		return state.Changes.ChangedFraction() > fraction
+	}
+}
+
+// SchedulerConfig defines when and how the index is rebuilt; full rebuild loads the source
+// into the new version of the index, which is promoted when trained, so searches are served
+// by the old version meanwhile (blue/green); incremental rebuild updates the serving version
+// in place, e.g. with LSHIndex.Retrain, Backfill or CompactNow
+type SchedulerConfig struct {
+	Source              Source
+	FullTriggers        []Trigger
+	Incremental         func(ctx context.Context, index *lsh.LSHIndex) error
+	IncrementalTriggers []Trigger
+	// CheckInterval is a period of the triggers check (1 minute by default)
+	CheckInterval time.Duration
+	// OnError is called with errors of the rebuilds started by Run
+	OnError func(err error)
+}
+
+// Scheduler rebuilds versioned index when its' triggers fire
+type Scheduler struct {
+	mx        sync.Mutex
+	index     *lsh.VersionedIndex
+	config    SchedulerConfig
+	lastBuild time.Time
+}
+
+func NewScheduler(index *lsh.VersionedIndex, config SchedulerConfig) *Scheduler {
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = defaultCheckInterval
+	}
+	return &Scheduler{
+		index:  index,
+		config: config,
+	}
+}
+
+// LastBuild returns time of the last successful rebuild
+func (s *Scheduler) LastBuild() time.Time {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.lastBuild
+}
+
+// serving returns serving version of the index, nil if nothing is served yet
+func (s *Scheduler) serving() *lsh.LSHIndex {
+	index, err := s.index.Version(s.index.ServingVersion())
+	if err != nil {
+		return nil
+	}
+	return index
+}
+
+func anyFired(triggers []Trigger, state TriggerState) bool {
+	for _, trigger := range triggers {
+		if trigger(state) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check evaluates the triggers once and runs the rebuild if any of them fires: full rebuild
+// takes precedence, and it's always run when nothing is served yet
+func (s *Scheduler) Check(ctx context.Context, now time.Time) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	state := TriggerState{Now: now, LastBuild: s.lastBuild}
+	serving := s.serving()
+	if serving != nil {
+		state.Changes = serving.Changes()
+	}
+	if serving == nil || anyFired(s.config.FullTriggers, state) {
+		return s.rebuild(ctx, now)
+	}
+	if s.config.Incremental != nil && anyFired(s.config.IncrementalTriggers, state) {
+		err := s.config.Incremental(ctx, serving)
+		if err != nil {
+			return err
+		}
+		s.lastBuild = now
+	}
+	return nil
+}
+
+// RebuildNow runs the full rebuild regardless of the triggers
+func (s *Scheduler) RebuildNow(ctx context.Context) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.rebuild(ctx, time.Now())
+}
+
+// rebuild must be called under the lock
+func (s *Scheduler) rebuild(ctx context.Context, now time.Time) error {
+	if s.config.Source == nil {
+		return noSourceErr
+	}
+	vecs, ids, err := s.config.Source.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	version, err := s.index.BuildVersion(vecs, ids)
+	if err != nil {
+		return err
+	}
+	err = s.index.PromoteVersion(version)
+	if err != nil {
+		return err
+	}
+	s.lastBuild = now
+	return s.index.CollectGarbage()
+}
+
+// Run checks the triggers every CheckInterval until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := s.Check(ctx, now)
+			if err != nil && s.config.OnError != nil {
+				s.config.OnError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package lsh
+
+import (
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"sort"
+	"time"
+)
+
+// tableCollisionProbability returns probability that the points at the given distance
+// share a bucket of a single table, it's known only for the angular banding construction
+func (lsh *LSHIndex) tableCollisionProbability(dist float64) (float64, bool) {
+	lsh.hasher.mutex.RLock()
+	config := lsh.hasher.Config
+	lsh.hasher.mutex.RUnlock()
+	if config.HashesPerTable <= 0 || config.FixedPlanes || config.Scheme != HyperplanesScheme || !config.isAngularMetric {
+		return 0, false
+	}
+	cosine := math.Max(-1, math.Min(1, 1-dist))
+	p := 1 - math.Acos(cosine)/math.Pi
+	return math.Pow(p, float64(config.HashesPerTable)), true
+}
+
+// recallEstimator estimates recall of the maxNN closest candidates while probing
+type recallEstimator struct {
+	lsh       *LSHIndex
+	maxNN     int
+	thrsh     float64
+	prevTopNN map[string]bool
+}
+
+// estimate is called after each probed bucket: with the known collision probability
+// (see EstimateRecall), recall is a probability to find a neighbor, which is as close as
+// the furthest of the maxNN candidates, in at least one of the tables, whose own bucket
+// has been probed; otherwise it's a share of the top candidates which haven't changed
+// after the last bucket
+func (e *recallEstimator) estimate(candidates *safeCandidates, tables int) float64 {
+	candidates.Lock()
+	pool := make([]*Neighbor, len(candidates.list))
+	copy(pool, candidates.list)
+	candidates.Unlock()
+	top := selectClosest(pool, e.maxNN)
+
+	dist := e.thrsh
+	if len(top) == e.maxNN && e.maxNN > 0 {
+		dist = top[len(top)-1].Dist
+	}
+	if p, ok := e.lsh.tableCollisionProbability(dist); ok {
+		return 1 - math.Pow(1-p, float64(tables))
+	}
+
+	topNN := make(map[string]bool, len(top))
+	changed := 0
+	for _, nn := range top {
+		topNN[nn.ID] = true
+		if !e.prevTopNN[nn.ID] {
+			changed++
+		}
+	}
+	first := e.prevTopNN == nil
+	e.prevTopNN = topNN
+	if first || len(top) < e.maxNN || e.maxNN <= 0 {
+		return 0
+	}
+	return 1 - float64(changed)/float64(e.maxNN)
+}
+
+// probeAdaptive probes own buckets of the tables one by one, and then the neighbor buckets,
+// round by round, until the estimated recall reaches the target, the deadline (if set)
+// is passed, or the candidates pool is full; returns the last recall estimate
+func (lsh *LSHIndex) probeAdaptive(hashes map[int]uint64, query *searchQuery, candidates *safeCandidates, maxNN int, target float64, deadline time.Time) (float64, error) {
+	perms := make([]int, 0, len(hashes))
+	for perm := range hashes {
+		perms = append(perms, perm)
+	}
+	sort.Ints(perms)
+	estimator := &recallEstimator{lsh: lsh, maxNN: maxNN, thrsh: query.distanceThrsh}
+	recall := 0.0
+	for round := 0; round <= store.HashBits; round++ {
+		for i, perm := range perms {
+			buckets := getBuckets(perm, hashes[perm], round)
+			if round >= len(buckets) {
+				continue
+			}
+			err := lsh.probe(buckets[round:round+1], query, candidates)
+			if err != nil {
+				return recall, err
+			}
+			tables := len(perms)
+			if round == 0 {
+				tables = i + 1
+			}
+			recall = estimator.estimate(candidates, tables)
+			if recall >= target || candidates.isFull() || (!deadline.IsZero() && time.Now().After(deadline)) {
+				return recall, nil
+			}
+		}
+	}
+	return recall, nil
+}
@@ -0,0 +1,105 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"sort"
+)
+
+var (
+	permErr   = errors.New("permutation doesn't exist")
+	pagingErr = errors.New("offset and limit must be >= 0")
+)
+
+func (lsh *LSHIndex) validatePerm(perm int) error {
+	if !lsh.hasher.isTrained() {
+		return ErrNotTrained
+	}
+	if perm < 0 || perm >= lsh.hasher.getNTrees() {
+		return fmt.Errorf("%w: %v", permErr, perm)
+	}
+	return nil
+}
+
+// ListBuckets returns stored buckets of the permutation, ordered by hash
+func (lsh *LSHIndex) ListBuckets(perm int) ([]BucketStats, error) {
+	scanner, ok := lsh.index.(store.Scanner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err := lsh.validatePerm(perm)
+	if err != nil {
+		return nil, err
+	}
+	bucketsIter, err := scanner.GetBuckets()
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]BucketStats, 0)
+	for _, bucket := range collectBuckets(bucketsIter) {
+		bucketPerm, hash := store.UnpackBucketKey(bucket)
+		if bucketPerm != perm {
+			continue
+		}
+		iter, err := lsh.index.GetHashIterator(bucket)
+		if err != nil {
+			return nil, fmt.Errorf("can't read bucket %v: %w", store.BucketName(bucket), err)
+		}
+		buckets = append(buckets, BucketStats{Hash: hash, Size: len(collectIds(iter))})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Hash < buckets[j].Hash
+	})
+	return buckets, nil
+}
+
+// BucketMembers returns up to limit ids of the bucket (all of them if limit is 0), skipping
+// the first offset ones, in the store order, along with the total number of ids in the bucket
+func (lsh *LSHIndex) BucketMembers(perm int, hash uint64, offset, limit int) ([]string, int, error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, pagingErr
+	}
+	err := lsh.validatePerm(perm)
+	if err != nil {
+		return nil, 0, err
+	}
+	bucket := getBucketKey(perm, hash)
+	iter, err := lsh.index.GetHashIterator(bucket)
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't read bucket %v: %w", store.BucketName(bucket), err)
+	}
+	ids := make([]string, 0)
+	total := 0
+	for id, ok := iter.Next(); ok; id, ok = iter.Next() {
+		if total >= offset && (limit == 0 || len(ids) < limit) {
+			ids = append(ids, id)
+		}
+		total++
+	}
+	return ids, total, nil
+}
+
+// RecordBuckets returns hashes of the buckets the record occupies, per permutation; only the
+// buckets expected by the current hasher are checked, so permutations where the record
+// is missing (see Backfill) are absent from the result, and stale entries are reported by Verify
+func (lsh *LSHIndex) RecordBuckets(id string) (map[int]uint64, error) {
+	if !lsh.hasher.isTrained() {
+		return nil, ErrNotTrained
+	}
+	vec, err := lsh.index.GetVector(id)
+	if err != nil {
+		return nil, fmt.Errorf("can't get vector %v: %w", id, err)
+	}
+	occupied := make(map[int]uint64)
+	for perm, hash := range lsh.hasher.getHashes(vec) {
+		stored, err := lsh.bucketHolds(getBucketKey(perm, hash), id)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			occupied[perm] = hash
+		}
+	}
+	return occupied, nil
+}
@@ -0,0 +1,117 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrClosed returned on writes to the closed async inserter
+	ErrClosed = errors.New("inserter is closed")
+)
+
+type insertOp struct {
+	id  string
+	vec []float64
+}
+
+// AsyncInserter queues inserts into the bounded queue, processed by background workers;
+// inserted vectors become searchable with a small lag, Flush waits for them to be stored
+type AsyncInserter struct {
+	index   *LSHIndex
+	queue   chan insertOp
+	workers sync.WaitGroup
+	closeMx sync.RWMutex
+	closed  bool
+
+	mx      sync.Mutex
+	drained *sync.Cond
+	pending int
+	err     error
+}
+
+// NewAsyncInserter starts workers writing to the index; Insert blocks when queueSize
+// vectors are already waiting
+func NewAsyncInserter(index *LSHIndex, queueSize, workers int) *AsyncInserter {
+	if workers < 1 {
+		workers = 1
+	}
+	ai := &AsyncInserter{
+		index: index,
+		queue: make(chan insertOp, queueSize),
+	}
+	ai.drained = sync.NewCond(&ai.mx)
+	for i := 0; i < workers; i++ {
+		ai.workers.Add(1)
+		go ai.work()
+	}
+	return ai
+}
+
+func (ai *AsyncInserter) work() {
+	defer ai.workers.Done()
+	for op := range ai.queue {
+		_, err := ai.index.Insert(op.id, op.vec)
+		ai.mx.Lock()
+		if err != nil && ai.err == nil {
+			ai.err = err
+		}
+		ai.pending--
+		if ai.pending == 0 {
+			ai.drained.Broadcast()
+		}
+		ai.mx.Unlock()
+	}
+}
+
+// Insert validates vector and puts it into the queue; store errors are returned by Flush
+func (ai *AsyncInserter) Insert(id string, vec []float64) error {
+	if ai.index.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if !ai.index.hasher.isTrained() {
+		return ErrNotTrained
+	}
+	err := validateVector(vec, ai.index.hasher.getDims())
+	if err != nil {
+		return fmt.Errorf("invalid vector %v: %w", id, err)
+	}
+	ai.closeMx.RLock()
+	defer ai.closeMx.RUnlock()
+	if ai.closed {
+		return ErrClosed
+	}
+	ai.mx.Lock()
+	ai.pending++
+	ai.mx.Unlock()
+	ai.queue <- insertOp{id: id, vec: vec}
+	return nil
+}
+
+// Flush blocks until all queued vectors are stored, and returns the first
+// error happened since the previous flush
+func (ai *AsyncInserter) Flush() error {
+	ai.mx.Lock()
+	defer ai.mx.Unlock()
+	for ai.pending > 0 {
+		ai.drained.Wait()
+	}
+	err := ai.err
+	ai.err = nil
+	return err
+}
+
+// Close flushes the queue and stops workers
+func (ai *AsyncInserter) Close() error {
+	ai.closeMx.Lock()
+	if ai.closed {
+		ai.closeMx.Unlock()
+		return ErrClosed
+	}
+	ai.closed = true
+	close(ai.queue)
+	ai.closeMx.Unlock()
+	ai.workers.Wait()
+	return ai.Flush()
+}
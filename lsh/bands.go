@@ -0,0 +1,69 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"math/rand"
+)
+
+var (
+	tablesNumberErr   = errors.New("NumTables and NTrees must be equal when both are set")
+	hashesPerTableErr = fmt.Errorf("hashes per table must not exceed %v", store.HashBits)
+	bandsITQErr       = errors.New("HashesPerTable can't be combined with ITQ, which sets the number of planes itself")
+)
+
+// applyBands validates banding parameters, NumTables is an alias of NTrees
+func (c *HasherConfig) applyBands() error {
+	if c.NumTables > 0 {
+		if c.NTrees > 0 && c.NTrees != c.NumTables {
+			return tablesNumberErr
+		}
+		c.NTrees = c.NumTables
+	}
+	if c.HashesPerTable < 0 || c.HashesPerTable > store.HashBits {
+		return hashesPerTableErr
+	}
+	if c.HashesPerTable > 0 && c.ITQ.Bits > 0 {
+		return bandsITQErr
+	}
+	return nil
+}
+
+// buildBandTree chains HashesPerTable random hyperplanes: through the origin for
+// angular metric (so collision probability is 1 - angle/pi), or through a random
+// training vector otherwise
+func buildBandTree(vecs [][]float64, config HasherConfig, rnd *rand.Rand) *treeNode {
+	planes := make([][]float64, config.HashesPerTable)
+	for i := range planes {
+		planes[i] = make([]float64, config.Dims+1)
+		for j := 0; j < config.Dims; j++ {
+			planes[i][j] = rnd.NormFloat64()
+		}
+		if !config.isAngularMetric && len(vecs) > 0 {
+			point := vecs[rnd.Intn(len(vecs))]
+			for j := 0; j < config.Dims; j++ {
+				planes[i][config.Dims] += planes[i][j] * point[j]
+			}
+		}
+	}
+	return chainTree(planes, config.Dims)
+}
+
+// SCurve returns probability that the points, which collide in a single hash with probability p,
+// share a bucket in at least one of the tables: 1 - (1 - p^hashesPerTable)^tables
+func SCurve(p float64, tables, hashesPerTable int) float64 {
+	return 1 - math.Pow(1-math.Pow(p, float64(hashesPerTable)), float64(tables))
+}
+
+// EstimateRecall returns probability to find a neighbor at the given angular distance
+// (1 - cosine) with a single probe per table; it's known only for random hyperplanes
+// of the banding construction (HashesPerTable > 0) and angular metric
+func (lsh *LSHIndex) EstimateRecall(dist float64) (float64, error) {
+	p, ok := lsh.tableCollisionProbability(dist)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	return SCurve(p, lsh.hasher.getNTrees(), 1), nil
+}
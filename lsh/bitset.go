@@ -0,0 +1,43 @@
+package lsh
+
+const (
+	pageWords = 64
+	pageBits  = pageWords * 64
+)
+
+// pagedBitset is a sparse bitset, which allocates pages of 4096 bits on demand,
+// so its' size is proportional to the number of touched key ranges
+type pagedBitset struct {
+	pages map[uint64]*[pageWords]uint64
+}
+
+func newPagedBitset() *pagedBitset {
+	return &pagedBitset{
+		pages: make(map[uint64]*[pageWords]uint64),
+	}
+}
+
+// testAndSet sets the bit and returns its' previous value
+func (b *pagedBitset) testAndSet(key uint64) bool {
+	page, ok := b.pages[key/pageBits]
+	if !ok {
+		page = new([pageWords]uint64)
+		b.pages[key/pageBits] = page
+	}
+	word := &page[(key%pageBits)/64]
+	mask := uint64(1) << (key % 64)
+	if *word&mask != 0 {
+		return true
+	}
+	*word |= mask
+	return false
+}
+
+// test returns value of the bit
+func (b *pagedBitset) test(key uint64) bool {
+	page, ok := b.pages[key/pageBits]
+	if !ok {
+		return false
+	}
+	return page[(key%pageBits)/64]&(uint64(1)<<(key%64)) != 0
+}
@@ -0,0 +1,324 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"sync"
+	"time"
+)
+
+var (
+	breakerOpenErr  = fmt.Errorf("circuit breaker is open: %w", store.ErrStoreUnavailable)
+	storeTimeoutErr = fmt.Errorf("store operation timed out: %w", store.ErrStoreUnavailable)
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerStore fails store operations fast with ErrStoreUnavailable after maxFailures
+// consecutive errors or read timeouts; after cooldown a single trial call is let through,
+// and its' success closes the breaker again
+type breakerStore struct {
+	store.Store
+	maxFailures int
+	cooldown    time.Duration
+	timeout     time.Duration
+
+	mx       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newBreakerStore(s store.Store, maxFailures int, cooldown, timeout time.Duration) *breakerStore {
+	return &breakerStore{
+		Store:       s,
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+		timeout:     timeout,
+	}
+}
+
+func (s *breakerStore) allow() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	switch s.state {
+	case breakerOpen:
+		if time.Since(s.openedAt) < s.cooldown {
+			return false
+		}
+		s.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// NOTE: only the single trial call is allowed
+		return false
+	}
+	return true
+}
+
+func (s *breakerStore) record(err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err == nil || errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrNotSupported) {
+		s.state = breakerClosed
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.state == breakerHalfOpen || s.failures >= s.maxFailures {
+		s.state = breakerOpen
+		s.openedAt = time.Now()
+	}
+}
+
+// read runs store read, abandoning it after the timeout
+func (s *breakerStore) read(op func() error) error {
+	return s.call(op, s.timeout)
+}
+
+// write runs store write without the timeout, since the abandoned write could still be applied,
+// e.g. breaking atomicity of the transaction, so the outcome of the timed out write is unknown
+func (s *breakerStore) write(op func() error) error {
+	return s.call(op, 0)
+}
+
+// call runs store operation, abandoning it after the timeout, if it's set
+func (s *breakerStore) call(op func() error, timeout time.Duration) error {
+	if !s.allow() {
+		return breakerOpenErr
+	}
+	var err error
+	if timeout <= 0 {
+		err = op()
+	} else {
+		done := make(chan error, 1)
+		go func() {
+			done <- op()
+		}()
+		timer := time.NewTimer(timeout)
+		select {
+		case err = <-done:
+			timer.Stop()
+		case <-timer.C:
+			err = storeTimeoutErr
+		}
+	}
+	s.record(err)
+	return err
+}
+
+func (s *breakerStore) SetVector(id string, vec []float64) error {
+	return s.write(func() error {
+		return s.Store.SetVector(id, vec)
+	})
+}
+
+func (s *breakerStore) GetVector(id string) ([]float64, error) {
+	var vec []float64
+	err := s.read(func() error {
+		var err error
+		vec, err = s.Store.GetVector(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vec, nil
+}
+
+func (s *breakerStore) SetHash(bucket uint64, vecId string) error {
+	return s.write(func() error {
+		return s.Store.SetHash(bucket, vecId)
+	})
+}
+
+func (s *breakerStore) GetHashIterator(bucket uint64) (store.Iterator, error) {
+	var iter store.Iterator
+	err := s.read(func() error {
+		var err error
+		iter, err = s.Store.GetHashIterator(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+func (s *breakerStore) DeleteVector(id string) error {
+	deleter, ok := s.Store.(store.Deleter)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	return s.write(func() error {
+		return deleter.DeleteVector(id)
+	})
+}
+
+func (s *breakerStore) DeleteHash(bucket uint64, vecId string) error {
+	deleter, ok := s.Store.(store.Deleter)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	return s.write(func() error {
+		return deleter.DeleteHash(bucket, vecId)
+	})
+}
+
+func (s *breakerStore) SetTombstone(id string) error {
+	tombstoner, ok := s.Store.(store.Tombstoner)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	return s.write(func() error {
+		return tombstoner.SetTombstone(id)
+	})
+}
+
+func (s *breakerStore) DeleteTombstone(id string) error {
+	tombstoner, ok := s.Store.(store.Tombstoner)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	return s.write(func() error {
+		return tombstoner.DeleteTombstone(id)
+	})
+}
+
+func (s *breakerStore) IsTombstone(id string) (bool, error) {
+	tombstoner, ok := s.Store.(store.Tombstoner)
+	if !ok {
+		return false, store.ErrNotSupported
+	}
+	var deleted bool
+	err := s.read(func() error {
+		var err error
+		deleted, err = tombstoner.IsTombstone(id)
+		return err
+	})
+	return deleted, err
+}
+
+func (s *breakerStore) GetTombstones() (store.Iterator, error) {
+	tombstoner, ok := s.Store.(store.Tombstoner)
+	if !ok {
+		return nil, store.ErrNotSupported
+	}
+	var iter store.Iterator
+	err := s.read(func() error {
+		var err error
+		iter, err = tombstoner.GetTombstones()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+func (s *breakerStore) GetVectorsIds() (store.Iterator, error) {
+	scanner, ok := s.Store.(store.Scanner)
+	if !ok {
+		return nil, store.ErrNotSupported
+	}
+	var iter store.Iterator
+	err := s.read(func() error {
+		var err error
+		iter, err = scanner.GetVectorsIds()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+func (s *breakerStore) GetBuckets() (store.BucketIterator, error) {
+	scanner, ok := s.Store.(store.Scanner)
+	if !ok {
+		return nil, store.ErrNotSupported
+	}
+	var iter store.BucketIterator
+	err := s.read(func() error {
+		var err error
+		iter, err = scanner.GetBuckets()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+func (s *breakerStore) SetMeta(id string, meta map[string]string) error {
+	metaStore, ok := s.Store.(store.MetaStore)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	return s.write(func() error {
+		return metaStore.SetMeta(id, meta)
+	})
+}
+
+func (s *breakerStore) GetMeta(id string) (map[string]string, error) {
+	metaStore, ok := s.Store.(store.MetaStore)
+	if !ok {
+		return nil, store.ErrNotSupported
+	}
+	var meta map[string]string
+	err := s.read(func() error {
+		var err error
+		meta, err = metaStore.GetMeta(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *breakerStore) Clear() error {
+	return s.write(func() error {
+		return s.Store.Clear()
+	})
+}
+
+// Ping bypasses the breaker, so the store can be probed while the breaker is open
+func (s *breakerStore) Ping() error {
+	checker, ok := s.Store.(store.HealthChecker)
+	if !ok {
+		return nil
+	}
+	return checker.Ping()
+}
+
+// Reconnect closes the breaker on success
+func (s *breakerStore) Reconnect() error {
+	reconnecter, ok := s.Store.(store.Reconnecter)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	err := reconnecter.Reconnect()
+	if err == nil {
+		s.record(nil)
+	}
+	return err
+}
+
+// Update runs the whole transaction as a single breaker call, stores which don't
+// support transactions get the writes one by one, each through the breaker
+func (s *breakerStore) Update(fn func(tx store.Store) error) error {
+	txn, ok := s.Store.(store.Txn)
+	if !ok {
+		return fn(s)
+	}
+	return s.write(func() error {
+		return txn.Update(fn)
+	})
+}
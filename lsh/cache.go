@@ -0,0 +1,120 @@
+package lsh
+
+import (
+	"container/list"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	key     string
+	value   []Neighbor
+	expires time.Time
+}
+
+// resultsCache is an LRU cache of search results with optional TTL
+type resultsCache struct {
+	mx        sync.Mutex
+	size      int
+	ttl       time.Duration
+	precision float64
+	items     map[string]*list.Element
+	order     *list.List
+}
+
+func newResultsCache(size int, ttl time.Duration, precision float64) *resultsCache {
+	return &resultsCache{
+		size:      size,
+		ttl:       ttl,
+		precision: precision,
+		items:     make(map[string]*list.Element),
+		order:     list.New(),
+	}
+}
+
+// getKey quantizes query components, so the close queries share the same cache entry
+func (c *resultsCache) getKey(query []float64, opts SearchOpts) string {
+	params := []float64{
+		float64(opts.MaxNN), opts.DistanceThrsh, float64(opts.MaxCandidates), float64(opts.NProbes),
+		float64(opts.MaxPerGroup), opts.MMRLambda, float64(len(opts.NegativeVecs)), opts.NegativeWeight,
+	}
+	for _, neg := range opts.NegativeVecs {
+		params = append(params, neg...)
+	}
+	buf := make([]byte, 8*(len(query)+len(params)), 8*(len(query)+len(params))+len(opts.GroupBy))
+	for i, val := range query {
+		if c.precision > 0 {
+			val = math.Round(val/c.precision) * c.precision
+		}
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(val))
+	}
+	for i, val := range params {
+		binary.LittleEndian.PutUint64(buf[8*(len(query)+i):], math.Float64bits(val))
+	}
+	buf = append(buf, opts.GroupBy...)
+	return string(buf)
+}
+
+func (c *resultsCache) get(key string) ([]Neighbor, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	value := make([]Neighbor, len(entry.value))
+	copy(value, entry.value)
+	return value, true
+}
+
+func (c *resultsCache) set(key string, value []Neighbor) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	cpy := make([]Neighbor, len(value))
+	copy(cpy, value)
+	entry := &cacheEntry{
+		key:     key,
+		value:   cpy,
+		expires: time.Now().Add(c.ttl),
+	}
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.order.PushFront(entry)
+	c.evict()
+}
+
+// evict removes the least recently used entries exceeding the size
+func (c *resultsCache) evict() {
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *resultsCache) resize(size int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.size = size
+	c.evict()
+}
+
+// clear invalidates all cached results
+func (c *resultsCache) clear() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
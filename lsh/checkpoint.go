@@ -0,0 +1,305 @@
+package lsh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/snapcrypt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	defaultCheckpointInterval = 100000
+	// checkpointFrameHeader is the size of the checkpoint length prefix
+	checkpointFrameHeader = 4
+)
+
+// Checkpoint holds progress of the interrupted training
+type Checkpoint struct {
+	// Offset is a number of already indexed entries of the source
+	Offset int
+	// Hasher is set only by the first checkpoint of the training
+	Hasher []byte
+	// IDs and Vecs hold the transformed entries indexed since the previous checkpoint, they're
+	// kept only if the store is volatile, while the store.Durable one keeps indexed entries by itself
+	IDs  []string
+	Vecs [][]float64
+}
+
+// merge appends the next checkpoint to the current one
+func (c *Checkpoint) merge(next *Checkpoint) {
+	c.Offset = next.Offset
+	if c.Hasher == nil {
+		c.Hasher = next.Hasher
+	}
+	c.IDs = append(c.IDs, next.IDs...)
+	c.Vecs = append(c.Vecs, next.Vecs...)
+}
+
+// CheckpointStore persists checkpoints of the training; since every checkpoint holds only
+// the entries indexed after the previous one, the store accumulates them
+type CheckpointStore interface {
+	// SaveCheckpoint appends checkpoint to the saved ones
+	SaveCheckpoint(checkpoint *Checkpoint) error
+	// LoadCheckpoint returns all saved checkpoints merged into one, or nil if there are none
+	LoadCheckpoint() (*Checkpoint, error)
+	ClearCheckpoint() error
+}
+
+// FileCheckpointStore appends checkpoints to a single file as the length-prefixed frames,
+// so each save costs only the size of the checkpoint
+type FileCheckpointStore struct {
+	path        string
+	keyring     snapcrypt.Keyring
+	compression Compression
+}
+
+// NewFileCheckpointStore creates checkpoint store at the given path
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path}
+}
+
+// NewEncryptedFileCheckpointStore creates checkpoint store which encrypts the checkpoints with
+// the current key of the keyring, since they hold the raw vectors; unencrypted
+// checkpoints are refused on load
+func NewEncryptedFileCheckpointStore(path string, keyring snapcrypt.Keyring) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path, keyring: keyring}
+}
+
+// SetCompression enables compression of the saved checkpoints (before the encryption),
+// compressed checkpoints are detected on load regardless of this setting
+func (s *FileCheckpointStore) SetCompression(compression Compression) error {
+	err := compression.validate()
+	if err != nil {
+		return err
+	}
+	s.compression = compression
+	return nil
+}
+
+// SaveCheckpoint appends checkpoint frame to the file and syncs it
+func (s *FileCheckpointStore) SaveCheckpoint(checkpoint *Checkpoint) error {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(checkpoint)
+	if err != nil {
+		return err
+	}
+	data, err := compress(buf.Bytes(), s.compression)
+	if err != nil {
+		return fmt.Errorf("can't compress checkpoint: %w", err)
+	}
+	if s.keyring != nil {
+		data, err = snapcrypt.Seal(s.keyring, data)
+		if err != nil {
+			return fmt.Errorf("can't encrypt checkpoint: %w", err)
+		}
+	}
+	frame := make([]byte, checkpointFrameHeader+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[checkpointFrameHeader:], data)
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(frame)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// LoadCheckpoint reads all checkpoint frames of the file; the torn last frame,
+// left by the crash during the save, is cut off, so the next saves follow the valid ones
+func (s *FileCheckpointStore) LoadCheckpoint() (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var merged *Checkpoint
+	pos := 0
+	for pos+checkpointFrameHeader <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if pos+checkpointFrameHeader+size > len(data) {
+			break
+		}
+		checkpoint, err := s.decodeFrame(data[pos+checkpointFrameHeader : pos+checkpointFrameHeader+size])
+		if err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = checkpoint
+		} else {
+			merged.merge(checkpoint)
+		}
+		pos += checkpointFrameHeader + size
+	}
+	if pos < len(data) {
+		err = os.Truncate(s.path, int64(pos))
+		if err != nil {
+			return nil, fmt.Errorf("can't cut off torn checkpoint: %w", err)
+		}
+	}
+	return merged, nil
+}
+
+func (s *FileCheckpointStore) decodeFrame(data []byte) (*Checkpoint, error) {
+	var err error
+	if s.keyring != nil {
+		data, err = snapcrypt.Open(s.keyring, data)
+		if err != nil {
+			return nil, fmt.Errorf("can't decrypt checkpoint: %w", err)
+		}
+	}
+	data, err = decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't decompress checkpoint: %w", err)
+	}
+	checkpoint := &Checkpoint{}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// ClearCheckpoint removes the checkpoint file
+func (s *FileCheckpointStore) ClearCheckpoint() error {
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// resume restores hasher and store from the checkpoint; the durable store already
+// holds the indexed entries, so only the number of trained records is restored
+func (lsh *LSHIndex) resume(checkpoint *Checkpoint) error {
+	err := lsh.LoadHasher(checkpoint.Hasher)
+	if err != nil {
+		return err
+	}
+	lsh.tombstones.clear()
+	if lsh.durable {
+		lsh.versions.resume(checkpoint.Offset)
+		return nil
+	}
+	lsh.versions.reset(nil)
+	err = lsh.index.Clear()
+	if err != nil {
+		return err
+	}
+	for i, id := range checkpoint.IDs {
+		err = lsh.indexVector(lsh.index, id, checkpoint.Vecs[i])
+		if err != nil {
+			return fmt.Errorf("can't restore checkpoint: %w", err)
+		}
+		lsh.versions.init(id)
+	}
+	return nil
+}
+
+// TrainWithCheckpoints fills new search index with the entries of the source, saving
+// a checkpoint every IndexConfig.CheckpointInterval entries; if checkpoints already hold one,
+// training is resumed from it, skipping already indexed entries of the source, so
+// source must return new iterator over the same data, in the same order, on each call;
+// checkpoints hold the indexed entries to restore them into the emptied store, unless
+// the store is store.Durable; checkpoint is cleared when training is finished
+func (lsh *LSHIndex) TrainWithCheckpoints(source func() (EntriesIterator, error), checkpoints CheckpointStore) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	checkpoint, err := checkpoints.LoadCheckpoint()
+	if err != nil {
+		return fmt.Errorf("can't load checkpoint: %w", err)
+	}
+	lsh.invalidateCache()
+	defer lsh.invalidateCache()
+	offset := 0
+	if checkpoint != nil {
+		err = lsh.resume(checkpoint)
+		if err != nil {
+			return err
+		}
+		offset = checkpoint.Offset
+	} else {
+		it, err := source()
+		if err != nil {
+			return err
+		}
+		sample, err := lsh.sampleEntries(it, defaultSpillSampleSize)
+		if err != nil {
+			return err
+		}
+		err = lsh.index.Clear()
+		if err != nil {
+			return err
+		}
+		lsh.tombstones.clear()
+		lsh.versions.reset(nil)
+		lsh.hasher.build(sample, lsh.pipelineID)
+	}
+
+	it, err := source()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < offset; i++ {
+		if _, _, ok := it.Next(); !ok {
+			if err := it.Err(); err != nil {
+				return fmt.Errorf("can't read entries: %w", err)
+			}
+			return fmt.Errorf("source is shorter than the checkpoint offset %v", offset)
+		}
+	}
+	dims := lsh.hasher.getDims()
+	interval := lsh.config.getCheckpointInterval()
+	keepEntries := !lsh.durable
+	next := &Checkpoint{}
+	if checkpoint == nil {
+		next.Hasher, err = lsh.hasher.dump()
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		id, vec, ok := it.Next()
+		if !ok {
+			break
+		}
+		vec, err = lsh.config.Pipeline.apply(vec, dims)
+		if err != nil {
+			return fmt.Errorf("invalid vector %v: %w", id, err)
+		}
+		err = lsh.indexVector(lsh.index, id, vec)
+		if err != nil {
+			return err
+		}
+		lsh.versions.init(id)
+		offset++
+		if keepEntries {
+			next.IDs = append(next.IDs, id)
+			next.Vecs = append(next.Vecs, vec)
+		}
+		if offset%interval == 0 {
+			next.Offset = offset
+			err = checkpoints.SaveCheckpoint(next)
+			if err != nil {
+				return fmt.Errorf("can't save checkpoint: %w", err)
+			}
+			next = &Checkpoint{}
+		}
+	}
+	err = it.Err()
+	if err != nil {
+		return fmt.Errorf("can't read entries: %w", err)
+	}
+	return checkpoints.ClearCheckpoint()
+}
@@ -0,0 +1,75 @@
+package lsh
+
+import (
+	"errors"
+)
+
+var (
+	// ErrNoNeighbors returned when there are no labeled neighbors to vote
+	ErrNoNeighbors = errors.New("No labeled neighbors found")
+)
+
+// Voting defines how neighbors' labels are combined into prediction
+type Voting int
+
+const (
+	// MajorityVote picks the most frequent label among neighbors
+	MajorityVote Voting = iota
+	// DistanceWeightedVote weights each neighbor's vote by the inverse distance
+	DistanceWeightedVote
+)
+
+// LabelLookup returns label of the stored vector
+type LabelLookup func(id string) (string, bool)
+
+// KNNClassifier predicts label of the vector by voting of its' NNs found in the index
+type KNNClassifier struct {
+	index         Indexer
+	labels        LabelLookup
+	k             int
+	distanceThrsh float64
+	voting        Voting
+}
+
+func NewKNNClassifier(index Indexer, labels LabelLookup, k int, distanceThrsh float64, voting Voting) *KNNClassifier {
+	return &KNNClassifier{
+		index:         index,
+		labels:        labels,
+		k:             k,
+		distanceThrsh: distanceThrsh,
+		voting:        voting,
+	}
+}
+
+// Predict returns the winning label and its' share of votes;
+// neighbors without label are skipped, ties are broken by label
+func (c *KNNClassifier) Predict(vec []float64) (string, float64, error) {
+	closest, err := c.index.Search(vec, c.k, c.distanceThrsh)
+	if err != nil {
+		return "", 0, err
+	}
+	votes := make(map[string]float64)
+	total := 0.0
+	for _, nn := range closest {
+		label, ok := c.labels(nn.ID)
+		if !ok {
+			continue
+		}
+		weight := 1.0
+		if c.voting == DistanceWeightedVote {
+			weight = 1.0 / (nn.Dist + tol)
+		}
+		votes[label] += weight
+		total += weight
+	}
+	if len(votes) == 0 {
+		return "", 0, ErrNoNeighbors
+	}
+	best, bestVotes := "", -1.0
+	for label, v := range votes {
+		if v > bestVotes || (v == bestVotes && label < best) {
+			best, bestVotes = label, v
+		}
+	}
+	return best, bestVotes / total, nil
+}
@@ -0,0 +1,244 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"sync"
+	"time"
+)
+
+// CompactionStats holds metrics of the deleted vectors compaction
+type CompactionStats struct {
+	Pending        int
+	Compacted      int
+	LastCompaction time.Time
+	LastDuration   time.Duration
+}
+
+// compaction serializes compaction passes and keeps their metrics
+type compaction struct {
+	mx    sync.Mutex
+	stats CompactionStats
+}
+
+// tombstones hold ids of the deleted vectors until compaction; they are kept in the store,
+// if it implements store.Tombstoner, so deletes survive restarts and are seen by every index
+// over the store, otherwise they are kept in memory of the index
+type tombstones struct {
+	store store.Tombstoner
+	local *StringSet
+}
+
+func newTombstones(s store.Store, stored bool) *tombstones {
+	if stored {
+		return &tombstones{store: s.(store.Tombstoner)}
+	}
+	return &tombstones{local: NewStringSet()}
+}
+
+func (t *tombstones) set(id string) error {
+	if t.store != nil {
+		return t.store.SetTombstone(id)
+	}
+	t.local.Set(id)
+	return nil
+}
+
+func (t *tombstones) remove(id string) error {
+	if t.store != nil {
+		return t.store.DeleteTombstone(id)
+	}
+	t.local.Remove(id)
+	return nil
+}
+
+func (t *tombstones) has(id string) (bool, error) {
+	if t.store != nil {
+		return t.store.IsTombstone(id)
+	}
+	return t.local.Get(id), nil
+}
+
+func (t *tombstones) keys() ([]string, error) {
+	if t.store != nil {
+		iter, err := t.store.GetTombstones()
+		if err != nil {
+			return nil, err
+		}
+		return collectIds(iter), nil
+	}
+	return t.local.Keys(), nil
+}
+
+// clear drops the in-memory tombstones, the stored ones are dropped by the store Clear
+func (t *tombstones) clear() {
+	if t.local != nil {
+		t.local.Clear()
+	}
+}
+
+// Delete marks vector as deleted, so it's skipped during the search; vector and its' hashes
+// are physically removed from the store during compaction, so the store must implement
+// store.Deleter, otherwise ErrNotSupported is returned; deleting the deleted vector is a no-op
+func (lsh *LSHIndex) Delete(id string) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if !lsh.deletable {
+		return ErrNotSupported
+	}
+	defer lsh.versions.lock(id)()
+	_, err := lsh.index.GetVector(id)
+	if err != nil {
+		return fmt.Errorf("can't delete vector %v: %w", id, err)
+	}
+	deleted, err := lsh.tombstones.has(id)
+	if err != nil {
+		return fmt.Errorf("can't check tombstone of vector %v: %w", id, err)
+	}
+	if deleted {
+		return nil
+	}
+	err = lsh.tombstones.set(id)
+	if err != nil {
+		return fmt.Errorf("can't delete vector %v: %w", id, err)
+	}
+	lsh.invalidateCache()
+	lsh.versions.deleted(id)
+	return nil
+}
+
+// CompactNow removes deleted vectors and their hashes from the store,
+// returns number of removed vectors
+func (lsh *LSHIndex) CompactNow() (int, error) {
+	if lsh.config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if !lsh.deletable {
+		return 0, ErrNotSupported
+	}
+	lsh.compaction.mx.Lock()
+	defer lsh.compaction.mx.Unlock()
+	start := time.Now()
+	compacted := 0
+	ids, err := lsh.tombstones.keys()
+	if err != nil {
+		lsh.updateCompactionStats(compacted, start)
+		return compacted, fmt.Errorf("can't get tombstones: %w", err)
+	}
+	for _, id := range ids {
+		removed, err := lsh.compactVector(id)
+		if err != nil {
+			lsh.updateCompactionStats(compacted, start)
+			return compacted, err
+		}
+		if removed {
+			compacted++
+		}
+	}
+	lsh.updateCompactionStats(compacted, start)
+	return compacted, nil
+}
+
+func (lsh *LSHIndex) updateCompactionStats(compacted int, start time.Time) {
+	lsh.compaction.stats.Compacted += compacted
+	lsh.compaction.stats.LastCompaction = start
+	lsh.compaction.stats.LastDuration = time.Since(start)
+}
+
+// compactVector removes vector and its' tombstone if it's still deleted,
+// since it could be inserted again
+func (lsh *LSHIndex) compactVector(id string) (bool, error) {
+	defer lsh.versions.lock(id)()
+	deleted, err := lsh.tombstones.has(id)
+	if err != nil {
+		return false, fmt.Errorf("can't check tombstone of vector %v: %w", id, err)
+	}
+	if !deleted {
+		return false, nil
+	}
+	err = lsh.removeVector(id)
+	if err != nil {
+		return false, err
+	}
+	err = lsh.tombstones.remove(id)
+	if err != nil {
+		return false, fmt.Errorf("can't delete tombstone of vector %v: %w", id, err)
+	}
+	return true, nil
+}
+
+// removeHashes deletes vector's id from all buckets it was hashed to
+func (lsh *LSHIndex) removeHashes(s store.Store, id string, vec []float64) error {
+	deleter, ok := s.(store.Deleter)
+	if !ok {
+		return fmt.Errorf("can't delete hashes of vector %v: %w", id, ErrNotSupported)
+	}
+	for perm, hash := range lsh.hasher.getHashes(vec) {
+		err := deleter.DeleteHash(getBucketKey(perm, hash), id)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("can't delete hash of vector %v: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// removeVector deletes vector from all buckets it was hashed to and then the vector itself,
+// atomically if the store supports it
+func (lsh *LSHIndex) removeVector(id string) error {
+	return store.Update(lsh.index, func(tx store.Store) error {
+		vec, err := tx.GetVector(id)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("can't get vector %v: %w", id, err)
+		}
+		err = lsh.removeHashes(tx, id, vec)
+		if err != nil {
+			return err
+		}
+		err = tx.(store.Deleter).DeleteVector(id)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("can't delete vector %v: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// StartCompaction runs compaction periodically in background until returned stop func is called;
+// errors are retried on the next tick and can be observed with CompactNow
+func (lsh *LSHIndex) StartCompaction(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				lsh.CompactNow()
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// CompactionStats returns compaction metrics
+func (lsh *LSHIndex) CompactionStats() CompactionStats {
+	lsh.compaction.mx.Lock()
+	defer lsh.compaction.mx.Unlock()
+	stats := lsh.compaction.stats
+	// NOTE: pending count is left zero if the stored tombstones can't be read
+	if ids, err := lsh.tombstones.keys(); err == nil {
+		stats.Pending = len(ids)
+	}
+	return stats
+}
@@ -0,0 +1,76 @@
+package lsh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	codecErr = errors.New("unknown compression codec")
+)
+
+// Codec is a compression algorithm of the files written by the index
+type Codec int
+
+const (
+	NoCompression Codec = iota
+	Gzip
+)
+
+// Compression holds codec along with its' level, zero level means the codec's default one
+type Compression struct {
+	Codec Codec
+	Level int
+}
+
+func (c Compression) validate() error {
+	switch c.Codec {
+	case NoCompression:
+		return nil
+	case Gzip:
+		if c.Level == 0 {
+			return nil
+		}
+		_, err := gzip.NewWriterLevel(ioutil.Discard, c.Level)
+		return err
+	}
+	return codecErr
+}
+
+func compress(data []byte, c Compression) ([]byte, error) {
+	if c.Codec == NoCompression {
+		return data, nil
+	}
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress detects compressed data by the gzip magic bytes, other data is returned as is
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
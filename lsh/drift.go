@@ -0,0 +1,118 @@
+package lsh
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	defaultDriftWindow = 1000
+)
+
+// DriftConfig holds parameters of the DriftMonitor
+type DriftConfig struct {
+	// Window is an effective number of the latest vectors the rolling stats are
+	// averaged over (1000 by default); score is reported after Window vectors
+	Window int
+	// OnDrift, when set, is called each time the score crosses Threshold from below
+	Threshold float64
+	OnDrift   func(score float64)
+}
+
+// DriftMonitor tracks exponentially weighted mean and std of the incoming vectors and compares
+// them with the scaler fitted at the training time, since the drifted scaler silently
+// degrades hashes quality
+type DriftMonitor struct {
+	mx       sync.Mutex
+	scaler   *StandartScaler
+	config   DriftConfig
+	alpha    float64
+	mean     []float64
+	variance []float64
+	count    int
+	drifted  bool
+}
+
+func NewDriftMonitor(scaler *StandartScaler, config DriftConfig) *DriftMonitor {
+	if config.Window <= 0 {
+		config.Window = defaultDriftWindow
+	}
+	return &DriftMonitor{
+		scaler: scaler,
+		config: config,
+		alpha:  2 / (float64(config.Window) + 1),
+	}
+}
+
+// Observe updates the rolling stats with the vector, vectors of the wrong dimensions are ignored
+func (m *DriftMonitor) Observe(vec []float64) {
+	m.mx.Lock()
+	if m.mean == nil {
+		m.mean = make([]float64, len(vec))
+		copy(m.mean, vec)
+		m.variance = make([]float64, len(vec))
+	} else if len(vec) == len(m.mean) {
+		for i, val := range vec {
+			diff := val - m.mean[i]
+			incr := m.alpha * diff
+			m.mean[i] += incr
+			m.variance[i] = (1 - m.alpha) * (m.variance[i] + diff*incr)
+		}
+	} else {
+		m.mx.Unlock()
+		return
+	}
+	m.count++
+	score, ok := m.score()
+	fire := ok && m.config.OnDrift != nil && score > m.config.Threshold && !m.drifted
+	if ok {
+		m.drifted = score > m.config.Threshold
+	}
+	m.mx.Unlock()
+	if fire {
+		m.config.OnDrift(score)
+	}
+}
+
+// score must be called under the lock
+func (m *DriftMonitor) score() (float64, bool) {
+	if m.count < m.config.Window {
+		return 0, false
+	}
+	m.scaler.RLock()
+	defer m.scaler.RUnlock()
+	if m.scaler.mean.Len() != len(m.mean) {
+		return math.Inf(1), true
+	}
+	score := 0.0
+	for i := range m.mean {
+		std := m.scaler.std.AtVec(i)
+		score += math.Abs(m.mean[i]-m.scaler.mean.AtVec(i))/std + math.Abs(math.Sqrt(m.variance[i])/std-1)
+	}
+	return score / float64(len(m.mean)), true
+}
+
+// Score returns drift of the incoming vectors: mean over dimensions of the mean shift in scaler
+// stds plus the relative change of std, so it's close to 0 for the data matching the scaler;
+// false is returned until Window vectors are observed
+func (m *DriftMonitor) Score() (float64, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.score()
+}
+
+func (lsh *LSHIndex) observeDrift(vec []float64) {
+	if lsh.config.Drift != nil {
+		lsh.config.Drift.Observe(vec)
+	}
+}
+
+// DriftScore returns score of the IndexConfig.Drift monitor, see DriftMonitor.Score;
+// ErrNotSupported is returned when the monitor isn't set
+func (lsh *LSHIndex) DriftScore() (float64, bool, error) {
+	if lsh.config.Drift == nil {
+		return 0, false, ErrNotSupported
+	}
+	score, ok := lsh.config.Drift.Score()
+	return score, ok, nil
+}
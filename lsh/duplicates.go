@@ -0,0 +1,147 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"sort"
+)
+
+// visitedSet keeps visited ids in bitset by their store keys,
+// map is used when the store doesn't implement store.Keyer, or doesn't know the id
+type visitedSet struct {
+	keyer store.Keyer
+	keys  *pagedBitset
+	ids   map[string]bool
+}
+
+func newVisitedSet(keyer store.Keyer) *visitedSet {
+	return &visitedSet{
+		keyer: keyer,
+		keys:  newPagedBitset(),
+		ids:   make(map[string]bool),
+	}
+}
+
+func (v *visitedSet) has(id string) bool {
+	if v.keyer != nil {
+		if key, ok := v.keyer.Key(id); ok {
+			return v.keys.test(key)
+		}
+	}
+	return v.ids[id]
+}
+
+// visit marks id as visited, returns false if it has been already visited
+func (v *visitedSet) visit(id string) bool {
+	if v.keyer != nil {
+		if key, ok := v.keyer.Key(id); ok {
+			return !v.keys.testAndSet(key)
+		}
+	}
+	if v.ids[id] {
+		return false
+	}
+	v.ids[id] = true
+	return true
+}
+
+// FindDuplicates looks for groups of vectors with pairwise distances <= distanceThrsh, each
+// member shares at least one bucket with another one; each cluster of sorted ids is passed to emit
+// as soon as it's complete, in no particular order, returning false from emit stops the process.
+// Clusters are grown greedily one at a time from the buckets of their members, and every vector
+// belongs to one cluster at most, so only the visited ids are kept in memory
+func (lsh *LSHIndex) FindDuplicates(distanceThrsh float64, emit func(cluster []string) bool) error {
+	scanner, ok := lsh.index.(store.Scanner)
+	if !ok {
+		return ErrNotSupported
+	}
+	idsIter, err := scanner.GetVectorsIds()
+	if err != nil {
+		return err
+	}
+	visited := newVisitedSet(lsh.keyer)
+	for {
+		id, opened := idsIter.Next()
+		if !opened {
+			return nil
+		}
+		deleted, err := lsh.isDeleted(id)
+		if err != nil {
+			return err
+		}
+		if deleted || !visited.visit(id) {
+			continue
+		}
+		cluster, err := lsh.growCluster(id, distanceThrsh, visited)
+		if err != nil {
+			return err
+		}
+		if len(cluster) < 2 {
+			continue
+		}
+		sort.Strings(cluster)
+		if !emit(cluster) {
+			return nil
+		}
+	}
+}
+
+// growCluster adds not yet visited ids from the buckets of the cluster members,
+// if they are within distanceThrsh from every member
+func (lsh *LSHIndex) growCluster(seed string, distanceThrsh float64, visited *visitedSet) ([]string, error) {
+	seedVec, err := lsh.index.GetVector(seed)
+	if err != nil {
+		return nil, fmt.Errorf("can't get vector %v: %w", seed, err)
+	}
+	cluster := []string{seed}
+	vecs := [][]float64{seedVec}
+	// NOTE: rejected candidates stay rejected, since the cluster only grows
+	rejected := make(map[string]bool)
+	for i := 0; i < len(cluster); i++ {
+		for perm, hash := range lsh.hasher.getHashes(vecs[i]) {
+			bucket := getBucketKey(perm, hash)
+			iter, err := lsh.index.GetHashIterator(bucket)
+			if errors.Is(err, store.ErrNotFound) {
+				continue // NOTE: missing buckets are restored by Backfill
+			}
+			if err != nil {
+				return nil, fmt.Errorf("can't read bucket %v: %w", store.BucketName(bucket), err)
+			}
+			for _, candidate := range collectIds(iter) {
+				if rejected[candidate] || visited.has(candidate) {
+					continue
+				}
+				deleted, err := lsh.isDeleted(candidate)
+				if err != nil {
+					return nil, err
+				}
+				if deleted {
+					continue
+				}
+				vec, err := lsh.index.GetVector(candidate)
+				if err != nil {
+					return nil, fmt.Errorf("can't get vector %v: %w", candidate, err)
+				}
+				if !lsh.withinDist(vec, vecs, distanceThrsh) {
+					rejected[candidate] = true
+					continue
+				}
+				visited.visit(candidate)
+				cluster = append(cluster, candidate)
+				vecs = append(vecs, vec)
+			}
+		}
+	}
+	return cluster, nil
+}
+
+// withinDist checks that vec is within distanceThrsh from each of vecs
+func (lsh *LSHIndex) withinDist(vec []float64, vecs [][]float64, distanceThrsh float64) bool {
+	for _, dist := range GetDists(lsh.distanceMetric, [][]float64{vec}, vecs)[0] {
+		if dist > distanceThrsh {
+			return false
+		}
+	}
+	return true
+}
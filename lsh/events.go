@@ -0,0 +1,53 @@
+package lsh
+
+import (
+	"time"
+)
+
+// EventType is a kind of the index lifecycle event
+type EventType int
+
+const (
+	TrainStarted EventType = iota
+	TrainFinished
+	VersionBuilt
+	VersionPromoted
+	VersionDropped
+)
+
+func (t EventType) String() string {
+	switch t {
+	case TrainStarted:
+		return "train_started"
+	case TrainFinished:
+		return "train_finished"
+	case VersionBuilt:
+		return "version_built"
+	case VersionPromoted:
+		return "version_promoted"
+	case VersionDropped:
+		return "version_dropped"
+	}
+	return "unknown"
+}
+
+// Event describes the index lifecycle change, e.g. to be streamed to a dashboard
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Version is set by VersionedIndex events
+	Version int
+	// Count is a number of the training vectors
+	Count int
+	// Err is set when the training has failed
+	Err error
+}
+
+// emit passes event to the handler, if it's set; handler is called synchronously
+func emit(handler func(event Event), event Event) {
+	if handler == nil {
+		return
+	}
+	event.Time = time.Now()
+	handler(event)
+}
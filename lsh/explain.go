@@ -0,0 +1,120 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+)
+
+// BucketExplanation describes a single permutation of the explained search
+type BucketExplanation struct {
+	Perm         int
+	QueryBucket  uint64
+	RecordBucket uint64
+	// Shared is true when the query and the record fall into the same bucket
+	Shared bool
+	// ProbeRank is a position of the record bucket among the probed ones:
+	// 0 for the query's own bucket, i for the i-th neighbor bucket, -1 if it isn't probed
+	ProbeRank int
+	// Stored is true when the record is actually present in its' bucket of the store
+	Stored bool
+}
+
+// Explanation describes how the record is treated by the search
+type Explanation struct {
+	ID      string
+	Deleted bool
+	Buckets []BucketExplanation
+	// Reachable is true when at least one of the probed buckets holds the record
+	Reachable bool
+	// CandidateDist is the distance used for the candidates selection, it differs
+	// from Dist only when IndexConfig.CandidateMetric is set
+	CandidateDist float64
+	Dist          float64
+	// PassedThreshold is true when Dist is within SearchOpts.DistanceThrsh
+	PassedThreshold bool
+	// Penalty is added by SearchOpts.NegativeVecs, Score is the final value used for
+	// the ordering, after the penalty and SearchOpts.Scorer
+	Penalty float64
+	Score   float64
+}
+
+// ExplainSearch returns why the record is (or isn't) found by the query, see ExplainSearchWithOpts
+func (lsh *LSHIndex) ExplainSearch(query []float64, id string) (Explanation, error) {
+	return lsh.ExplainSearchWithOpts(query, id, SearchOpts{DistanceThrsh: math.Inf(1)})
+}
+
+// ExplainSearchWithOpts returns which permutations and buckets the query and the record share,
+// the raw distance, threshold check and scorer adjustments; candidates limit isn't taken into
+// account, so the record may be left out by the search even if it's reachable
+func (lsh *LSHIndex) ExplainSearchWithOpts(query []float64, id string, opts SearchOpts) (Explanation, error) {
+	explanation := Explanation{ID: id}
+	q, err := lsh.newQuery(query, opts)
+	if err != nil {
+		return explanation, err
+	}
+	vec, err := lsh.index.GetVector(id)
+	if err != nil {
+		return explanation, fmt.Errorf("can't get vector %v: %w", id, err)
+	}
+	explanation.Deleted, err = lsh.isDeleted(id)
+	if err != nil {
+		return explanation, err
+	}
+
+	queryHashes := lsh.hasher.getHashes(q.vec)
+	recordHashes := lsh.hasher.getHashes(vec)
+	explanation.Buckets = make([]BucketExplanation, len(queryHashes))
+	for perm := range explanation.Buckets {
+		bucket := BucketExplanation{
+			Perm:         perm,
+			QueryBucket:  getBucketKey(perm, queryHashes[perm]),
+			RecordBucket: getBucketKey(perm, recordHashes[perm]),
+			ProbeRank:    -1,
+		}
+		bucket.Shared = bucket.QueryBucket == bucket.RecordBucket
+		for rank, probed := range getBuckets(perm, queryHashes[perm], q.nProbes) {
+			if probed == bucket.RecordBucket {
+				bucket.ProbeRank = rank
+				break
+			}
+		}
+		bucket.Stored, err = lsh.bucketHolds(bucket.RecordBucket, id)
+		if err != nil {
+			return explanation, err
+		}
+		explanation.Reachable = explanation.Reachable || (bucket.ProbeRank >= 0 && bucket.Stored)
+		explanation.Buckets[perm] = bucket
+	}
+
+	explanation.Dist = lsh.distanceMetric.GetDist(vec, q.vec)
+	explanation.CandidateDist = explanation.Dist
+	if candidateMetric, _ := lsh.config.getRerank(); candidateMetric != nil {
+		explanation.CandidateDist = candidateMetric.GetDist(vec, q.vec)
+	}
+	explanation.PassedThreshold = explanation.Dist <= opts.DistanceThrsh
+	explanation.Penalty = q.penalize(lsh.distanceMetric, vec, explanation.Dist) - explanation.Dist
+	explanation.Score, err = lsh.score(q, lsh.distanceMetric, id, vec, explanation.Dist)
+	if err != nil {
+		return explanation, err
+	}
+	return explanation, nil
+}
+
+// bucketHolds checks that the bucket of the store contains the id
+func (lsh *LSHIndex) bucketHolds(bucket uint64, id string) (bool, error) {
+	iter, err := lsh.index.GetHashIterator(bucket)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	for stored, ok := iter.Next(); ok; stored, ok = iter.Next() {
+		if stored == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,257 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultForestDepth = 32
+	maxForestDepth     = 64
+)
+
+var (
+	forestDepthErr = fmt.Errorf("forest depth must not exceed %v", maxForestDepth)
+	forestTreesErr = errors.New("forest must contain at least one tree")
+)
+
+// ForestConfig holds parameters of the LSH Forest: each of NTrees prefix trees keeps
+// MaxDepth-bit hash labels (32 by default), so buckets are the label prefixes
+// of the variable length, long enough to hold MaxCandidates points
+type ForestConfig struct {
+	MaxCandidates int
+	NTrees        int
+	MaxDepth      int
+	Dims          int
+}
+
+// trieNode is a node of the binary prefix tree, ids are kept in the leaves only
+type trieNode struct {
+	children [2]*trieNode
+	ids      []string
+}
+
+func (node *trieNode) insert(label uint64, depth int, id string) {
+	for d := 0; d < depth; d++ {
+		bit := (label >> uint(d)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.ids = append(node.ids, id)
+}
+
+// path returns nodes along the label, up to the longest existing prefix
+func (node *trieNode) path(label uint64, depth int) []*trieNode {
+	path := []*trieNode{node}
+	for d := 0; d < depth; d++ {
+		node = node.children[(label>>uint(d))&1]
+		if node == nil {
+			break
+		}
+		path = append(path, node)
+	}
+	return path
+}
+
+// collect passes ids of the subtree to emit, until it returns false
+func (node *trieNode) collect(emit func(id string) bool) bool {
+	if node == nil {
+		return true
+	}
+	for _, id := range node.ids {
+		if !emit(id) {
+			return false
+		}
+	}
+	for _, child := range node.children {
+		if !child.collect(emit) {
+			return false
+		}
+	}
+	return true
+}
+
+// ForestIndex is the LSH Forest: instead of fixed-length hashes, candidates are taken
+// from the longest label prefixes shared with the query, descending to the shorter
+// ones until enough candidates are found, so bucket granularity adapts to the data density;
+// prefix trees are kept in memory, vectors are kept in the store
+type ForestIndex struct {
+	mx            sync.RWMutex
+	maxCandidates int
+	nTrees        int
+	maxDepth      int
+	dims          int
+	index         store.Store
+	metric        Metric
+	planes        [][][]float64
+	tries         []*trieNode
+}
+
+// NewForest creates new LSH Forest index
+func NewForest(config ForestConfig, s store.Store, metric Metric) (*ForestIndex, error) {
+	if config.Dims <= 0 {
+		return nil, dimensionsNumberErr
+	}
+	if config.NTrees <= 0 {
+		return nil, forestTreesErr
+	}
+	if config.MaxCandidates <= 0 {
+		return nil, maxCandidatesErr
+	}
+	if config.MaxDepth > maxForestDepth {
+		return nil, forestDepthErr
+	}
+	if config.MaxDepth <= 0 {
+		config.MaxDepth = defaultForestDepth
+	}
+	return &ForestIndex{
+		maxCandidates: config.MaxCandidates,
+		nTrees:        config.NTrees,
+		maxDepth:      config.MaxDepth,
+		dims:          config.Dims,
+		index:         s,
+		metric:        metric,
+	}, nil
+}
+
+// label calculates hash label of the vector in the given tree, bit per plane
+func (f *ForestIndex) label(tree int, vec []float64) uint64 {
+	var label uint64
+	for d, plane := range f.planes[tree] {
+		prod := -plane[f.dims]
+		for i, val := range vec {
+			prod += plane[i] * val
+		}
+		if prod < 0 {
+			label |= 1 << uint(d)
+		}
+	}
+	return label
+}
+
+// Train generates random planes (through the origin for angular metric, or through
+// random training vectors otherwise) and fills prefix trees with the vectors
+func (f *ForestIndex) Train(vecs [][]float64, ids []string) error {
+	if len(vecs) != len(ids) {
+		return idsNumberErr
+	}
+	for i, vec := range vecs {
+		err := validateVector(vec, f.dims)
+		if err != nil {
+			return fmt.Errorf("invalid vector %v: %w", ids[i], err)
+		}
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	err := f.index.Clear()
+	if err != nil {
+		return err
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	f.planes = make([][][]float64, f.nTrees)
+	f.tries = make([]*trieNode, f.nTrees)
+	for t := range f.planes {
+		f.planes[t] = make([][]float64, f.maxDepth)
+		for d := range f.planes[t] {
+			plane := make([]float64, f.dims+1)
+			for i := 0; i < f.dims; i++ {
+				plane[i] = rnd.NormFloat64()
+			}
+			if !f.metric.IsAngular() && len(vecs) > 0 {
+				point := vecs[rnd.Intn(len(vecs))]
+				for i := 0; i < f.dims; i++ {
+					plane[f.dims] += plane[i] * point[i]
+				}
+			}
+			f.planes[t][d] = plane
+		}
+		f.tries[t] = &trieNode{}
+	}
+	for i, vec := range vecs {
+		err = f.index.SetVector(ids[i], vec)
+		if err != nil {
+			return fmt.Errorf("can't store vector %v: %w", ids[i], err)
+		}
+		for t, trie := range f.tries {
+			trie.insert(f.label(t, vec), f.maxDepth, ids[i])
+		}
+	}
+	return nil
+}
+
+// Search returns NNs for the query point: prefix trees are descended along the query
+// labels as deep as possible, and then candidates are collected level by level, from
+// the longest shared prefixes to the shorter ones, until MaxCandidates are collected;
+// exact distances to the candidates are compared with distanceThrsh
+func (f *ForestIndex) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	f.mx.RLock()
+	defer f.mx.RUnlock()
+	if f.tries == nil {
+		return nil, ErrNotTrained
+	}
+	err := validateVector(query, f.dims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	labels := make([]uint64, f.nTrees)
+	paths := make([][]*trieNode, f.nTrees)
+	maxLevel := 0
+	for t, trie := range f.tries {
+		labels[t] = f.label(t, query)
+		paths[t] = trie.path(labels[t], f.maxDepth)
+		if len(paths[t])-1 > maxLevel {
+			maxLevel = len(paths[t]) - 1
+		}
+	}
+	seen := make(map[string]bool)
+	ids := make([]string, 0)
+	emit := func(id string) bool {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		return len(ids) < f.maxCandidates
+	}
+	// NOTE: all trees are descended synchronously, so candidates of the same prefix length are
+	//       collected together; deeper prefix subtree is collected already, so only the sibling is added
+	full := false
+	for level := maxLevel; level >= 0 && !full; level-- {
+		for t, path := range paths {
+			deepest := len(path) - 1
+			if level > deepest {
+				continue
+			}
+			node := path[level]
+			if level < deepest {
+				bit := (labels[t] >> uint(level)) & 1
+				node = node.children[1-bit]
+			}
+			if !node.collect(emit) {
+				full = true
+				break
+			}
+		}
+	}
+	closest := make([]Neighbor, 0, len(ids))
+	for _, id := range ids {
+		vec, err := f.index.GetVector(id)
+		if err != nil {
+			return nil, fmt.Errorf("can't get vector %v: %w", id, err)
+		}
+		dist := f.metric.GetDist(vec, query)
+		if dist <= distanceThrsh {
+			closest = append(closest, Neighbor{ID: id, Vec: vec, Dist: dist})
+		}
+	}
+	SortNeighbors(closest)
+	if len(closest) > maxNN {
+		closest = closest[:maxNN]
+	}
+	return closest, nil
+}
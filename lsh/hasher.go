@@ -4,16 +4,26 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
 	"gonum.org/v1/gonum/blas/blas64"
+	"gonum.org/v1/gonum/mat"
 	"math"
 	"math/rand"
 	"sync"
 	"time"
 )
 
+const (
+	// maxTrees is limited by the number of permutations which fit into the bucket key
+	maxTrees = store.MaxPerms
+)
+
 var (
 	dimensionsNumberErr     = errors.New("dimensions number must be a positive integer")
-	hasherEmptyInstancesErr = errors.New("hasher must contain at least one instance")
+	hasherEmptyInstancesErr = fmt.Errorf("hasher must contain at least one instance: %w", ErrNotTrained)
+	treesNumberErr          = fmt.Errorf("number of trees must not exceed %v", store.MaxPerms)
+	planesShapeErr          = errors.New("malformed planes matrix")
 )
 
 // plane struct holds data needed to work with plane
@@ -57,26 +67,98 @@ func (node *treeNode) getHash(vec blas64.Vector) uint64 {
 }
 
 type HasherConfig struct {
-	NTrees          int
-	KMinVecs        int
+	NTrees   int
+	KMinVecs int
+	// NumTables (OR) and HashesPerTable (AND) set up the classic banding construction:
+	// each of NumTables tables hashes vectors by HashesPerTable random hyperplanes instead
+	// of growing data-dependent trees; NumTables is an alias of NTrees. For the cross-polytope
+	// scheme HashesPerTable is a number of rotations, when Rotations isn't set
+	NumTables       int
+	HashesPerTable  int
 	Dims            int
 	isAngularMetric bool
+	// PipelineID identifies the transform pipeline used for training, it's set by the index
+	PipelineID string
+	// FixedPlanes hasher keeps its' planes on training, see NewHasherFromPlanes
+	FixedPlanes bool
+	// ITQ enables learned hashing instead of random trees, see ITQConfig
+	ITQ ITQConfig
+	// Scheme is a hash family, hyperplanes trees by default
+	Scheme HashScheme
+	// Rotations is a number of cross-polytope hashes concatenated into the bucket hash
+	// of each of NTrees tables, 1 by default
+	Rotations int
+	// Seed, when set, makes hasher building reproducible: the same training data
+	// produces the same planes (or rotations)
+	Seed int64
 }
 
 // Hasher holds N_PERMUTS number of trees
 type Hasher struct {
-	mutex  sync.RWMutex
-	Config HasherConfig
-	trees  []*treeNode
+	mutex     sync.RWMutex
+	Config    HasherConfig
+	trees     []*treeNode
+	rotations [][]*mat.Dense
 }
 
 func NewHasher(config HasherConfig) *Hasher {
+	if config.NTrees == 0 {
+		config.NTrees = config.NumTables
+	}
 	return &Hasher{
 		Config: config,
 		trees:  make([]*treeNode, config.NTrees),
 	}
 }
 
+// NewHasherFromPlanes creates hasher with the given projections, e.g. learned offline (PCA, ITQ);
+// each row holds a normal vector, optionally followed by the offset. Rows are split evenly
+// between config.NTrees trees, so each tree hashes vectors by len(planes)/NTrees planes,
+// with a bit per plane. Planes of such hasher are kept on training
+func NewHasherFromPlanes(planes [][]float64, config HasherConfig) (*Hasher, error) {
+	if config.Dims <= 0 {
+		return nil, dimensionsNumberErr
+	}
+	if config.NTrees <= 0 || config.NTrees > maxTrees {
+		return nil, treesNumberErr
+	}
+	if len(planes) == 0 || len(planes)%config.NTrees != 0 {
+		return nil, fmt.Errorf("%w: %v planes can't be split between %v trees", planesShapeErr, len(planes), config.NTrees)
+	}
+	bits := len(planes) / config.NTrees
+	if bits > store.HashBits {
+		return nil, fmt.Errorf("%w: %v planes per tree, max is %v", planesShapeErr, bits, store.HashBits)
+	}
+	for i, row := range planes {
+		if len(row) != config.Dims && len(row) != config.Dims+1 {
+			return nil, fmt.Errorf("%w: plane %v has %v values instead of %v", planesShapeErr, i, len(row), config.Dims)
+		}
+	}
+	config.FixedPlanes = true
+	config.Scheme = HyperplanesScheme
+	hasher := NewHasher(config)
+	for t := range hasher.trees {
+		hasher.trees[t] = chainTree(planes[t*bits:(t+1)*bits], config.Dims)
+	}
+	return hasher, nil
+}
+
+// chainTree makes tree which hashes vectors by a bit per plane; every node of the same
+// depth uses the same plane, so nodes are shared between the branches
+func chainTree(planes [][]float64, dims int) *treeNode {
+	var child *treeNode
+	for i := len(planes) - 1; i >= 0; i-- {
+		n := NewVec(make([]float64, dims))
+		copy(n.Data, planes[i])
+		node := &treeNode{plane: &plane{n: n}, left: child, right: child}
+		if len(planes[i]) > dims {
+			node.plane.d = planes[i][dims]
+		}
+		child = node
+	}
+	return child
+}
+
 // SafeHashesHolder allows to lock map while write values in it
 type safeHashesHolder struct {
 	sync.Mutex
@@ -97,7 +179,7 @@ func planeByPoints(points []blas64.Vector, ndims int) *plane {
 	return planeCoefs
 }
 
-func getRandomPlane(vecs [][]float64, isAngular bool) *plane {
+func getRandomPlane(vecs [][]float64, isAngular bool, rnd *rand.Rand) *plane {
 	randIndeces := make(map[int]bool)
 	randVecs := make([]blas64.Vector, 2)
 	norms := make([]float64, 2)
@@ -105,7 +187,7 @@ func getRandomPlane(vecs [][]float64, isAngular bool) *plane {
 	var i int = 0
 	maxPoints := 2
 	for i < maxPoints && i < len(vecs)*3 {
-		idx := rand.Intn(len(vecs))
+		idx := rnd.Intn(len(vecs))
 		if _, has := randIndeces[idx]; !has {
 			randIndeces[idx] = true
 			randVecs[i] = NewVec(vecs[idx])
@@ -134,11 +216,11 @@ func getRandomPlane(vecs [][]float64, isAngular bool) *plane {
 }
 
 // growTree ...
-func growTree(vecs [][]float64, node *treeNode, depth int, config HasherConfig) {
-	if depth > 63 || len(vecs) < 2 { // NOTE: depth <= 63 since we will use 8 byte int to store a hash
+func growTree(vecs [][]float64, node *treeNode, depth int, config HasherConfig, rnd *rand.Rand) {
+	if depth >= store.HashBits || len(vecs) < 2 { // NOTE: hash must fit into the bucket key, along with the permutation index
 		return
 	}
-	node.plane = getRandomPlane(vecs, config.isAngularMetric)
+	node.plane = getRandomPlane(vecs, config.isAngularMetric, rnd)
 	var l, r [][]float64
 	for _, v := range vecs {
 		inpVec := NewVec(v)
@@ -152,34 +234,63 @@ func growTree(vecs [][]float64, node *treeNode, depth int, config HasherConfig)
 	depth++
 	if len(r) > config.KMinVecs {
 		node.right = &treeNode{}
-		growTree(r, node.right, depth, config)
+		growTree(r, node.right, depth, config, rnd)
 	}
 	if len(l) > config.KMinVecs {
 		node.left = &treeNode{}
-		growTree(l, node.left, depth, config)
+		growTree(l, node.left, depth, config, rnd)
 	}
 }
 
 // buildTree creates set of planes which will be used to calculate hash
-func buildTree(vecs [][]float64, config HasherConfig) *treeNode {
-	rand.Seed(time.Now().UnixNano())
+func buildTree(vecs [][]float64, config HasherConfig, rnd *rand.Rand) *treeNode {
 	tree := &treeNode{}
-	growTree(vecs, tree, 0, config)
+	growTree(vecs, tree, 0, config, rnd)
 	return tree
 }
 
+// newTreeRand returns random source of the tree, seeded by HasherConfig.Seed when it's set
+func newTreeRand(config HasherConfig, tree int) *rand.Rand {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed + int64(tree)))
+}
+
 // build method creates the hasher instances
-func (hasher *Hasher) build(vecs [][]float64) {
+func (hasher *Hasher) build(vecs [][]float64, pipelineID string) {
 	hasher.mutex.Lock()
 	defer hasher.mutex.Unlock()
 
+	hasher.Config.PipelineID = pipelineID
+	if hasher.Config.FixedPlanes {
+		return
+	}
+	if hasher.Config.Scheme == CrossPolytopeScheme {
+		rotations := make([][]*mat.Dense, hasher.Config.NTrees)
+		for i := range rotations {
+			rotations[i] = buildRotations(hasher.Config, newTreeRand(hasher.Config, i))
+		}
+		hasher.rotations = rotations
+		return
+	}
 	trees := make([]*treeNode, hasher.Config.NTrees)
 	wg := sync.WaitGroup{}
 	wg.Add(len(trees))
 	for i := 0; i < hasher.Config.NTrees; i++ {
 		go func(i int, wg *sync.WaitGroup) {
 			defer wg.Done()
-			tmpTree := buildTree(vecs, hasher.Config)
+			rnd := newTreeRand(hasher.Config, i)
+			if hasher.Config.ITQ.Bits > 0 {
+				trees[i] = buildITQTree(vecs, hasher.Config, rnd)
+				return
+			}
+			if hasher.Config.HashesPerTable > 0 {
+				trees[i] = buildBandTree(vecs, hasher.Config, rnd)
+				return
+			}
+			tmpTree := buildTree(vecs, hasher.Config, rnd)
 			trees[i] = tmpTree
 		}(i, &wg)
 	}
@@ -187,6 +298,88 @@ func (hasher *Hasher) build(vecs [][]float64) {
 	hasher.trees = trees
 }
 
+func (hasher *Hasher) getPipelineID() string {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+	return hasher.Config.PipelineID
+}
+
+// isTrained checks that planes trees has been built or loaded
+func (hasher *Hasher) isTrained() bool {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+	return hasher.trained()
+}
+
+func (hasher *Hasher) trained() bool {
+	if hasher.Config.Scheme == CrossPolytopeScheme {
+		return len(hasher.rotations) > 0
+	}
+	return len(hasher.trees) > 0 && hasher.trees[0] != nil
+}
+
+func (hasher *Hasher) getNTrees() int {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+	return hasher.Config.NTrees
+}
+
+func (hasher *Hasher) getDims() int {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+	return hasher.Config.Dims
+}
+
+// treeShape holds number of leaves (possible hashes) and max depth of the tree
+type treeShape struct {
+	leaves   int
+	maxDepth int
+}
+
+// measureTree returns shape of the subtree; subtrees may be shared, so they are measured once
+func measureTree(node *treeNode, measured map[*treeNode]treeShape) treeShape {
+	if node == nil || node.plane == nil {
+		return treeShape{leaves: 1}
+	}
+	if shape, ok := measured[node]; ok {
+		return shape
+	}
+	shape := treeShape{}
+	for _, child := range []*treeNode{node.left, node.right} {
+		childShape := measureTree(child, measured)
+		shape.leaves += childShape.leaves
+		if childShape.maxDepth+1 > shape.maxDepth {
+			shape.maxDepth = childShape.maxDepth + 1
+		}
+	}
+	measured[node] = shape
+	return shape
+}
+
+// getShapes returns shape of each tree
+func (hasher *Hasher) getShapes() []treeShape {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+	if hasher.Config.Scheme == CrossPolytopeScheme {
+		shapes := make([]treeShape, len(hasher.rotations))
+		for i, rotations := range hasher.rotations {
+			shapes[i] = treeShape{leaves: 1, maxDepth: len(rotations)}
+			for range rotations {
+				shapes[i].leaves *= 2 * hasher.Config.Dims
+			}
+		}
+		return shapes
+	}
+	shapes := make([]treeShape, len(hasher.trees))
+	measured := make(map[*treeNode]treeShape)
+	for i, tree := range hasher.trees {
+		if tree != nil {
+			shapes[i] = measureTree(tree, measured)
+		}
+	}
+	return shapes
+}
+
 // getHashes returns map of calculated lsh values for a given vector
 func (hasher *Hasher) getHashes(inpVec []float64) map[int]uint64 {
 	hasher.mutex.RLock()
@@ -203,6 +396,14 @@ func (hasher *Hasher) getHashes(inpVec []float64) map[int]uint64 {
 			blas64.Copy(normed, vec)
 		}
 	}
+	if hasher.Config.Scheme == CrossPolytopeScheme {
+		hashes := make(map[int]uint64, len(hasher.rotations))
+		polytopeVec := mat.NewVecDense(vec.N, vec.Data)
+		for i, rotations := range hasher.rotations {
+			hashes[i] = polytopeHash(rotations, polytopeVec)
+		}
+		return hashes
+	}
 	hashes := &safeHashesHolder{v: make(map[int]uint64)}
 	wg := sync.WaitGroup{}
 	wg.Add(len(hasher.trees))
@@ -218,34 +419,179 @@ func (hasher *Hasher) getHashes(inpVec []float64) map[int]uint64 {
 	return hashes.v
 }
 
+const (
+	// noChild marks absent child node in the planes matrix
+	noChild = -1
+)
+
+// Planes returns hyperplanes of all trees as a dense matrix with a row per tree node:
+// normal vector (Dims values), offset, and row indices of the left and the right child
+// (-1 when there is no child); vectors with dot(normal, vec) - offset < 0 go to the left.
+// First NTrees rows are the roots, children always come after their parents.
+// It's nil for the cross-polytope scheme
+func (hasher *Hasher) Planes() [][]float64 {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+	return hasher.planes()
+}
+
+func (hasher *Hasher) planes() [][]float64 {
+	dims := hasher.Config.Dims
+	rows := make(map[*treeNode]int)
+	queue := make([]*treeNode, 0, len(hasher.trees))
+	for _, tree := range hasher.trees {
+		if tree == nil {
+			return nil
+		}
+		rows[tree] = len(queue)
+		queue = append(queue, tree)
+	}
+	getRow := func(node *treeNode) float64 {
+		if node == nil || node.plane == nil {
+			return noChild
+		}
+		if row, ok := rows[node]; ok {
+			return float64(row)
+		}
+		rows[node] = len(queue)
+		queue = append(queue, node)
+		return float64(rows[node])
+	}
+	planes := make([][]float64, 0, len(queue))
+	for i := 0; i < len(queue); i++ {
+		node := queue[i]
+		row := make([]float64, dims+3)
+		// NOTE: root without a plane is kept as zero plane, which sends everything to the right
+		if node.plane != nil {
+			copy(row, node.plane.n.Data)
+			row[dims] = node.plane.d
+			row[dims+1] = getRow(node.left)
+			row[dims+2] = getRow(node.right)
+		} else {
+			row[dims+1], row[dims+2] = noChild, noChild
+		}
+		planes = append(planes, row)
+	}
+	return planes
+}
+
+// SetPlanes replaces trees with the ones described by the planes matrix, see Planes
+func (hasher *Hasher) SetPlanes(planes [][]float64) error {
+	hasher.mutex.Lock()
+	defer hasher.mutex.Unlock()
+	if hasher.Config.Scheme != HyperplanesScheme {
+		return planesSchemeErr
+	}
+	trees, err := treesFromPlanes(planes, hasher.Config.NTrees, hasher.Config.Dims)
+	if err != nil {
+		return err
+	}
+	hasher.trees = trees
+	return nil
+}
+
+func treesFromPlanes(planes [][]float64, nTrees, dims int) ([]*treeNode, error) {
+	if len(planes) < nTrees {
+		return nil, fmt.Errorf("%w: %v rows for %v trees", planesShapeErr, len(planes), nTrees)
+	}
+	nodes := make([]*treeNode, len(planes))
+	for i, row := range planes {
+		if len(row) != dims+3 {
+			return nil, fmt.Errorf("%w: row %v has %v values instead of %v", planesShapeErr, i, len(row), dims+3)
+		}
+		n := NewVec(make([]float64, dims))
+		copy(n.Data, row[:dims])
+		nodes[i] = &treeNode{plane: &plane{n: n, d: row[dims]}}
+	}
+	// NOTE: children are linked in reverse order, so the depth is known before the parent is linked
+	depths := make([]int, len(planes))
+	for i := len(planes) - 1; i >= 0; i-- {
+		for j, child := range []**treeNode{&nodes[i].left, &nodes[i].right} {
+			idx := planes[i][dims+1+j]
+			if idx == noChild {
+				continue
+			}
+			if idx != math.Trunc(idx) || int(idx) <= i || int(idx) >= len(planes) {
+				return nil, fmt.Errorf("%w: row %v has invalid child index %v", planesShapeErr, i, idx)
+			}
+			*child = nodes[int(idx)]
+			if depths[int(idx)]+1 > depths[i] {
+				depths[i] = depths[int(idx)] + 1
+			}
+		}
+		if depths[i] >= store.HashBits {
+			return nil, fmt.Errorf("%w: tree depth exceeds %v", planesShapeErr, store.HashBits)
+		}
+	}
+	return nodes[:nTrees], nil
+}
+
+// hasherDump is the serialized hasher
+type hasherDump struct {
+	Config    HasherConfig
+	Planes    [][]float64
+	Rotations [][][]float64
+}
+
 // dump encodes Hasher object as a byte-array
 func (hasher *Hasher) dump() ([]byte, error) {
 	hasher.mutex.RLock()
 	defer hasher.mutex.RUnlock()
 
-	if len(hasher.trees) == 0 {
+	if !hasher.trained() {
 		return nil, hasherEmptyInstancesErr
 	}
+	dump := hasherDump{Config: hasher.Config}
+	if hasher.Config.Scheme == CrossPolytopeScheme {
+		dump.Rotations = make([][][]float64, len(hasher.rotations))
+		for i, rotations := range hasher.rotations {
+			for _, rotation := range rotations {
+				dump.Rotations[i] = append(dump.Rotations[i], rotation.RawMatrix().Data)
+			}
+		}
+	} else {
+		dump.Planes = hasher.planes()
+	}
 	buf := &bytes.Buffer{}
 	enc := gob.NewEncoder(buf)
-	err := enc.Encode(hasher)
+	err := enc.Encode(dump)
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-// load loads Hasher struct from the byte-array file
-func (hasher *Hasher) load(inp []byte) error {
-	hasher.mutex.Lock()
-	defer hasher.mutex.Unlock()
-
+// load loads Hasher struct from the byte-array file, the dump is decoded and
+// checked to be trained with the pipelineID before the hasher gets replaced
+func (hasher *Hasher) load(inp []byte, pipelineID string) error {
 	buf := &bytes.Buffer{}
 	buf.Write(inp)
 	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&hasher)
+	dump := hasherDump{}
+	err := dec.Decode(&dump)
+	if err != nil {
+		return err
+	}
+	if dump.Config.PipelineID != pipelineID {
+		return ErrPipelineMismatch
+	}
+	var trees []*treeNode
+	var rotations [][]*mat.Dense
+	if dump.Config.Scheme == CrossPolytopeScheme {
+		rotations, err = rotationsFromDump(dump.Rotations, dump.Config.Dims)
+	} else {
+		trees, err = treesFromPlanes(dump.Planes, dump.Config.NTrees, dump.Config.Dims)
+	}
 	if err != nil {
 		return err
 	}
+
+	hasher.mutex.Lock()
+	defer hasher.mutex.Unlock()
+	// NOTE: metric type is defined by the index, not by the dump
+	dump.Config.isAngularMetric = hasher.Config.isAngularMetric
+	hasher.Config = dump.Config
+	hasher.trees = trees
+	hasher.rotations = rotations
 	return nil
 }
@@ -0,0 +1,107 @@
+package lsh
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"sync"
+	"time"
+)
+
+// HealthStatus holds result of the last store health check
+type HealthStatus struct {
+	Healthy bool
+	// Err is the last failed ping (or reconnect) error
+	Err       error
+	CheckedAt time.Time
+	// Reconnects is a number of successful reconnects made by the health checks
+	Reconnects int
+}
+
+type health struct {
+	mx     sync.Mutex
+	status HealthStatus
+}
+
+func (h *health) set(err error) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.status.Err = err
+	h.status.CheckedAt = time.Now()
+}
+
+// Ping checks connection to the store, stores which don't implement
+// store.HealthChecker are considered always available
+func (lsh *LSHIndex) Ping() error {
+	var err error
+	if checker, ok := lsh.index.(store.HealthChecker); ok {
+		err = checker.Ping()
+	}
+	lsh.health.set(err)
+	return err
+}
+
+// Healthy returns false when the last health check has failed, so the index works in the
+// degraded mode: store operations are expected to fail until the connection is restored
+func (lsh *LSHIndex) Healthy() bool {
+	return lsh.Health().Healthy
+}
+
+// Health returns status of the last health check
+func (lsh *LSHIndex) Health() HealthStatus {
+	lsh.health.mx.Lock()
+	defer lsh.health.mx.Unlock()
+	status := lsh.health.status
+	status.Healthy = status.Err == nil
+	return status
+}
+
+// CheckHealth pings the store, and if it fails, tries to reconnect stores which implement
+// store.Reconnecter, then pings again; returns nil if the store is available in the end
+func (lsh *LSHIndex) CheckHealth() error {
+	err := lsh.Ping()
+	if err == nil {
+		return nil
+	}
+	reconnecter, ok := lsh.index.(store.Reconnecter)
+	if !ok {
+		return err
+	}
+	reconnectErr := reconnecter.Reconnect()
+	if errors.Is(reconnectErr, store.ErrNotSupported) {
+		return err
+	}
+	if reconnectErr != nil {
+		lsh.health.set(reconnectErr)
+		return reconnectErr
+	}
+	err = lsh.Ping()
+	if err == nil {
+		lsh.health.mx.Lock()
+		lsh.health.status.Reconnects++
+		lsh.health.mx.Unlock()
+	}
+	return err
+}
+
+// StartHealthChecks runs CheckHealth periodically in background until returned stop func is called
+func (lsh *LSHIndex) StartHealthChecks(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				lsh.CheckHealth()
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
@@ -2,7 +2,8 @@ package lsh
 
 import (
 	"errors"
-	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"gonum.org/v1/gonum/blas"
 	"gonum.org/v1/gonum/blas/blas64"
 	"gonum.org/v1/gonum/mat"
 	"math"
@@ -12,6 +13,8 @@ import (
 
 const (
 	tol = 1e-6
+	// distBlockSize is a number of vectors packed into a single matrix for batch distance calculation
+	distBlockSize = 256
 )
 
 var (
@@ -117,6 +120,77 @@ func GetMeanStdSampledRecords(vecs [][]float64, sampleSize int) ([]float64, []fl
 	return mean.RawVector().Data, stdVec.RawVector().Data, nil
 }
 
+// VectorsIterator returns vectors one by one, e.g. while reading them from the storage
+type VectorsIterator interface {
+	Next() ([]float64, bool)
+}
+
+// SliceIterator iterates over the in-memory vectors
+type SliceIterator struct {
+	vecs [][]float64
+	pos  int
+}
+
+func NewSliceIterator(vecs [][]float64) *SliceIterator {
+	return &SliceIterator{vecs: vecs}
+}
+
+func (it *SliceIterator) Next() ([]float64, bool) {
+	if it.pos >= len(it.vecs) {
+		return nil, false
+	}
+	it.pos++
+	return it.vecs[it.pos-1], true
+}
+
+// GetMeanStdStreaming calculates mean and std in a single pass with the Welford's algorithm
+func GetMeanStdStreaming(it VectorsIterator) ([]float64, []float64, error) {
+	var mean, m2 []float64
+	var count float64
+	for {
+		vec, ok := it.Next()
+		if !ok {
+			break
+		}
+		if mean == nil {
+			mean = make([]float64, len(vec))
+			m2 = make([]float64, len(vec))
+		}
+		if len(vec) != len(mean) {
+			return nil, nil, ErrDimMismatch
+		}
+		count++
+		for i, val := range vec {
+			delta := val - mean[i]
+			mean[i] += delta / count
+			m2[i] += delta * (val - mean[i])
+		}
+	}
+	if count == 0 {
+		return nil, nil, dataSliceEmptyErr
+	}
+	std := make([]float64, len(m2))
+	for i := range m2 {
+		std[i] = math.Sqrt(m2[i] / count)
+	}
+	return mean, std, nil
+}
+
+// FitStandardScaler creates scaler with mean and std calculated in one streaming pass;
+// zero std values are replaced with 1 to avoid division by zero
+func FitStandardScaler(it VectorsIterator) (*StandartScaler, error) {
+	mean, std, err := GetMeanStdStreaming(it)
+	if err != nil {
+		return nil, err
+	}
+	for i := range std {
+		if std[i] < tol {
+			std[i] = 1.0
+		}
+	}
+	return NewStandartScaler(mean, std, len(mean)), nil
+}
+
 // NewVec creates new blas vector
 func NewVec(data []float64) blas64.Vector {
 	if data == nil {
@@ -148,6 +222,47 @@ func (l2 L2) IsAngular() bool {
 	return bool(l2)
 }
 
+// GetDists calculates l2-distances between each pair of query and vector, using matrix product;
+// distances which are small relative to the norms lose precision due to cancellation,
+// so they're recalculated directly
+func (l2 L2) GetDists(queries, vecs [][]float64) [][]float64 {
+	dots := pairwiseDots(queries, vecs)
+	vecsNorms := sqNorms(vecs)
+	for i, q := range queries {
+		qNorm := blas64.Dot(NewVec(q), NewVec(q))
+		for j := range dots[i] {
+			sqDist := qNorm + vecsNorms[j] - 2*dots[i][j]
+			if sqDist <= tol*(qNorm+vecsNorms[j]) {
+				dots[i][j] = l2.GetDist(q, vecs[j])
+				continue
+			}
+			dots[i][j] = math.Sqrt(sqDist)
+		}
+	}
+	return dots
+}
+
+// Hamming counts differing components, it's meant for the binary vectors, e.g. perceptual hashes bits
+type Hamming bool
+
+func NewHamming() Hamming {
+	return Hamming(false)
+}
+
+func (h Hamming) GetDist(l, r []float64) float64 {
+	dist := 0.0
+	for i := range l {
+		if l[i] != r[i] {
+			dist++
+		}
+	}
+	return dist
+}
+
+func (h Hamming) IsAngular() bool {
+	return bool(h)
+}
+
 // StandartScaler ...
 type StandartScaler struct {
 	sync.RWMutex
@@ -237,6 +352,103 @@ func (c Angular) IsAngular() bool {
 	return bool(c)
 }
 
+// GetDists calculates cosine distances between each pair of query and vector, using matrix product
+func (c Angular) GetDists(queries, vecs [][]float64) [][]float64 {
+	dots := pairwiseDots(queries, vecs)
+	vecsNorms := sqNorms(vecs)
+	for i, q := range queries {
+		qNorm := blas64.Nrm2(NewVec(q))
+		for j := range dots[i] {
+			var dist float64 = 1.0
+			lrNorm := qNorm * math.Sqrt(vecsNorms[j])
+			if lrNorm > tol {
+				dist = 1.0 - dots[i][j]/lrNorm
+			}
+			if dist < tol {
+				dist = 0.0
+			}
+			dots[i][j] = dist
+		}
+	}
+	return dots
+}
+
+// BatchMetric is implemented by metrics that can calculate distances for many pairs at once
+type BatchMetric interface {
+	Metric
+	GetDists(queries, vecs [][]float64) [][]float64
+}
+
+// GetDists returns distances from each query to each vector,
+// falls back to the pairwise calculation when metric doesn't support batches
+func GetDists(metric Metric, queries, vecs [][]float64) [][]float64 {
+	if batchMetric, ok := metric.(BatchMetric); ok {
+		return batchMetric.GetDists(queries, vecs)
+	}
+	dists := make([][]float64, len(queries))
+	for i, q := range queries {
+		dists[i] = make([]float64, len(vecs))
+		for j, vec := range vecs {
+			dists[i][j] = metric.GetDist(vec, q)
+		}
+	}
+	return dists
+}
+
+func sqNorms(vecs [][]float64) []float64 {
+	norms := make([]float64, len(vecs))
+	for i, vec := range vecs {
+		blasVec := NewVec(vec)
+		norms[i] = blas64.Dot(blasVec, blasVec)
+	}
+	return norms
+}
+
+// packRows copies vectors into the row-major matrix
+func packRows(vecs [][]float64) blas64.General {
+	cols := len(vecs[0])
+	m := blas64.General{
+		Rows:   len(vecs),
+		Cols:   cols,
+		Stride: cols,
+		Data:   make([]float64, len(vecs)*cols),
+	}
+	for i, vec := range vecs {
+		copy(m.Data[i*cols:(i+1)*cols], vec)
+	}
+	return m
+}
+
+// pairwiseDots calculates queries x vecs^T product over the blocks of vectors
+func pairwiseDots(queries, vecs [][]float64) [][]float64 {
+	dots := make([][]float64, len(queries))
+	for i := range dots {
+		dots[i] = make([]float64, len(vecs))
+	}
+	if len(queries) == 0 || len(vecs) == 0 {
+		return dots
+	}
+	q := packRows(queries)
+	for start := 0; start < len(vecs); start += distBlockSize {
+		end := start + distBlockSize
+		if end > len(vecs) {
+			end = len(vecs)
+		}
+		block := packRows(vecs[start:end])
+		res := blas64.General{
+			Rows:   q.Rows,
+			Cols:   block.Rows,
+			Stride: block.Rows,
+			Data:   make([]float64, q.Rows*block.Rows),
+		}
+		blas64.Gemm(blas.NoTrans, blas.Trans, 1.0, q, block, 0.0, res)
+		for i := range dots {
+			copy(dots[i][start:end], res.Data[i*res.Stride:(i+1)*res.Stride])
+		}
+	}
+	return dots
+}
+
 func AngularToCosineDist(angular float64) float64 {
 	return (angular * angular) / 2
 }
@@ -275,6 +487,28 @@ func (s *StringSet) Remove(key string) {
 	delete(s.Items, key)
 }
 
-func getBucketName(perm int, hash uint64) string {
-	return fmt.Sprintf("%v_%v", perm, hash)
+func (s *StringSet) Len() int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return len(s.Items)
+}
+
+func (s *StringSet) Keys() []string {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	keys := make([]string, 0, len(s.Items))
+	for key := range s.Items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *StringSet) Clear() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.Items = make(map[string]bool)
+}
+
+func getBucketKey(perm int, hash uint64) uint64 {
+	return store.PackBucketKey(perm, hash)
 }
@@ -0,0 +1,223 @@
+package lsh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+var (
+	// ErrVersionConflict returned when the record has been changed by another writer
+	ErrVersionConflict = errors.New("record version conflict")
+)
+
+// recordLockStripes is the number of locks serializing writes of the same record
+const recordLockStripes = 256
+
+// recordVersions holds monotonically increasing version per record along with
+// the counts of changes since training; writes of the single record are serialized
+// by the striped lock keyed on the id hash, so different records are written in parallel
+type recordVersions struct {
+	mx      sync.Mutex
+	m       map[string]uint64
+	changes ChangeStats
+	stripes [recordLockStripes]sync.Mutex
+}
+
+// ChangeStats holds number of records indexed by the last training,
+// and number of inserts and deletes since then
+type ChangeStats struct {
+	Trained  int
+	Inserted int
+	Deleted  int
+}
+
+// ChangedFraction returns number of changes relative to the number of trained records
+func (c ChangeStats) ChangedFraction() float64 {
+	changed := float64(c.Inserted + c.Deleted)
+	if c.Trained == 0 {
+		if changed == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return changed / float64(c.Trained)
+}
+
+func newRecordVersions() *recordVersions {
+	return &recordVersions{
+		m: make(map[string]uint64),
+	}
+}
+
+func (v *recordVersions) reset(ids []string) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	v.m = make(map[string]uint64, len(ids))
+	v.changes = ChangeStats{Trained: len(ids)}
+	for _, id := range ids {
+		v.m[id] = 1
+	}
+}
+
+// resume resets versions after resuming the training of already indexed records,
+// which versions are unknown, so only their number is kept
+func (v *recordVersions) resume(trained int) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	v.m = make(map[string]uint64)
+	v.changes = ChangeStats{Trained: trained}
+}
+
+// init sets the first version of the newly trained record
+func (v *recordVersions) init(id string) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	v.m[id] = 1
+	v.changes.Trained++
+}
+
+// lock locks writes of the record, returns the unlock func
+func (v *recordVersions) lock(id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	mx := &v.stripes[h.Sum32()%recordLockStripes]
+	mx.Lock()
+	return mx.Unlock
+}
+
+func (v *recordVersions) get(id string) uint64 {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	return v.m[id]
+}
+
+// inserted increments version of the inserted record and returns the new one
+func (v *recordVersions) inserted(id string) uint64 {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	v.m[id]++
+	v.changes.Inserted++
+	return v.m[id]
+}
+
+// deleted increments version of the deleted record
+func (v *recordVersions) deleted(id string) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	v.m[id]++
+	v.changes.Deleted++
+}
+
+// Changes returns number of inserts and deletes since the last training,
+// e.g. to decide whether the index should be rebuilt
+func (lsh *LSHIndex) Changes() ChangeStats {
+	lsh.versions.mx.Lock()
+	defer lsh.versions.mx.Unlock()
+	return lsh.versions.changes
+}
+
+// RecordVersion returns current version of the record; versions start from 1
+// on Train, and are incremented by every insert and delete of the record
+func (lsh *LSHIndex) RecordVersion(id string) (uint64, bool) {
+	lsh.versions.mx.Lock()
+	defer lsh.versions.mx.Unlock()
+	version, ok := lsh.versions.m[id]
+	return version, ok
+}
+
+// Insert adds vector to the trained index or replaces the existing one,
+// returns the new record version
+func (lsh *LSHIndex) Insert(id string, vec []float64) (uint64, error) {
+	defer lsh.versions.lock(id)()
+	return lsh.insert(id, vec)
+}
+
+// InsertIfVersion inserts vector only if the current record version equals to the expected one
+// (0 for the records which have never been stored), otherwise ErrVersionConflict is returned
+func (lsh *LSHIndex) InsertIfVersion(id string, vec []float64, expectedVersion uint64) (uint64, error) {
+	defer lsh.versions.lock(id)()
+	version := lsh.versions.get(id)
+	if version != expectedVersion {
+		return version, fmt.Errorf("record %v has version %v instead of %v: %w", id, version, expectedVersion, ErrVersionConflict)
+	}
+	return lsh.insert(id, vec)
+}
+
+// insert must be called under the record lock
+func (lsh *LSHIndex) insert(id string, vec []float64) (uint64, error) {
+	if lsh.config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if !lsh.hasher.isTrained() {
+		return 0, ErrNotTrained
+	}
+	lsh.observeDrift(vec)
+	vec, err := lsh.transform(vec)
+	if err != nil {
+		return 0, fmt.Errorf("invalid vector %v: %w", id, err)
+	}
+	ctx, span := lsh.tracer.Start(context.Background(), "lsh.Insert")
+	defer span.End()
+	// NOTE: old hashes removal and the new ones are applied atomically, if the store supports it
+	err = store.Update(lsh.storeWithContext(ctx), func(tx store.Store) error {
+		oldVec, err := tx.GetVector(id)
+		if err == nil {
+			err = lsh.removeHashes(tx, id, oldVec)
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		return lsh.indexVector(tx, id, vec)
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = lsh.tombstones.remove(id)
+	if err != nil {
+		return 0, fmt.Errorf("can't delete tombstone of vector %v: %w", id, err)
+	}
+	lsh.invalidateCache()
+	return lsh.versions.inserted(id), nil
+}
+
+// Retrain re-hashes only the given records with the vectors returned by fetch (e.g. after
+// the embedding model refresh for a subset of the records), the rest of the index stays intact;
+// records must exist and not be deleted, otherwise ErrNotFound is returned; records processed
+// before the first error stay retrained; versions of the retrained records are incremented
+func (lsh *LSHIndex) Retrain(ids []string, fetch func(id string) ([]float64, error)) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if !lsh.hasher.isTrained() {
+		return ErrNotTrained
+	}
+	for _, id := range ids {
+		vec, err := fetch(id)
+		if err != nil {
+			return fmt.Errorf("can't fetch vector %v: %w", id, err)
+		}
+		err = lsh.retrain(id, vec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lsh *LSHIndex) retrain(id string, vec []float64) error {
+	defer lsh.versions.lock(id)()
+	deleted, err := lsh.isDeleted(id)
+	if err != nil {
+		return err
+	}
+	if lsh.versions.get(id) == 0 || deleted {
+		return fmt.Errorf("can't retrain record %v: %w", id, ErrNotFound)
+	}
+	_, err = lsh.insert(id, vec)
+	return err
+}
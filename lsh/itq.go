@@ -0,0 +1,146 @@
+package lsh
+
+import (
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"gonum.org/v1/gonum/blas/blas64"
+	"gonum.org/v1/gonum/mat"
+	"math/rand"
+)
+
+const (
+	defaultITQIterations = 50
+	defaultITQSampleSize = 10000
+)
+
+var (
+	itqBitsErr = fmt.Errorf("number of ITQ bits must not exceed dimensions number and %v", store.HashBits)
+)
+
+// ITQConfig holds parameters of iterative quantization: training sample is projected
+// on the top Bits principal components, then the projection is rotated to minimize
+// the binarization error; each tree gets its' own sample and initial rotation
+type ITQConfig struct {
+	// Bits is a number of planes per tree, ITQ is disabled when zero
+	Bits int
+	// Iterations of the rotation fitting, 50 by default
+	Iterations int
+	// SampleSize is a max number of training vectors used for fitting, 10000 by default
+	SampleSize int
+}
+
+func (c ITQConfig) validate(dims int) error {
+	if c.Bits < 0 || c.Bits > dims || c.Bits > store.HashBits {
+		return itqBitsErr
+	}
+	return nil
+}
+
+// buildITQTree fits ITQ planes on a random sample and chains them into a tree
+func buildITQTree(vecs [][]float64, config HasherConfig, rnd *rand.Rand) *treeNode {
+	sampleSize := config.ITQ.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = defaultITQSampleSize
+	}
+	if sampleSize > len(vecs) {
+		sampleSize = len(vecs)
+	}
+	if sampleSize == 0 {
+		return &treeNode{}
+	}
+	sample := make([][]float64, sampleSize)
+	for i, idx := range rnd.Perm(len(vecs))[:sampleSize] {
+		sample[i] = vecs[idx]
+		if config.isAngularMetric {
+			vec := NewVec(make([]float64, len(vecs[idx])))
+			copy(vec.Data, vecs[idx])
+			if norm := blas64.Nrm2(vec); norm > tol {
+				blas64.Scal(1/norm, vec)
+			}
+			sample[i] = vec.Data
+		}
+	}
+	iterations := config.ITQ.Iterations
+	if iterations <= 0 {
+		iterations = defaultITQIterations
+	}
+	return chainTree(fitITQ(sample, config.ITQ.Bits, iterations, rnd), config.Dims)
+}
+
+// fitITQ returns planes as rows of normal vector followed by the offset
+func fitITQ(vecs [][]float64, bits, iterations int, rnd *rand.Rand) [][]float64 {
+	n, dims := len(vecs), len(vecs[0])
+	mean := make([]float64, dims)
+	for _, vec := range vecs {
+		for j, val := range vec {
+			mean[j] += val / float64(n)
+		}
+	}
+	centered := mat.NewDense(n, dims, nil)
+	for i, vec := range vecs {
+		for j, val := range vec {
+			centered.Set(i, j, val-mean[j])
+		}
+	}
+	// NOTE: eigen values are sorted ascending, so the top components are the last ones
+	cov := mat.NewSymDense(dims, nil)
+	cov.SymOuterK(1/float64(n), centered.T())
+	var eig mat.EigenSym
+	eig.Factorize(cov, true)
+	var eigVecs mat.Dense
+	eig.VectorsTo(&eigVecs)
+	components := eigVecs.Slice(0, dims, dims-bits, dims)
+
+	var projected mat.Dense
+	projected.Mul(centered, components)
+	rotation := randomRotation(bits, rnd)
+	var rotated, corr, u, v mat.Dense
+	binary := mat.NewDense(n, bits, nil)
+	var svd mat.SVD
+	for it := 0; it < iterations; it++ {
+		rotated.Mul(&projected, rotation)
+		for i := 0; i < n; i++ {
+			for j := 0; j < bits; j++ {
+				if rotated.At(i, j) < 0 {
+					binary.Set(i, j, -1)
+				} else {
+					binary.Set(i, j, 1)
+				}
+			}
+		}
+		// NOTE: orthogonal Procrustes problem: rotation = U * V^T, where U * S * V^T = projected^T * binary
+		corr.Mul(projected.T(), binary)
+		svd.Factorize(&corr, mat.SVDFull)
+		svd.UTo(&u)
+		svd.VTo(&v)
+		rotation.Mul(&u, v.T())
+	}
+
+	var normals mat.Dense
+	normals.Mul(components, rotation)
+	planes := make([][]float64, bits)
+	for j := range planes {
+		planes[j] = make([]float64, dims+1)
+		for k := 0; k < dims; k++ {
+			planes[j][k] = normals.At(k, j)
+			// NOTE: dot(vec - mean, normal) < 0 <=> dot(vec, normal) - dot(mean, normal) < 0
+			planes[j][dims] += mean[k] * planes[j][k]
+		}
+	}
+	return planes
+}
+
+// randomRotation returns random orthogonal matrix, as Q of the gaussian matrix QR decomposition
+func randomRotation(size int, rnd *rand.Rand) *mat.Dense {
+	gaussian := mat.NewDense(size, size, nil)
+	for i := 0; i < size; i++ {
+		for j := 0; j < size; j++ {
+			gaussian.Set(i, j, rnd.NormFloat64())
+		}
+	}
+	var qr mat.QR
+	qr.Factorize(gaussian)
+	rotation := &mat.Dense{}
+	qr.QTo(rotation)
+	return rotation
+}
@@ -0,0 +1,118 @@
+package lsh
+
+import (
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"sync"
+)
+
+// JoinPair is a match between the vector of the current index and the vector of the other one
+type JoinPair struct {
+	LeftID   string
+	RightID  string
+	Distance float64
+}
+
+type joinResult struct {
+	pairs []JoinPair
+	err   error
+}
+
+// Join searches up to k NNs within distanceThrsh in the other index for every
+// vector stored in the current one; vectors are scanned by SearchParallelism workers,
+// and the matched pairs are passed to emit, returning false from emit stops the join.
+// Stored vectors are already transformed, so if the current index has a transform pipeline,
+// the other one must be LSHIndex with the same pipeline, otherwise ErrPipelineMismatch is returned
+func (lsh *LSHIndex) Join(other Indexer, k int, distanceThrsh float64, emit func(pair JoinPair) bool) error {
+	scanner, ok := lsh.index.(store.Scanner)
+	if !ok {
+		return ErrNotSupported
+	}
+	search := other.Search
+	if lsh.pipelineID != "" {
+		index, ok := other.(*LSHIndex)
+		if !ok || index.pipelineID != lsh.pipelineID {
+			return fmt.Errorf("%w: can't join transformed vectors", ErrPipelineMismatch)
+		}
+		search = func(vec []float64, k int, distanceThrsh float64) ([]Neighbor, error) {
+			closest, _, err := index.search(vec, SearchOpts{MaxNN: k, DistanceThrsh: distanceThrsh, transformed: true})
+			return closest, err
+		}
+	}
+	idsIter, err := scanner.GetVectorsIds()
+	if err != nil {
+		return err
+	}
+	workers := lsh.config.getSearchParallelism()
+	if workers < 1 {
+		workers = 1
+	}
+	ids := make(chan string)
+	results := make(chan joinResult)
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				res := lsh.joinVector(search, id, k, distanceThrsh)
+				select {
+				case results <- res:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(ids)
+		for {
+			id, opened := idsIter.Next()
+			if !opened {
+				return
+			}
+			select {
+			case ids <- id:
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	defer close(done)
+	for res := range results {
+		if res.err != nil {
+			return res.err
+		}
+		for _, pair := range res.pairs {
+			if !emit(pair) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (lsh *LSHIndex) joinVector(search func(vec []float64, k int, distanceThrsh float64) ([]Neighbor, error), id string, k int, distanceThrsh float64) joinResult {
+	deleted, err := lsh.isDeleted(id)
+	if err != nil || deleted {
+		return joinResult{err: err}
+	}
+	vec, err := lsh.index.GetVector(id)
+	if err != nil {
+		return joinResult{err: fmt.Errorf("can't get vector %v: %w", id, err)}
+	}
+	closest, err := search(vec, k, distanceThrsh)
+	if err != nil {
+		return joinResult{err: fmt.Errorf("can't join vector %v: %w", id, err)}
+	}
+	pairs := make([]JoinPair, len(closest))
+	for i, nn := range closest {
+		pairs[i] = JoinPair{LeftID: id, RightID: nn.ID, Distance: nn.Dist}
+	}
+	return joinResult{pairs: pairs}
+}
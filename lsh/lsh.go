@@ -2,14 +2,35 @@ package lsh
 
 import (
 	"container/heap"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/gasparian/lsh-search-go/store"
 	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	DistanceErr = errors.New("Distance can't be calculated")
+	// ErrNotTrained is returned when index is used before Train or LoadHasher
+	ErrNotTrained = errors.New("index is not trained")
+	// ErrDimMismatch is returned when vector length differs from the configured dimensions number
+	ErrDimMismatch = errors.New("vector dimensions mismatch")
+	// ErrInvalidVector is returned when vector contains NaN or Inf values
+	ErrInvalidVector = errors.New("vector contains NaN or Inf")
+	// ErrReadOnly is returned by the mutating methods of the read-only index
+	ErrReadOnly = errors.New("index is read-only")
+	// store errors, exposed here for convenience
+	ErrNotFound         = store.ErrNotFound
+	ErrStoreUnavailable = store.ErrStoreUnavailable
+	ErrNotSupported     = store.ErrNotSupported
+
+	idsNumberErr     = errors.New("number of ids must be equal to the number of vectors")
+	batchSizeErr     = errors.New("batch size must be a positive integer")
+	maxCandidatesErr = errors.New("max candidates must be a positive integer")
 )
 
 // Neighbor represent neighbor vector with distance to the query vector
@@ -19,6 +40,21 @@ type Neighbor struct {
 	Dist float64
 }
 
+// lessNeighbor orders neighbors by ascending distance, ties are broken by ID
+func lessNeighbor(l, r *Neighbor) bool {
+	if l.Dist == r.Dist {
+		return l.ID < r.ID
+	}
+	return l.Dist < r.Dist
+}
+
+// SortNeighbors sorts neighbors in the same order as search results are returned
+func SortNeighbors(neighbors []Neighbor) {
+	sort.Slice(neighbors, func(i, j int) bool {
+		return lessNeighbor(&neighbors[i], &neighbors[j])
+	})
+}
+
 type NeighborMinHeap []*Neighbor
 
 func (h NeighborMinHeap) Len() int {
@@ -26,7 +62,7 @@ func (h NeighborMinHeap) Len() int {
 }
 
 func (h NeighborMinHeap) Less(i, j int) bool {
-	return h[i].Dist < h[j].Dist
+	return lessNeighbor(h[i], h[j])
 }
 
 func (h NeighborMinHeap) Swap(i, j int) {
@@ -63,20 +99,132 @@ type IndexConfig struct {
 	mx            *sync.RWMutex
 	BatchSize     int
 	MaxCandidates int
+	// CandidateMetric, when set, is used to cheaply select candidates, and then
+	// the top RerankSize of them are re-ranked with the exact index metric
+	CandidateMetric Metric
+	RerankSize      int
+	// SearchParallelism bounds the number of permutations probed concurrently
+	// during a single search; values <= 1 mean sequential probing
+	SearchParallelism int
+	// Tracer, when set, wraps training, search and store operations with spans
+	Tracer Tracer
+	// CacheSize enables LRU cache of search results, which expire after CacheTTL (never if zero);
+	// query components are rounded to CachePrecision for the cache key (exact if zero)
+	CacheSize      int
+	CacheTTL       time.Duration
+	CachePrecision float64
+	// BreakerFailures enables circuit breaker around the store: after that many consecutive
+	// failed store calls, the next ones fail fast with ErrStoreUnavailable for BreakerCooldown;
+	// reads which take longer than StoreTimeout (if set) are treated as failed; writes aren't
+	// timed out, since the abandoned write could still be applied
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	StoreTimeout    time.Duration
+	// Pipeline, when set, transforms vectors before training, inserts and search;
+	// the index refuses to work with a hasher trained using another pipeline
+	Pipeline *Pipeline
+	// Drift, when set, observes inserted and query vectors before the transform
+	Drift *DriftMonitor
+	// CheckpointInterval is a number of entries indexed by TrainWithCheckpoints between
+	// the checkpoints (100000 by default)
+	CheckpointInterval int
+	// DumpCompression enables compression of DumpHasher output,
+	// compressed dumps are detected by LoadHasher regardless of this setting
+	DumpCompression Compression
+	// SlowQueryThreshold enables the slow-query log: searches which take longer are passed
+	// to SlowQueryLog, or written to the standard logger when it's not set
+	SlowQueryThreshold time.Duration
+	SlowQueryLog       func(query SlowQuery)
+	// Deterministic search returns bit-for-bit identical results for the same index state
+	// and query: permutations are probed sequentially in order, and ids of each bucket are
+	// sorted, so the same candidates are picked when the candidates limit is hit; it ignores
+	// SearchParallelism, and doesn't hold with SearchOpts.LatencyBudget. See also HasherConfig.Seed
+	Deterministic bool
+	// OnEvent, when set, is called synchronously when training starts and finishes
+	OnEvent func(event Event)
+	// ReadOnly index rejects training, inserts, deletes and config changes with ErrReadOnly,
+	// so the search path doesn't need config and tombstones locks (e.g. for replicas)
+	ReadOnly bool
+	// Records index holds vectors of the multi-vector records (see InsertRecord), searches
+	// return record ids, each with the distance of its' closest vector; like with GroupBy,
+	// the whole candidates pool is collapsed, so MaxCandidates should leave room for it
+	Records bool
 }
 
-func (c *IndexConfig) getBatchSize() int {
+func (c *IndexConfig) validate() error {
+	if c.BatchSize <= 0 {
+		return batchSizeErr
+	}
+	return c.DumpCompression.validate()
+}
+
+// rlock locks config for reading, unless it's immutable; returns unlock func
+func (c *IndexConfig) rlock() func() {
+	if c.ReadOnly {
+		return func() {}
+	}
 	c.mx.RLock()
-	defer c.mx.RUnlock()
+	return c.mx.RUnlock
+}
+
+func (c *IndexConfig) getBatchSize() int {
+	defer c.rlock()()
 	return c.BatchSize
 }
 
 func (c *IndexConfig) getMaxCandidates() int {
-	c.mx.RLock()
-	defer c.mx.RUnlock()
+	defer c.rlock()()
 	return c.MaxCandidates
 }
 
+func (c *IndexConfig) getCheckpointInterval() int {
+	defer c.rlock()()
+	if c.CheckpointInterval <= 0 {
+		return defaultCheckpointInterval
+	}
+	return c.CheckpointInterval
+}
+
+func (c *IndexConfig) getRerank() (Metric, int) {
+	defer c.rlock()()
+	if c.RerankSize <= 0 {
+		return nil, 0
+	}
+	return c.CandidateMetric, c.RerankSize
+}
+
+func (c *IndexConfig) setBatchSize(batchSize int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.BatchSize = batchSize
+}
+
+func (c *IndexConfig) setMaxCandidates(maxCandidates int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.MaxCandidates = maxCandidates
+}
+
+func (c *IndexConfig) getSearchParallelism() int {
+	defer c.rlock()()
+	return c.SearchParallelism
+}
+
+func (c *IndexConfig) getSlowQueryLog() (time.Duration, func(query SlowQuery)) {
+	defer c.rlock()()
+	return c.SlowQueryThreshold, c.SlowQueryLog
+}
+
+func (c *IndexConfig) getOnEvent() func(event Event) {
+	defer c.rlock()()
+	return c.OnEvent
+}
+
+func (c *IndexConfig) isDeterministic() bool {
+	defer c.rlock()()
+	return c.Deterministic
+}
+
 // Config holds all needed constants for creating the Hasher instance
 type Config struct {
 	IndexConfig
@@ -89,29 +237,171 @@ type LSHIndex struct {
 	index          store.Store
 	hasher         *Hasher
 	distanceMetric Metric
+	tracer         Tracer
+	tombstones     *tombstones
+	deletable      bool
+	durable        bool
+	compaction     compaction
+	health         health
+	cache          *resultsCache
+	versions       *recordVersions
+	keyer          store.Keyer
+	quantizer      store.Quantizer
+	pipelineID     string
 }
 
 // New creates new instance of hasher and index, where generated hashes will be stored
-func NewLsh(config Config, store store.Store, metric Metric) (*LSHIndex, error) {
+func NewLsh(config Config, s store.Store, metric Metric) (*LSHIndex, error) {
+	if config.HasherConfig.Dims <= 0 {
+		return nil, dimensionsNumberErr
+	}
+	err := config.HasherConfig.applyBands()
+	if err != nil {
+		return nil, err
+	}
+	if config.HasherConfig.NTrees > maxTrees {
+		return nil, treesNumberErr
+	}
+	err = config.HasherConfig.ITQ.validate(config.HasherConfig.Dims)
+	if err != nil {
+		return nil, err
+	}
 	config.HasherConfig.isAngularMetric = metric.IsAngular()
-	hasher := NewHasher(config.HasherConfig)
-	config.IndexConfig.mx = new(sync.RWMutex)
+	err = validateCrossPolytope(config.HasherConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = config.IndexConfig.validate()
+	if err != nil {
+		return nil, err
+	}
+	return newLsh(config.IndexConfig, NewHasher(config.HasherConfig), s, metric), nil
+}
+
+// NewLshWithHasher creates index which uses the given hasher, e.g. made by NewHasherFromPlanes
+func NewLshWithHasher(config IndexConfig, hasher *Hasher, s store.Store, metric Metric) (*LSHIndex, error) {
+	if hasher.getDims() <= 0 {
+		return nil, dimensionsNumberErr
+	}
+	hasher.mutex.Lock()
+	hasher.Config.isAngularMetric = metric.IsAngular()
+	err := validateCrossPolytope(hasher.Config)
+	hasher.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return newLsh(config, hasher, s, metric), nil
+}
+
+func newLsh(config IndexConfig, hasher *Hasher, s store.Store, metric Metric) *LSHIndex {
+	config.mx = new(sync.RWMutex)
+	// NOTE: keys are looked up for every candidate, so the store wrappers are bypassed
+	keyer, _ := s.(store.Keyer)
+	_, deletable := s.(store.Deleter)
+	_, tombstoned := s.(store.Tombstoner)
+	durable, _ := s.(store.Durable)
+	quantizer, _ := s.(store.Quantizer)
+	if quantizer != nil && !quantizer.Quantized() {
+		quantizer = nil
+	}
+	if config.BreakerFailures > 0 {
+		s = newBreakerStore(s, config.BreakerFailures, config.BreakerCooldown, config.StoreTimeout)
+	}
+	var tracer Tracer = noopTracer{}
+	if config.Tracer != nil {
+		tracer = config.Tracer
+		s = newTracedStore(s, tracer)
+	}
+	var cache *resultsCache
+	if config.CacheSize > 0 {
+		cache = newResultsCache(config.CacheSize, config.CacheTTL, config.CachePrecision)
+	}
 	return &LSHIndex{
-		config:         config.IndexConfig,
+		config:         config,
 		hasher:         hasher,
-		index:          store,
+		index:          s,
 		distanceMetric: metric,
-	}, nil
+		tracer:         tracer,
+		tombstones:     newTombstones(s, tombstoned),
+		deletable:      deletable,
+		durable:        durable != nil && durable.Durable(),
+		cache:          cache,
+		versions:       newRecordVersions(),
+		keyer:          keyer,
+		quantizer:      quantizer,
+		pipelineID:     config.Pipeline.id(),
+	}
+}
+
+// validateVector checks vector's length and values
+func validateVector(vec []float64, dims int) error {
+	if len(vec) != dims {
+		return fmt.Errorf("vector has %v dimensions instead of %v: %w", len(vec), dims, ErrDimMismatch)
+	}
+	for _, val := range vec {
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return ErrInvalidVector
+		}
+	}
+	return nil
 }
 
 // Train fills new search index with vectors
 func (lsh *LSHIndex) Train(vecs [][]float64, ids []string) error {
-	err := lsh.index.Clear()
+	return lsh.TrainWithProgress(vecs, ids, nil)
+}
+
+// TrainWithProgress fills new search index with vectors, reporting number of
+// already hashed vectors after each batch; progress func must be safe for concurrent use
+func (lsh *LSHIndex) TrainWithProgress(vecs [][]float64, ids []string, progress func(processed, total int)) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	onEvent := lsh.config.getOnEvent()
+	emit(onEvent, Event{Type: TrainStarted, Count: len(vecs)})
+	err := lsh.train(vecs, ids, progress)
+	emit(onEvent, Event{Type: TrainFinished, Count: len(vecs), Err: err})
+	return err
+}
+
+func (lsh *LSHIndex) train(vecs [][]float64, ids []string, progress func(processed, total int)) error {
+	if len(vecs) != len(ids) {
+		return idsNumberErr
+	}
+	dims := lsh.hasher.getDims()
+	transformed := make([][]float64, len(vecs))
+	for i, vec := range vecs {
+		var err error
+		transformed[i], err = lsh.config.Pipeline.apply(vec, dims)
+		if err != nil {
+			return fmt.Errorf("invalid vector %v: %w", ids[i], err)
+		}
+	}
+	vecs = transformed
+	ctx, span := lsh.tracer.Start(context.Background(), "lsh.Train")
+	defer span.End()
+	err := lsh.storeWithContext(ctx).Clear()
 	if err != nil {
 		return err
 	}
-	lsh.hasher.build(vecs)
+	lsh.tombstones.clear()
+	lsh.versions.reset(ids)
+	lsh.invalidateCache()
+	defer lsh.invalidateCache()
+	_, buildSpan := lsh.tracer.Start(ctx, "lsh.Train.build")
+	lsh.hasher.build(vecs, lsh.pipelineID)
+	buildSpan.End()
+	hashingCtx, hashingSpan := lsh.tracer.Start(ctx, "lsh.Train.hashing")
+	defer hashingSpan.End()
+	s := lsh.storeWithContext(hashingCtx)
 	batchSize := lsh.config.getBatchSize()
+	total := len(vecs)
+	errs := make(chan error, len(vecs)/batchSize+1)
+	var processed int64
 	wg := sync.WaitGroup{}
 	for i := 0; i < len(vecs); i += batchSize {
 		wg.Add(1)
@@ -122,88 +412,717 @@ func (lsh *LSHIndex) Train(vecs [][]float64, ids []string) error {
 		go func(vecs [][]float64, ids []string, wg *sync.WaitGroup) {
 			defer wg.Done()
 			for i := range vecs {
-				hashes := lsh.hasher.getHashes(vecs[i])
-				lsh.index.SetVector(ids[i], vecs[i])
-				for perm, hash := range hashes {
-					bucketName := getBucketName(perm, hash)
-					lsh.index.SetHash(bucketName, ids[i])
+				err := lsh.indexVector(s, ids[i], vecs[i])
+				if err != nil {
+					errs <- err
+					return
 				}
 			}
+			done := atomic.AddInt64(&processed, int64(len(vecs)))
+			if progress != nil {
+				progress(int(done), total)
+			}
 		}(vecs[i:end], ids[i:end], &wg)
 	}
 	wg.Wait()
+	close(errs)
+	if err, ok := <-errs; ok {
+		return err
+	}
 	return nil
 }
 
-// Search returns NNs for the query point
-func (lsh *LSHIndex) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
-	maxCandidates := lsh.config.getMaxCandidates()
-	hashes := lsh.hasher.getHashes(query)
-	closestSet := make(map[string]bool)
-	minHeap := new(NeighborMinHeap)
+// isDeleted checks tombstones, the in-memory ones are always empty for the read-only index
+func (lsh *LSHIndex) isDeleted(id string) (bool, error) {
+	if lsh.config.ReadOnly && lsh.tombstones.local != nil {
+		return false, nil
+	}
+	deleted, err := lsh.tombstones.has(id)
+	if err != nil {
+		return false, fmt.Errorf("can't check tombstone of vector %v: %w", id, err)
+	}
+	return deleted, nil
+}
+
+func (lsh *LSHIndex) invalidateCache() {
+	if lsh.cache != nil {
+		lsh.cache.clear()
+	}
+}
+
+// quantize rounds vector the same way the store does, so the vector is hashed
+// exactly as it will be read back, e.g. by deletes and Verify
+func (lsh *LSHIndex) quantize(vec []float64) []float64 {
+	if lsh.quantizer == nil {
+		return vec
+	}
+	return lsh.quantizer.Quantize(vec)
+}
+
+// indexVector stores vector and puts its' id into the buckets
+func (lsh *LSHIndex) indexVector(s store.Store, id string, vec []float64) error {
+	vec = lsh.quantize(vec)
+	hashes := lsh.hasher.getHashes(vec)
+	err := s.SetVector(id, vec)
+	if err != nil {
+		return fmt.Errorf("can't store vector %v: %w", id, err)
+	}
 	for perm, hash := range hashes {
-		if minHeap.Len() >= maxCandidates {
-			break
+		err = s.SetHash(getBucketKey(perm, hash), id)
+		if err != nil {
+			return fmt.Errorf("can't store hash of vector %v: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// SearchStats holds diagnostics of a single search
+type SearchStats struct {
+	CacheHit           bool
+	BucketsProbed      int
+	CandidatesExamined int
+	CandidatesPassed   int
+	HashingTime        time.Duration
+	ProbingTime        time.Duration
+	RerankTime         time.Duration
+	// EstimatedRecall is set by the adaptive probing, see SearchOpts.RecallTarget
+	EstimatedRecall float64
+}
+
+// safeCandidates allows to lock candidates heap while probing buckets concurrently
+type safeCandidates struct {
+	sync.Mutex
+	keyer store.Keyer
+	// NOTE: seen ids are kept in bitset by their store keys, map is used
+	//       when the store doesn't implement store.Keyer, or doesn't know the id
+	seen    *pagedBitset
+	seenIDs map[string]bool
+	// NOTE: candidates are pushed into heap, or collected into the list
+	//       when a lot of them are requested, see selectThreshold
+	heap    *NeighborMinHeap
+	list    []*Neighbor
+	collect bool
+	// NOTE: when emit is set, candidates are passed to it instead of being kept,
+	//       see SearchEach
+	emit          func(candidate *Neighbor) bool
+	stopped       bool
+	maxCandidates int
+	stats         SearchStats
+}
+
+func newSafeCandidates(maxCandidates int, keyer store.Keyer, requested int) *safeCandidates {
+	return &safeCandidates{
+		keyer:         keyer,
+		seen:          newPagedBitset(),
+		heap:          new(NeighborMinHeap),
+		collect:       requested >= selectThreshold,
+		maxCandidates: maxCandidates,
+	}
+}
+
+func (c *safeCandidates) len() int {
+	if c.collect {
+		return len(c.list)
+	}
+	return c.heap.Len()
+}
+
+func (c *safeCandidates) isFull() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.stopped || c.len() >= c.maxCandidates
+}
+
+// closest returns up to k closest candidates, sorted by distance
+func (c *safeCandidates) closest(k int) []*Neighbor {
+	c.Lock()
+	defer c.Unlock()
+	if c.collect {
+		return selectClosest(c.list, k)
+	}
+	if k > c.heap.Len() {
+		k = c.heap.Len()
+	}
+	closest := make([]*Neighbor, 0, k)
+	for len(closest) < k {
+		closest = append(closest, heap.Pop(c.heap).(*Neighbor))
+	}
+	return closest
+}
+
+// markSeen returns false if the candidate has been already checked
+func (c *safeCandidates) markSeen(id string) bool {
+	var key uint64
+	var keyed bool
+	if c.keyer != nil {
+		key, keyed = c.keyer.Key(id)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if keyed {
+		if c.seen.testAndSet(key) {
+			return false
+		}
+	} else {
+		if c.seenIDs == nil {
+			c.seenIDs = make(map[string]bool)
+		}
+		if c.seenIDs[id] {
+			return false
+		}
+		c.seenIDs[id] = true
+	}
+	c.stats.CandidatesExamined++
+	return true
+}
+
+func (c *safeCandidates) bucketProbed() {
+	c.Lock()
+	defer c.Unlock()
+	c.stats.BucketsProbed++
+}
+
+func (c *safeCandidates) push(candidate *Neighbor) {
+	c.Lock()
+	defer c.Unlock()
+	if c.stopped || c.len() >= c.maxCandidates {
+		return
+	}
+	if c.emit != nil {
+		c.stats.CandidatesPassed++
+		if !c.emit(candidate) || c.stats.CandidatesPassed >= c.maxCandidates {
+			c.stopped = true
+		}
+		return
+	}
+	if c.collect {
+		c.list = append(c.list, candidate)
+	} else {
+		heap.Push(c.heap, candidate)
+	}
+	c.stats.CandidatesPassed++
+}
+
+// SearchOpts holds parameters of a single search
+type SearchOpts struct {
+	MaxNN         int
+	DistanceThrsh float64
+	// MaxCandidates overrides the index config value when > 0
+	MaxCandidates int
+	// NProbes is a number of neighbor buckets to look into per permutation, default is 1
+	NProbes int
+	// GroupBy is a metadata key, results are limited to MaxPerGroup neighbors per its' value;
+	// the limit is applied over the whole candidates pool, so MaxCandidates should leave room for it
+	GroupBy     string
+	MaxPerGroup int
+	// MMRLambda enables maximal marginal relevance ordering of the candidates when > 0:
+	// 1 keeps pure relevance, lower values favor neighbors which are far from each other;
+	// only MaxNN * 10 closest candidates are reordered, so grouping is limited to them too
+	MMRLambda float64
+	// NegativeVecs are examples to stay away from: NegativeWeight / (1 + distance to the closest
+	// negative vector) is added to the candidate's distance; threshold is checked before the penalty
+	NegativeVecs   [][]float64
+	NegativeWeight float64
+	// Scorer replaces the candidate's distance with a custom score (e.g. blended with
+	// popularity from the metadata) before the ordering; searches with scorer aren't cached
+	Scorer func(dist float64, meta map[string]string) float64
+	// RecallTarget enables adaptive probing when > 0: buckets are probed one by one until
+	// the estimated recall of MaxNN closest candidates reaches the target or LatencyBudget
+	// (if set) expires; index MaxCandidates isn't applied then, only the MaxCandidates option;
+	// adaptive searches are sequential and aren't cached
+	RecallTarget  float64
+	LatencyBudget time.Duration
+	// TraceID identifies the request: it's passed to the tracer spans via the context
+	// (see TraceIDFromContext) and to the slow-query log
+	TraceID string
+	// transformed marks the query already transformed by the index pipeline,
+	// e.g. read from the store of the index with the same pipeline
+	transformed bool
+	// children makes search of the Records index return vectors of the records as is
+	children bool
+}
+
+// searchQuery holds everything needed to score candidates during a single search
+type searchQuery struct {
+	// store is the index store, traced within the search span
+	store         store.Store
+	vec           []float64
+	metric        Metric
+	distanceThrsh float64
+	nProbes       int
+	negatives     [][]float64
+	negWeight     float64
+	scorer        func(dist float64, meta map[string]string) float64
+	deterministic bool
+}
+
+// penalize adds penalty for closeness of the candidate to the negative vectors
+func (q *searchQuery) penalize(metric Metric, vec []float64, dist float64) float64 {
+	if len(q.negatives) == 0 || q.negWeight == 0 {
+		return dist
+	}
+	minDist := math.Inf(1)
+	for _, neg := range q.negatives {
+		minDist = math.Min(minDist, metric.GetDist(vec, neg))
+	}
+	return dist + q.negWeight/(1+minDist)
+}
+
+// score returns distance to the candidate, adjusted by the negative vectors and the custom scorer
+func (lsh *LSHIndex) score(query *searchQuery, metric Metric, id string, vec []float64, dist float64) (float64, error) {
+	dist = query.penalize(metric, vec, dist)
+	if query.scorer == nil {
+		return dist, nil
+	}
+	meta, err := lsh.GetMeta(id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) && !errors.Is(err, store.ErrNotSupported) {
+		return 0, fmt.Errorf("can't get metadata of vector %v: %w", id, err)
+	}
+	return query.scorer(dist, meta), nil
+}
+
+// getBuckets returns keys of the query point bucket and nProbes of its' neighbor buckets
+func getBuckets(perm int, hash uint64, nProbes int) []uint64 {
+	// NOTE: look in the neigbors' "buckets" too, starting from the one
+	//       which differs in the highest set bit
+	var neighborPos int = 0
+	if hash > 0 {
+		neighborPos = int(math.Floor(math.Log2(float64(hash))))
+	}
+	positions := make([]int, 0, store.HashBits)
+	for pos := neighborPos; pos >= 0; pos-- {
+		positions = append(positions, pos)
+	}
+	for pos := neighborPos + 1; pos < store.HashBits; pos++ {
+		positions = append(positions, pos)
+	}
+	if nProbes > len(positions) {
+		nProbes = len(positions)
+	}
+	buckets := []uint64{getBucketKey(perm, hash)}
+	for _, pos := range positions[:nProbes] {
+		buckets = append(buckets, getBucketKey(perm, hash^(1<<pos)))
+	}
+	return buckets
+}
+
+// probe adds candidates from the buckets of a single permutation
+func (lsh *LSHIndex) probe(buckets []uint64, query *searchQuery, candidates *safeCandidates) error {
+	for _, bucket := range buckets {
+		iter, err := query.store.GetHashIterator(bucket)
+		if errors.Is(err, store.ErrNotFound) {
+			continue // NOTE: it's normal when we couldn't find bucket for the query point
 		}
-		// NOTE: look in the neigbors' "bucket" too
-		var neighborPos int = 0
-		if hash > 0 {
-			neighborPos = int(math.Floor(math.Log2(float64(hash))))
+		if err != nil {
+			return err
 		}
-		neighborHash := hash ^ (1 << neighborPos)
-		bucketsNames := []string{
-			getBucketName(perm, hash),
-			getBucketName(perm, neighborHash),
+		candidates.bucketProbed()
+		if query.deterministic {
+			ids := collectIds(iter)
+			sort.Strings(ids)
+			iter = &idsIterator{ids: ids}
 		}
-		for _, bucketName := range bucketsNames {
-			iter, err := lsh.index.GetHashIterator(bucketName)
+		for !candidates.isFull() {
+			id, opened := iter.Next()
+			if !opened {
+				break
+			}
+			if !candidates.markSeen(id) {
+				continue
+			}
+			deleted, err := lsh.isDeleted(id)
 			if err != nil {
-				continue // NOTE: it's normal when we couldn't find bucket for the query point
+				return err
 			}
-			for {
-				if minHeap.Len() >= maxCandidates {
-					break
-				}
-				id, opened := iter.Next()
-				if !opened {
-					break
+			if deleted {
+				continue
+			}
+			vec, err := query.store.GetVector(id)
+			if err != nil {
+				return fmt.Errorf("can't get vector %v: %w", id, err)
+			}
+			dist := query.metric.GetDist(vec, query.vec)
+			if dist <= query.distanceThrsh {
+				dist, err = lsh.score(query, query.metric, id, vec, dist)
+				if err != nil {
+					return err
 				}
-				if closestSet[id] {
+				candidates.push(
+					&Neighbor{
+						ID:   id,
+						Vec:  vec,
+						Dist: dist,
+					},
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// probeAll probes buckets of all permutations, concurrently if parallelism > 1
+func (lsh *LSHIndex) probeAll(hashes map[int]uint64, query *searchQuery, candidates *safeCandidates, parallelism int) error {
+	if query.deterministic {
+		perms := make([]int, 0, len(hashes))
+		for perm := range hashes {
+			perms = append(perms, perm)
+		}
+		sort.Ints(perms)
+		for _, perm := range perms {
+			if candidates.isFull() {
+				break
+			}
+			err := lsh.probe(getBuckets(perm, hashes[perm], query.nProbes), query, candidates)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if parallelism <= 1 {
+		for perm, hash := range hashes {
+			if candidates.isFull() {
+				break
+			}
+			err := lsh.probe(getBuckets(perm, hash, query.nProbes), query, candidates)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sem := make(chan struct{}, parallelism)
+	errs := make(chan error, len(hashes))
+	wg := sync.WaitGroup{}
+	for perm, hash := range hashes {
+		if candidates.isFull() {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(perm int, hash uint64, wg *sync.WaitGroup) {
+			defer wg.Done()
+			errs <- lsh.probe(getBuckets(perm, hash, query.nProbes), query, candidates)
+			<-sem
+		}(perm, hash, &wg)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns NNs for the query point,
+// sorted by ascending distance with ties broken by ID
+func (lsh *LSHIndex) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	closest, _, err := lsh.search(query, SearchOpts{MaxNN: maxNN, DistanceThrsh: distanceThrsh})
+	return closest, err
+}
+
+// SearchWithStats returns NNs for the query point along with the search diagnostics
+func (lsh *LSHIndex) SearchWithStats(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, SearchStats, error) {
+	return lsh.search(query, SearchOpts{MaxNN: maxNN, DistanceThrsh: distanceThrsh})
+}
+
+// SearchWithOpts returns NNs for the query point, using per-query overrides of the index config
+func (lsh *LSHIndex) SearchWithOpts(query []float64, opts SearchOpts) ([]Neighbor, error) {
+	closest, _, err := lsh.search(query, opts)
+	return closest, err
+}
+
+// newQuery validates the query point along with options and prepares the query,
+// which uses the exact metric
+func (lsh *LSHIndex) newQuery(vec []float64, opts SearchOpts) (*searchQuery, error) {
+	if !lsh.hasher.isTrained() {
+		return nil, ErrNotTrained
+	}
+	var err error
+	if opts.transformed {
+		err = validateVector(vec, lsh.hasher.getDims())
+	} else {
+		lsh.observeDrift(vec)
+		vec, err = lsh.transform(vec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	negatives := make([][]float64, len(opts.NegativeVecs))
+	for i, neg := range opts.NegativeVecs {
+		negatives[i], err = lsh.transform(neg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid negative vector: %w", err)
+		}
+	}
+	query := &searchQuery{
+		store:         lsh.index,
+		vec:           vec,
+		metric:        lsh.distanceMetric,
+		distanceThrsh: opts.DistanceThrsh,
+		nProbes:       opts.NProbes,
+		negatives:     negatives,
+		negWeight:     opts.NegativeWeight,
+		scorer:        opts.Scorer,
+		deterministic: lsh.config.isDeterministic(),
+	}
+	if query.nProbes <= 0 {
+		query.nProbes = 1
+	}
+	return query, nil
+}
+
+func (lsh *LSHIndex) getMaxCandidates(opts SearchOpts) int {
+	if opts.MaxCandidates > 0 {
+		return opts.MaxCandidates
+	}
+	return lsh.config.getMaxCandidates()
+}
+
+func (lsh *LSHIndex) search(vec []float64, opts SearchOpts) ([]Neighbor, SearchStats, error) {
+	begin := time.Now()
+	maxCandidates := lsh.getMaxCandidates(opts)
+	adaptive := opts.RecallTarget > 0
+	if adaptive && opts.MaxCandidates <= 0 {
+		maxCandidates = math.MaxInt32
+	}
+	query, err := lsh.newQuery(vec, opts)
+	if err != nil {
+		return nil, SearchStats{}, err
+	}
+	candidateMetric, rerankSize := lsh.config.getRerank()
+	if candidateMetric != nil {
+		query.metric = candidateMetric
+	}
+	if rerankSize > 0 {
+		// NOTE: threshold is checked against the exact metric only, during re-ranking
+		query.distanceThrsh = math.Inf(1)
+	}
+	var cacheKey string
+	useCache := lsh.cache != nil && opts.Scorer == nil && !adaptive && !opts.transformed && !opts.children
+	if useCache {
+		cacheKey = lsh.cache.getKey(vec, opts)
+		if closest, ok := lsh.cache.get(cacheKey); ok {
+			return closest, SearchStats{CacheHit: true}, nil
+		}
+	}
+	ctx := context.Background()
+	if opts.TraceID != "" {
+		ctx = ContextWithTraceID(ctx, opts.TraceID)
+	}
+	ctx, span := lsh.tracer.Start(ctx, "lsh.Search")
+	defer span.End()
+
+	start := time.Now()
+	_, phaseSpan := lsh.tracer.Start(ctx, "lsh.Search.hashing")
+	hashes := lsh.hasher.getHashes(query.vec)
+	phaseSpan.End()
+	hashingTime := time.Since(start)
+
+	start = time.Now()
+	probingCtx, phaseSpan := lsh.tracer.Start(ctx, "lsh.Search.probing")
+	query.store = lsh.storeWithContext(probingCtx)
+	// NOTE: number of the closest candidates needed after probing
+	requested := opts.MaxNN
+	grouped := opts.GroupBy != "" && opts.MaxPerGroup > 0
+	collapsed := lsh.config.Records && !opts.children
+	if grouped || collapsed {
+		requested = maxCandidates
+	}
+	mmrPool := opts.MaxNN * mmrPoolFactor
+	if opts.MMRLambda > 0 && mmrPool < maxCandidates {
+		requested = mmrPool
+	}
+	if rerankSize > 0 {
+		requested = rerankSize
+	}
+	candidates := newSafeCandidates(maxCandidates, lsh.keyer, requested)
+	var recall float64
+	if adaptive {
+		var deadline time.Time
+		if opts.LatencyBudget > 0 {
+			deadline = begin.Add(opts.LatencyBudget)
+		}
+		// NOTE: estimator selects the closest candidates from the list after each bucket
+		candidates.collect = true
+		recall, err = lsh.probeAdaptive(hashes, query, candidates, opts.MaxNN, opts.RecallTarget, deadline)
+	} else {
+		err = lsh.probeAll(hashes, query, candidates, lsh.config.getSearchParallelism())
+	}
+	phaseSpan.End()
+	if err != nil {
+		return nil, SearchStats{}, err
+	}
+	stats := candidates.stats
+	stats.EstimatedRecall = recall
+	stats.HashingTime = hashingTime
+	stats.ProbingTime = time.Since(start)
+
+	ordered := candidates.closest(requested)
+	if rerankSize > 0 {
+		start = time.Now()
+		_, phaseSpan = lsh.tracer.Start(ctx, "lsh.Search.rerank")
+		ordered, err = lsh.rerank(ordered, query, opts.DistanceThrsh)
+		phaseSpan.End()
+		if err != nil {
+			return nil, SearchStats{}, err
+		}
+		stats.RerankTime = time.Since(start)
+	}
+	if opts.MMRLambda > 0 {
+		if len(ordered) > mmrPool {
+			ordered = ordered[:mmrPool]
+		}
+		// NOTE: grouping and collapsing may skip the picked candidates, so the whole pool is ordered then
+		picks := opts.MaxNN
+		if grouped || collapsed {
+			picks = len(ordered)
+		}
+		ordered = lsh.mmr(ordered, opts.MMRLambda, picks)
+	}
+	closest, err := lsh.limitGroups(ordered, opts.MaxNN, opts.GroupBy, opts.MaxPerGroup, collapsed)
+	if err != nil {
+		return nil, SearchStats{}, err
+	}
+	if useCache {
+		lsh.cache.set(cacheKey, closest)
+	}
+	lsh.logSlowQuery(opts, stats, time.Since(begin))
+	return closest, stats, nil
+}
+
+// rerank recalculates distances of the candidates with the exact metric
+func (lsh *LSHIndex) rerank(candidates []*Neighbor, query *searchQuery, distanceThrsh float64) ([]*Neighbor, error) {
+	vecs := make([][]float64, len(candidates))
+	for i, candidate := range candidates {
+		vecs[i] = candidate.Vec
+	}
+	reranked := make([]*Neighbor, 0, len(candidates))
+	dists := GetDists(lsh.distanceMetric, [][]float64{query.vec}, vecs)[0]
+	for i, candidate := range candidates {
+		if dists[i] <= distanceThrsh {
+			dist, err := lsh.score(query, lsh.distanceMetric, candidate.ID, candidate.Vec, dists[i])
+			if err != nil {
+				return nil, err
+			}
+			candidate.Dist = dist
+			reranked = append(reranked, candidate)
+		}
+	}
+	sortNeighborsPtrs(reranked)
+	return reranked, nil
+}
+
+// Warmup fetches buckets and vectors which would be touched by the given queries,
+// so caching store backends are filled before serving the real traffic;
+// returns number of fetched vectors
+func (lsh *LSHIndex) Warmup(queries [][]float64) (int, error) {
+	if !lsh.hasher.isTrained() {
+		return 0, ErrNotTrained
+	}
+	fetched := make(map[string]bool)
+	for _, query := range queries {
+		query, err := lsh.transform(query)
+		if err != nil {
+			return len(fetched), fmt.Errorf("invalid query: %w", err)
+		}
+		for perm, hash := range lsh.hasher.getHashes(query) {
+			for _, bucket := range getBuckets(perm, hash, 1) {
+				iter, err := lsh.index.GetHashIterator(bucket)
+				if errors.Is(err, store.ErrNotFound) {
 					continue
 				}
-				vec, err := lsh.index.GetVector(id)
 				if err != nil {
-					return nil, err
+					return len(fetched), err
 				}
-				dist := lsh.distanceMetric.GetDist(vec, query)
-				if dist <= distanceThrsh {
-					closestSet[id] = true
-					heap.Push(
-						minHeap,
-						&Neighbor{
-							ID:   id,
-							Vec:  vec,
-							Dist: dist,
-						},
-					)
+				for {
+					id, opened := iter.Next()
+					if !opened {
+						break
+					}
+					if fetched[id] {
+						continue
+					}
+					deleted, err := lsh.isDeleted(id)
+					if err != nil {
+						return len(fetched), err
+					}
+					if deleted {
+						continue
+					}
+					_, err = lsh.index.GetVector(id)
+					if err != nil {
+						return len(fetched), fmt.Errorf("can't get vector %v: %w", id, err)
+					}
+					fetched[id] = true
 				}
 			}
-
 		}
 	}
-	closest := make([]Neighbor, 0)
-	for i := 0; i < maxNN && minHeap.Len() > 0; i++ {
-		closest = append(closest, *heap.Pop(minHeap).(*Neighbor))
+	return len(fetched), nil
+}
+
+// SetMaxCandidates changes maximum number of candidates checked during the search
+func (lsh *LSHIndex) SetMaxCandidates(maxCandidates int) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if maxCandidates <= 0 {
+		return maxCandidatesErr
 	}
-	return closest, nil
+	lsh.config.setMaxCandidates(maxCandidates)
+	return nil
 }
 
-// DumpHasher serializes hasher
+// SetBatchSize changes number of vectors processed by a single goroutine during training
+func (lsh *LSHIndex) SetBatchSize(batchSize int) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if batchSize <= 0 {
+		return batchSizeErr
+	}
+	lsh.config.setBatchSize(batchSize)
+	return nil
+}
+
+// DumpHasher serializes hasher, compressing it with IndexConfig.DumpCompression
 func (lsh *LSHIndex) DumpHasher() ([]byte, error) {
-	return lsh.hasher.dump()
+	dump, err := lsh.hasher.dump()
+	if err != nil {
+		return nil, err
+	}
+	return compress(dump, lsh.config.DumpCompression)
+}
+
+// Planes returns hyperplanes of the hasher as a dense matrix, see Hasher.Planes
+func (lsh *LSHIndex) Planes() [][]float64 {
+	return lsh.hasher.Planes()
+}
+
+// SetPlanes replaces hyperplanes of the hasher, stored buckets are expected
+// to be built with the same planes
+func (lsh *LSHIndex) SetPlanes(planes [][]float64) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	defer lsh.invalidateCache()
+	return lsh.hasher.SetPlanes(planes)
 }
 
-// LoadHasher fills hasher from byte array
+// LoadHasher fills hasher from byte array, returns ErrPipelineMismatch
+// if it has been trained with another transform pipeline, keeping the current hasher
 func (lsh *LSHIndex) LoadHasher(inp []byte) error {
-	return lsh.hasher.load(inp)
+	inp, err := decompress(inp)
+	if err != nil {
+		return fmt.Errorf("can't decompress hasher: %w", err)
+	}
+	err = lsh.hasher.load(inp, lsh.pipelineID)
+	if err != nil {
+		return err
+	}
+	lsh.invalidateCache()
+	return nil
 }
@@ -1,13 +1,26 @@
 package lsh
 
 import (
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/snapcrypt"
+	"github.com/gasparian/lsh-search-go/store"
 	"github.com/gasparian/lsh-search-go/store/kv"
 	guuid "github.com/google/uuid"
 	"gonum.org/v1/gonum/blas/blas64"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -32,7 +45,7 @@ func TestGetHash(t *testing.T) {
 		[]float64{-1.0, -1.0},
 		[]float64{2.0, -1.0},
 	}
-	hasherInstance := buildTree(vecs, HasherConfig{KMinVecs: 2, isAngularMetric: false})
+	hasherInstance := buildTree(vecs, HasherConfig{KMinVecs: 2, isAngularMetric: false}, rand.New(rand.NewSource(0)))
 	hash := hasherInstance.getHash(NewVec(vecs[0]))
 	if hash != 1 {
 		t.Fatal("Wrong hash value, must be 1")
@@ -103,6 +116,23 @@ func TestL2(t *testing.T) {
 	if math.Abs(dist-5.0) > tol {
 		t.Error("L2 distance is wrong")
 	}
+
+	// NOTE: matrix product form loses small distances between the large vectors
+	v1 = []float64{1e4, 1e4, 1e4}
+	v2 = []float64{1e4 + 1e-4, 1e4, 1e4}
+	dist = l2.GetDist(v1, v2)
+	dists := l2.GetDists([][]float64{v1}, [][]float64{v2, v1})
+	if math.Abs(dists[0][0]-dist) > 1e-9 || dists[0][1] != 0 {
+		t.Fatalf("Batch L2 distances must match pairwise ones %v, got %v", dist, dists[0])
+	}
+}
+
+func TestHamming(t *testing.T) {
+	hamming := NewHamming()
+	dist := hamming.GetDist([]float64{0, 1, 1, 0}, []float64{1, 1, 0, 0})
+	if dist != 2.0 {
+		t.Fatalf("Hamming distance must be equal to 2.0, got %v", dist)
+	}
 }
 
 func TestDumpHasher(t *testing.T) {
@@ -116,7 +146,7 @@ func TestDumpHasher(t *testing.T) {
 		[]float64{2.0, -1.0},
 	}
 	hasher := NewHasher(config)
-	hasher.build(vecs)
+	hasher.build(vecs, "")
 	coefToTest := hasher.trees[0].plane.d
 	b, err := hasher.dump()
 	if err != nil {
@@ -126,7 +156,7 @@ func TestDumpHasher(t *testing.T) {
 		t.Fatal("Smth went wrong serializing the hasher: resulting bytearray is empty")
 	}
 
-	err = hasher.load(b)
+	err = hasher.load(b, "")
 	if err != nil {
 		t.Fatalf("Could not deserialize hasher: %v", err)
 	}
@@ -339,3 +369,3878 @@ func TestLshL2(t *testing.T) {
 	metric := NewL2()
 	testLSH(metric, config, maxNN, distanceThrsh, inpVecs, trainIds, t)
 }
+
+// l1 is used as a cheap candidate metric in tests
+type l1 bool
+
+func (m l1) GetDist(l, r []float64) float64 {
+	var dist float64
+	for i := range l {
+		dist += math.Abs(l[i] - r[i])
+	}
+	return dist
+}
+
+func (m l1) IsAngular() bool {
+	return false
+}
+
+func TestLshRerank(t *testing.T) {
+	t.Parallel()
+	const (
+		distanceThrsh = 0.02
+		maxNN         = 4
+	)
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:       2,
+			MaxCandidates:   10,
+			CandidateMetric: l1(false),
+			RerankSize:      5,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	metric := NewL2()
+	testLSH(metric, config, maxNN, distanceThrsh, inpVecs, trainIds, t)
+}
+
+func TestLshRecords(t *testing.T) {
+	t.Parallel()
+	records := []Record{
+		Record{ID: "a", Vecs: [][]float64{{0.1, 0.1}, {0.1, 0.08}}},
+		Record{ID: "b", Vecs: [][]float64{{0.11, 0.09}, {-0.1, 0.1}}},
+		Record{ID: "c", Vecs: [][]float64{{-0.1, 0.08}, {-0.09, 0.11}}},
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			Records:       true,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainRecords([]Record{Record{ID: "a#1", Vecs: [][]float64{{0.1, 0.1}}}})
+	if !errors.Is(err, recordIDErr) {
+		t.Fatalf("Record id with the separator must be rejected, got %v", err)
+	}
+	err = lsh.TrainRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, agg := range []Aggregation{MinDist, MeanDist} {
+		nns, err := lsh.SearchRecords([]float64{0.1, 0.1}, 3, 0.05, agg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nns) < 1 || nns[0].ID != "a" {
+			t.Fatalf("Closest record must be \"a\", got %v", nns)
+		}
+		seen := make(map[string]bool)
+		for _, nn := range nns {
+			if seen[nn.ID] {
+				t.Fatalf("Record %v returned twice", nn.ID)
+			}
+			seen[nn.ID] = true
+		}
+	}
+
+	nns, err := lsh.Search([]float64{0.1, 0.1}, 3, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 3 {
+		t.Fatalf("Expected all 3 records, got %v", nns)
+	}
+	for _, nn := range nns {
+		if nn.ID != "a" && nn.ID != "b" && nn.ID != "c" {
+			t.Fatalf("Search must return record ids, got %v", nn.ID)
+		}
+	}
+
+	err = lsh.InsertRecord(Record{ID: "b", Vecs: [][]float64{{-0.1, 0.1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err = lsh.SearchRecords([]float64{0.11, 0.09}, 3, 0.05, MinDist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nn := range nns {
+		if nn.ID == "b" {
+			t.Fatal("Removed vector of the shrunk record must not be found")
+		}
+	}
+	err = lsh.DeleteRecord("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.DeleteRecord("c")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Deleted record must not be found, got %v", err)
+	}
+	nns, err = lsh.Search([]float64{-0.1, 0.1}, 3, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 2 {
+		t.Fatalf("Expected records a and b only, got %v", nns)
+	}
+	for _, nn := range nns {
+		if nn.ID == "c" {
+			t.Fatal("Deleted record must not be found")
+		}
+	}
+}
+
+func TestSparse(t *testing.T) {
+	t.Parallel()
+	_, err := NewSparseVector([]int{1, 1}, []float64{1.0, 2.0})
+	if err == nil {
+		t.Fatal("Sparse vector with duplicated indices must not be created")
+	}
+	l, err := NewSparseVector([]int{99999, 5}, []float64{1.0, 2.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Indices[0] != 5 {
+		t.Fatal("Sparse vector indices must be sorted")
+	}
+	r, _ := NewSparseVector([]int{5, 7}, []float64{3.0, 1.0})
+	if math.Abs(SparseDot(l, r)-6.0) > tol {
+		t.Error("Sparse dot product is wrong")
+	}
+	dist := NewSparseAngular().GetDist(l, l)
+	if math.Abs(dist) > tol {
+		t.Error("Cosine distance must be 0.0 for equal sparse vectors")
+	}
+	if NewSparseInnerProduct().GetDist(l, r) >= 0 {
+		t.Error("Inner product distance must be negative for co-directed sparse vectors")
+	}
+
+	config := SparseConfig{
+		IndexConfig: IndexConfig{
+			MaxCandidates: 10,
+		},
+		SparseHasherConfig: SparseHasherConfig{
+			NTables: 5,
+			NPlanes: 8,
+			Density: 0.1,
+			Seed:    42,
+		},
+	}
+	_, err = NewSparseLsh(config, kv.NewKVStoreWithConfig(kv.Config{Encoding: kv.BFloat16Encoding}), NewSparseAngular())
+	if err == nil {
+		t.Fatal("Sparse index must not be created over the store with reduced precision")
+	}
+	lsh, err := NewSparseLsh(config, kv.NewKVStore(), NewSparseAngular())
+	if err != nil {
+		t.Fatal(err)
+	}
+	far, _ := NewSparseVector([]int{100, 200}, []float64{1.0, 1.0})
+	err = lsh.Train([]SparseVector{l, r, far}, []string{"l", "r", "far"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err := lsh.Search(l, 2, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) == 0 || nns[0].ID != "l" {
+		t.Fatalf("Query point must be the closest to itself, got %v", nns)
+	}
+	for _, nn := range nns {
+		if nn.ID == "far" {
+			t.Fatal("Orthogonal vector must not pass the threshold")
+		}
+	}
+}
+
+func TestBatchDists(t *testing.T) {
+	t.Parallel()
+	queries := make([][]float64, 3)
+	vecs := make([][]float64, 2*distBlockSize+10)
+	for _, data := range [][][]float64{queries, vecs} {
+		for i := range data {
+			data[i] = []float64{rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()}
+		}
+	}
+	vecs[0] = []float64{0.0, 0.0, 0.0}
+	for _, metric := range []BatchMetric{NewL2(), NewAngular()} {
+		dists := GetDists(metric, queries, vecs)
+		for i, q := range queries {
+			for j, vec := range vecs {
+				if math.Abs(dists[i][j]-metric.GetDist(vec, q)) > tol {
+					t.Fatalf("Batch distance differs from the pairwise one: %v vs %v", dists[i][j], metric.GetDist(vec, q))
+				}
+			}
+		}
+	}
+}
+
+func TestLshParallelProbing(t *testing.T) {
+	t.Parallel()
+	const (
+		distanceThrsh = 0.02
+		maxNN         = 4
+	)
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:         2,
+			MaxCandidates:     10,
+			SearchParallelism: 4,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	metric := NewL2()
+	testLSH(metric, config, maxNN, distanceThrsh, inpVecs, trainIds, t)
+}
+
+func TestLshSearchWithStats(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, stats, err := lsh.SearchWithStats(inpVecs[0], 4, 0.02)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BucketsProbed == 0 {
+		t.Error("At least the query point bucket must be probed")
+	}
+	if stats.CandidatesExamined < stats.CandidatesPassed || stats.CandidatesPassed < len(nns) {
+		t.Errorf("Inconsistent search stats: %+v", stats)
+	}
+}
+
+type testSpan struct {
+	name  string
+	spans *StringSet
+}
+
+func (s testSpan) End() {
+	s.spans.Set(s.name)
+}
+
+type testTracer struct {
+	spans *StringSet
+}
+
+type testSpanKey struct{}
+
+// Start records span name, and its' name along with the parent one as "name<-parent"
+func (t testTracer) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	parent, _ := ctx.Value(testSpanKey{}).(string)
+	t.spans.Set(spanName + "<-" + parent)
+	return context.WithValue(ctx, testSpanKey{}, spanName), testSpan{name: spanName, spans: t.spans}
+}
+
+func TestLshTracing(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	tracer := testTracer{spans: NewStringSet()}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			Tracer:        tracer,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Search(inpVecs[0], 4, 0.02)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Insert("new", []float64{0.5, 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"lsh.Train", "lsh.Search", "lsh.Search.probing", "store.SetHash", "store.GetVector",
+		"store.SetHash<-lsh.Train.hashing", "store.GetVector<-lsh.Search.probing",
+		"store.GetHashIterator<-lsh.Search.probing", "store.Update<-lsh.Insert", "store.SetVector<-store.Update",
+	} {
+		if !tracer.spans.Get(name) {
+			t.Errorf("Span %v has not been recorded", name)
+		}
+	}
+}
+
+type traceIDTracer struct {
+	spans *StringSet
+}
+
+func (t traceIDTracer) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	traceID, _ := TraceIDFromContext(ctx)
+	return ctx, testSpan{name: spanName + ":" + traceID, spans: t.spans}
+}
+
+func TestLshSlowQueryLog(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	tracer := traceIDTracer{spans: NewStringSet()}
+	logged := make([]SlowQuery, 0)
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:          2,
+			MaxCandidates:      10,
+			Tracer:             tracer,
+			SlowQueryThreshold: time.Nanosecond,
+			SlowQueryLog: func(query SlowQuery) {
+				logged = append(logged, query)
+			},
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.SearchWithOpts(inpVecs[0], SearchOpts{MaxNN: 4, DistanceThrsh: 0.02, TraceID: "req-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"lsh.Search:req-1", "lsh.Search.probing:req-1", "store.GetVector:req-1"} {
+		if !tracer.spans.Get(name) {
+			t.Errorf("Span %v has not been recorded", name)
+		}
+	}
+	if len(logged) != 1 || logged[0].TraceID != "req-1" || logged[0].MaxNN != 4 || logged[0].Stats.BucketsProbed == 0 {
+		t.Fatalf("Expected slow query req-1 to be logged with its' stats, got %+v", logged)
+	}
+}
+
+func TestLshResultsOrder(t *testing.T) {
+	t.Parallel()
+	vecs := [][]float64{
+		[]float64{0.0, 0.1},
+		[]float64{0.1, 0.0},
+		[]float64{0.0, -0.1},
+		[]float64{-0.1, 0.0},
+		[]float64{0.05, 0.0},
+	}
+	ids := []string{"d", "b", "c", "a", "e"}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   1,
+			KMinVecs: 10,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err := lsh.Search([]float64{0.0, 0.0}, 5, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"e", "a", "b", "c", "d"}
+	if len(nns) != len(expected) {
+		t.Fatalf("Expected %v neighbors, got %v", len(expected), len(nns))
+	}
+	for i, nn := range nns {
+		if nn.ID != expected[i] {
+			t.Fatalf("Results must be sorted by distance and then by ID, got %v", nns)
+		}
+	}
+}
+
+func TestLshErrors(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+		},
+	}
+	_, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err == nil {
+		t.Fatal("Index must not be created without dimensions number")
+	}
+	config.HasherConfig.Dims = 2
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Search([]float64{0.0, 0.0}, 4, 1.0)
+	if !errors.Is(err, ErrNotTrained) {
+		t.Fatalf("Expected ErrNotTrained, got %v", err)
+	}
+	inpVecs, trainIds := getTestLSHData()
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Search([]float64{0.0, 0.0, 0.0}, 4, 1.0)
+	if !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("Expected ErrDimMismatch, got %v", err)
+	}
+}
+
+func TestLshValidation(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inpVecs, trainIds := getTestLSHData()
+	err = lsh.Train(append(inpVecs, []float64{1.0}), append(trainIds, "short"))
+	if !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("Expected ErrDimMismatch, got %v", err)
+	}
+	err = lsh.Train(append(inpVecs, []float64{math.NaN(), 1.0}), append(trainIds, "nan"))
+	if !errors.Is(err, ErrInvalidVector) {
+		t.Fatalf("Expected ErrInvalidVector, got %v", err)
+	}
+	err = lsh.Train(inpVecs, trainIds[1:])
+	if err == nil {
+		t.Fatal("Train must fail when ids number differs from vectors number")
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Search([]float64{math.Inf(1), 0.0}, 4, 1.0)
+	if !errors.Is(err, ErrInvalidVector) {
+		t.Fatalf("Expected ErrInvalidVector, got %v", err)
+	}
+}
+
+func TestLshTunableParams(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsh.SetBatchSize(0) == nil || lsh.SetMaxCandidates(-1) == nil {
+		t.Fatal("Non-positive parameters must be rejected")
+	}
+	config.IndexConfig.BatchSize = 0
+	_, err = NewLsh(config, kv.NewKVStore(), NewL2())
+	if !errors.Is(err, batchSizeErr) {
+		t.Fatalf("Expected error %v, got %v", batchSizeErr, err)
+	}
+	err = lsh.SetBatchSize(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.SetMaxCandidates(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err := lsh.Search(inpVecs[0], 4, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 {
+		t.Fatalf("Expected single neighbor with MaxCandidates = 1, got %v", len(nns))
+	}
+	nns, err = lsh.SearchWithOpts(inpVecs[0], SearchOpts{
+		MaxNN:         4,
+		DistanceThrsh: 0.02,
+		MaxCandidates: 10,
+		NProbes:       3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) < 3 {
+		t.Fatalf("Per-query MaxCandidates must override the config value, got %v neighbors", len(nns))
+	}
+}
+
+func TestFitStandardScaler(t *testing.T) {
+	t.Parallel()
+	vecs := [][]float64{
+		[]float64{1.0, 5.0},
+		[]float64{3.0, 5.0},
+		[]float64{5.0, 5.0},
+		[]float64{7.0, 5.0},
+	}
+	mean, std, err := GetMeanStdStreaming(NewSliceIterator(vecs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(mean[0]-4.0) > tol || math.Abs(mean[1]-5.0) > tol {
+		t.Errorf("Wrong mean: %v", mean)
+	}
+	if math.Abs(std[0]-math.Sqrt(5.0)) > tol || math.Abs(std[1]) > tol {
+		t.Errorf("Wrong std: %v", std)
+	}
+	_, _, err = GetMeanStdStreaming(NewSliceIterator(nil))
+	if err == nil {
+		t.Error("Stats of empty data must not be calculated")
+	}
+	scaler, err := FitStandardScaler(NewSliceIterator(vecs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scaled := scaler.Scale([]float64{4.0 + math.Sqrt(5.0), 6.0})
+	if math.Abs(scaled.Data[0]-1.0) > tol || math.Abs(scaled.Data[1]-1.0) > tol {
+		t.Errorf("Wrong scaled vector: %v", scaled.Data)
+	}
+}
+
+func TestVersionedIndex(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	vi := NewVersionedIndex(func() (*LSHIndex, error) {
+		return NewLsh(config, kv.NewKVStore(), NewL2())
+	})
+	_, err := vi.Search([]float64{0.1, 0.1}, 1, 0.01)
+	if !errors.Is(err, ErrNotTrained) {
+		t.Fatalf("Expected ErrNotTrained, got %v", err)
+	}
+	err = vi.Train([][]float64{{0.1, 0.1}, {-0.1, 0.1}}, []string{"v1", "v1_far"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := vi.BuildVersion([][]float64{{0.1, 0.1}, {-0.1, 0.1}}, []string{"v2", "v2_far"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err := vi.Search([]float64{0.1, 0.1}, 1, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != "v1" {
+		t.Fatalf("Not promoted version must not be served, got %v", nns)
+	}
+	err = vi.PromoteVersion(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err = vi.Search([]float64{0.1, 0.1}, 1, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != "v2" {
+		t.Fatalf("Promoted version must be served, got %v", nns)
+	}
+	if vi.DropVersion(v2) == nil {
+		t.Fatal("Serving version must not be dropped")
+	}
+	err = vi.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := vi.Versions()
+	if len(versions) != 1 || versions[0] != v2 {
+		t.Fatalf("Only serving version must be kept, got %v", versions)
+	}
+
+	// NOTE: searches running on the dropped version must finish before its' store is cleared
+	blocking := &blockingStore{
+		KVStore: kv.NewKVStore(),
+		blocked: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	vi.factory = func() (*LSHIndex, error) {
+		return NewLsh(config, blocking, NewL2())
+	}
+	v3, err := vi.BuildVersion([][]float64{{0.1, 0.1}, {-0.1, 0.1}}, []string{"v3", "v3_far"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vi.PromoteVersion(v3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&blocking.block, 1)
+	searched := make(chan []Neighbor)
+	go func() {
+		nns, err := vi.Search([]float64{0.1, 0.1}, 1, 0.01)
+		if err != nil {
+			t.Error(err)
+		}
+		searched <- nns
+	}()
+	<-blocking.blocked
+	err = vi.PromoteVersion(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := make(chan error)
+	go func() {
+		dropped <- vi.DropVersion(v3)
+	}()
+	select {
+	case <-dropped:
+		t.Fatal("Version must not be dropped while it's searched")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(blocking.release)
+	nns, err = <-searched, <-dropped
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != "v3" {
+		t.Fatalf("In-flight search must see the whole dropped version, got %v", nns)
+	}
+}
+
+// blockingStore blocks bucket reads once block is set, until release is closed
+type blockingStore struct {
+	*kv.KVStore
+	block   int32
+	once    sync.Once
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) GetHashIterator(bucket uint64) (store.Iterator, error) {
+	if atomic.LoadInt32(&s.block) == 1 {
+		s.once.Do(func() { close(s.blocked) })
+		<-s.release
+	}
+	return s.KVStore.GetHashIterator(bucket)
+}
+
+func TestLshWarmup(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Warmup(inpVecs[:1])
+	if !errors.Is(err, ErrNotTrained) {
+		t.Fatalf("Expected ErrNotTrained, got %v", err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := lsh.Warmup(inpVecs[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched < 2 || fetched > len(inpVecs) {
+		t.Fatalf("Warmup must fetch at least the query points themselves, got %v", fetched)
+	}
+}
+
+func TestLshDelete(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(lsh.Delete("unknown"), ErrNotFound) {
+		t.Fatal("Deleting unknown vector must return ErrNotFound")
+	}
+	for i := 0; i < 2; i++ {
+		err = lsh.Delete(trainIds[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if changes := lsh.Changes(); changes.Deleted != 1 {
+		t.Fatalf("Repeated delete must be a no-op, got %+v", changes)
+	}
+	nns, err := lsh.Search(inpVecs[0], 4, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 0 {
+		t.Fatalf("Deleted vector must not be returned, got %v", nns)
+	}
+	if lsh.CompactionStats().Pending != 1 {
+		t.Fatal("Deleted vector must wait for compaction")
+	}
+	restarted, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.hasher = lsh.hasher
+	nns, err = restarted.Search(inpVecs[0], 4, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 0 || restarted.CompactionStats().Pending != 1 {
+		t.Fatalf("Tombstones must be kept in the store, got %v", nns)
+	}
+
+	stop := lsh.StartCompaction(time.Millisecond)
+	defer stop()
+	for i := 0; i < 1000 && lsh.CompactionStats().Pending > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	stats := lsh.CompactionStats()
+	if stats.Pending != 0 || stats.Compacted != 1 {
+		t.Fatalf("Deleted vector must be compacted, got %+v", stats)
+	}
+	_, err = s.GetVector(trainIds[0])
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatal("Compacted vector must be removed from the store")
+	}
+	for perm, hash := range lsh.hasher.getHashes(inpVecs[0]) {
+		iter, err := s.GetHashIterator(getBucketKey(perm, hash))
+		if err != nil {
+			continue
+		}
+		for {
+			id, opened := iter.Next()
+			if !opened {
+				break
+			}
+			if id == trainIds[0] {
+				t.Fatal("Compacted vector must be removed from the buckets")
+			}
+		}
+	}
+}
+
+func TestLshVerify(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			CacheSize:     2,
+			CacheTTL:      time.Minute,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := lsh.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsConsistent() || report.Vectors != len(inpVecs) {
+		t.Fatalf("Freshly trained index must be consistent, got %+v", report)
+	}
+
+	nns, err := lsh.Search(inpVecs[1], 1, 0.001)
+	if err != nil || len(nns) != 1 {
+		t.Fatalf("Expected %v to be found, got %v, %v", trainIds[1], nns, err)
+	}
+	// NOTE: cached result must not outlive the repaired vector
+	s.SetVector(trainIds[1], []float64{1.0})
+	s.SetHash(getBucketKey(0, 0), "orphan")
+	s.SetVector("wrong_dims", []float64{1.0})
+	s.SetHash(getBucketKey(1, 0), "wrong_dims")
+	missingBucket := getBucketKey(1, lsh.hasher.getHashes(inpVecs[0])[1])
+	s.DeleteHash(missingBucket, trainIds[0])
+
+	report, err = lsh.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanedEntries) != 1 || len(report.MissingEntries) != 1 || len(report.DimMismatches) != 2 ||
+		len(report.StaleEntries) != 6 {
+		t.Fatalf("Inconsistencies must be found, got %+v", report)
+	}
+	if !report.Repaired {
+		t.Fatal("Inconsistencies must be repaired")
+	}
+	report, err = lsh.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsConsistent() {
+		t.Fatalf("Repaired index must be consistent, got %+v", report)
+	}
+	nns, err = lsh.Search(inpVecs[1], 1, 0.001)
+	if err != nil || len(nns) != 0 {
+		t.Fatalf("Removed vector must not be returned, got %v, %v", nns, err)
+	}
+}
+
+func TestLshVerifyBFloat16(t *testing.T) {
+	t.Parallel()
+	const n, dims = 500, 16
+	rnd := rand.New(rand.NewSource(7))
+	vecs := make([][]float64, n)
+	ids := make([]string, n)
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rnd.NormFloat64()
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     50,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 10,
+			Dims:     dims,
+		},
+	}
+	s := kv.NewKVStoreWithConfig(kv.Config{Encoding: kv.BFloat16Encoding})
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Insert("inserted", vecs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := lsh.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsConsistent() {
+		t.Fatalf("Index must hash vectors as they are stored, got %v missing and %v orphaned entries",
+			len(report.MissingEntries), len(report.OrphanedEntries))
+	}
+	for _, id := range append(ids, "inserted") {
+		err = lsh.Delete(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = lsh.CompactNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := s.GetBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := buckets.Next(); ok {
+		t.Fatal("All postings must be removed along with the vectors")
+	}
+}
+
+func TestLshBackfill(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for perm, hash := range lsh.hasher.getHashes(inpVecs[0]) {
+		s.DeleteHash(getBucketKey(perm, hash), trainIds[0])
+	}
+	s.DeleteHash(getBucketKey(2, lsh.hasher.getHashes(inpVecs[1])[2]), trainIds[1])
+	s.SetHash(getBucketKey(0, 0), "orphan")
+
+	report, err := lsh.Backfill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Vectors != len(inpVecs) || report.Backfilled != 2 || report.Entries != 6 {
+		t.Fatalf("Expected 6 entries of 2 vectors to be backfilled, got %+v", report)
+	}
+	verified, err := lsh.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verified.MissingEntries) != 0 || len(verified.OrphanedEntries) != 1 {
+		t.Fatalf("Backfill must add missing entries only, got %+v", verified)
+	}
+	report, err = lsh.Backfill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Backfilled != 0 || report.Entries != 0 {
+		t.Fatalf("Nothing must be backfilled twice, got %+v", report)
+	}
+}
+
+func TestShadowIndex(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	primary, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.HasherConfig.NTrees = 2
+	shadow, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := NewShadowIndex(primary, shadow, 1.0, 16, 2)
+	defer si.Close()
+	err = si.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserted := []float64{0.5, 0.5}
+	_, err = si.Insert("inserted", inserted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = si.Delete(trainIds[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vec := range [][]float64{inpVecs[0], inpVecs[1], inserted} {
+		nns, err := si.Search(vec, 1, 0.001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nns) != 1 {
+			t.Fatalf("Query point must be found by the primary index, got %v", nns)
+		}
+	}
+	si.Wait()
+	stats := si.Stats()
+	if stats.Queries != 3 || stats.Compared != 3 || stats.ShadowErrors != 0 {
+		t.Fatalf("All queries must be compared, got %+v", stats)
+	}
+	if math.Abs(stats.MeanOverlap-1.0) > tol {
+		t.Fatalf("Both indexes must find the query points, got overlap %v", stats.MeanOverlap)
+	}
+	nns, err := shadow.Search(inpVecs[2], 1, 0.001)
+	if err != nil || len(nns) != 0 {
+		t.Fatalf("Delete must be mirrored to the shadow index, got %v, %v", nns, err)
+	}
+	// NOTE: queries may be enqueued while Wait is blocked
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				si.Search(inpVecs[0], 1, 0.001)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				si.Wait()
+			}
+		}()
+	}
+	wg.Wait()
+	si.Wait()
+	stats = si.Stats()
+	if stats.Compared+stats.Dropped+stats.ShadowErrors != stats.Queries {
+		t.Fatalf("All sampled queries must be finished after Wait, got %+v", stats)
+	}
+
+	// NOTE: single worker is blocked, so only one query can wait in the queue
+	blocked := &blockingIndexer{release: make(chan struct{})}
+	si = NewShadowIndex(primary, blocked, 1.0, 1, 1)
+	for i := 0; i < 3; i++ {
+		_, err := si.Search(inpVecs[0], 1, 0.001)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(blocked.release)
+	si.Close()
+	stats = si.Stats()
+	if stats.Dropped == 0 || stats.Compared+stats.Dropped != 3 {
+		t.Fatalf("Queries must be dropped when the queue is full, got %+v", stats)
+	}
+}
+
+type blockingIndexer struct {
+	release chan struct{}
+}
+
+func (b *blockingIndexer) Train(vecs [][]float64, ids []string) error {
+	return nil
+}
+
+func (b *blockingIndexer) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	<-b.release
+	return nil, nil
+}
+
+func TestLshCache(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:      2,
+			MaxCandidates:  10,
+			CacheSize:      2,
+			CacheTTL:       time.Minute,
+			CachePrecision: 0.001,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, stats, err := lsh.SearchWithStats(inpVecs[0], 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheHit || len(nns) != 1 {
+		t.Fatalf("First search must not hit the cache, got %v %+v", nns, stats)
+	}
+	cached, stats, err := lsh.SearchWithStats([]float64{0.1001, 0.0999}, 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.CacheHit || len(cached) != 1 || cached[0].ID != nns[0].ID {
+		t.Fatalf("Close query must hit the cache, got %v %+v", cached, stats)
+	}
+	err = lsh.Delete(nns[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, stats, err = lsh.SearchWithStats(inpVecs[0], 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheHit || len(nns) != 0 {
+		t.Fatalf("Cache must be invalidated after delete, got %v %+v", nns, stats)
+	}
+}
+
+func TestLshFindDuplicates(t *testing.T) {
+	t.Parallel()
+	vecs := [][]float64{
+		[]float64{0.1, 0.1},
+		[]float64{0.1, 0.1001},
+		[]float64{0.1001, 0.1},
+		[]float64{-0.1, 0.1},
+		[]float64{-0.1, 0.1001},
+		[]float64{0.0, -0.1},
+	}
+	ids := []string{"a1", "a2", "a3", "b1", "b2", "c"}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 3,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters := make([][]string, 0)
+	err = lsh.FindDuplicates(0.001, func(cluster []string) bool {
+		clusters = append(clusters, cluster)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i][0] < clusters[j][0]
+	})
+	if len(clusters) != 2 || len(clusters[0]) != 3 || clusters[0][0] != "a1" || len(clusters[1]) != 2 || clusters[1][0] != "b1" {
+		t.Fatalf("Expected two clusters of near-duplicates, got %v", clusters)
+	}
+	emitted := 0
+	err = lsh.FindDuplicates(0.001, func(cluster []string) bool {
+		emitted++
+		return false
+	})
+	if err != nil || emitted != 1 {
+		t.Fatalf("Search must stop after emit returns false, got %v clusters, %v", emitted, err)
+	}
+
+	// NOTE: chained vectors, the ends are too far from each other to be duplicates
+	chain := [][]float64{
+		[]float64{0.5, 0.5},
+		[]float64{0.5, 0.5008},
+		[]float64{0.5, 0.5016},
+		[]float64{-0.5, 0.5},
+		[]float64{0.0, -0.5},
+	}
+	lsh, err = NewLsh(config, missingBucketStore{kv.NewKVStore()}, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(chain, []string{"x0", "x1", "x2", "y", "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters = clusters[:0]
+	err = lsh.FindDuplicates(0.001, func(cluster []string) bool {
+		clusters = append(clusters, cluster)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || len(clusters[0]) != 2 {
+		t.Fatalf("Expected single pair of duplicates out of the chain, got %v", clusters)
+	}
+}
+
+// missingBucketStore has lost all buckets of the first permutation
+type missingBucketStore struct {
+	*kv.KVStore
+}
+
+func (s missingBucketStore) GetHashIterator(bucket uint64) (store.Iterator, error) {
+	if perm, _ := store.UnpackBucketKey(bucket); perm == 0 {
+		return nil, store.ErrNotFound
+	}
+	return s.KVStore.GetHashIterator(bucket)
+}
+
+func TestLshJoin(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:         2,
+			MaxCandidates:     10,
+			SearchParallelism: 2,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	left, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = left.Train([][]float64{{0.1, 0.1}, {-0.1, 0.1}, {0.0, -0.1}}, []string{"l1", "l2", "l3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = right.Train([][]float64{{0.1, 0.1001}, {-0.1, 0.1001}, {5.0, 5.0}}, []string{"r1", "r2", "r3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := make(map[string]string)
+	err = left.Join(right, 1, 0.001, func(pair JoinPair) bool {
+		matches[pair.LeftID] = pair.RightID
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches["l1"] != "r1" || matches["l2"] != "r2" {
+		t.Fatalf("Wrong matched pairs: %v", matches)
+	}
+	emitted := 0
+	err = left.Join(right, 1, 0.001, func(pair JoinPair) bool {
+		emitted++
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emitted != 1 {
+		t.Fatalf("Join must stop after emit returns false, got %v pairs", emitted)
+	}
+
+	// NOTE: stored vectors are transformed, so they must not be transformed again
+	config.IndexConfig.Pipeline = &Pipeline{Scaler: NewStandartScaler([]float64{1, 1}, []float64{2, 2}, 2)}
+	for _, index := range []**LSHIndex{&left, &right} {
+		*index, err = NewLsh(config, kv.NewKVStore(), NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = left.Train([][]float64{{0.1, 0.1}, {-0.1, 0.1}, {0.0, -0.1}}, []string{"l1", "l2", "l3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = right.Train([][]float64{{0.1, 0.1001}, {-0.1, 0.1001}, {5.0, 5.0}}, []string{"r1", "r2", "r3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches = make(map[string]string)
+	err = left.Join(right, 1, 0.001, func(pair JoinPair) bool {
+		matches[pair.LeftID] = pair.RightID
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches["l1"] != "r1" || matches["l2"] != "r2" {
+		t.Fatalf("Wrong matched pairs of the transformed vectors: %v", matches)
+	}
+	err = left.Join(fixedIndexer{}, 1, 0.001, func(pair JoinPair) bool {
+		return true
+	})
+	if !errors.Is(err, ErrPipelineMismatch) {
+		t.Fatalf("Expected error %v, got %v", ErrPipelineMismatch, err)
+	}
+}
+
+type fixedIndexer []Neighbor
+
+func (f fixedIndexer) Train(vecs [][]float64, ids []string) error {
+	return nil
+}
+
+func (f fixedIndexer) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	return f, nil
+}
+
+func TestKNNClassifier(t *testing.T) {
+	t.Parallel()
+	index := fixedIndexer{
+		{ID: "1", Dist: 0.1},
+		{ID: "2", Dist: 0.5},
+		{ID: "3", Dist: 0.6},
+		{ID: "4", Dist: 0.7},
+	}
+	labels := map[string]string{"1": "spam", "2": "ham", "3": "ham"}
+	lookup := func(id string) (string, bool) {
+		label, ok := labels[id]
+		return label, ok
+	}
+	label, share, err := NewKNNClassifier(index, lookup, 4, 1.0, MajorityVote).Predict(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label != "ham" || math.Abs(share-2.0/3.0) > tol {
+		t.Fatalf("Expected majority vote for `ham`, got %v with share %v", label, share)
+	}
+	label, _, err = NewKNNClassifier(index, lookup, 4, 1.0, DistanceWeightedVote).Predict(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label != "spam" {
+		t.Fatalf("Expected weighted vote for `spam`, got %v", label)
+	}
+	_, _, err = NewKNNClassifier(fixedIndexer{}, lookup, 4, 1.0, MajorityVote).Predict(nil)
+	if !errors.Is(err, ErrNoNeighbors) {
+		t.Fatalf("Expected ErrNoNeighbors, got %v", err)
+	}
+}
+
+func TestLshGroupBy(t *testing.T) {
+	t.Parallel()
+	vecs := [][]float64{
+		[]float64{0.1, 0.1},
+		[]float64{0.1, 0.1001},
+		[]float64{0.1, 0.1002},
+		[]float64{0.1, 0.1003},
+		[]float64{-0.1, -0.1},
+	}
+	ids := []string{"a1", "a2", "b1", "b2", "c"}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 3,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[:4] {
+		err = lsh.SetMeta(id, map[string]string{"seller": id[:1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	nns, err := lsh.SearchWithOpts(vecs[0], SearchOpts{MaxNN: 3, DistanceThrsh: 0.01, GroupBy: "seller", MaxPerGroup: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 2 || nns[0].ID != "a1" || nns[1].ID != "b1" {
+		t.Fatalf("Expected one neighbor per seller, got %v", nns)
+	}
+	err = lsh.SetMeta("missing", map[string]string{"seller": "a"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for missing vector, got %v", err)
+	}
+}
+
+func TestLshMMR(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := []*Neighbor{
+		{ID: "a1", Vec: []float64{0.1, 0.1}, Dist: 0.0},
+		{ID: "a2", Vec: []float64{0.1, 0.101}, Dist: 0.001},
+		{ID: "a3", Vec: []float64{0.101, 0.1}, Dist: 0.001},
+		{ID: "d", Vec: []float64{0.12, 0.12}, Dist: 0.028},
+	}
+	ordered := lsh.mmr(candidates, 0.3, 4)
+	if len(ordered) != 4 || ordered[0].ID != "a1" || ordered[1].ID != "d" {
+		t.Fatalf("Distinct candidate must be promoted, got %v", ordered)
+	}
+	ordered = lsh.mmr(candidates, 1.0, 4)
+	if ordered[1].ID != "a2" {
+		t.Fatalf("Lambda 1 must keep relevance order, got %v", ordered)
+	}
+	ordered = lsh.mmr(candidates, 0.3, 2)
+	if len(ordered) != 2 || ordered[1].ID != "d" {
+		t.Fatalf("Only the requested number of candidates must be picked, got %v", ordered)
+	}
+}
+
+// countingMetric counts calculated distances, it isn't BatchMetric, so batches are counted too
+type countingMetric struct {
+	l2    L2
+	dists *int64
+}
+
+func (m countingMetric) GetDist(l, r []float64) float64 {
+	atomic.AddInt64(m.dists, 1)
+	return m.l2.GetDist(l, r)
+}
+
+func (m countingMetric) IsAngular() bool {
+	return false
+}
+
+func TestLshMMRLargePool(t *testing.T) {
+	t.Parallel()
+	const n, dims, maxNN = 2000, 4, 5
+	rnd := rand.New(rand.NewSource(3))
+	vecs := make([][]float64, n)
+	ids := make([]string, n)
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rnd.NormFloat64() * 0.01
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: n,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   1,
+			KMinVecs: n,
+			Dims:     dims,
+		},
+	}
+	var dists int64
+	lsh, err := NewLsh(config, kv.NewKVStore(), countingMetric{l2: NewL2(), dists: &dists})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&dists, 0)
+	closest, err := lsh.SearchWithOpts(vecs[0], SearchOpts{MaxNN: maxNN, DistanceThrsh: math.Inf(1), MMRLambda: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closest) != maxNN {
+		t.Fatalf("Expected %v neighbors, got %v", maxNN, closest)
+	}
+	// NOTE: probing calculates a distance per candidate, MMR only a row per pick over its' pool
+	if calculated := atomic.LoadInt64(&dists); calculated > n+maxNN*maxNN*mmrPoolFactor {
+		t.Fatalf("MMR must not calculate distances between all the candidates, got %v", calculated)
+	}
+}
+
+func TestLshSearchMulti(t *testing.T) {
+	t.Parallel()
+	vecs := [][]float64{
+		[]float64{0.1, 0.1},
+		[]float64{0.1, 0.12},
+		[]float64{0.1, 0.11},
+		[]float64{0.1, 0.2},
+		[]float64{-0.1, -0.1},
+	}
+	ids := []string{"a", "b", "m", "f", "o"}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 3,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := [][]float64{vecs[0], vecs[1]}
+	nns, err := lsh.SearchMulti(queries, AvgQuery, 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != "m" {
+		t.Fatalf("Expected the middle point for the mean query, got %v", nns)
+	}
+	nns, err = lsh.SearchMulti(queries, AnyQuery, 2, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 2 || nns[0].ID != "a" || nns[1].ID != "b" {
+		t.Fatalf("Expected the query points themselves, got %v", nns)
+	}
+	nns, err = lsh.SearchMulti(queries, AllQueries, 10, 0.011)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 3 {
+		t.Fatalf("Expected points close to both queries on average, got %v", nns)
+	}
+	_, err = lsh.SearchMulti(nil, AnyQuery, 1, 0.001)
+	if err == nil {
+		t.Fatal("Expected error on empty queries")
+	}
+}
+
+func TestLshNegativeVecs(t *testing.T) {
+	t.Parallel()
+	vecs := [][]float64{
+		[]float64{0.1, 0.1},
+		[]float64{0.1, 0.11},
+		[]float64{0.11, 0.1},
+		[]float64{-0.1, -0.1},
+	}
+	ids := []string{"q", "up", "right", "o"}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			RerankSize:    10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 3,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := SearchOpts{
+		MaxNN:          3,
+		DistanceThrsh:  0.02,
+		NegativeVecs:   [][]float64{{0.1, 0.2}},
+		NegativeWeight: 1.0,
+	}
+	nns, err := lsh.SearchWithOpts(vecs[0], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 3 || nns[1].ID != "right" || nns[2].ID != "up" {
+		t.Fatalf("Neighbor close to the negative example must be demoted, got %v", nns)
+	}
+	opts.NegativeVecs = [][]float64{{0.1}}
+	_, err = lsh.SearchWithOpts(vecs[0], opts)
+	if !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("Expected ErrDimMismatch for malformed negative vector, got %v", err)
+	}
+}
+
+func TestLshScorer(t *testing.T) {
+	t.Parallel()
+	vecs := [][]float64{
+		[]float64{0.1, 0.1},
+		[]float64{0.1, 0.11},
+		[]float64{0.11, 0.1},
+		[]float64{-0.1, -0.1},
+	}
+	ids := []string{"q", "up", "right", "o"}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			CacheSize:     10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 3,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.SetMeta("up", map[string]string{"boost": "yes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := SearchOpts{
+		MaxNN:         3,
+		DistanceThrsh: 0.02,
+		Scorer: func(dist float64, meta map[string]string) float64 {
+			if meta["boost"] == "yes" {
+				return dist - 1
+			}
+			return dist
+		},
+	}
+	for i := 0; i < 2; i++ {
+		nns, err := lsh.SearchWithOpts(vecs[0], opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nns) != 3 || nns[0].ID != "up" || nns[1].ID != "q" {
+			t.Fatalf("Boosted neighbor must go first, got %v", nns)
+		}
+	}
+}
+
+func TestTimeDecayScorer(t *testing.T) {
+	t.Parallel()
+	scorer := TimeDecayScorer("ts", time.Hour)
+	now := time.Now()
+	fresh := scorer(0.5, map[string]string{"ts": strconv.FormatInt(now.Unix(), 10)})
+	if math.Abs(fresh-0.5) > 0.01 {
+		t.Fatalf("Fresh vector must keep its' distance, got %v", fresh)
+	}
+	old := scorer(0.5, map[string]string{"ts": now.Add(-time.Hour).Format(time.RFC3339)})
+	if math.Abs(old-2.0) > 0.01 {
+		t.Fatalf("Similarity must halve after the half-life, got %v", old)
+	}
+	missing := scorer(0.5, nil)
+	if missing != 0.5 {
+		t.Fatalf("Vector without timestamp must keep its' distance, got %v", missing)
+	}
+}
+
+func TestLshInsertIfVersion(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			CacheSize:     10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Insert("new", []float64{0.5, 0.5})
+	if !errors.Is(err, ErrNotTrained) {
+		t.Fatalf("Expected ErrNotTrained, got %v", err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := trainIds[0]
+	version, ok := lsh.RecordVersion(id)
+	if !ok || version != 1 {
+		t.Fatalf("Trained record must have version 1, got %v", version)
+	}
+	nns, err := lsh.Search(inpVecs[0], 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != id {
+		t.Fatalf("Expected %v, got %v", id, nns)
+	}
+	moved := []float64{-0.5, 0.5}
+	version, err = lsh.InsertIfVersion(id, moved, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Fatalf("Expected version 2, got %v", version)
+	}
+	_, err = lsh.InsertIfVersion(id, inpVecs[0], 1)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("Stale write must fail with ErrVersionConflict, got %v", err)
+	}
+	nns, err = lsh.Search(inpVecs[0], 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 0 {
+		t.Fatalf("Replaced vector must not be found by the old value, got %v", nns)
+	}
+	nns, err = lsh.Search(moved, 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != id {
+		t.Fatalf("Expected %v, got %v", id, nns)
+	}
+	report, err := lsh.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsConsistent() {
+		t.Fatalf("Index must stay consistent after insert: %+v", report)
+	}
+	err = lsh.Delete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err = lsh.InsertIfVersion(id, moved, 3)
+	if err != nil || version != 4 {
+		t.Fatalf("Deleted record must be restorable with its' latest version, got %v, %v", version, err)
+	}
+	_, err = lsh.InsertIfVersion("new", []float64{0.5, 0.5}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	var succeeded int32
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := lsh.InsertIfVersion(id, moved, 4)
+			if err == nil {
+				atomic.AddInt32(&succeeded, 1)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			_, err := lsh.Insert(fmt.Sprintf("parallel-%v", i), []float64{0.1 * float64(i), 0.5})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Fatalf("Exactly one of the concurrent conditional writes must succeed, got %v", succeeded)
+	}
+	if changes := lsh.Changes(); changes.Inserted != 12 {
+		t.Fatalf("Expected 12 inserts, got %+v", changes)
+	}
+}
+
+func TestAsyncInserter(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserter := NewAsyncInserter(lsh, 2, 3)
+	vecs := [][]float64{{0.5, 0.5}, {-0.5, 0.5}, {0.5, -0.5}, {-0.5, -0.5}}
+	for i, vec := range vecs {
+		err = inserter.Insert(strconv.Itoa(i), vec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = inserter.Insert("bad", []float64{1})
+	if !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("Expected ErrDimMismatch, got %v", err)
+	}
+	err = inserter.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, vec := range vecs {
+		nns, err := lsh.Search(vec, 1, 0.001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nns) != 1 || nns[0].ID != strconv.Itoa(i) {
+			t.Fatalf("Flushed vector %v must be searchable, got %v", i, nns)
+		}
+	}
+	err = inserter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inserter.Insert("late", []float64{0.5, 0.5})
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+}
+
+type flakyStore struct {
+	*kv.KVStore
+	down  int32
+	delay time.Duration
+	calls int32
+}
+
+func (s *flakyStore) GetVector(id string) ([]float64, error) {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(s.delay)
+	if atomic.LoadInt32(&s.down) == 1 {
+		return nil, errors.New("connection refused")
+	}
+	return s.KVStore.GetVector(id)
+}
+
+func (s *flakyStore) SetVector(id string, vec []float64) error {
+	time.Sleep(s.delay)
+	return s.KVStore.SetVector(id, vec)
+}
+
+func TestBreakerStore(t *testing.T) {
+	t.Parallel()
+	flaky := &flakyStore{KVStore: kv.NewKVStore(), down: 1}
+	flaky.SetVector("0", []float64{1, 2})
+	s := newBreakerStore(flaky, 2, 50*time.Millisecond, 0)
+	for i := 0; i < 2; i++ {
+		_, err := s.GetVector("0")
+		if err == nil || errors.Is(err, ErrStoreUnavailable) {
+			t.Fatalf("Expected store error before the breaker opens, got %v", err)
+		}
+	}
+	_, err := s.GetVector("0")
+	if !errors.Is(err, ErrStoreUnavailable) || atomic.LoadInt32(&flaky.calls) != 2 {
+		t.Fatalf("Open breaker must fail fast with ErrStoreUnavailable, got %v", err)
+	}
+	atomic.StoreInt32(&flaky.down, 0)
+	time.Sleep(60 * time.Millisecond)
+	_, err = s.GetVector("0")
+	if err != nil {
+		t.Fatalf("Trial call after cooldown must pass, got %v", err)
+	}
+	_, err = s.GetVector("1")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	slow := &flakyStore{KVStore: kv.NewKVStore(), delay: 50 * time.Millisecond}
+	s = newBreakerStore(slow, 1, time.Minute, time.Millisecond)
+	_, err = s.GetVector("0")
+	if !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("Expected ErrStoreUnavailable on timeout, got %v", err)
+	}
+	s = newBreakerStore(slow, 1, time.Minute, time.Millisecond)
+	err = s.SetVector("0", []float64{1, 2})
+	if err != nil {
+		t.Fatalf("Writes must not be timed out, got %v", err)
+	}
+}
+
+type reconnectingStore struct {
+	*flakyStore
+	reconnects int32
+}
+
+func (s *reconnectingStore) Ping() error {
+	if atomic.LoadInt32(&s.down) == 1 {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (s *reconnectingStore) Reconnect() error {
+	atomic.AddInt32(&s.reconnects, 1)
+	atomic.StoreInt32(&s.down, 0)
+	return nil
+}
+
+func TestLshHealthChecks(t *testing.T) {
+	t.Parallel()
+	s := &reconnectingStore{flakyStore: &flakyStore{KVStore: kv.NewKVStore()}}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:       2,
+			MaxCandidates:   10,
+			BreakerFailures: 1,
+			BreakerCooldown: time.Minute,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   1,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lsh.Healthy() || lsh.Ping() != nil {
+		t.Fatal("Index must be healthy while the store is up")
+	}
+	atomic.StoreInt32(&s.down, 1)
+	if lsh.Ping() == nil || lsh.Healthy() {
+		t.Fatal("Index must be unhealthy after the failed ping")
+	}
+	// NOTE: the failed store call opens the breaker, successful reconnect must close it
+	_, err = lsh.index.GetVector("0")
+	if err == nil {
+		t.Fatal("Expected store error while the store is down")
+	}
+	stop := lsh.StartHealthChecks(10 * time.Millisecond)
+	defer stop()
+	time.Sleep(50 * time.Millisecond)
+	status := lsh.Health()
+	if !status.Healthy || status.Reconnects != 1 || atomic.LoadInt32(&s.reconnects) != 1 {
+		t.Fatalf("Health checks must reconnect the store once, got %+v", status)
+	}
+	_, err = lsh.index.GetVector("0")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound after the breaker is closed, got %v", err)
+	}
+}
+
+// appendOnlyStore hides all the optional interfaces of the wrapped store
+type appendOnlyStore struct {
+	store.Store
+}
+
+func TestLshDeleteNotSupported(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			Tracer:        testTracer{spans: NewStringSet()},
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, appendOnlyStore{kv.NewKVStore()}, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Insert("new", inpVecs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Insert("new", inpVecs[1])
+	if !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Replacing vector must need deletes support, got %v", err)
+	}
+	if !errors.Is(lsh.Delete(trainIds[0]), ErrNotSupported) {
+		t.Fatal("Delete must need deletes support")
+	}
+	_, err = lsh.CompactNow()
+	if !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Compaction must need deletes support, got %v", err)
+	}
+}
+
+func TestLshReadOnly(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := kv.NewKVStore()
+	writer, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ReadOnly = true
+	replica, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica.hasher = writer.hasher
+	nns, err := replica.Search(inpVecs[0], 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != trainIds[0] {
+		t.Fatalf("Expected %v, got %v", trainIds[0], nns)
+	}
+	errs := []error{
+		replica.Train(inpVecs, trainIds),
+		replica.Delete(trainIds[0]),
+		replica.SetMaxCandidates(5),
+		replica.SetMeta(trainIds[0], nil),
+	}
+	_, err = replica.Insert("new", inpVecs[0])
+	errs = append(errs, err)
+	_, err = replica.CompactNow()
+	errs = append(errs, err)
+	for i, err := range errs {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Write %v must fail with ErrReadOnly, got %v", i, err)
+		}
+	}
+	err = writer.Delete(trainIds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err = replica.Search(inpVecs[0], 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 0 {
+		t.Fatalf("Replica must skip vectors deleted by the writer, got %v", nns)
+	}
+}
+
+func TestLshHashStats(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.HashStats(2)
+	if !errors.Is(err, ErrNotTrained) {
+		t.Fatalf("Expected ErrNotTrained, got %v", err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.HashStats(-1)
+	if err == nil {
+		t.Fatal("Negative number of top buckets must be rejected")
+	}
+	stats, err := lsh.HashStats(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != config.NTrees {
+		t.Fatalf("Expected stats for %v permutations, got %v", config.NTrees, len(stats))
+	}
+	for _, permStats := range stats {
+		if permStats.Entries != len(trainIds) || permStats.DistinctHashes > permStats.Leaves {
+			t.Fatalf("Wrong entries or hashes count: %+v", permStats)
+		}
+		if len(permStats.TopBuckets) > 2 || permStats.TopBuckets[0].Size < permStats.TopBuckets[len(permStats.TopBuckets)-1].Size {
+			t.Fatalf("Top buckets must be sorted by size: %+v", permStats.TopBuckets)
+		}
+		if permStats.ObservedCollisionRate <= 0 || permStats.ObservedCollisionRate > 1 || permStats.ExpectedCollisionRate <= 0 {
+			t.Fatalf("Wrong collision rates: %+v", permStats)
+		}
+	}
+}
+
+func TestPagedBitset(t *testing.T) {
+	t.Parallel()
+	b := newPagedBitset()
+	for _, key := range []uint64{0, 63, 64, 4095, 4096, 1 << 40} {
+		if b.testAndSet(key) {
+			t.Fatalf("Key %v must not be set yet", key)
+		}
+		if !b.testAndSet(key) {
+			t.Fatalf("Key %v must be set", key)
+		}
+	}
+	if len(b.pages) != 3 {
+		t.Fatalf("Expected 3 allocated pages, got %v", len(b.pages))
+	}
+}
+
+func getRandomNeighbors(n int) []*Neighbor {
+	items := make([]*Neighbor, n)
+	for i := range items {
+		// NOTE: repeated distances check ordering by id
+		items[i] = &Neighbor{ID: strconv.Itoa(i), Dist: float64(rand.Intn(n / 2))}
+	}
+	return items
+}
+
+func TestSelectClosest(t *testing.T) {
+	t.Parallel()
+	for _, k := range []int{0, 1, 10, 500, 999, 1000, 2000} {
+		items := getRandomNeighbors(1000)
+		expected := make([]*Neighbor, len(items))
+		copy(expected, items)
+		sortNeighborsPtrs(expected)
+		if k < len(expected) {
+			expected = expected[:k]
+		}
+		selected := selectClosest(items, k)
+		if len(selected) != len(expected) {
+			t.Fatalf("k=%v: expected %v items, got %v", k, len(expected), len(selected))
+		}
+		for i := range expected {
+			if selected[i] != expected[i] {
+				t.Fatalf("k=%v: wrong item at %v: expected %v, got %v", k, i, *expected[i], *selected[i])
+			}
+		}
+	}
+}
+
+func TestLshLargeMaxNN(t *testing.T) {
+	t.Parallel()
+	vecs := make([][]float64, 2000)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = []float64{rand.Float64(), rand.Float64()}
+		ids[i] = strconv.Itoa(i)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: len(vecs),
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   1,
+			KMinVecs: len(vecs), // NOTE: single bucket, so every vector is a candidate
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := []float64{0.5, 0.5}
+	maxNN := 2 * selectThreshold
+	closest, err := lsh.Search(query, maxNN, math.Inf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]Neighbor, len(vecs))
+	for i, vec := range vecs {
+		expected[i] = Neighbor{ID: ids[i], Vec: vec, Dist: NewL2().GetDist(query, vec)}
+	}
+	SortNeighbors(expected)
+	if len(closest) != maxNN {
+		t.Fatalf("Expected %v neighbors, got %v", maxNN, len(closest))
+	}
+	for i := range closest {
+		if closest[i].ID != expected[i].ID {
+			t.Fatalf("Wrong neighbor at %v: expected %v, got %v", i, expected[i].ID, closest[i].ID)
+		}
+	}
+}
+
+func benchmarkSelect(b *testing.B, n, k int, selectFn func(items []*Neighbor, k int) []*Neighbor) {
+	items := getRandomNeighbors(n)
+	buf := make([]*Neighbor, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(buf, items)
+		selectFn(buf, k)
+	}
+}
+
+func heapSelect(items []*Neighbor, k int) []*Neighbor {
+	h := new(NeighborMinHeap)
+	for _, item := range items {
+		heap.Push(h, item)
+	}
+	closest := make([]*Neighbor, 0, k)
+	for len(closest) < k && h.Len() > 0 {
+		closest = append(closest, heap.Pop(h).(*Neighbor))
+	}
+	return closest
+}
+
+func BenchmarkHeapSelect(b *testing.B) {
+	benchmarkSelect(b, 100000, 5000, heapSelect)
+}
+
+func BenchmarkQuickSelect(b *testing.B) {
+	benchmarkSelect(b, 100000, 5000, selectClosest)
+}
+
+func BenchmarkHeapSelectSmallK(b *testing.B) {
+	benchmarkSelect(b, 10000, 10, heapSelect)
+}
+
+func BenchmarkQuickSelectSmallK(b *testing.B) {
+	benchmarkSelect(b, 10000, 10, selectClosest)
+}
+
+func TestLshSearchEach(t *testing.T) {
+	t.Parallel()
+	vecs := make([][]float64, 500)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = []float64{rand.Float64(), rand.Float64()}
+		ids[i] = strconv.Itoa(i)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: len(vecs),
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   1,
+			KMinVecs: len(vecs), // NOTE: single bucket, so every vector is a candidate
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := []float64{0.5, 0.5}
+	thr := 0.2
+	t.Run("All", func(t *testing.T) {
+		expected := 0
+		for _, vec := range vecs {
+			if NewL2().GetDist(query, vec) <= thr {
+				expected++
+			}
+		}
+		found := 0
+		err := lsh.SearchEach(query, SearchOpts{DistanceThrsh: thr}, func(nn Neighbor) bool {
+			if nn.Dist > thr {
+				t.Errorf("Neighbor %v is out of threshold", nn)
+			}
+			found++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != expected {
+			t.Fatalf("Expected %v neighbors, got %v", expected, found)
+		}
+	})
+	t.Run("EarlyStop", func(t *testing.T) {
+		found := 0
+		err := lsh.SearchEach(query, SearchOpts{DistanceThrsh: thr}, func(nn Neighbor) bool {
+			found++
+			return false
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != 1 {
+			t.Fatalf("Search must stop after the first neighbor, got %v", found)
+		}
+	})
+	t.Run("MaxNN", func(t *testing.T) {
+		found := 0
+		err := lsh.SearchEach(query, SearchOpts{MaxNN: 3, DistanceThrsh: thr}, func(nn Neighbor) bool {
+			found++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != 3 {
+			t.Fatalf("Expected 3 neighbors, got %v", found)
+		}
+	})
+	t.Run("GroupBy", func(t *testing.T) {
+		err := lsh.SearchEach(query, SearchOpts{GroupBy: "key", MaxPerGroup: 1}, func(nn Neighbor) bool {
+			return true
+		})
+		if !errors.Is(err, streamOptsErr) {
+			t.Fatalf("Expected error %v, got %v", streamOptsErr, err)
+		}
+	})
+}
+
+func TestLshPipeline(t *testing.T) {
+	t.Parallel()
+	vecs, ids := getTestLSHData()
+	scaler := NewStandartScaler([]float64{1, 1}, []float64{2, 2}, 2)
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			Pipeline:      &Pipeline{Scaler: scaler, Normalize: true},
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := lsh.index.GetVector(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(blas64.Nrm2(NewVec(stored))-1) > tol {
+		t.Fatalf("Stored vector must be normalized, got %v", stored)
+	}
+	closest, err := lsh.Search(vecs[0], 1, 1e-6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closest) != 1 || closest[0].ID != ids[0] {
+		t.Fatalf("Query must be transformed the same way as the indexed vectors, got %v", closest)
+	}
+	_, err = lsh.Search([]float64{0.1}, 1, 1)
+	if !errors.Is(err, ErrDimMismatch) {
+		t.Fatalf("Expected error %v, got %v", ErrDimMismatch, err)
+	}
+
+	dump, err := lsh.DumpHasher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.IndexConfig.Pipeline = &Pipeline{Scaler: scaler}
+	serving, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = serving.LoadHasher(dump)
+	if !errors.Is(err, ErrPipelineMismatch) {
+		t.Fatalf("Expected error %v, got %v", ErrPipelineMismatch, err)
+	}
+	_, err = serving.Search(vecs[0], 1, 1)
+	if !errors.Is(err, ErrNotTrained) {
+		t.Fatalf("Expected error %v, got %v", ErrNotTrained, err)
+	}
+
+	err = serving.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = serving.LoadHasher(dump)
+	if !errors.Is(err, ErrPipelineMismatch) {
+		t.Fatalf("Expected error %v, got %v", ErrPipelineMismatch, err)
+	}
+	closest, err = serving.Search(vecs[0], 1, 1e-6)
+	if err != nil {
+		t.Fatalf("Mismatched dump must leave the hasher untouched, got %v", err)
+	}
+	if len(closest) != 1 || closest[0].ID != ids[0] {
+		t.Fatalf("Mismatched dump must leave the hasher untouched, got %v", closest)
+	}
+}
+
+func TestHasherPlanes(t *testing.T) {
+	t.Parallel()
+	config := HasherConfig{
+		NTrees:   3,
+		KMinVecs: 2,
+		Dims:     2,
+	}
+	vecs := make([][]float64, 100)
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64()}
+	}
+	hasher := NewHasher(config)
+	hasher.build(vecs, "")
+	planes := hasher.Planes()
+	if len(planes) < config.NTrees || len(planes[0]) != config.Dims+3 {
+		t.Fatalf("Wrong planes matrix shape: %vx%v", len(planes), len(planes[0]))
+	}
+	transplanted := NewHasher(config)
+	err := transplanted.SetPlanes(planes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vec := range vecs {
+		if !reflect.DeepEqual(hasher.getHashes(vec), transplanted.getHashes(vec)) {
+			t.Fatal("Hashes of the transplanted hasher differ from the original ones")
+		}
+	}
+	if !reflect.DeepEqual(planes, transplanted.Planes()) {
+		t.Fatal("Planes of the transplanted hasher differ from the original ones")
+	}
+
+	b, err := hasher.dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewHasher(HasherConfig{})
+	err = loaded.load(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(planes, loaded.Planes()) {
+		t.Fatal("Planes of the loaded hasher differ from the original ones")
+	}
+
+	planes[0][config.Dims+1] = 0 // NOTE: cycle
+	err = transplanted.SetPlanes(planes)
+	if !errors.Is(err, planesShapeErr) {
+		t.Fatalf("Expected error %v, got %v", planesShapeErr, err)
+	}
+	err = transplanted.SetPlanes(planes[:1])
+	if !errors.Is(err, planesShapeErr) {
+		t.Fatalf("Expected error %v, got %v", planesShapeErr, err)
+	}
+}
+
+func TestNewHasherFromPlanes(t *testing.T) {
+	t.Parallel()
+	config := HasherConfig{
+		NTrees: 2,
+		Dims:   2,
+	}
+	planes := [][]float64{
+		{1, 0},
+		{0, 1},
+		{1, 1, 0.5},
+		{1, -1},
+	}
+	hasher, err := NewHasherFromPlanes(planes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := hasher.getHashes([]float64{-1, 2})
+	// NOTE: bit is set when vector is on the negative side of the plane
+	if hashes[0] != 1 || hashes[1] != 2 {
+		t.Fatalf("Wrong hashes: %v", hashes)
+	}
+	if len(hasher.Planes()) != len(planes) {
+		t.Fatalf("Shared nodes must be exported once, got %v rows", len(hasher.Planes()))
+	}
+	_, err = NewHasherFromPlanes(planes[:3], config)
+	if !errors.Is(err, planesShapeErr) {
+		t.Fatalf("Expected error %v, got %v", planesShapeErr, err)
+	}
+
+	vecs, ids := getTestLSHData()
+	lsh, err := NewLshWithHasher(IndexConfig{BatchSize: 2, MaxCandidates: 10}, hasher, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hasher.getHashes([]float64{-1, 2}), hashes) {
+		t.Fatal("Training must not change fixed planes")
+	}
+	closest, err := lsh.Search(vecs[0], 1, 1e-6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closest) != 1 || closest[0].ID != ids[0] {
+		t.Fatalf("Expected %v, got %v", ids[0], closest)
+	}
+	stats, err := lsh.HashStats(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Leaves != 4 || stats[0].MaxDepth != 2 {
+		t.Fatalf("Expected 4 leaves and depth 2, got %v and %v", stats[0].Leaves, stats[0].MaxDepth)
+	}
+}
+
+func TestLshITQ(t *testing.T) {
+	t.Parallel()
+	centers := [][]float64{{1, 1}, {1, -1}, {-1, 1}, {-1, -1}}
+	vecs := make([][]float64, 0, 400)
+	ids := make([]string, 0, 400)
+	for i := 0; i < 100; i++ {
+		for c, center := range centers {
+			vecs = append(vecs, []float64{center[0] + rand.NormFloat64()*0.05, center[1] + rand.NormFloat64()*0.05})
+			ids = append(ids, strconv.Itoa(c)+"_"+strconv.Itoa(i))
+		}
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: 1000,
+		},
+		HasherConfig: HasherConfig{
+			NTrees: 3,
+			Dims:   2,
+			ITQ:    ITQConfig{Bits: 2},
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: ITQ aligns planes between the clusters, so each cluster gets its' own code
+	for perm := 0; perm < config.NTrees; perm++ {
+		codes := make(map[uint64]int)
+		for i, vec := range vecs {
+			hash := lsh.hasher.getHashes(vec)[perm]
+			cluster := i % len(centers)
+			if c, ok := codes[hash]; ok && c != cluster {
+				t.Fatalf("Clusters %v and %v share the code %v", c, cluster, hash)
+			}
+			codes[hash] = cluster
+		}
+		if len(codes) != len(centers) {
+			t.Fatalf("Expected %v codes, got %v", len(centers), len(codes))
+		}
+	}
+	closest, err := lsh.Search(vecs[0], 1, 1e-6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closest) != 1 || closest[0].ID != ids[0] {
+		t.Fatalf("Expected %v, got %v", ids[0], closest)
+	}
+	config.HasherConfig.ITQ.Bits = 3
+	_, err = NewLsh(config, kv.NewKVStore(), NewL2())
+	if !errors.Is(err, itqBitsErr) {
+		t.Fatalf("Expected error %v, got %v", itqBitsErr, err)
+	}
+}
+
+func TestLshCrossPolytope(t *testing.T) {
+	t.Parallel()
+	vecs := make([][]float64, 200)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()}
+		ids[i] = strconv.Itoa(i)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     50,
+			MaxCandidates: 1000,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:    4,
+			Dims:      4,
+			Scheme:    CrossPolytopeScheme,
+			Rotations: 2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewAngular())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, vec := range vecs[:10] {
+		closest, err := lsh.Search(vec, 1, 1e-6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(closest) != 1 || closest[0].ID != ids[i] {
+			t.Fatalf("Expected %v, got %v", ids[i], closest)
+		}
+	}
+	// NOTE: scaled vector has the same hash, since only direction matters
+	scaled := []float64{3 * vecs[0][0], 3 * vecs[0][1], 3 * vecs[0][2], 3 * vecs[0][3]}
+	if !reflect.DeepEqual(lsh.hasher.getHashes(vecs[0]), lsh.hasher.getHashes(scaled)) {
+		t.Fatal("Hashes must not depend on the vector norm")
+	}
+	stats, err := lsh.HashStats(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Leaves != 64 {
+		t.Fatalf("Expected (2*4)^2 possible hashes, got %v", stats[0].Leaves)
+	}
+	dump, err := lsh.DumpHasher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewLsh(config, kv.NewKVStore(), NewAngular())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loaded.LoadHasher(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lsh.hasher.getHashes(vecs[1]), loaded.hasher.getHashes(vecs[1])) {
+		t.Fatal("Loaded hasher must produce the same hashes")
+	}
+	_, err = NewLsh(config, kv.NewKVStore(), NewL2())
+	if !errors.Is(err, crossPolytopeMetricErr) {
+		t.Fatalf("Expected error %v, got %v", crossPolytopeMetricErr, err)
+	}
+}
+
+func TestLshBands(t *testing.T) {
+	t.Parallel()
+	dims := 8
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: 100,
+		},
+		HasherConfig: HasherConfig{
+			NumTables:      4,
+			HashesPerTable: 3,
+			Dims:           dims,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewAngular())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecs := make([][]float64, 100)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := lsh.HashStats(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 4 || stats[0].Leaves != 8 || stats[0].MaxDepth != 3 {
+		t.Fatalf("Expected 4 tables with 8 possible hashes, got %v tables with %v", len(stats), stats[0].Leaves)
+	}
+
+	dist := 0.3
+	expected, err := lsh.EstimateRecall(dist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closer, _ := lsh.EstimateRecall(dist / 2)
+	if closer <= expected {
+		t.Fatalf("Recall must decrease with distance: %v at %v, %v at %v", closer, dist/2, expected, dist)
+	}
+	// NOTE: random pairs at the given angular distance, share bucket in at least one table
+	angle := math.Acos(1 - dist)
+	found := 0
+	pairs := 4000
+	for i := 0; i < pairs; i++ {
+		u := NewVec(make([]float64, dims))
+		w := NewVec(make([]float64, dims))
+		for j := 0; j < dims; j++ {
+			u.Data[j] = rand.NormFloat64()
+			w.Data[j] = rand.NormFloat64()
+		}
+		blas64.Scal(1/blas64.Nrm2(u), u)
+		blas64.Axpy(-blas64.Dot(u, w), u, w)
+		blas64.Scal(1/blas64.Nrm2(w), w)
+		v := NewVec(make([]float64, dims))
+		blas64.Axpy(math.Cos(angle), u, v)
+		blas64.Axpy(math.Sin(angle), w, v)
+		uHashes, vHashes := lsh.hasher.getHashes(u.Data), lsh.hasher.getHashes(v.Data)
+		for perm := range uHashes {
+			if uHashes[perm] == vHashes[perm] {
+				found++
+				break
+			}
+		}
+	}
+	observed := float64(found) / float64(pairs)
+	if math.Abs(observed-expected) > 0.05 {
+		t.Fatalf("Estimated recall %v differs from the observed one %v", expected, observed)
+	}
+
+	config.HasherConfig.NTrees = 5
+	_, err = NewLsh(config, kv.NewKVStore(), NewAngular())
+	if !errors.Is(err, tablesNumberErr) {
+		t.Fatalf("Expected error %v, got %v", tablesNumberErr, err)
+	}
+	if math.Abs(SCurve(0.5, 2, 1)-0.75) > tol {
+		t.Fatalf("Wrong S-curve value: %v", SCurve(0.5, 2, 1))
+	}
+}
+
+func TestLshAdaptiveProbing(t *testing.T) {
+	t.Parallel()
+	dims := 8
+	vecs := make([][]float64, 1000)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	for _, config := range []HasherConfig{
+		{NumTables: 10, HashesPerTable: 6, Dims: dims},
+		{NTrees: 10, KMinVecs: 20, Dims: dims},
+	} {
+		lsh, err := NewLsh(Config{IndexConfig: IndexConfig{BatchSize: 100, MaxCandidates: 10}, HasherConfig: config}, kv.NewKVStore(), NewAngular())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = lsh.Train(vecs, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, target := range []float64{0.5, 0.99} {
+			closest, stats, err := lsh.search(vecs[0], SearchOpts{MaxNN: 5, DistanceThrsh: 2, RecallTarget: target})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(closest) == 0 || closest[0].ID != ids[0] {
+				t.Fatalf("Query point must be found, got %v", closest)
+			}
+			if stats.EstimatedRecall < target && stats.BucketsProbed < config.NTrees+config.NumTables {
+				t.Fatalf("Probing stopped at recall %v before the target %v", stats.EstimatedRecall, target)
+			}
+		}
+		_, stats, err := lsh.search(vecs[0], SearchOpts{MaxNN: 5, DistanceThrsh: 2, RecallTarget: 0.99})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, budgetStats, err := lsh.search(vecs[0], SearchOpts{MaxNN: 5, DistanceThrsh: 2, RecallTarget: 0.99, LatencyBudget: time.Nanosecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if budgetStats.BucketsProbed > 1 && budgetStats.BucketsProbed >= stats.BucketsProbed {
+			t.Fatalf("Latency budget must stop probing, %v buckets probed", budgetStats.BucketsProbed)
+		}
+	}
+}
+
+func TestForest(t *testing.T) {
+	t.Parallel()
+	dims := 4
+	vecs := make([][]float64, 0, 550)
+	ids := make([]string, 0, 550)
+	// NOTE: skewed data: dense cluster along with the sparse points
+	for i := 0; i < 550; i++ {
+		scale := 10.0
+		if i < 500 {
+			scale = 0.01
+		}
+		vec := make([]float64, dims)
+		for j := range vec {
+			vec[j] = 1 + rand.NormFloat64()*scale
+		}
+		vecs = append(vecs, vec)
+		ids = append(ids, strconv.Itoa(i))
+	}
+	config := ForestConfig{
+		MaxCandidates: 30,
+		NTrees:        5,
+		Dims:          dims,
+	}
+	forest, err := NewForest(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = forest.Search(vecs[0], 1, 1)
+	if !errors.Is(err, ErrNotTrained) {
+		t.Fatalf("Expected error %v, got %v", ErrNotTrained, err)
+	}
+	err = forest.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 250, 520, 549} {
+		closest, err := forest.Search(vecs[i], 5, math.Inf(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(closest) != 5 || closest[0].ID != ids[i] {
+			t.Fatalf("Expected 5 neighbors starting with %v, got %v", ids[i], closest)
+		}
+	}
+	// NOTE: the dense cluster shares the long prefixes, but only MaxCandidates of it are checked
+	closest, err := forest.Search(vecs[0], len(vecs), math.Inf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closest) != config.MaxCandidates {
+		t.Fatalf("Expected %v candidates, got %v", config.MaxCandidates, len(closest))
+	}
+	config.MaxDepth = 65
+	_, err = NewForest(config, kv.NewKVStore(), NewL2())
+	if !errors.Is(err, forestDepthErr) {
+		t.Fatalf("Expected error %v, got %v", forestDepthErr, err)
+	}
+	config.MaxDepth = 0
+	config.MaxCandidates = 0
+	_, err = NewForest(config, kv.NewKVStore(), NewL2())
+	if !errors.Is(err, maxCandidatesErr) {
+		t.Fatalf("Expected error %v, got %v", maxCandidatesErr, err)
+	}
+}
+
+// entriesSlice fails with err after the entries, if it's set
+type entriesSlice struct {
+	ids  []string
+	vecs [][]float64
+	pos  int
+	err  error
+}
+
+func (it *entriesSlice) Next() (string, []float64, bool) {
+	if it.pos >= len(it.ids) {
+		return "", nil, false
+	}
+	it.pos++
+	return it.ids[it.pos-1], it.vecs[it.pos-1], true
+}
+
+func (it *entriesSlice) Err() error {
+	if it.pos >= len(it.ids) {
+		return it.err
+	}
+	return nil
+}
+
+func TestLshTrainSpilled(t *testing.T) {
+	t.Parallel()
+	dims := 8
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: 1000,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   3,
+			KMinVecs: 10,
+			Dims:     dims,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecs := make([][]float64, 300)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	open := func() (EntriesIterator, error) {
+		return &entriesSlice{ids: ids, vecs: vecs}, nil
+	}
+	dir, err := ioutil.TempDir("", "lsh-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// NOTE: tiny runs, so postings are merged from the several files
+	err = lsh.TrainSpilled(open, SpillConfig{Dir: dir, RunSize: 100, SampleSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(left) != 0 {
+		t.Fatalf("Expected spill runs to be removed, got %v", left)
+	}
+	for i, vec := range vecs {
+		for perm, hash := range lsh.hasher.getHashes(vec) {
+			iter, err := lsh.index.GetHashIterator(getBucketKey(perm, hash))
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for id, ok := iter.Next(); ok; id, ok = iter.Next() {
+				found = found || id == ids[i]
+			}
+			if !found {
+				t.Fatalf("Vector %v is missing in the bucket of the tree %v", ids[i], perm)
+			}
+		}
+		if v, ok := lsh.RecordVersion(ids[i]); !ok || v != 1 {
+			t.Fatalf("Expected version 1 of %v, got %v", ids[i], v)
+		}
+	}
+	closest, err := lsh.Search(vecs[7], 1, math.Inf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closest) != 1 || closest[0].ID != ids[7] {
+		t.Fatalf("Expected %v to be the closest, got %v", ids[7], closest)
+	}
+
+	readErr := errors.New("truncated spill file")
+	truncated := func() (EntriesIterator, error) {
+		return &entriesSlice{ids: ids[:100], vecs: vecs[:100], err: readErr}, nil
+	}
+	err = lsh.TrainSpilled(truncated, SpillConfig{Dir: dir, RunSize: 100, SampleSize: 200})
+	if !errors.Is(err, readErr) {
+		t.Fatalf("Expected error %v, got %v", readErr, err)
+	}
+	err = lsh.TrainWithCheckpoints(truncated, NewFileCheckpointStore(filepath.Join(dir, "checkpoint")))
+	if !errors.Is(err, readErr) {
+		t.Fatalf("Expected error %v, got %v", readErr, err)
+	}
+}
+
+type failingCheckpoints struct {
+	*FileCheckpointStore
+	saves int
+}
+
+func (s *failingCheckpoints) SaveCheckpoint(checkpoint *Checkpoint) error {
+	s.saves++
+	if s.saves > 1 {
+		return errors.New("crash")
+	}
+	return s.FileCheckpointStore.SaveCheckpoint(checkpoint)
+}
+
+func TestLshTrainWithCheckpoints(t *testing.T) {
+	t.Parallel()
+	dims := 8
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:          100,
+			MaxCandidates:      1000,
+			CheckpointInterval: 100,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   3,
+			KMinVecs: 10,
+			Dims:     dims,
+		},
+	}
+	vecs := make([][]float64, 350)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	source := func() (EntriesIterator, error) {
+		return &entriesSlice{ids: ids, vecs: vecs}, nil
+	}
+	dir, err := ioutil.TempDir("", "lsh-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoints := NewFileCheckpointStore(filepath.Join(dir, "checkpoint"))
+
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainWithCheckpoints(source, &failingCheckpoints{FileCheckpointStore: checkpoints})
+	if err == nil {
+		t.Fatal("Expected training to fail on the second checkpoint")
+	}
+	checkpoint, err := checkpoints.LoadCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint == nil || checkpoint.Offset != 100 || len(checkpoint.IDs) != 100 {
+		t.Fatalf("Expected checkpoint at 100, got %v", checkpoint)
+	}
+	// NOTE: torn frame of the crashed save is cut off on load
+	f, err := os.OpenFile(filepath.Join(dir, "checkpoint"), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42})
+	f.Close()
+
+	// NOTE: the new process starts with the empty store
+	lsh, err = NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainWithCheckpoints(source, checkpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err = checkpoints.LoadCheckpoint()
+	if err != nil || checkpoint != nil {
+		t.Fatalf("Expected checkpoint to be cleared, got %v, %v", checkpoint, err)
+	}
+	for _, i := range []int{0, 99, 100, 349} {
+		closest, err := lsh.Search(vecs[i], 1, math.Inf(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(closest) != 1 || closest[0].ID != ids[i] {
+			t.Fatalf("Expected %v to be the closest, got %v", ids[i], closest)
+		}
+		if v, ok := lsh.RecordVersion(ids[i]); !ok || v != 1 {
+			t.Fatalf("Expected version 1 of %v, got %v", ids[i], v)
+		}
+	}
+	if changes := lsh.Changes(); changes.Trained != len(vecs) {
+		t.Fatalf("Expected %v trained records, got %+v", len(vecs), changes)
+	}
+
+	// NOTE: durable store keeps the indexed entries, so checkpoints don't
+	s := durableStore{kv.NewKVStore()}
+	lsh, err = NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainWithCheckpoints(source, &failingCheckpoints{FileCheckpointStore: checkpoints})
+	if err == nil {
+		t.Fatal("Expected training to fail on the second checkpoint")
+	}
+	checkpoint, err = checkpoints.LoadCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint == nil || checkpoint.Offset != 100 || len(checkpoint.IDs) != 0 {
+		t.Fatalf("Expected checkpoint at 100 without entries, got %v", checkpoint)
+	}
+	lsh, err = NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainWithCheckpoints(source, checkpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 99, 100, 349} {
+		closest, err := lsh.Search(vecs[i], 1, math.Inf(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(closest) != 1 || closest[0].ID != ids[i] {
+			t.Fatalf("Expected %v to be the closest, got %v", ids[i], closest)
+		}
+	}
+	if changes := lsh.Changes(); changes.Trained != len(vecs) {
+		t.Fatalf("Expected %v trained records, got %+v", len(vecs), changes)
+	}
+}
+
+// durableStore pretends to keep the data across restarts
+type durableStore struct {
+	*kv.KVStore
+}
+
+func (s durableStore) Durable() bool {
+	return true
+}
+
+func TestLshRetrain(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed := map[string][]float64{
+		trainIds[0]: {-0.5, 0.5},
+		trainIds[1]: {0.5, -0.5},
+	}
+	fetch := func(id string) ([]float64, error) {
+		vec, ok := refreshed[id]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return vec, nil
+	}
+	err = lsh.Retrain([]string{trainIds[0], trainIds[1]}, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range trainIds[:2] {
+		nns, err := lsh.Search(inpVecs[i], 1, 0.001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nns) != 0 {
+			t.Fatalf("Retrained vector must not be found by the old value, got %v", nns)
+		}
+		nns, err = lsh.Search(refreshed[id], 1, 0.001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nns) != 1 || nns[0].ID != id {
+			t.Fatalf("Expected %v, got %v", id, nns)
+		}
+		if version, _ := lsh.RecordVersion(id); version != 2 {
+			t.Fatalf("Expected version 2, got %v", version)
+		}
+	}
+	nns, err := lsh.Search(inpVecs[2], 1, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) != 1 || nns[0].ID != trainIds[2] {
+		t.Fatalf("Records which aren't retrained must stay intact, got %v", nns)
+	}
+	refreshed["unknown"] = []float64{0, 0}
+	err = lsh.Retrain([]string{"unknown"}, fetch)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestLshDeterministic(t *testing.T) {
+	t.Parallel()
+	dims := 8
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:         50,
+			MaxCandidates:     20,
+			SearchParallelism: 4,
+			Deterministic:     true,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   8,
+			KMinVecs: 20,
+			Dims:     dims,
+			Seed:     42,
+		},
+	}
+	vecs := make([][]float64, 500)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	results := make([][]Neighbor, 0)
+	var planes [][]float64
+	for run := 0; run < 3; run++ {
+		lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = lsh.Train(vecs, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run == 0 {
+			planes = lsh.Planes()
+		} else if !reflect.DeepEqual(planes, lsh.Planes()) {
+			t.Fatal("Seeded hasher must produce the same planes")
+		}
+		for _, i := range []int{0, 100, 200} {
+			closest, err := lsh.Search(vecs[i], 10, math.Inf(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, closest)
+		}
+	}
+	for i := 3; i < len(results); i++ {
+		if !reflect.DeepEqual(results[i], results[i%3]) {
+			t.Fatalf("Expected identical results, got %v and %v", results[i], results[i%3])
+		}
+	}
+}
+
+func TestLshExplainSearch(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	explanation, err := lsh.ExplainSearch(inpVecs[0], trainIds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(explanation.Buckets) != 5 || !explanation.Reachable || explanation.Dist != 0 || !explanation.PassedThreshold {
+		t.Fatalf("Record must be reachable by its' own vector, got %+v", explanation)
+	}
+	for _, bucket := range explanation.Buckets {
+		if !bucket.Shared || bucket.ProbeRank != 0 || !bucket.Stored {
+			t.Fatalf("Record must share all buckets with its' own vector, got %+v", bucket)
+		}
+	}
+	s.DeleteHash(explanation.Buckets[0].RecordBucket, trainIds[0])
+	opts := SearchOpts{
+		DistanceThrsh: 0.001,
+		Scorer: func(dist float64, meta map[string]string) float64 {
+			return dist + 1
+		},
+	}
+	explanation, err = lsh.ExplainSearchWithOpts(inpVecs[1], trainIds[0], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Buckets[0].Stored || explanation.PassedThreshold || explanation.Score != explanation.Dist+1 {
+		t.Fatalf("Expected missing entry, failed threshold and adjusted score, got %+v", explanation)
+	}
+	_, err = lsh.ExplainSearch(inpVecs[0], "unknown")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestLshBucketInspection(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   3,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := kv.NewKVStore()
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	occupied, err := lsh.RecordBuckets(trainIds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(occupied) != 3 {
+		t.Fatalf("Record must occupy a bucket per permutation, got %v", occupied)
+	}
+	buckets, err := lsh.ListBuckets(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	listed := false
+	for i, bucket := range buckets {
+		if i > 0 && buckets[i-1].Hash >= bucket.Hash {
+			t.Fatalf("Buckets must be ordered by hash, got %v", buckets)
+		}
+		total += bucket.Size
+		listed = listed || bucket.Hash == occupied[1]
+	}
+	if total != len(inpVecs) || !listed {
+		t.Fatalf("Buckets must hold all the records, got %v", buckets)
+	}
+	all, size, err := lsh.BucketMembers(1, occupied[1], 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, pageSize, err := lsh.BucketMembers(1, occupied[1], 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(all) || pageSize != size || (size > 1 && (len(page) != 1 || page[0] != all[1])) {
+		t.Fatalf("Unexpected page %v of %v members: %v", page, size, all)
+	}
+	s.DeleteHash(getBucketKey(2, occupied[2]), trainIds[0])
+	occupied, err = lsh.RecordBuckets(trainIds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := occupied[2]; ok || len(occupied) != 2 {
+		t.Fatalf("Missing entry must not be reported, got %v", occupied)
+	}
+	_, err = lsh.ListBuckets(3)
+	if !errors.Is(err, permErr) {
+		t.Fatalf("Expected error %v, got %v", permErr, err)
+	}
+}
+
+func TestDriftMonitor(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	scaler := NewStandartScaler([]float64{0, 0}, []float64{1, 1}, 2)
+	fired := make([]float64, 0)
+	monitor := NewDriftMonitor(scaler, DriftConfig{
+		Window:    100,
+		Threshold: 1,
+		OnDrift: func(score float64) {
+			fired = append(fired, score)
+		},
+	})
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     10,
+			MaxCandidates: 10,
+			Drift:         monitor,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   2,
+			KMinVecs: 10,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecs := make([][]float64, 300)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = []float64{rnd.NormFloat64(), rnd.NormFloat64()}
+		ids[i] = strconv.Itoa(i)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vec := range vecs[:50] {
+		lsh.Search(vec, 1, 1)
+	}
+	_, ok, err := lsh.DriftScore()
+	if err != nil || ok {
+		t.Fatalf("Score must not be reported before the window is filled, got %v, %v", ok, err)
+	}
+	for _, vec := range vecs[50:] {
+		lsh.Search(vec, 1, 1)
+	}
+	score, ok, err := lsh.DriftScore()
+	if err != nil || !ok || score > 0.5 || len(fired) != 0 {
+		t.Fatalf("Data matching the scaler must not drift, got %v, %v fired", score, fired)
+	}
+	for i := 0; i < 300; i++ {
+		_, err = lsh.Insert("shifted"+strconv.Itoa(i), []float64{3 + rnd.NormFloat64(), 3 + rnd.NormFloat64()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	score, _, _ = lsh.DriftScore()
+	if score < 2 || len(fired) != 1 {
+		t.Fatalf("Shifted data must be reported once, got %v, %v fired", score, fired)
+	}
+}
+
+// failingTxnStore fails the transactions after the given number of SetHash calls
+type failingTxnStore struct {
+	*kv.KVStore
+	failAfter int
+}
+
+type failingHashesTx struct {
+	store.Store
+	left int
+}
+
+func (tx *failingHashesTx) SetHash(bucket uint64, vecId string) error {
+	if tx.left == 0 {
+		return errors.New("connection reset")
+	}
+	tx.left--
+	return tx.Store.SetHash(bucket, vecId)
+}
+
+func (s *failingTxnStore) Update(fn func(tx store.Store) error) error {
+	return s.KVStore.Update(func(tx store.Store) error {
+		return fn(&failingHashesTx{Store: tx, left: s.failAfter})
+	})
+}
+
+func TestLshInsertTxn(t *testing.T) {
+	t.Parallel()
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := &failingTxnStore{KVStore: kv.NewKVStore(), failAfter: 2}
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := trainIds[0]
+	oldVec, _ := s.GetVector(id)
+	oldBuckets, err := lsh.RecordBuckets(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Insert(id, []float64{-oldVec[0], -oldVec[1]})
+	if err == nil {
+		t.Fatal("Expected insert to fail")
+	}
+	vec, _ := s.GetVector(id)
+	if vec[0] != oldVec[0] || vec[1] != oldVec[1] {
+		t.Fatal("Failed insert must keep the old vector")
+	}
+	for perm, hash := range oldBuckets {
+		held, err := lsh.bucketHolds(getBucketKey(perm, hash), id)
+		if err != nil || !held {
+			t.Fatalf("Failed insert must keep the old hashes, perm %v: %v", perm, err)
+		}
+	}
+	_, err = lsh.Insert("new", []float64{0.5, 0.5})
+	if err == nil {
+		t.Fatal("Expected insert to fail")
+	}
+	_, err = s.GetVector("new")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Failed insert must not leave the vector, got %v", err)
+	}
+}
+
+func TestLshTunables(t *testing.T) {
+	t.Parallel()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			CacheSize:     10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   1,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Reload(Tunables{MaxCandidates: 20, CacheSize: -1})
+	if err != tunablesErr || lsh.Tunables().MaxCandidates != 10 {
+		t.Fatalf("Invalid tunables must be rejected as a whole, got %v", err)
+	}
+	err = lsh.Reload(Tunables{MaxCandidates: 20, CacheSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunables := lsh.Tunables()
+	if tunables.MaxCandidates != 20 || tunables.BatchSize != 2 || tunables.CacheSize != 5 {
+		t.Fatalf("Unexpected tunables %+v", tunables)
+	}
+
+	dir, err := ioutil.TempDir("", "tunables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tunables.json")
+	err = ioutil.WriteFile(path, []byte(`{"maxCandidates": 30, "searchParallelism": 4}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 10)
+	stop := lsh.WatchTunables(path, 10*time.Millisecond, func(err error) {
+		errs <- err
+	})
+	defer stop()
+	deadline := time.Now().Add(time.Second)
+	for lsh.Tunables().MaxCandidates != 30 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	tunables = lsh.Tunables()
+	if tunables.MaxCandidates != 30 || tunables.SearchParallelism != 4 {
+		t.Fatalf("Tunables must be reloaded from the file, got %+v", tunables)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("Unexpected reload error %v", err)
+	default:
+	}
+	stop()
+
+	err = ioutil.WriteFile(path, []byte(`{"maxCandidates": 40}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop = lsh.WatchTunables(path, 0, nil)
+	defer stop()
+	deadline = time.Now().Add(time.Second)
+	for lsh.Tunables().MaxCandidates != 40 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if lsh.Tunables().MaxCandidates != 40 {
+		t.Fatalf("Tunables must be loaded with the default interval, got %+v", lsh.Tunables())
+	}
+}
+
+func TestLshEvents(t *testing.T) {
+	t.Parallel()
+	mx := sync.Mutex{}
+	events := make([]string, 0)
+	record := func(event Event) {
+		mx.Lock()
+		defer mx.Unlock()
+		events = append(events, fmt.Sprintf("%v:%v:%v", event.Type, event.Version, event.Count))
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			OnEvent:       record,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	vi := NewVersionedIndex(func() (*LSHIndex, error) {
+		return NewLsh(config, kv.NewKVStore(), NewL2())
+	})
+	vi.SetEventHandler(record)
+	err := vi.Train([][]float64{{0.1, 0.1}, {-0.1, 0.1}}, []string{"v1", "v1_far"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := vi.BuildVersion([][]float64{{0.1, 0.1}}, []string{"v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vi.PromoteVersion(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vi.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"train_started:0:2", "train_finished:0:2", "version_built:1:2", "version_promoted:1:0",
+		"train_started:0:1", "train_finished:0:1", "version_built:2:1", "version_promoted:2:0",
+		"version_dropped:1:0",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestMergeNeighbors(t *testing.T) {
+	merged := MergeNeighbors(0,
+		[]Neighbor{{ID: "a", Dist: 0.1}, {ID: "c", Dist: 0.3}, {ID: "d", Dist: 0.5}},
+		nil,
+		[]Neighbor{{ID: "b", Dist: 0.3}, {ID: "a", Dist: 0.4}},
+		[]Neighbor{{ID: "d", Dist: 0.2}},
+	)
+	ids := make([]string, len(merged))
+	for i, nn := range merged {
+		ids[i] = nn.ID
+	}
+	// NOTE: ties are broken by ID, duplicates keep the smallest distance
+	expected := []string{"a", "d", "b", "c"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+	if merged[0].Dist != 0.1 || merged[1].Dist != 0.2 {
+		t.Fatalf("Duplicates must keep the smallest distance, got %v", merged)
+	}
+	merged = MergeNeighbors(2, []Neighbor{{ID: "a"}, {ID: "b"}, {ID: "c"}})
+	if len(merged) != 2 {
+		t.Fatalf("Expected 2 neighbors, got %v", merged)
+	}
+}
+
+func TestEncryptedCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+	keyring := snapcrypt.NewMemoryKeyring()
+	keyring.Rotate("k1", make([]byte, 32))
+	checkpoints := NewEncryptedFileCheckpointStore(path, keyring)
+	checkpoint := &Checkpoint{Offset: 42, IDs: []string{"raw"}, Vecs: [][]float64{{1, 2}}}
+	err = checkpoints.SaveCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if !snapcrypt.IsSealed(data[checkpointFrameHeader:]) {
+		t.Fatal("Checkpoint file must be encrypted")
+	}
+	loaded, err := checkpoints.LoadCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Offset != 42 || !reflect.DeepEqual(loaded.Vecs, checkpoint.Vecs) {
+		t.Fatalf("Unexpected checkpoint %+v", loaded)
+	}
+	err = NewFileCheckpointStore(path).SaveCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkpoints.LoadCheckpoint()
+	if !errors.Is(err, snapcrypt.ErrNotSealed) {
+		t.Fatalf("Unencrypted checkpoint must be refused, got %v", err)
+	}
+}
+
+func TestCompressedCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plainPath := filepath.Join(dir, "plain")
+	compressedPath := filepath.Join(dir, "compressed")
+	checkpoint := &Checkpoint{Offset: 1, IDs: []string{"zeros"}, Vecs: [][]float64{make([]float64, 1<<13)}}
+	err = NewFileCheckpointStore(plainPath).SaveCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints := NewFileCheckpointStore(compressedPath)
+	if checkpoints.SetCompression(Compression{Codec: Gzip, Level: 42}) == nil {
+		t.Fatal("Invalid compression level must be rejected")
+	}
+	err = checkpoints.SetCompression(Compression{Codec: Gzip, Level: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkpoints.SaveCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := os.Stat(plainPath)
+	compressed, _ := os.Stat(compressedPath)
+	if compressed.Size()*10 > plain.Size() {
+		t.Fatalf("Checkpoint must be compressed, got %v bytes of %v", compressed.Size(), plain.Size())
+	}
+	// NOTE: compression is detected on load
+	for _, path := range []string{plainPath, compressedPath} {
+		loaded, err := NewFileCheckpointStore(path).LoadCheckpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Offset != 1 || len(loaded.Vecs) != 1 || len(loaded.Vecs[0]) != 1<<13 {
+			t.Fatalf("Unexpected checkpoint loaded from %v", path)
+		}
+	}
+}
+
+func TestCompressedHasherDump(t *testing.T) {
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:       2,
+			MaxCandidates:   10,
+			DumpCompression: Compression{Codec: Gzip},
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   5,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	compressed, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressed.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := compressed.DumpHasher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(dump, []byte{0x1f, 0x8b}) {
+		t.Fatal("Hasher dump must be compressed")
+	}
+	config.IndexConfig.DumpCompression = Compression{}
+	plain, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: compression is detected on load
+	err = plain.LoadHasher(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(compressed.Planes(), plain.Planes()) {
+		t.Fatal("Planes of the loaded hasher differ from the original ones")
+	}
+	config.IndexConfig.DumpCompression = Compression{Codec: Gzip, Level: 42}
+	_, err = NewLsh(config, kv.NewKVStore(), NewL2())
+	if err == nil {
+		t.Fatal("Invalid compression level must be rejected")
+	}
+}
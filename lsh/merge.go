@@ -0,0 +1,69 @@
+package lsh
+
+import (
+	"container/heap"
+)
+
+// mergeHead is a current position in one of the merged lists
+type mergeHead struct {
+	list int
+	pos  int
+}
+
+type mergeHeap struct {
+	lists [][]Neighbor
+	heads []mergeHead
+}
+
+func (h *mergeHeap) Len() int { return len(h.heads) }
+func (h *mergeHeap) Less(i, j int) bool {
+	l, r := h.heads[i], h.heads[j]
+	ln, rn := &h.lists[l.list][l.pos], &h.lists[r.list][r.pos]
+	if ln.Dist == rn.Dist && ln.ID == rn.ID {
+		return l.list < r.list
+	}
+	return lessNeighbor(ln, rn)
+}
+func (h *mergeHeap) Swap(i, j int)      { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+func (h *mergeHeap) Push(x interface{}) { h.heads = append(h.heads, x.(mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	head := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return head
+}
+
+// MergeNeighbors k-way merges search results, each list sorted as returned by the search
+// (see SortNeighbors), into a single sorted list of up to maxNN neighbors (all of them if
+// maxNN <= 0); ID found in several lists is kept once, with the smallest distance, and equal
+// neighbors are taken from the earliest list, so the merge is deterministic
+func MergeNeighbors(maxNN int, lists ...[]Neighbor) []Neighbor {
+	h := &mergeHeap{lists: lists, heads: make([]mergeHead, 0, len(lists))}
+	total := 0
+	for i, list := range lists {
+		if len(list) > 0 {
+			h.heads = append(h.heads, mergeHead{list: i})
+			total += len(list)
+		}
+	}
+	if maxNN > 0 && maxNN < total {
+		total = maxNN
+	}
+	heap.Init(h)
+	merged := make([]Neighbor, 0, total)
+	seen := make(map[string]bool, total)
+	for h.Len() > 0 && (maxNN <= 0 || len(merged) < maxNN) {
+		head := h.heads[0]
+		nn := lists[head.list][head.pos]
+		if !seen[nn.ID] {
+			seen[nn.ID] = true
+			merged = append(merged, nn)
+		}
+		if head.pos+1 < len(lists[head.list]) {
+			h.heads[0].pos++
+			heap.Fix(h, 0)
+			continue
+		}
+		heap.Pop(h)
+	}
+	return merged
+}
@@ -0,0 +1,77 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+)
+
+// SetMeta attaches metadata (e.g. seller or document id) to the stored vector
+func (lsh *LSHIndex) SetMeta(id string, meta map[string]string) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	metaStore, ok := lsh.index.(store.MetaStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	_, err := lsh.index.GetVector(id)
+	if err != nil {
+		return fmt.Errorf("can't set metadata of vector %v: %w", id, err)
+	}
+	err = metaStore.SetMeta(id, meta)
+	if err != nil {
+		return err
+	}
+	lsh.invalidateCache()
+	return nil
+}
+
+// GetMeta returns metadata of the stored vector
+func (lsh *LSHIndex) GetMeta(id string) (map[string]string, error) {
+	metaStore, ok := lsh.index.(store.MetaStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return metaStore.GetMeta(id)
+}
+
+// limitGroups takes up to maxNN ordered candidates, keeping at most maxPerGroup
+// of them per value of the groupBy metadata key; candidates without the key
+// aren't limited; collapsed candidates are replaced by their records, closest vector per record,
+// groups are still taken from the metadata of the vectors
+func (lsh *LSHIndex) limitGroups(candidates []*Neighbor, maxNN int, groupBy string, maxPerGroup int, collapsed bool) ([]Neighbor, error) {
+	closest := make([]Neighbor, 0)
+	groups := make(map[string]int)
+	records := make(map[string]bool)
+	for _, candidate := range candidates {
+		if len(closest) >= maxNN {
+			break
+		}
+		var recordID string
+		if collapsed {
+			recordID = getParentID(candidate.ID)
+			if records[recordID] {
+				continue
+			}
+		}
+		if groupBy != "" && maxPerGroup > 0 {
+			meta, err := lsh.GetMeta(candidate.ID)
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				return nil, err
+			}
+			if group, ok := meta[groupBy]; ok {
+				if groups[group] >= maxPerGroup {
+					continue
+				}
+				groups[group]++
+			}
+		}
+		if collapsed {
+			records[recordID] = true
+			candidate = &Neighbor{ID: recordID, Vec: candidate.Vec, Dist: candidate.Dist}
+		}
+		closest = append(closest, *candidate)
+	}
+	return closest, nil
+}
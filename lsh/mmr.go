@@ -0,0 +1,56 @@
+package lsh
+
+import (
+	"math"
+)
+
+// mmrPoolFactor limits the candidates reordered with MMR to the MaxNN * mmrPoolFactor closest ones
+const mmrPoolFactor = 10
+
+// mmr picks up to n candidates, sorted by distance to the query, with maximal marginal relevance:
+// each next candidate maximizes lambda * relevance + (1 - lambda) * distance to the already picked ones;
+// distances are calculated only to the candidate picked last, so memory is linear in the candidates
+func (lsh *LSHIndex) mmr(candidates []*Neighbor, lambda float64, n int) []*Neighbor {
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	if len(candidates) < 2 || lambda >= 1 {
+		return candidates[:n]
+	}
+	rest := make([]*Neighbor, len(candidates))
+	copy(rest, candidates)
+	// NOTE: minimal distance from each candidate to the picked ones
+	minDists := make([]float64, len(rest))
+	for i := range minDists {
+		minDists[i] = math.Inf(1)
+	}
+	ordered := make([]*Neighbor, 0, n)
+	for {
+		best, bestScore := -1, math.Inf(-1)
+		for i, candidate := range rest {
+			score := -lambda * candidate.Dist
+			if len(ordered) > 0 {
+				score += (1 - lambda) * minDists[i]
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		picked := rest[best]
+		ordered = append(ordered, picked)
+		if len(ordered) == n {
+			return ordered
+		}
+		rest = append(rest[:best], rest[best+1:]...)
+		minDists = append(minDists[:best], minDists[best+1:]...)
+		vecs := make([][]float64, len(rest))
+		for i, candidate := range rest {
+			vecs[i] = candidate.Vec
+		}
+		for i, dist := range GetDists(lsh.distanceMetric, [][]float64{picked.Vec}, vecs)[0] {
+			if dist < minDists[i] {
+				minDists[i] = dist
+			}
+		}
+	}
+}
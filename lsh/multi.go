@@ -0,0 +1,97 @@
+package lsh
+
+import (
+	"errors"
+	"math"
+)
+
+var (
+	emptyQueriesErr = errors.New("At least one query vector is needed")
+)
+
+// MultiQueryMode defines how several query vectors are combined into a single search
+type MultiQueryMode int
+
+const (
+	// AvgQuery searches NNs of the mean query vector
+	AvgQuery MultiQueryMode = iota
+	// AnyQuery merges candidates of all queries, scoring them by distance to the closest query
+	AnyQuery
+	// AllQueries merges candidates of all queries, scoring them by mean distance to the queries
+	AllQueries
+)
+
+// SearchMulti returns NNs for a group of query points ("more like these items");
+// in merging modes candidates of every query are re-scored against all of the queries
+func (lsh *LSHIndex) SearchMulti(queries [][]float64, mode MultiQueryMode, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	if len(queries) == 0 {
+		return nil, emptyQueriesErr
+	}
+	if mode == AvgQuery {
+		mean := make([]float64, len(queries[0]))
+		for _, query := range queries {
+			if len(query) != len(mean) {
+				return nil, ErrDimMismatch
+			}
+			for i, val := range query {
+				mean[i] += val / float64(len(queries))
+			}
+		}
+		return lsh.Search(mean, maxNN, distanceThrsh)
+	}
+
+	maxCandidates := lsh.config.getMaxCandidates()
+	pool := make(map[string]Neighbor)
+	order := make([]string, 0)
+	for _, query := range queries {
+		// NOTE: candidates far from one query can still be close to the others,
+		//       so the threshold is checked after aggregation only
+		candidates, err := lsh.Search(query, maxCandidates, math.Inf(1))
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range candidates {
+			if _, ok := pool[candidate.ID]; !ok {
+				pool[candidate.ID] = candidate
+				order = append(order, candidate.ID)
+			}
+		}
+	}
+	vecs := make([][]float64, len(order))
+	for i, id := range order {
+		vecs[i] = pool[id].Vec
+	}
+	// NOTE: stored vectors are transformed by the pipeline, so the queries must be too
+	transformed := make([][]float64, len(queries))
+	for i, query := range queries {
+		var err error
+		transformed[i], err = lsh.transform(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dists := GetDists(lsh.distanceMetric, transformed, vecs)
+	closest := make([]Neighbor, 0, len(order))
+	for j, id := range order {
+		candidate := pool[id]
+		candidate.Dist = dists[0][j]
+		for i := 1; i < len(queries); i++ {
+			if mode == AnyQuery {
+				candidate.Dist = math.Min(candidate.Dist, dists[i][j])
+			} else {
+				candidate.Dist += dists[i][j]
+			}
+		}
+		if mode == AllQueries {
+			candidate.Dist /= float64(len(queries))
+		}
+		if candidate.Dist <= distanceThrsh {
+			closest = append(closest, candidate)
+		}
+	}
+	SortNeighbors(closest)
+	if len(closest) > maxNN {
+		closest = closest[:maxNN]
+	}
+	return closest, nil
+}
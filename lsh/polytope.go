@@ -0,0 +1,106 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"gonum.org/v1/gonum/mat"
+	"math/bits"
+	"math/rand"
+)
+
+// HashScheme defines the family of hash functions used by the hasher
+type HashScheme int
+
+const (
+	// HyperplanesScheme hashes vectors by the trees of hyperplanes
+	HyperplanesScheme HashScheme = iota
+	// CrossPolytopeScheme hashes vectors by the closest vertex of the cross-polytope (+-e_i)
+	// after the random rotation, so each rotation gives one of 2*Dims values;
+	// it suits angular distance only and doesn't depend on the training data
+	CrossPolytopeScheme
+)
+
+var (
+	crossPolytopeMetricErr = errors.New("cross-polytope scheme needs angular metric")
+	crossPolytopeBitsErr   = fmt.Errorf("cross-polytope hashes of all rotations must fit into %v bits", store.HashBits)
+	planesSchemeErr        = errors.New("planes are used by the hyperplanes scheme only")
+)
+
+// polytopeBits returns number of bits taken by a single cross-polytope hash
+func polytopeBits(dims int) int {
+	return bits.Len(uint(2*dims - 1))
+}
+
+func validateCrossPolytope(config HasherConfig) error {
+	if config.Scheme != CrossPolytopeScheme {
+		return nil
+	}
+	if !config.isAngularMetric {
+		return crossPolytopeMetricErr
+	}
+	if getRotations(config)*polytopeBits(config.Dims) > store.HashBits {
+		return crossPolytopeBitsErr
+	}
+	return nil
+}
+
+func getRotations(config HasherConfig) int {
+	if config.Rotations <= 0 {
+		if config.HashesPerTable > 0 {
+			return config.HashesPerTable
+		}
+		return 1
+	}
+	return config.Rotations
+}
+
+// buildRotations generates random rotations of a single table
+func buildRotations(config HasherConfig, rnd *rand.Rand) []*mat.Dense {
+	rotations := make([]*mat.Dense, getRotations(config))
+	for i := range rotations {
+		rotations[i] = randomRotation(config.Dims, rnd)
+	}
+	return rotations
+}
+
+// polytopeHash concatenates indices of the closest cross-polytope vertices after each rotation
+func polytopeHash(rotations []*mat.Dense, vec *mat.VecDense) uint64 {
+	dims := vec.Len()
+	shift := polytopeBits(dims)
+	var hash uint64
+	rotated := mat.NewVecDense(dims, nil)
+	for r, rotation := range rotations {
+		rotated.MulVec(rotation, vec)
+		closest, maxAbs := 0, -1.0
+		for i := 0; i < dims; i++ {
+			val := rotated.AtVec(i)
+			if val < 0 {
+				val = -val
+			}
+			if val > maxAbs {
+				closest, maxAbs = i, val
+			}
+		}
+		vertex := uint64(closest)
+		if rotated.AtVec(closest) < 0 {
+			vertex += uint64(dims)
+		}
+		hash |= vertex << uint(r*shift)
+	}
+	return hash
+}
+
+func rotationsFromDump(dumped [][][]float64, dims int) ([][]*mat.Dense, error) {
+	rotations := make([][]*mat.Dense, len(dumped))
+	for i := range dumped {
+		rotations[i] = make([]*mat.Dense, len(dumped[i]))
+		for j, data := range dumped[i] {
+			if len(data) != dims*dims {
+				return nil, fmt.Errorf("rotation %v of table %v has %v values instead of %v", j, i, len(data), dims*dims)
+			}
+			rotations[i][j] = mat.NewDense(dims, dims, data)
+		}
+	}
+	return rotations, nil
+}
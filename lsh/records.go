@@ -0,0 +1,188 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"strings"
+)
+
+const (
+	childIDSep = "#"
+)
+
+// Aggregation defines how distances of record's vectors are collapsed into a single one
+type Aggregation int
+
+const (
+	// MinDist takes distance of the closest vector of the record
+	MinDist Aggregation = iota
+	// MeanDist takes mean distance over the record's vectors found during the search
+	MeanDist
+)
+
+// Record holds several vectors (e.g. one per image crop) that belong to a single ID
+type Record struct {
+	ID   string
+	Vecs [][]float64
+}
+
+var (
+	recordsDisabledErr = errors.New("records need IndexConfig.Records to be set")
+	recordIDErr        = fmt.Errorf("record id must not contain %q", childIDSep)
+)
+
+func getChildID(parentID string, idx int) string {
+	return fmt.Sprintf("%v%v%v", parentID, childIDSep, idx)
+}
+
+// getParentID returns record id of the vector, record ids never contain the separator
+func getParentID(childID string) string {
+	pos := strings.Index(childID, childIDSep)
+	if pos < 0 {
+		return childID
+	}
+	return childID[:pos]
+}
+
+func (lsh *LSHIndex) validateRecord(id string) error {
+	if !lsh.config.Records {
+		return recordsDisabledErr
+	}
+	if strings.Contains(id, childIDSep) {
+		return fmt.Errorf("%w: %v", recordIDErr, id)
+	}
+	return nil
+}
+
+// TrainRecords fills new search index with records, indexing each record's vector separately
+func (lsh *LSHIndex) TrainRecords(records []Record) error {
+	vecs := make([][]float64, 0, len(records))
+	ids := make([]string, 0, len(records))
+	for _, record := range records {
+		err := lsh.validateRecord(record.ID)
+		if err != nil {
+			return err
+		}
+		for i, vec := range record.Vecs {
+			vecs = append(vecs, vec)
+			ids = append(ids, getChildID(record.ID, i))
+		}
+	}
+	return lsh.Train(vecs, ids)
+}
+
+// InsertRecord adds record to the trained index or replaces the existing one, vectors left
+// from the previous version of the record are deleted; vectors are written one by one,
+// so the concurrent writes of the same record must be avoided
+func (lsh *LSHIndex) InsertRecord(record Record) error {
+	err := lsh.validateRecord(record.ID)
+	if err != nil {
+		return err
+	}
+	for i, vec := range record.Vecs {
+		_, err = lsh.Insert(getChildID(record.ID, i), vec)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = lsh.deleteChildren(record.ID, len(record.Vecs))
+	return err
+}
+
+// DeleteRecord deletes all vectors of the record, see Delete
+func (lsh *LSHIndex) DeleteRecord(id string) error {
+	err := lsh.validateRecord(id)
+	if err != nil {
+		return err
+	}
+	deleted, err := lsh.deleteChildren(id, 0)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("can't delete record %v: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// deleteChildren deletes vectors of the record starting from the given index, returns number
+// of the deleted ones; vectors of the record are numbered contiguously and the deleted ones
+// stay in the store until compaction, which removes the whole tail, so the first
+// missing vector ends the record
+func (lsh *LSHIndex) deleteChildren(id string, from int) (int, error) {
+	deleted := 0
+	for i := from; ; i++ {
+		childID := getChildID(id, i)
+		_, err := lsh.index.GetVector(childID)
+		if errors.Is(err, store.ErrNotFound) {
+			return deleted, nil
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("can't get vector %v: %w", childID, err)
+		}
+		isDeleted, err := lsh.isDeleted(childID)
+		if err != nil {
+			return deleted, err
+		}
+		if isDeleted {
+			continue
+		}
+		err = lsh.Delete(childID)
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+}
+
+// SearchRecords returns closest records for the query point, collapsing hits of
+// the separate vectors back to the record ID with the given aggregation
+func (lsh *LSHIndex) SearchRecords(query []float64, maxNN int, distanceThrsh float64, agg Aggregation) ([]Neighbor, error) {
+	if !lsh.config.Records {
+		return nil, recordsDisabledErr
+	}
+	children, _, err := lsh.search(query, SearchOpts{
+		MaxNN:         lsh.config.getMaxCandidates(),
+		DistanceThrsh: distanceThrsh,
+		children:      true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[string]*Neighbor)
+	counts := make(map[string]int)
+	order := make([]string, 0)
+	for _, child := range children {
+		parentID := getParentID(child.ID)
+		parent, ok := parents[parentID]
+		if !ok {
+			// NOTE: children are sorted by distance, so the first one is the closest
+			parents[parentID] = &Neighbor{
+				ID:   parentID,
+				Vec:  child.Vec,
+				Dist: child.Dist,
+			}
+			counts[parentID] = 1
+			order = append(order, parentID)
+			continue
+		}
+		if agg == MeanDist {
+			parent.Dist += child.Dist
+		}
+		counts[parentID]++
+	}
+	closest := make([]Neighbor, 0, len(order))
+	for _, parentID := range order {
+		parent := parents[parentID]
+		if agg == MeanDist {
+			parent.Dist /= float64(counts[parentID])
+		}
+		closest = append(closest, *parent)
+	}
+	SortNeighbors(closest)
+	if len(closest) > maxNN {
+		closest = closest[:maxNN]
+	}
+	return closest, nil
+}
@@ -0,0 +1,36 @@
+package lsh
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// parseTimestamp accepts unix seconds or RFC3339 time
+func parseTimestamp(val string) (time.Time, bool) {
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(secs, 0), true
+	}
+	ts, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// TimeDecayScorer returns scorer for the SearchOpts which makes the older vectors rank lower:
+// similarity 1 / (1 + dist) halves every halfLife of the age, taken from the timestampField
+// metadata (unix seconds or RFC3339); vectors without valid timestamp keep their distance
+func TimeDecayScorer(timestampField string, halfLife time.Duration) func(dist float64, meta map[string]string) float64 {
+	return func(dist float64, meta map[string]string) float64 {
+		ts, ok := parseTimestamp(meta[timestampField])
+		if !ok || halfLife <= 0 {
+			return dist
+		}
+		age := time.Since(ts)
+		if age < 0 {
+			age = 0
+		}
+		return (1+dist)*math.Exp2(float64(age)/float64(halfLife)) - 1
+	}
+}
@@ -0,0 +1,68 @@
+package lsh
+
+import (
+	"sort"
+)
+
+const (
+	// selectThreshold is a number of requested closest candidates, starting from which
+	// candidates are collected into a slice and selected with quickselect instead of the heap
+	selectThreshold = 256
+)
+
+// partition moves items less than the pivot (median of three) to the left,
+// returns pivot's final position
+func partition(items []*Neighbor) int {
+	mid, last := len(items)/2, len(items)-1
+	if lessNeighbor(items[mid], items[0]) {
+		items[mid], items[0] = items[0], items[mid]
+	}
+	if lessNeighbor(items[last], items[0]) {
+		items[last], items[0] = items[0], items[last]
+	}
+	if lessNeighbor(items[mid], items[last]) {
+		items[mid], items[last] = items[last], items[mid]
+	}
+	pivot := items[last]
+	pos := 0
+	for i := 0; i < last; i++ {
+		if lessNeighbor(items[i], pivot) {
+			items[i], items[pos] = items[pos], items[i]
+			pos++
+		}
+	}
+	items[pos], items[last] = items[last], items[pos]
+	return pos
+}
+
+// quickselect reorders items so the first k of them are the closest ones (in any order)
+func quickselect(items []*Neighbor, k int) {
+	for len(items) > 1 && k > 0 && k < len(items) {
+		pos := partition(items)
+		if pos == k || pos == k-1 {
+			return
+		}
+		if pos > k {
+			items = items[:pos]
+			continue
+		}
+		items = items[pos+1:]
+		k -= pos + 1
+	}
+}
+
+// selectClosest returns up to k closest items sorted by distance, reordering the input slice
+func selectClosest(items []*Neighbor, k int) []*Neighbor {
+	if k < len(items) {
+		quickselect(items, k)
+		items = items[:k]
+	}
+	sortNeighborsPtrs(items)
+	return items
+}
+
+func sortNeighborsPtrs(neighbors []*Neighbor) {
+	sort.Slice(neighbors, func(i, j int) bool {
+		return lessNeighbor(neighbors[i], neighbors[j])
+	})
+}
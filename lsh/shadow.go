@@ -0,0 +1,271 @@
+package lsh
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	writesUnsupportedErr = errors.New("primary index doesn't support writes")
+)
+
+// Writer is implemented by indexes supporting single record writes, e.g. LSHIndex
+type Writer interface {
+	Insert(id string, vec []float64) (uint64, error)
+	Delete(id string) error
+}
+
+// ShadowStats holds comparison of the shadow index against the primary one;
+// overlap is a share of primary results also found by the shadow index
+type ShadowStats struct {
+	Queries  int
+	Compared int
+	// Dropped is a number of sampled queries skipped since the comparison queue was full
+	Dropped          int
+	ShadowErrors     int
+	LastShadowErr    error
+	MeanOverlap      float64
+	MeanLatencyDelta time.Duration
+}
+
+type shadowQuery struct {
+	query          []float64
+	maxNN          int
+	distanceThrsh  float64
+	primary        []Neighbor
+	primaryLatency time.Duration
+}
+
+// ShadowIndex serves searches from the primary index, and mirrors training, writes and
+// a sampled fraction of queries to the shadow index, to validate new configurations
+type ShadowIndex struct {
+	mx             sync.Mutex
+	drained        *sync.Cond
+	pending        int
+	workers        sync.WaitGroup
+	queue          chan shadowQuery
+	closeMx        sync.RWMutex
+	closed         bool
+	primary        Indexer
+	shadow         Indexer
+	sampleFraction float64
+	stats          ShadowStats
+	overlapSum     float64
+	latencyDelta   time.Duration
+}
+
+// NewShadowIndex starts workers comparing sampled queries; queries are dropped
+// when queueSize of them are already waiting
+func NewShadowIndex(primary, shadow Indexer, sampleFraction float64, queueSize, workers int) *ShadowIndex {
+	if workers < 1 {
+		workers = 1
+	}
+	si := &ShadowIndex{
+		queue:          make(chan shadowQuery, queueSize),
+		primary:        primary,
+		shadow:         shadow,
+		sampleFraction: sampleFraction,
+	}
+	si.drained = sync.NewCond(&si.mx)
+	for i := 0; i < workers; i++ {
+		si.workers.Add(1)
+		go si.work()
+	}
+	return si
+}
+
+func (si *ShadowIndex) work() {
+	defer si.workers.Done()
+	for q := range si.queue {
+		si.compare(q)
+		si.done()
+	}
+}
+
+// done marks the queued query as finished
+func (si *ShadowIndex) done() {
+	si.mx.Lock()
+	defer si.mx.Unlock()
+	si.pending--
+	if si.pending == 0 {
+		si.drained.Broadcast()
+	}
+}
+
+func (si *ShadowIndex) recordShadowErr(err error) {
+	si.mx.Lock()
+	defer si.mx.Unlock()
+	si.stats.ShadowErrors++
+	si.stats.LastShadowErr = err
+}
+
+// Train fills both indexes; shadow index errors are only recorded in stats
+func (si *ShadowIndex) Train(vecs [][]float64, ids []string) error {
+	err := si.primary.Train(vecs, ids)
+	if err != nil {
+		return err
+	}
+	err = si.shadow.Train(vecs, ids)
+	if err != nil {
+		si.recordShadowErr(err)
+	}
+	return nil
+}
+
+// Insert writes vector to the primary index, and then to the shadow one;
+// shadow index errors are only recorded in stats
+func (si *ShadowIndex) Insert(id string, vec []float64) (uint64, error) {
+	primary, ok := si.primary.(Writer)
+	if !ok {
+		return 0, writesUnsupportedErr
+	}
+	version, err := primary.Insert(id, vec)
+	if err != nil {
+		return 0, err
+	}
+	if shadow, ok := si.shadow.(Writer); ok {
+		_, err = shadow.Insert(id, vec)
+	} else {
+		err = writesUnsupportedErr
+	}
+	if err != nil {
+		si.recordShadowErr(err)
+	}
+	return version, nil
+}
+
+// Delete deletes vector from the primary index, and then from the shadow one;
+// shadow index errors are only recorded in stats
+func (si *ShadowIndex) Delete(id string) error {
+	primary, ok := si.primary.(Writer)
+	if !ok {
+		return writesUnsupportedErr
+	}
+	err := primary.Delete(id)
+	if err != nil {
+		return err
+	}
+	if shadow, ok := si.shadow.(Writer); ok {
+		err = shadow.Delete(id)
+	} else {
+		err = writesUnsupportedErr
+	}
+	if err != nil {
+		si.recordShadowErr(err)
+	}
+	return nil
+}
+
+// Search returns NNs from the primary index; sampled queries are repeated
+// on the shadow index in background, or dropped if the queue is full
+func (si *ShadowIndex) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	start := time.Now()
+	closest, err := si.primary.Search(query, maxNN, distanceThrsh)
+	if err != nil {
+		return nil, err
+	}
+	primaryLatency := time.Since(start)
+
+	si.mx.Lock()
+	si.stats.Queries++
+	sampled := rand.Float64() < si.sampleFraction
+	si.mx.Unlock()
+	if sampled {
+		si.enqueue(shadowQuery{
+			query:          query,
+			maxNN:          maxNN,
+			distanceThrsh:  distanceThrsh,
+			primary:        closest,
+			primaryLatency: primaryLatency,
+		})
+	}
+	return closest, nil
+}
+
+func (si *ShadowIndex) enqueue(q shadowQuery) {
+	si.closeMx.RLock()
+	defer si.closeMx.RUnlock()
+	if si.closed {
+		return
+	}
+	si.mx.Lock()
+	si.pending++
+	si.mx.Unlock()
+	select {
+	case si.queue <- q:
+	default:
+		si.mx.Lock()
+		si.stats.Dropped++
+		si.mx.Unlock()
+		si.done()
+	}
+}
+
+func (si *ShadowIndex) compare(q shadowQuery) {
+	start := time.Now()
+	shadow, err := si.shadow.Search(q.query, q.maxNN, q.distanceThrsh)
+	if err != nil {
+		si.recordShadowErr(err)
+		return
+	}
+	shadowLatency := time.Since(start)
+
+	primary := q.primary
+	overlap := 1.0
+	if len(primary) > 0 {
+		shadowIds := make(map[string]bool)
+		for _, nn := range shadow {
+			shadowIds[nn.ID] = true
+		}
+		found := 0
+		for _, nn := range primary {
+			if shadowIds[nn.ID] {
+				found++
+			}
+		}
+		overlap = float64(found) / float64(len(primary))
+	}
+
+	si.mx.Lock()
+	defer si.mx.Unlock()
+	si.stats.Compared++
+	si.overlapSum += overlap
+	si.latencyDelta += shadowLatency - q.primaryLatency
+}
+
+// Wait blocks until all queued shadow searches are finished
+func (si *ShadowIndex) Wait() {
+	si.mx.Lock()
+	defer si.mx.Unlock()
+	for si.pending > 0 {
+		si.drained.Wait()
+	}
+}
+
+// Close finishes queued shadow searches and stops workers,
+// queries sampled after that aren't compared
+func (si *ShadowIndex) Close() {
+	si.closeMx.Lock()
+	if si.closed {
+		si.closeMx.Unlock()
+		return
+	}
+	si.closed = true
+	close(si.queue)
+	si.closeMx.Unlock()
+	si.workers.Wait()
+}
+
+// Stats returns current comparison results
+func (si *ShadowIndex) Stats() ShadowStats {
+	si.mx.Lock()
+	defer si.mx.Unlock()
+	stats := si.stats
+	if stats.Compared > 0 {
+		stats.MeanOverlap = si.overlapSum / float64(stats.Compared)
+		stats.MeanLatencyDelta = si.latencyDelta / time.Duration(stats.Compared)
+	}
+	return stats
+}
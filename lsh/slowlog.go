@@ -0,0 +1,55 @@
+package lsh
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// SlowQuery is a record of the slow-query log
+type SlowQuery struct {
+	TraceID       string
+	Duration      time.Duration
+	MaxNN         int
+	DistanceThrsh float64
+	MaxCandidates int
+	NProbes       int
+	RecallTarget  float64
+	Stats         SearchStats
+}
+
+func (q SlowQuery) String() string {
+	return fmt.Sprintf(
+		"slow query %q took %v: maxNN=%v distanceThrsh=%v maxCandidates=%v nProbes=%v recallTarget=%v; "+
+			"buckets=%v examined=%v passed=%v hashing=%v probing=%v rerank=%v",
+		q.TraceID, q.Duration, q.MaxNN, q.DistanceThrsh, q.MaxCandidates, q.NProbes, q.RecallTarget,
+		q.Stats.BucketsProbed, q.Stats.CandidatesExamined, q.Stats.CandidatesPassed,
+		q.Stats.HashingTime, q.Stats.ProbingTime, q.Stats.RerankTime,
+	)
+}
+
+// logSlowQuery passes search to the slow-query log when it took longer than the threshold
+func (lsh *LSHIndex) logSlowQuery(opts SearchOpts, stats SearchStats, took time.Duration) {
+	threshold, logFunc := lsh.config.getSlowQueryLog()
+	if threshold <= 0 || took < threshold {
+		return
+	}
+	query := SlowQuery{
+		TraceID:       opts.TraceID,
+		Duration:      took,
+		MaxNN:         opts.MaxNN,
+		DistanceThrsh: opts.DistanceThrsh,
+		MaxCandidates: lsh.getMaxCandidates(opts),
+		NProbes:       opts.NProbes,
+		RecallTarget:  opts.RecallTarget,
+		Stats:         stats,
+	}
+	if query.NProbes <= 0 {
+		query.NProbes = 1
+	}
+	if logFunc == nil {
+		log.Print(query)
+		return
+	}
+	logFunc(query)
+}
@@ -0,0 +1,319 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"sort"
+	"sync"
+)
+
+var (
+	sparseLengthErr  = errors.New("sparse vector indices and values must have the same length")
+	sparseIndexErr   = errors.New("sparse vector indices must be non-negative and unique")
+	sparseDensityErr = errors.New("projections density must be in (0, 1]")
+	sparseNPlanesErr = fmt.Errorf("number of planes must be in [1, %v]", store.HashBits)
+	sparseNTablesErr = fmt.Errorf("number of tables must not exceed %v", store.MaxPerms)
+	sparseStoreErr   = errors.New("sparse vectors can't be kept with reduced precision, since indices are stored as values")
+)
+
+// SparseVector holds only non-zero components of a vector, indices are sorted
+type SparseVector struct {
+	Indices []int
+	Values  []float64
+}
+
+// NewSparseVector creates sparse vector sorting its' components by index
+func NewSparseVector(indices []int, values []float64) (SparseVector, error) {
+	if len(indices) != len(values) {
+		return SparseVector{}, sparseLengthErr
+	}
+	vec := SparseVector{
+		Indices: make([]int, len(indices)),
+		Values:  make([]float64, len(values)),
+	}
+	copy(vec.Indices, indices)
+	copy(vec.Values, values)
+	sort.Sort(vec)
+	for i, idx := range vec.Indices {
+		if idx < 0 || (i > 0 && vec.Indices[i-1] == idx) {
+			return SparseVector{}, sparseIndexErr
+		}
+	}
+	return vec, nil
+}
+
+func (v SparseVector) Len() int {
+	return len(v.Indices)
+}
+
+func (v SparseVector) Less(i, j int) bool {
+	return v.Indices[i] < v.Indices[j]
+}
+
+func (v SparseVector) Swap(i, j int) {
+	v.Indices[i], v.Indices[j] = v.Indices[j], v.Indices[i]
+	v.Values[i], v.Values[j] = v.Values[j], v.Values[i]
+}
+
+// SparseDot calculates dot product of two sparse vectors
+func SparseDot(l, r SparseVector) float64 {
+	var dot float64
+	i, j := 0, 0
+	for i < len(l.Indices) && j < len(r.Indices) {
+		switch {
+		case l.Indices[i] == r.Indices[j]:
+			dot += l.Values[i] * r.Values[j]
+			i++
+			j++
+		case l.Indices[i] < r.Indices[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return dot
+}
+
+// SparseNorm calculates l2-norm of a sparse vector
+func SparseNorm(v SparseVector) float64 {
+	var norm float64
+	for _, val := range v.Values {
+		norm += val * val
+	}
+	return math.Sqrt(norm)
+}
+
+// SparseMetric holds implementation of distance metric for sparse vectors
+type SparseMetric interface {
+	GetDist(l, r SparseVector) float64
+}
+
+// SparseAngular calculates cosine distance between two sparse vectors
+type SparseAngular bool
+
+func NewSparseAngular() SparseAngular {
+	return SparseAngular(true)
+}
+
+func (c SparseAngular) GetDist(l, r SparseVector) float64 {
+	var dist float64 = 1.0
+	lrNorm := SparseNorm(l) * SparseNorm(r)
+	if lrNorm > tol {
+		dist = 1.0 - SparseDot(l, r)/lrNorm
+	}
+	if dist < tol {
+		return 0.0
+	}
+	return dist
+}
+
+// SparseInnerProduct uses negative dot product as a distance, so larger products are closer
+type SparseInnerProduct bool
+
+func NewSparseInnerProduct() SparseInnerProduct {
+	return SparseInnerProduct(false)
+}
+
+func (ip SparseInnerProduct) GetDist(l, r SparseVector) float64 {
+	return -SparseDot(l, r)
+}
+
+// SparseHasherConfig holds parameters of sampled sparse random projections
+type SparseHasherConfig struct {
+	NTables int
+	NPlanes int
+	Density float64
+	Seed    int64
+}
+
+// SparseHasher calculates hashes as signs of sparse random projections;
+// projection components are derived from the seed on the fly,
+// so nothing proportional to the space dimensionality is stored
+type SparseHasher struct {
+	Config SparseHasherConfig
+}
+
+func NewSparseHasher(config SparseHasherConfig) (*SparseHasher, error) {
+	if config.Density <= 0 || config.Density > 1 {
+		return nil, sparseDensityErr
+	}
+	if config.NPlanes <= 0 || config.NPlanes > store.HashBits {
+		return nil, sparseNPlanesErr
+	}
+	if config.NTables > store.MaxPerms {
+		return nil, sparseNTablesErr
+	}
+	return &SparseHasher{Config: config}, nil
+}
+
+// splitMix64 is a fast bits mixer used to generate projection components
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// component returns -1, 0 or 1 as a value of plane's component at the given dimension
+func (hasher *SparseHasher) component(table, plane, dim int) float64 {
+	h := splitMix64(uint64(hasher.Config.Seed))
+	h = splitMix64(h ^ uint64(table))
+	h = splitMix64(h ^ uint64(plane))
+	h = splitMix64(h ^ uint64(dim))
+	u := float64(h>>11) / float64(1<<53)
+	if u >= hasher.Config.Density {
+		return 0
+	}
+	if h&1 == 0 {
+		return -1
+	}
+	return 1
+}
+
+// getHashes returns map of calculated lsh values for a given sparse vector
+func (hasher *SparseHasher) getHashes(vec SparseVector) map[int]uint64 {
+	hashes := make(map[int]uint64)
+	for t := 0; t < hasher.Config.NTables; t++ {
+		var hash uint64
+		for p := 0; p < hasher.Config.NPlanes; p++ {
+			var prod float64
+			for i, dim := range vec.Indices {
+				prod += hasher.component(t, p, dim) * vec.Values[i]
+			}
+			if math.Signbit(prod) {
+				hash |= (1 << p)
+			}
+		}
+		hashes[t] = hash
+	}
+	return hashes
+}
+
+// encodeSparse packs sparse vector into the dense one to keep it in the store
+func encodeSparse(vec SparseVector) []float64 {
+	encoded := make([]float64, 2*len(vec.Indices))
+	for i, idx := range vec.Indices {
+		encoded[2*i] = float64(idx)
+		encoded[2*i+1] = vec.Values[i]
+	}
+	return encoded
+}
+
+func decodeSparse(encoded []float64) SparseVector {
+	vec := SparseVector{
+		Indices: make([]int, len(encoded)/2),
+		Values:  make([]float64, len(encoded)/2),
+	}
+	for i := range vec.Indices {
+		vec.Indices[i] = int(encoded[2*i])
+		vec.Values[i] = encoded[2*i+1]
+	}
+	return vec
+}
+
+// SparseNeighbor represent sparse neighbor vector with distance to the query vector
+type SparseNeighbor struct {
+	Vec  SparseVector
+	ID   string
+	Dist float64
+}
+
+// SparseConfig holds all needed constants for creating the sparse index
+type SparseConfig struct {
+	IndexConfig
+	SparseHasherConfig
+}
+
+// SparseLSHIndex holds buckets with sparse vectors and hasher instance
+type SparseLSHIndex struct {
+	config         IndexConfig
+	index          store.Store
+	hasher         *SparseHasher
+	distanceMetric SparseMetric
+}
+
+// NewSparseLsh creates new instance of sparse hasher and index
+func NewSparseLsh(config SparseConfig, s store.Store, metric SparseMetric) (*SparseLSHIndex, error) {
+	if quantizer, ok := s.(store.Quantizer); ok && quantizer.Quantized() {
+		return nil, sparseStoreErr
+	}
+	hasher, err := NewSparseHasher(config.SparseHasherConfig)
+	if err != nil {
+		return nil, err
+	}
+	config.IndexConfig.mx = new(sync.RWMutex)
+	return &SparseLSHIndex{
+		config:         config.IndexConfig,
+		hasher:         hasher,
+		index:          s,
+		distanceMetric: metric,
+	}, nil
+}
+
+// Train fills new search index with sparse vectors
+func (lsh *SparseLSHIndex) Train(vecs []SparseVector, ids []string) error {
+	err := lsh.index.Clear()
+	if err != nil {
+		return err
+	}
+	for i, vec := range vecs {
+		err = lsh.index.SetVector(ids[i], encodeSparse(vec))
+		if err != nil {
+			return err
+		}
+		for perm, hash := range lsh.hasher.getHashes(vec) {
+			err = lsh.index.SetHash(getBucketKey(perm, hash), ids[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Search returns NNs for the sparse query point
+func (lsh *SparseLSHIndex) Search(query SparseVector, maxNN int, distanceThrsh float64) ([]SparseNeighbor, error) {
+	maxCandidates := lsh.config.getMaxCandidates()
+	closestSet := make(map[string]bool)
+	candidates := make([]SparseNeighbor, 0)
+	for perm, hash := range lsh.hasher.getHashes(query) {
+		iter, err := lsh.index.GetHashIterator(getBucketKey(perm, hash))
+		if errors.Is(err, store.ErrNotFound) {
+			continue // NOTE: it's normal when we couldn't find bucket for the query point
+		}
+		if err != nil {
+			return nil, err
+		}
+		for len(candidates) < maxCandidates {
+			id, opened := iter.Next()
+			if !opened {
+				break
+			}
+			if closestSet[id] {
+				continue
+			}
+			closestSet[id] = true
+			encoded, err := lsh.index.GetVector(id)
+			if err != nil {
+				return nil, err
+			}
+			vec := decodeSparse(encoded)
+			dist := lsh.distanceMetric.GetDist(vec, query)
+			if dist <= distanceThrsh {
+				candidates = append(candidates, SparseNeighbor{ID: id, Vec: vec, Dist: dist})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Dist == candidates[j].Dist {
+			return candidates[i].ID < candidates[j].ID
+		}
+		return candidates[i].Dist < candidates[j].Dist
+	})
+	if len(candidates) > maxNN {
+		candidates = candidates[:maxNN]
+	}
+	return candidates, nil
+}
@@ -0,0 +1,315 @@
+package lsh
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const (
+	defaultSpillRunSize    = 1 << 20
+	defaultSpillSampleSize = 100000
+)
+
+var (
+	spillRunErr = errors.New("corrupted spill run")
+)
+
+// EntriesIterator returns ids along with their vectors one by one, e.g. while reading them from the disk;
+// Next returns false at the end of the entries or on the failure, which is then returned by Err
+type EntriesIterator interface {
+	Next() (string, []float64, bool)
+	Err() error
+}
+
+// SpillConfig holds parameters of the disk-spill training
+type SpillConfig struct {
+	// Dir holds temporary run files, system temp dir is used by default
+	Dir string
+	// RunSize is a number of (bucket, id) postings kept in memory before they're spilled to disk
+	RunSize int
+	// SampleSize is a number of vectors, reservoir-sampled on the first pass, the hasher is built on
+	SampleSize int
+}
+
+func (c SpillConfig) getRunSize() int {
+	if c.RunSize <= 0 {
+		return defaultSpillRunSize
+	}
+	return c.RunSize
+}
+
+func (c SpillConfig) getSampleSize() int {
+	if c.SampleSize <= 0 {
+		return defaultSpillSampleSize
+	}
+	return c.SampleSize
+}
+
+// posting is a single id in a single bucket
+type posting struct {
+	bucket uint64
+	id     string
+}
+
+func postingLess(a, b posting) bool {
+	if a.bucket != b.bucket {
+		return a.bucket < b.bucket
+	}
+	return a.id < b.id
+}
+
+// writeRun sorts postings and writes them into the new file of the dir
+func writeRun(dir string, postings []posting) (string, error) {
+	sort.Slice(postings, func(i, j int) bool {
+		return postingLess(postings[i], postings[j])
+	})
+	f, err := ioutil.TempFile(dir, "lsh-run-")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	buf := make([]byte, 8+binary.MaxVarintLen64)
+	for _, p := range postings {
+		binary.LittleEndian.PutUint64(buf, p.bucket)
+		n := binary.PutUvarint(buf[8:], uint64(len(p.id)))
+		_, err = w.Write(buf[:8+n])
+		if err == nil {
+			_, err = w.WriteString(p.id)
+		}
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// runReader reads postings of a single run in order
+type runReader struct {
+	f   *os.File
+	r   *bufio.Reader
+	cur posting
+}
+
+func openRun(path string) (*runReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &runReader{f: f, r: bufio.NewReader(f)}, nil
+}
+
+// next reads the next posting into cur, returns false at the end of the run
+func (r *runReader) next() (bool, error) {
+	var bucket [8]byte
+	_, err := io.ReadFull(r.r, bucket[:])
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, spillRunErr
+	}
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return false, spillRunErr
+	}
+	id := make([]byte, size)
+	_, err = io.ReadFull(r.r, id)
+	if err != nil {
+		return false, spillRunErr
+	}
+	r.cur = posting{bucket: binary.LittleEndian.Uint64(bucket[:]), id: string(id)}
+	return true, nil
+}
+
+// runsHeap holds heads of the runs during k-way merge
+type runsHeap []*runReader
+
+func (h runsHeap) Len() int            { return len(h) }
+func (h runsHeap) Less(i, j int) bool  { return postingLess(h[i].cur, h[j].cur) }
+func (h runsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runsHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runsHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// mergeRuns merges sorted runs and passes postings to emit in (bucket, id) order
+func mergeRuns(paths []string, emit func(posting) error) error {
+	h := make(runsHeap, 0, len(paths))
+	defer func() {
+		for _, r := range h {
+			r.f.Close()
+		}
+	}()
+	for _, path := range paths {
+		r, err := openRun(path)
+		if err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil || !ok {
+			r.f.Close()
+			if err != nil {
+				return fmt.Errorf("%v: %w", path, err)
+			}
+			continue
+		}
+		h = append(h, r)
+	}
+	heap.Init(&h)
+	for h.Len() > 0 {
+		r := h[0]
+		err := emit(r.cur)
+		if err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return fmt.Errorf("%v: %w", r.f.Name(), err)
+		}
+		if ok {
+			heap.Fix(&h, 0)
+			continue
+		}
+		r.f.Close()
+		heap.Pop(&h)
+	}
+	return nil
+}
+
+// sampleEntries reservoir-samples transformed vectors of the whole dataset
+func (lsh *LSHIndex) sampleEntries(it EntriesIterator, size int) ([][]float64, error) {
+	dims := lsh.hasher.getDims()
+	lsh.hasher.mutex.RLock()
+	rnd := newTreeRand(lsh.hasher.Config, 0)
+	lsh.hasher.mutex.RUnlock()
+	sample := make([][]float64, 0, size)
+	seen := 0
+	for {
+		id, vec, ok := it.Next()
+		if !ok {
+			break
+		}
+		vec, err := lsh.config.Pipeline.apply(vec, dims)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector %v: %w", id, err)
+		}
+		seen++
+		if len(sample) < size {
+			sample = append(sample, vec)
+			continue
+		}
+		if j := rnd.Intn(seen); j < size {
+			sample[j] = vec
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("can't read entries: %w", err)
+	}
+	return sample, nil
+}
+
+// TrainSpilled fills new search index with the dataset which doesn't fit into memory,
+// external-sort style: the hasher is built on the sample of the first pass over the data,
+// then, on the second pass, vectors go straight to the store while their postings are
+// collected into sorted runs on disk, which are merged into the store at the end, so buckets
+// are written in order; open must return new iterator over the same data on each call
+func (lsh *LSHIndex) TrainSpilled(open func() (EntriesIterator, error), config SpillConfig) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	it, err := open()
+	if err != nil {
+		return err
+	}
+	sample, err := lsh.sampleEntries(it, config.getSampleSize())
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(config.Dir, "lsh-spill-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	err = lsh.index.Clear()
+	if err != nil {
+		return err
+	}
+	lsh.tombstones.clear()
+	lsh.versions.reset(nil)
+	lsh.invalidateCache()
+	defer lsh.invalidateCache()
+	lsh.hasher.build(sample, lsh.pipelineID)
+	sample = nil
+
+	it, err = open()
+	if err != nil {
+		return err
+	}
+	dims := lsh.hasher.getDims()
+	runSize := config.getRunSize()
+	postings := make([]posting, 0, runSize)
+	runs := make([]string, 0)
+	for {
+		id, vec, ok := it.Next()
+		if !ok {
+			break
+		}
+		vec, err = lsh.config.Pipeline.apply(vec, dims)
+		if err != nil {
+			return fmt.Errorf("invalid vector %v: %w", id, err)
+		}
+		vec = lsh.quantize(vec)
+		err = lsh.index.SetVector(id, vec)
+		if err != nil {
+			return fmt.Errorf("can't store vector %v: %w", id, err)
+		}
+		lsh.versions.init(id)
+		for perm, hash := range lsh.hasher.getHashes(vec) {
+			postings = append(postings, posting{bucket: getBucketKey(perm, hash), id: id})
+		}
+		if len(postings) >= runSize {
+			run, err := writeRun(dir, postings)
+			if err != nil {
+				return fmt.Errorf("can't spill postings: %w", err)
+			}
+			runs = append(runs, run)
+			postings = postings[:0]
+		}
+	}
+	err = it.Err()
+	if err != nil {
+		return fmt.Errorf("can't read entries: %w", err)
+	}
+	if len(postings) > 0 {
+		run, err := writeRun(dir, postings)
+		if err != nil {
+			return fmt.Errorf("can't spill postings: %w", err)
+		}
+		runs = append(runs, run)
+	}
+	postings = nil
+	return mergeRuns(runs, func(p posting) error {
+		err := lsh.index.SetHash(p.bucket, p.id)
+		if err != nil {
+			return fmt.Errorf("can't store hash of vector %v: %w", p.id, err)
+		}
+		return nil
+	})
+}
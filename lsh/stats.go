@@ -0,0 +1,97 @@
+package lsh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"sort"
+)
+
+var (
+	topNErr = errors.New("number of top buckets must not be negative")
+)
+
+// BucketStats holds number of entries in the bucket
+type BucketStats struct {
+	Hash uint64
+	Size int
+}
+
+// PermutationStats describes selectivity of a single hasher permutation (tree):
+// expected collision rate assumes evenly filled leaves, observed one is the probability
+// that two random stored entries share a bucket; much higher observed rate means
+// that the planes split the data poorly
+type PermutationStats struct {
+	Perm                  int
+	Leaves                int
+	MaxDepth              int
+	Entries               int
+	DistinctHashes        int
+	TopBuckets            []BucketStats
+	ExpectedCollisionRate float64
+	ObservedCollisionRate float64
+}
+
+// HashStats returns stats of every permutation with up to topN most populated buckets
+func (lsh *LSHIndex) HashStats(topN int) ([]PermutationStats, error) {
+	if topN < 0 {
+		return nil, topNErr
+	}
+	scanner, ok := lsh.index.(store.Scanner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if !lsh.hasher.isTrained() {
+		return nil, ErrNotTrained
+	}
+	shapes := lsh.hasher.getShapes()
+	buckets := make([][]BucketStats, len(shapes))
+	bucketsIter, err := scanner.GetBuckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range collectBuckets(bucketsIter) {
+		perm, hash := store.UnpackBucketKey(bucket)
+		if perm >= len(shapes) {
+			return nil, fmt.Errorf("bucket %v doesn't match any permutation", store.BucketName(bucket))
+		}
+		iter, err := lsh.index.GetHashIterator(bucket)
+		if err != nil {
+			return nil, fmt.Errorf("can't read bucket %v: %w", store.BucketName(bucket), err)
+		}
+		buckets[perm] = append(buckets[perm], BucketStats{Hash: hash, Size: len(collectIds(iter))})
+	}
+	stats := make([]PermutationStats, len(shapes))
+	for perm, shape := range shapes {
+		permStats := PermutationStats{
+			Perm:           perm,
+			Leaves:         shape.leaves,
+			MaxDepth:       shape.maxDepth,
+			DistinctHashes: len(buckets[perm]),
+		}
+		if shape.leaves > 0 {
+			permStats.ExpectedCollisionRate = 1 / float64(shape.leaves)
+		}
+		sqSum := 0
+		for _, bucket := range buckets[perm] {
+			permStats.Entries += bucket.Size
+			sqSum += bucket.Size * bucket.Size
+		}
+		if permStats.Entries > 0 {
+			permStats.ObservedCollisionRate = float64(sqSum) / float64(permStats.Entries*permStats.Entries)
+		}
+		sort.Slice(buckets[perm], func(i, j int) bool {
+			l, r := buckets[perm][i], buckets[perm][j]
+			if l.Size == r.Size {
+				return l.Hash < r.Hash
+			}
+			return l.Size > r.Size
+		})
+		if len(buckets[perm]) > topN {
+			buckets[perm] = buckets[perm][:topN]
+		}
+		permStats.TopBuckets = buckets[perm]
+		stats[perm] = permStats
+	}
+	return stats, nil
+}
@@ -0,0 +1,49 @@
+package lsh
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	streamOptsErr = errors.New("grouping and MMR need the whole candidates pool, so they can't be used with SearchEach")
+)
+
+// SearchEach passes candidates within opts.DistanceThrsh to emit as soon as they are found,
+// in no particular order; search stops after opts.MaxNN candidates (if > 0), after the
+// candidates limit, or when emit returns false. emit is never called concurrently.
+// Candidates are checked with the exact metric, since there is nothing to re-rank.
+// Records index emits each record once, with the distance of its' first found vector
+func (lsh *LSHIndex) SearchEach(query []float64, opts SearchOpts, emit func(nn Neighbor) bool) error {
+	if opts.GroupBy != "" || opts.MMRLambda > 0 {
+		return streamOptsErr
+	}
+	q, err := lsh.newQuery(query, opts)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if opts.TraceID != "" {
+		ctx = ContextWithTraceID(ctx, opts.TraceID)
+	}
+	ctx, span := lsh.tracer.Start(ctx, "lsh.SearchEach")
+	defer span.End()
+	q.store = lsh.storeWithContext(ctx)
+	emitted := 0
+	records := make(map[string]bool)
+	candidates := newSafeCandidates(lsh.getMaxCandidates(opts), lsh.keyer, 0)
+	candidates.emit = func(candidate *Neighbor) bool {
+		if lsh.config.Records {
+			recordID := getParentID(candidate.ID)
+			if records[recordID] {
+				return true
+			}
+			records[recordID] = true
+			candidate = &Neighbor{ID: recordID, Vec: candidate.Vec, Dist: candidate.Dist}
+		}
+		emitted++
+		return emit(*candidate) && (opts.MaxNN <= 0 || emitted < opts.MaxNN)
+	}
+	hashes := lsh.hasher.getHashes(q.vec)
+	return lsh.probeAll(hashes, q, candidates, lsh.config.getSearchParallelism())
+}
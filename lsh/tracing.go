@@ -0,0 +1,236 @@
+package lsh
+
+import (
+	"context"
+	"github.com/gasparian/lsh-search-go/store"
+)
+
+// Span is a single traced operation, finished by End
+type Span interface {
+	End()
+}
+
+// Tracer starts new spans; it has the same shape as OpenTelemetry's trace.Tracer
+// (without options), so it can be backed by any TracerProvider with a thin adapter
+type Tracer interface {
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+type traceIDKey struct{}
+
+// ContextWithTraceID returns context holding the request trace ID
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceIDFromContext returns trace ID of the request, e.g. to be set as a span attribute
+// by the Tracer adapter; search spans get it from SearchOpts.TraceID
+func TraceIDFromContext(ctx context.Context) (string, bool) {
+	traceID, ok := ctx.Value(traceIDKey{}).(string)
+	return traceID, ok
+}
+
+type noopSpan struct{}
+
+func (s noopSpan) End() {}
+
+type noopTracer struct{}
+
+func (t noopTracer) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+// tracedStore wraps store operations with spans, started from ctx,
+// so they're the children of the index operation span
+type tracedStore struct {
+	store.Store
+	tracer Tracer
+	ctx    context.Context
+}
+
+func newTracedStore(s store.Store, tracer Tracer) *tracedStore {
+	return &tracedStore{
+		Store:  s,
+		tracer: tracer,
+		ctx:    context.Background(),
+	}
+}
+
+// withContext returns the store starting spans from the given context
+func (s *tracedStore) withContext(ctx context.Context) *tracedStore {
+	return &tracedStore{
+		Store:  s.Store,
+		tracer: s.tracer,
+		ctx:    ctx,
+	}
+}
+
+// storeWithContext returns index store, which spans (if it's traced) are started from ctx
+func (lsh *LSHIndex) storeWithContext(ctx context.Context) store.Store {
+	if traced, ok := lsh.index.(*tracedStore); ok {
+		return traced.withContext(ctx)
+	}
+	return lsh.index
+}
+
+func (s *tracedStore) SetVector(id string, vec []float64) error {
+	_, span := s.tracer.Start(s.ctx, "store.SetVector")
+	defer span.End()
+	return s.Store.SetVector(id, vec)
+}
+
+func (s *tracedStore) GetVector(id string) ([]float64, error) {
+	_, span := s.tracer.Start(s.ctx, "store.GetVector")
+	defer span.End()
+	return s.Store.GetVector(id)
+}
+
+func (s *tracedStore) SetHash(bucket uint64, vecId string) error {
+	_, span := s.tracer.Start(s.ctx, "store.SetHash")
+	defer span.End()
+	return s.Store.SetHash(bucket, vecId)
+}
+
+func (s *tracedStore) GetHashIterator(bucket uint64) (store.Iterator, error) {
+	_, span := s.tracer.Start(s.ctx, "store.GetHashIterator")
+	defer span.End()
+	return s.Store.GetHashIterator(bucket)
+}
+
+func (s *tracedStore) DeleteVector(id string) error {
+	deleter, ok := s.Store.(store.Deleter)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.DeleteVector")
+	defer span.End()
+	return deleter.DeleteVector(id)
+}
+
+func (s *tracedStore) DeleteHash(bucket uint64, vecId string) error {
+	deleter, ok := s.Store.(store.Deleter)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.DeleteHash")
+	defer span.End()
+	return deleter.DeleteHash(bucket, vecId)
+}
+
+func (s *tracedStore) SetTombstone(id string) error {
+	tombstoner, ok := s.Store.(store.Tombstoner)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.SetTombstone")
+	defer span.End()
+	return tombstoner.SetTombstone(id)
+}
+
+func (s *tracedStore) DeleteTombstone(id string) error {
+	tombstoner, ok := s.Store.(store.Tombstoner)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.DeleteTombstone")
+	defer span.End()
+	return tombstoner.DeleteTombstone(id)
+}
+
+func (s *tracedStore) IsTombstone(id string) (bool, error) {
+	tombstoner, ok := s.Store.(store.Tombstoner)
+	if !ok {
+		return false, store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.IsTombstone")
+	defer span.End()
+	return tombstoner.IsTombstone(id)
+}
+
+func (s *tracedStore) GetTombstones() (store.Iterator, error) {
+	tombstoner, ok := s.Store.(store.Tombstoner)
+	if !ok {
+		return nil, store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.GetTombstones")
+	defer span.End()
+	return tombstoner.GetTombstones()
+}
+
+func (s *tracedStore) GetVectorsIds() (store.Iterator, error) {
+	scanner, ok := s.Store.(store.Scanner)
+	if !ok {
+		return nil, store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.GetVectorsIds")
+	defer span.End()
+	return scanner.GetVectorsIds()
+}
+
+func (s *tracedStore) GetBuckets() (store.BucketIterator, error) {
+	scanner, ok := s.Store.(store.Scanner)
+	if !ok {
+		return nil, store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.GetBuckets")
+	defer span.End()
+	return scanner.GetBuckets()
+}
+
+func (s *tracedStore) SetMeta(id string, meta map[string]string) error {
+	metaStore, ok := s.Store.(store.MetaStore)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.SetMeta")
+	defer span.End()
+	return metaStore.SetMeta(id, meta)
+}
+
+func (s *tracedStore) GetMeta(id string) (map[string]string, error) {
+	metaStore, ok := s.Store.(store.MetaStore)
+	if !ok {
+		return nil, store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.GetMeta")
+	defer span.End()
+	return metaStore.GetMeta(id)
+}
+
+func (s *tracedStore) Clear() error {
+	_, span := s.tracer.Start(s.ctx, "store.Clear")
+	defer span.End()
+	return s.Store.Clear()
+}
+
+func (s *tracedStore) Ping() error {
+	checker, ok := s.Store.(store.HealthChecker)
+	if !ok {
+		return nil
+	}
+	_, span := s.tracer.Start(s.ctx, "store.Ping")
+	defer span.End()
+	return checker.Ping()
+}
+
+func (s *tracedStore) Reconnect() error {
+	reconnecter, ok := s.Store.(store.Reconnecter)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	_, span := s.tracer.Start(s.ctx, "store.Reconnect")
+	defer span.End()
+	return reconnecter.Reconnect()
+}
+
+func (s *tracedStore) Update(fn func(tx store.Store) error) error {
+	txn, ok := s.Store.(store.Txn)
+	if !ok {
+		return fn(s)
+	}
+	ctx, span := s.tracer.Start(s.ctx, "store.Update")
+	defer span.End()
+	return txn.Update(func(tx store.Store) error {
+		return fn(newTracedStore(tx, s.tracer).withContext(ctx))
+	})
+}
@@ -0,0 +1,77 @@
+package lsh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gonum.org/v1/gonum/blas/blas64"
+	"hash/fnv"
+	"math"
+)
+
+var (
+	// ErrPipelineMismatch is returned when the index has been trained with another transform pipeline
+	ErrPipelineMismatch = errors.New("transform pipeline differs from the one used for training")
+)
+
+// Pipeline transforms vectors the same way before indexing and before search:
+// dimensions and values are validated, then vectors are scaled (if Scaler is set)
+// and L2 normalized (if Normalize is set); stored vectors are the transformed ones
+type Pipeline struct {
+	Scaler    *StandartScaler
+	Normalize bool
+}
+
+// id fingerprints pipeline parameters, it's empty for the identity pipeline
+func (p *Pipeline) id() string {
+	if p == nil || (p.Scaler == nil && !p.Normalize) {
+		return ""
+	}
+	scaler := uint64(0)
+	if p.Scaler != nil {
+		h := fnv.New64a()
+		buf := make([]byte, 8)
+		p.Scaler.RLock()
+		for _, vec := range []blas64.Vector{p.Scaler.mean.RawVector(), p.Scaler.std.RawVector()} {
+			for _, val := range vec.Data {
+				binary.LittleEndian.PutUint64(buf, math.Float64bits(val))
+				h.Write(buf)
+			}
+		}
+		p.Scaler.RUnlock()
+		scaler = h.Sum64()
+	}
+	return fmt.Sprintf("scaler=%x,normalize=%v", scaler, p.Normalize)
+}
+
+// apply validates the vector and returns its' transformed copy
+func (p *Pipeline) apply(vec []float64, dims int) ([]float64, error) {
+	err := validateVector(vec, dims)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return vec, nil
+	}
+	res := NewVec(make([]float64, len(vec)))
+	copy(res.Data, vec)
+	if p.Scaler != nil {
+		res = p.Scaler.Scale(res.Data)
+	}
+	if p.Normalize {
+		norm := blas64.Nrm2(res)
+		if norm > tol {
+			blas64.Scal(1/norm, res)
+		}
+	}
+	return res.Data, nil
+}
+
+// transform applies the index pipeline to the vector, checking that the index
+// has been trained with the same pipeline
+func (lsh *LSHIndex) transform(vec []float64) ([]float64, error) {
+	if lsh.hasher.getPipelineID() != lsh.pipelineID {
+		return nil, ErrPipelineMismatch
+	}
+	return lsh.config.Pipeline.apply(vec, lsh.hasher.getDims())
+}
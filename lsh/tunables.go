@@ -0,0 +1,148 @@
+package lsh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchInterval = 10 * time.Second
+)
+
+var (
+	tunablesErr      = errors.New("tunables must not be negative")
+	cacheDisabledErr = errors.New("cache size can't be changed, since the cache is disabled")
+)
+
+// Tunables holds index parameters which can be changed at runtime without rebuilding the index;
+// zero values leave the current ones unchanged. SlowQueryThreshold is in nanoseconds in JSON
+type Tunables struct {
+	MaxCandidates      int           `json:"maxCandidates"`
+	BatchSize          int           `json:"batchSize"`
+	SearchParallelism  int           `json:"searchParallelism"`
+	RerankSize         int           `json:"rerankSize"`
+	SlowQueryThreshold time.Duration `json:"slowQueryThreshold"`
+	// CacheSize resizes the results cache, which must be enabled with IndexConfig.CacheSize
+	CacheSize int `json:"cacheSize"`
+}
+
+// LoadTunables reads tunables from the JSON file
+func LoadTunables(path string) (Tunables, error) {
+	tunables := Tunables{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tunables, err
+	}
+	err = json.Unmarshal(data, &tunables)
+	if err != nil {
+		return tunables, fmt.Errorf("can't parse tunables %v: %w", path, err)
+	}
+	return tunables, nil
+}
+
+// Tunables returns current values of the tunables
+func (lsh *LSHIndex) Tunables() Tunables {
+	defer lsh.config.rlock()()
+	tunables := Tunables{
+		MaxCandidates:      lsh.config.MaxCandidates,
+		BatchSize:          lsh.config.BatchSize,
+		SearchParallelism:  lsh.config.SearchParallelism,
+		RerankSize:         lsh.config.RerankSize,
+		SlowQueryThreshold: lsh.config.SlowQueryThreshold,
+	}
+	if lsh.cache != nil {
+		lsh.cache.mx.Lock()
+		tunables.CacheSize = lsh.cache.size
+		lsh.cache.mx.Unlock()
+	}
+	return tunables
+}
+
+// Reload validates all the tunables first, and then applies them at once under the config lock,
+// so searches never see a mix of the old and new values
+func (lsh *LSHIndex) Reload(tunables Tunables) error {
+	if lsh.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if tunables.MaxCandidates < 0 || tunables.BatchSize < 0 || tunables.SearchParallelism < 0 ||
+		tunables.RerankSize < 0 || tunables.SlowQueryThreshold < 0 || tunables.CacheSize < 0 {
+		return tunablesErr
+	}
+	if tunables.CacheSize > 0 && lsh.cache == nil {
+		return cacheDisabledErr
+	}
+	lsh.config.mx.Lock()
+	defer lsh.config.mx.Unlock()
+	if tunables.MaxCandidates > 0 {
+		lsh.config.MaxCandidates = tunables.MaxCandidates
+	}
+	if tunables.BatchSize > 0 {
+		lsh.config.BatchSize = tunables.BatchSize
+	}
+	if tunables.SearchParallelism > 0 {
+		lsh.config.SearchParallelism = tunables.SearchParallelism
+	}
+	if tunables.RerankSize > 0 {
+		lsh.config.RerankSize = tunables.RerankSize
+	}
+	if tunables.SlowQueryThreshold > 0 {
+		lsh.config.SlowQueryThreshold = tunables.SlowQueryThreshold
+	}
+	if tunables.CacheSize > 0 {
+		lsh.cache.resize(tunables.CacheSize)
+	}
+	return nil
+}
+
+// WatchTunables checks modification time of the JSON file every interval and reloads tunables
+// when it changes (the file is loaded on the first check as well), until returned stop func
+// is called; errors are passed to onError, if set, invalid file is loaded again once it changes;
+// non-positive interval falls back to the default one of 10 seconds
+func (lsh *LSHIndex) WatchTunables(path string, interval time.Duration, onError func(err error)) (stop func()) {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	var modTime time.Time
+	check := func() {
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().Equal(modTime) {
+			return
+		}
+		if err == nil {
+			modTime = info.ModTime()
+			var tunables Tunables
+			tunables, err = LoadTunables(path)
+			if err == nil {
+				err = lsh.Reload(tunables)
+			}
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	go func() {
+		defer ticker.Stop()
+		check()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package lsh
+
+import (
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+)
+
+// BucketEntry is a single vector id stored in the bucket
+type BucketEntry struct {
+	Bucket uint64
+	ID     string
+}
+
+// VerifyReport holds inconsistencies between stored vectors and bucket entries:
+// orphaned entries point to missing vectors, missing entries are absent from the buckets
+// expected by the current hasher, stale entries are present in the unexpected buckets,
+// e.g. all entries of the vectors with dimensions mismatch
+type VerifyReport struct {
+	Vectors         int
+	OrphanedEntries []BucketEntry
+	MissingEntries  []BucketEntry
+	StaleEntries    []BucketEntry
+	DimMismatches   []string
+	Repaired        bool
+}
+
+// IsConsistent returns true when no inconsistencies were found
+func (r VerifyReport) IsConsistent() bool {
+	return len(r.OrphanedEntries) == 0 && len(r.MissingEntries) == 0 &&
+		len(r.StaleEntries) == 0 && len(r.DimMismatches) == 0
+}
+
+func collectIds(iter store.Iterator) []string {
+	ids := make([]string, 0)
+	for {
+		id, opened := iter.Next()
+		if !opened {
+			return ids
+		}
+		ids = append(ids, id)
+	}
+}
+
+// idsIterator iterates over the in-memory ids
+type idsIterator struct {
+	ids []string
+	pos int
+}
+
+func (it *idsIterator) Next() (string, bool) {
+	if it.pos >= len(it.ids) {
+		return "", false
+	}
+	it.pos++
+	return it.ids[it.pos-1], true
+}
+
+func collectBuckets(iter store.BucketIterator) []uint64 {
+	buckets := make([]uint64, 0)
+	for {
+		bucket, opened := iter.Next()
+		if !opened {
+			return buckets
+		}
+		buckets = append(buckets, bucket)
+	}
+}
+
+// scanEntries returns buckets keys for each id stored in buckets
+func scanEntries(s store.Store, scanner store.Scanner) (map[string]map[uint64]bool, error) {
+	bucketsIter, err := scanner.GetBuckets()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]map[uint64]bool)
+	for _, bucket := range collectBuckets(bucketsIter) {
+		iter, err := s.GetHashIterator(bucket)
+		if err != nil {
+			return nil, fmt.Errorf("can't read bucket %v: %w", store.BucketName(bucket), err)
+		}
+		for _, id := range collectIds(iter) {
+			if _, ok := entries[id]; !ok {
+				entries[id] = make(map[uint64]bool)
+			}
+			entries[id][bucket] = true
+		}
+	}
+	return entries, nil
+}
+
+// Verify scans the store and checks that bucket entries match the stored vectors
+// and the current hasher; inconsistencies are fixed when repair is true,
+// which needs the store to implement store.Deleter
+func (lsh *LSHIndex) Verify(repair bool) (VerifyReport, error) {
+	report := VerifyReport{}
+	if repair && lsh.config.ReadOnly {
+		return report, ErrReadOnly
+	}
+	if repair && !lsh.deletable {
+		return report, ErrNotSupported
+	}
+	scanner, ok := lsh.index.(store.Scanner)
+	if !ok {
+		return report, ErrNotSupported
+	}
+	if !lsh.hasher.isTrained() {
+		return report, ErrNotTrained
+	}
+	entries, err := scanEntries(lsh.index, scanner)
+	if err != nil {
+		return report, err
+	}
+	idsIter, err := scanner.GetVectorsIds()
+	if err != nil {
+		return report, err
+	}
+	dims := lsh.hasher.getDims()
+	for _, id := range collectIds(idsIter) {
+		report.Vectors++
+		actual := entries[id]
+		delete(entries, id)
+		vec, err := lsh.index.GetVector(id)
+		if err != nil {
+			return report, fmt.Errorf("can't get vector %v: %w", id, err)
+		}
+		if len(vec) != dims {
+			report.DimMismatches = append(report.DimMismatches, id)
+			for bucket := range actual {
+				report.StaleEntries = append(report.StaleEntries, BucketEntry{Bucket: bucket, ID: id})
+			}
+			continue
+		}
+		for perm, hash := range lsh.hasher.getHashes(vec) {
+			bucket := getBucketKey(perm, hash)
+			if actual[bucket] {
+				delete(actual, bucket)
+				continue
+			}
+			report.MissingEntries = append(report.MissingEntries, BucketEntry{Bucket: bucket, ID: id})
+		}
+		for bucket := range actual {
+			report.StaleEntries = append(report.StaleEntries, BucketEntry{Bucket: bucket, ID: id})
+		}
+	}
+	for id, buckets := range entries {
+		for bucket := range buckets {
+			report.OrphanedEntries = append(report.OrphanedEntries, BucketEntry{Bucket: bucket, ID: id})
+		}
+	}
+	if repair && !report.IsConsistent() {
+		err = lsh.repair(report)
+		if err != nil {
+			return report, err
+		}
+		report.Repaired = true
+	}
+	return report, nil
+}
+
+// repair removes orphaned and stale entries along with the vectors of mismatched dimensions,
+// and adds the missing entries
+func (lsh *LSHIndex) repair(report VerifyReport) error {
+	defer lsh.invalidateCache()
+	deleter := lsh.index.(store.Deleter)
+	for _, entries := range [][]BucketEntry{report.OrphanedEntries, report.StaleEntries} {
+		for _, entry := range entries {
+			err := deleter.DeleteHash(entry.Bucket, entry.ID)
+			if err != nil {
+				return fmt.Errorf("can't delete hash of vector %v: %w", entry.ID, err)
+			}
+		}
+	}
+	for _, entry := range report.MissingEntries {
+		err := lsh.index.SetHash(entry.Bucket, entry.ID)
+		if err != nil {
+			return fmt.Errorf("can't store hash of vector %v: %w", entry.ID, err)
+		}
+	}
+	for _, id := range report.DimMismatches {
+		err := deleter.DeleteVector(id)
+		if err != nil {
+			return fmt.Errorf("can't delete vector %v: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// BackfillReport holds counts of the backfilled hashes
+type BackfillReport struct {
+	Vectors int
+	// Backfilled is a number of vectors which have been missing from at least one permutation
+	Backfilled int
+	// Entries is a number of the added bucket entries
+	Entries int
+	// Skipped is a number of vectors with dimensions different from the hasher ones
+	Skipped int
+}
+
+// Backfill scans stored vectors and re-hashes only those missing from the expected
+// bucket of some permutation (e.g. after partially failed Train), unlike Verify
+// it never removes entries, so it's cheap to run on the live index
+func (lsh *LSHIndex) Backfill() (BackfillReport, error) {
+	report := BackfillReport{}
+	if lsh.config.ReadOnly {
+		return report, ErrReadOnly
+	}
+	scanner, ok := lsh.index.(store.Scanner)
+	if !ok {
+		return report, ErrNotSupported
+	}
+	if !lsh.hasher.isTrained() {
+		return report, ErrNotTrained
+	}
+	entries, err := scanEntries(lsh.index, scanner)
+	if err != nil {
+		return report, err
+	}
+	idsIter, err := scanner.GetVectorsIds()
+	if err != nil {
+		return report, err
+	}
+	defer lsh.invalidateCache()
+	dims := lsh.hasher.getDims()
+	for _, id := range collectIds(idsIter) {
+		deleted, err := lsh.isDeleted(id)
+		if err != nil {
+			return report, err
+		}
+		if deleted {
+			continue
+		}
+		report.Vectors++
+		vec, err := lsh.index.GetVector(id)
+		if err != nil {
+			return report, fmt.Errorf("can't get vector %v: %w", id, err)
+		}
+		if len(vec) != dims {
+			report.Skipped++
+			continue
+		}
+		missing := false
+		for perm, hash := range lsh.hasher.getHashes(vec) {
+			bucket := getBucketKey(perm, hash)
+			if entries[id][bucket] {
+				continue
+			}
+			err = lsh.index.SetHash(bucket, id)
+			if err != nil {
+				return report, fmt.Errorf("can't store hash of vector %v: %w", id, err)
+			}
+			report.Entries++
+			missing = true
+		}
+		if missing {
+			report.Backfilled++
+		}
+	}
+	return report, nil
+}
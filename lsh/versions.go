@@ -0,0 +1,173 @@
+package lsh
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrVersionNotFound is returned when there is no index of the requested version
+	ErrVersionNotFound = errors.New("index version not found")
+
+	servingVersionDropErr = errors.New("serving version can't be dropped")
+)
+
+// IndexFactory creates new empty index, usually backed by its' own store
+type IndexFactory func() (*LSHIndex, error)
+
+// indexVersion counts in-flight searches, so the dropped version is cleared only after them
+type indexVersion struct {
+	index   *LSHIndex
+	readers sync.WaitGroup
+}
+
+// VersionedIndex keeps several versions of the index and serves searches from one of them,
+// so the index can be rebuilt in background and then switched atomically
+type VersionedIndex struct {
+	mx          sync.RWMutex
+	factory     IndexFactory
+	versions    map[int]*indexVersion
+	serving     int
+	lastVersion int
+	onEvent     func(event Event)
+}
+
+func NewVersionedIndex(factory IndexFactory) *VersionedIndex {
+	return &VersionedIndex{
+		factory:  factory,
+		versions: make(map[int]*indexVersion),
+	}
+}
+
+// SetEventHandler sets handler of the versions lifecycle events, nil disables them;
+// handler is called synchronously, after the change is made
+func (vi *VersionedIndex) SetEventHandler(handler func(event Event)) {
+	vi.mx.Lock()
+	defer vi.mx.Unlock()
+	vi.onEvent = handler
+}
+
+// BuildVersion creates and trains new version of the index without serving it
+func (vi *VersionedIndex) BuildVersion(vecs [][]float64, ids []string) (int, error) {
+	index, err := vi.factory()
+	if err != nil {
+		return 0, err
+	}
+	err = index.Train(vecs, ids)
+	if err != nil {
+		return 0, err
+	}
+	vi.mx.Lock()
+	vi.lastVersion++
+	version := vi.lastVersion
+	vi.versions[version] = &indexVersion{index: index}
+	onEvent := vi.onEvent
+	vi.mx.Unlock()
+	emit(onEvent, Event{Type: VersionBuilt, Version: version, Count: len(vecs)})
+	return version, nil
+}
+
+// PromoteVersion switches searches to the given version
+func (vi *VersionedIndex) PromoteVersion(version int) error {
+	vi.mx.Lock()
+	if _, ok := vi.versions[version]; !ok {
+		vi.mx.Unlock()
+		return ErrVersionNotFound
+	}
+	vi.serving = version
+	onEvent := vi.onEvent
+	vi.mx.Unlock()
+	emit(onEvent, Event{Type: VersionPromoted, Version: version})
+	return nil
+}
+
+// ServingVersion returns currently served version, 0 means nothing is served yet
+func (vi *VersionedIndex) ServingVersion() int {
+	vi.mx.RLock()
+	defer vi.mx.RUnlock()
+	return vi.serving
+}
+
+// Versions returns all kept versions in ascending order
+func (vi *VersionedIndex) Versions() []int {
+	vi.mx.RLock()
+	defer vi.mx.RUnlock()
+	versions := make([]int, 0, len(vi.versions))
+	for version := range vi.versions {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Version returns index of the given version
+func (vi *VersionedIndex) Version(version int) (*LSHIndex, error) {
+	vi.mx.RLock()
+	defer vi.mx.RUnlock()
+	v, ok := vi.versions[version]
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+	return v.index, nil
+}
+
+// DropVersion removes non-serving version and clears its' store,
+// once the searches already running on it are finished
+func (vi *VersionedIndex) DropVersion(version int) error {
+	vi.mx.Lock()
+	v, ok := vi.versions[version]
+	if !ok {
+		vi.mx.Unlock()
+		return ErrVersionNotFound
+	}
+	if version == vi.serving {
+		vi.mx.Unlock()
+		return servingVersionDropErr
+	}
+	delete(vi.versions, version)
+	onEvent := vi.onEvent
+	vi.mx.Unlock()
+	emit(onEvent, Event{Type: VersionDropped, Version: version})
+	v.readers.Wait()
+	return v.index.index.Clear()
+}
+
+// CollectGarbage drops all versions older than the serving one
+func (vi *VersionedIndex) CollectGarbage() error {
+	serving := vi.ServingVersion()
+	for _, version := range vi.Versions() {
+		if version >= serving {
+			break
+		}
+		err := vi.DropVersion(version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Train builds new version of the index and promotes it
+func (vi *VersionedIndex) Train(vecs [][]float64, ids []string) error {
+	version, err := vi.BuildVersion(vecs, ids)
+	if err != nil {
+		return err
+	}
+	return vi.PromoteVersion(version)
+}
+
+// Search returns NNs for the query point from the serving version
+func (vi *VersionedIndex) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	vi.mx.RLock()
+	v, ok := vi.versions[vi.serving]
+	if ok {
+		v.readers.Add(1)
+	}
+	vi.mx.RUnlock()
+	if !ok {
+		return nil, ErrNotTrained
+	}
+	defer v.readers.Done()
+	return v.index.Search(query, maxNN, distanceThrsh)
+}
@@ -0,0 +1,28 @@
+package lshtest
+
+import (
+	"github.com/gasparian/lsh-search-go/lsh"
+	"math/rand"
+)
+
+// Planes returns n planes through the origin with normal vectors drawn from the
+// standard normal distribution, the same for the same seed
+func Planes(dims, n int, seed int64) [][]float64 {
+	rnd := rand.New(rand.NewSource(seed))
+	planes := make([][]float64, n)
+	for i := range planes {
+		planes[i] = make([]float64, dims)
+		for j := range planes[i] {
+			planes[i][j] = rnd.NormFloat64()
+		}
+	}
+	return planes
+}
+
+// NewHasher creates hasher of config.NTrees trees of planesPerTree fixed planes each,
+// generated by Planes with the given seed; its' planes are kept on training,
+// so the index built with lsh.NewLshWithHasher hashes vectors the same way on every run;
+// set lsh.IndexConfig.Deterministic as well to get the same results when candidates limit is hit
+func NewHasher(config lsh.HasherConfig, planesPerTree int, seed int64) (*lsh.Hasher, error) {
+	return lsh.NewHasherFromPlanes(Planes(config.Dims, config.NTrees*planesPerTree, seed), config)
+}
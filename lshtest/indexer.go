@@ -0,0 +1,79 @@
+package lshtest
+
+import (
+	"github.com/gasparian/lsh-search-go/lsh"
+	"sync"
+)
+
+// TrainCall holds arguments of the Indexer.Train call
+type TrainCall struct {
+	Vecs [][]float64
+	Ids  []string
+}
+
+// SearchCall holds arguments of the Indexer.Search call
+type SearchCall struct {
+	Query         []float64
+	MaxNN         int
+	DistanceThrsh float64
+}
+
+// Indexer is a scriptable lsh.Indexer mock: calls are recorded and passed to TrainFunc
+// and SearchFunc when they're set; otherwise Train succeeds and Search returns no neighbors
+type Indexer struct {
+	mx          sync.Mutex
+	TrainFunc   func(vecs [][]float64, ids []string) error
+	SearchFunc  func(query []float64, maxNN int, distanceThrsh float64) ([]lsh.Neighbor, error)
+	trainCalls  []TrainCall
+	searchCalls []SearchCall
+}
+
+// Train records the call and passes it to TrainFunc
+func (m *Indexer) Train(vecs [][]float64, ids []string) error {
+	m.mx.Lock()
+	m.trainCalls = append(m.trainCalls, TrainCall{Vecs: vecs, Ids: ids})
+	train := m.TrainFunc
+	m.mx.Unlock()
+	if train == nil {
+		return nil
+	}
+	return train(vecs, ids)
+}
+
+// Search records the call and passes it to SearchFunc
+func (m *Indexer) Search(query []float64, maxNN int, distanceThrsh float64) ([]lsh.Neighbor, error) {
+	m.mx.Lock()
+	m.searchCalls = append(m.searchCalls, SearchCall{Query: query, MaxNN: maxNN, DistanceThrsh: distanceThrsh})
+	search := m.SearchFunc
+	m.mx.Unlock()
+	if search == nil {
+		return nil, nil
+	}
+	return search(query, maxNN, distanceThrsh)
+}
+
+// TrainCalls returns recorded Train calls
+func (m *Indexer) TrainCalls() []TrainCall {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return append([]TrainCall(nil), m.trainCalls...)
+}
+
+// SearchCalls returns recorded Search calls
+func (m *Indexer) SearchCalls() []SearchCall {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return append([]SearchCall(nil), m.searchCalls...)
+}
+
+// Results returns SearchFunc which always returns the given neighbors, limited by maxNN
+func Results(neighbors ...lsh.Neighbor) func(query []float64, maxNN int, distanceThrsh float64) ([]lsh.Neighbor, error) {
+	return func(query []float64, maxNN int, distanceThrsh float64) ([]lsh.Neighbor, error) {
+		if maxNN >= 0 && len(neighbors) > maxNN {
+			return neighbors[:maxNN], nil
+		}
+		return neighbors, nil
+	}
+}
+
+var _ lsh.Indexer = (*Indexer)(nil)
@@ -0,0 +1,98 @@
+package lshtest
+
+import (
+	"errors"
+	"github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func getData() ([][]float64, []string) {
+	vecs := Planes(4, 200, 7)
+	ids := make([]string, len(vecs))
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	return vecs, ids
+}
+
+func TestFixedIndex(t *testing.T) {
+	vecs, ids := getData()
+	config := lsh.HasherConfig{NTrees: 4, Dims: 4}
+	results := make([][]lsh.Neighbor, 2)
+	for run := range results {
+		hasher, err := NewHasher(config, 3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := lsh.NewLshWithHasher(lsh.IndexConfig{BatchSize: 50, MaxCandidates: 20, Deterministic: true}, hasher, NewStore(), lsh.NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = index.Train(vecs, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[run], err = index.Search(vecs[0], 5, math.Inf(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(results[0]) == 0 || results[0][0].ID != ids[0] || !reflect.DeepEqual(results[0], results[1]) {
+		t.Fatalf("Expected identical results, got %v and %v", results[0], results[1])
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	for _, id := range []string{"c", "a", "b"} {
+		s.SetVector(id, []float64{1})
+		s.SetHash(store.PackBucketKey(0, 1), id)
+	}
+	iter, err := s.GetHashIterator(store.PackBucketKey(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for id, ok := iter.Next(); ok; id, ok = iter.Next() {
+		ids = append(ids, id)
+	}
+	if !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+		t.Fatalf("Expected sorted ids, got %v", ids)
+	}
+	_, err = s.GetVector("d")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	failure := errors.New("failure")
+	s.SetError(OpGetVector, failure)
+	_, err = s.GetVector("a")
+	if err != failure {
+		t.Fatalf("Expected injected error, got %v", err)
+	}
+	s.SetError(OpGetVector, nil)
+	_, err = s.GetVector("a")
+	if err != nil || s.Calls(OpGetVector) != 3 {
+		t.Fatalf("Expected 3 calls without error, got %v calls, %v", s.Calls(OpGetVector), err)
+	}
+}
+
+func TestIndexer(t *testing.T) {
+	var indexer lsh.Indexer = &Indexer{
+		SearchFunc: Results(lsh.Neighbor{ID: "a"}, lsh.Neighbor{ID: "b"}),
+	}
+	neighbors, err := indexer.Search([]float64{1}, 1, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(neighbors) != 1 || neighbors[0].ID != "a" {
+		t.Fatalf("Expected scripted neighbor, got %v", neighbors)
+	}
+	calls := indexer.(*Indexer).SearchCalls()
+	if len(calls) != 1 || calls[0].MaxNN != 1 || calls[0].DistanceThrsh != 0.5 {
+		t.Fatalf("Expected recorded call, got %+v", calls)
+	}
+}
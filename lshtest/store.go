@@ -0,0 +1,265 @@
+// Package lshtest provides deterministic fakes for testing code which embeds the search index:
+// in-memory store with ordered iteration and injectable errors, hasher with fixed planes
+// and scriptable Indexer mock
+package lshtest
+
+import (
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"sort"
+	"sync"
+)
+
+// Store operation names, used to inject errors
+const (
+	OpSetVector       = "SetVector"
+	OpGetVector       = "GetVector"
+	OpSetHash         = "SetHash"
+	OpGetHashIterator = "GetHashIterator"
+	OpDeleteVector    = "DeleteVector"
+	OpDeleteHash      = "DeleteHash"
+	OpClear           = "Clear"
+	OpGetVectorsIds   = "GetVectorsIds"
+	OpGetBuckets      = "GetBuckets"
+	OpSetMeta         = "SetMeta"
+	OpGetMeta         = "GetMeta"
+)
+
+// Store is an in-memory store.Store, store.Deleter, store.Scanner and store.MetaStore, which iterates
+// over ids and buckets in sorted order, so the search results don't depend on the insertion order
+type Store struct {
+	mx      sync.RWMutex
+	vecs    map[string][]float64
+	buckets map[uint64]map[string]bool
+	meta    map[string]map[string]string
+	errs    map[string]error
+	calls   map[string]int
+}
+
+// NewStore creates empty store
+func NewStore() *Store {
+	return &Store{
+		vecs:    make(map[string][]float64),
+		buckets: make(map[uint64]map[string]bool),
+		meta:    make(map[string]map[string]string),
+		errs:    make(map[string]error),
+		calls:   make(map[string]int),
+	}
+}
+
+// SetError makes every following call of the operation (see Op constants) fail with err,
+// nil err removes the failure
+func (s *Store) SetError(op string, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err == nil {
+		delete(s.errs, op)
+		return
+	}
+	s.errs[op] = err
+}
+
+// Calls returns number of calls of the operation, including failed ones
+func (s *Store) Calls(op string) int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.calls[op]
+}
+
+// call must be called under the lock
+func (s *Store) call(op string) error {
+	s.calls[op]++
+	return s.errs[op]
+}
+
+type sliceIterator struct {
+	ids []string
+}
+
+func (it *sliceIterator) Next() (string, bool) {
+	if len(it.ids) == 0 {
+		return "", false
+	}
+	id := it.ids[0]
+	it.ids = it.ids[1:]
+	return id, true
+}
+
+type bucketsIterator struct {
+	buckets []uint64
+}
+
+func (it *bucketsIterator) Next() (uint64, bool) {
+	if len(it.buckets) == 0 {
+		return 0, false
+	}
+	bucket := it.buckets[0]
+	it.buckets = it.buckets[1:]
+	return bucket, true
+}
+
+func sortedIds(set map[string]bool) []string {
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *Store) SetVector(id string, vec []float64) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpSetVector); err != nil {
+		return err
+	}
+	stored := make([]float64, len(vec))
+	copy(stored, vec)
+	s.vecs[id] = stored
+	return nil
+}
+
+func (s *Store) GetVector(id string) ([]float64, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpGetVector); err != nil {
+		return nil, err
+	}
+	vec, ok := s.vecs[id]
+	if !ok {
+		return nil, fmt.Errorf("vector %v: %w", id, store.ErrNotFound)
+	}
+	return vec, nil
+}
+
+func (s *Store) SetHash(bucket uint64, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpSetHash); err != nil {
+		return err
+	}
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]bool)
+	}
+	s.buckets[bucket][vecId] = true
+	return nil
+}
+
+// GetHashIterator iterates over the sorted ids of the bucket
+func (s *Store) GetHashIterator(bucket uint64) (store.Iterator, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpGetHashIterator); err != nil {
+		return nil, err
+	}
+	ids, ok := s.buckets[bucket]
+	if !ok {
+		return nil, fmt.Errorf("bucket %v: %w", store.BucketName(bucket), store.ErrNotFound)
+	}
+	return &sliceIterator{ids: sortedIds(ids)}, nil
+}
+
+func (s *Store) DeleteVector(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpDeleteVector); err != nil {
+		return err
+	}
+	if _, ok := s.vecs[id]; !ok {
+		return fmt.Errorf("vector %v: %w", id, store.ErrNotFound)
+	}
+	delete(s.vecs, id)
+	delete(s.meta, id)
+	return nil
+}
+
+func (s *Store) DeleteHash(bucket uint64, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpDeleteHash); err != nil {
+		return err
+	}
+	ids, ok := s.buckets[bucket]
+	if !ok || !ids[vecId] {
+		return fmt.Errorf("hash of vector %v in bucket %v: %w", vecId, store.BucketName(bucket), store.ErrNotFound)
+	}
+	delete(ids, vecId)
+	if len(ids) == 0 {
+		delete(s.buckets, bucket)
+	}
+	return nil
+}
+
+func (s *Store) Clear() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpClear); err != nil {
+		return err
+	}
+	s.vecs = make(map[string][]float64)
+	s.buckets = make(map[uint64]map[string]bool)
+	s.meta = make(map[string]map[string]string)
+	return nil
+}
+
+// GetVectorsIds iterates over the sorted ids of the stored vectors
+func (s *Store) GetVectorsIds() (store.Iterator, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpGetVectorsIds); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(s.vecs))
+	for id := range s.vecs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return &sliceIterator{ids: ids}, nil
+}
+
+// GetBuckets iterates over the sorted bucket keys
+func (s *Store) GetBuckets() (store.BucketIterator, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpGetBuckets); err != nil {
+		return nil, err
+	}
+	buckets := make([]uint64, 0, len(s.buckets))
+	for bucket := range s.buckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i] < buckets[j]
+	})
+	return &bucketsIterator{buckets: buckets}, nil
+}
+
+func (s *Store) SetMeta(id string, meta map[string]string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpSetMeta); err != nil {
+		return err
+	}
+	if _, ok := s.vecs[id]; !ok {
+		return fmt.Errorf("vector %v: %w", id, store.ErrNotFound)
+	}
+	stored := make(map[string]string, len(meta))
+	for k, v := range meta {
+		stored[k] = v
+	}
+	s.meta[id] = stored
+	return nil
+}
+
+func (s *Store) GetMeta(id string) (map[string]string, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.call(OpGetMeta); err != nil {
+		return nil, err
+	}
+	meta, ok := s.meta[id]
+	if !ok {
+		return nil, fmt.Errorf("metadata of %v: %w", id, store.ErrNotFound)
+	}
+	return meta, nil
+}
@@ -0,0 +1,234 @@
+// Package minhash turns raw texts into shingle sets and MinHash signatures,
+// so near-duplicate documents can be found by the estimated Jaccard similarity
+package minhash
+
+import (
+	"errors"
+	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"unicode"
+)
+
+var (
+	shingleSizeErr = errors.New("shingle size must be positive")
+	numHashesErr   = errors.New("number of hash functions must be positive")
+	bandsErr       = errors.New("signature length must be divisible by the number of rows per band")
+	signaturesErr  = errors.New("signatures must be of the same non-zero length")
+	dimsErr        = errors.New("number of dimensions must be positive")
+)
+
+// mersennePrime is used as a modulus of the universal hash functions
+const mersennePrime = (1 << 61) - 1
+
+// Normalize lowercases the text, replaces punctuation with spaces and collapses whitespaces
+func Normalize(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+	space := true
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			b.WriteRune(r)
+			space = false
+			continue
+		}
+		if !space {
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// Tokens returns words of the normalized text
+func Tokens(text string) []string {
+	return strings.Fields(Normalize(text))
+}
+
+// WordShingles returns unique k-grams of the text tokens; texts shorter than k
+// words give a single shingle of all the tokens
+func WordShingles(text string, k int) ([]string, error) {
+	if k <= 0 {
+		return nil, shingleSizeErr
+	}
+	tokens := Tokens(text)
+	if len(tokens) == 0 {
+		return []string{}, nil
+	}
+	if len(tokens) < k {
+		return []string{strings.Join(tokens, " ")}, nil
+	}
+	return unique(len(tokens)-k+1, func(i int) string {
+		return strings.Join(tokens[i:i+k], " ")
+	}), nil
+}
+
+// CharShingles returns unique k-character substrings of the normalized text
+func CharShingles(text string, k int) ([]string, error) {
+	if k <= 0 {
+		return nil, shingleSizeErr
+	}
+	runes := []rune(Normalize(text))
+	if len(runes) == 0 {
+		return []string{}, nil
+	}
+	if len(runes) < k {
+		return []string{string(runes)}, nil
+	}
+	return unique(len(runes)-k+1, func(i int) string {
+		return string(runes[i : i+k])
+	}), nil
+}
+
+func unique(n int, get func(i int) string) []string {
+	seen := make(map[string]bool, n)
+	shingles := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		shingle := get(i)
+		if !seen[shingle] {
+			seen[shingle] = true
+			shingles = append(shingles, shingle)
+		}
+	}
+	return shingles
+}
+
+func hashShingle(shingle string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(shingle))
+	return h.Sum64()
+}
+
+// Hasher calculates MinHash signatures with the fixed set of (a*x + b) mod p hash functions,
+// signatures of the hashers with the same seed and number of hashes are comparable
+type Hasher struct {
+	a []uint64
+	b []uint64
+}
+
+// NewHasher creates MinHash hasher with numHashes hash functions generated from the seed
+func NewHasher(numHashes int, seed int64) (*Hasher, error) {
+	if numHashes <= 0 {
+		return nil, numHashesErr
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	hasher := &Hasher{
+		a: make([]uint64, numHashes),
+		b: make([]uint64, numHashes),
+	}
+	for i := range hasher.a {
+		hasher.a[i] = uint64(rnd.Int63n(mersennePrime-1)) + 1
+		hasher.b[i] = uint64(rnd.Int63n(mersennePrime))
+	}
+	return hasher, nil
+}
+
+// mulMod calculates a*x mod 2^61-1 without overflow
+func mulMod(a, x uint64) uint64 {
+	hi, lo := bits.Mul64(a, x)
+	// NOTE: 2^64 = 2^3 * 2^61 = 8 (mod p)
+	r := (lo & mersennePrime) + (lo >> 61) + (hi << 3)
+	for r >= mersennePrime {
+		r -= mersennePrime
+	}
+	return r
+}
+
+// Signature returns minimum of each hash function over the shingles,
+// empty set gives the signature of math.MaxUint64 values
+func (hasher *Hasher) Signature(shingles []string) []uint64 {
+	signature := make([]uint64, len(hasher.a))
+	for i := range signature {
+		signature[i] = math.MaxUint64
+	}
+	for _, shingle := range shingles {
+		x := hashShingle(shingle) % mersennePrime
+		for i := range signature {
+			h := mulMod(hasher.a[i], x) + hasher.b[i]
+			if h >= mersennePrime {
+				h -= mersennePrime
+			}
+			if h < signature[i] {
+				signature[i] = h
+			}
+		}
+	}
+	return signature
+}
+
+// TextSignature normalizes the text, splits it into word k-shingles and returns their signature
+func (hasher *Hasher) TextSignature(text string, k int) ([]uint64, error) {
+	shingles, err := WordShingles(text, k)
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Signature(shingles), nil
+}
+
+// Similarity estimates Jaccard similarity as a fraction of the equal signature components
+func Similarity(l, r []uint64) (float64, error) {
+	if len(l) != len(r) || len(l) == 0 {
+		return 0, signaturesErr
+	}
+	equal := 0
+	for i := range l {
+		if l[i] == r[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(l)), nil
+}
+
+// Bands splits the signature into bands of rowsPerBand components and hashes each of them,
+// documents sharing at least one band key are the near-duplicate candidates; keys are
+// mixed with the band number, so they can be used as a single set of buckets
+func Bands(signature []uint64, rowsPerBand int) ([]uint64, error) {
+	if rowsPerBand <= 0 || len(signature)%rowsPerBand != 0 {
+		return nil, bandsErr
+	}
+	keys := make([]uint64, len(signature)/rowsPerBand)
+	buf := make([]byte, 8)
+	for band := range keys {
+		h := fnv.New64a()
+		putUint64(buf, uint64(band))
+		h.Write(buf)
+		for _, v := range signature[band*rowsPerBand : (band+1)*rowsPerBand] {
+			putUint64(buf, v)
+			h.Write(buf)
+		}
+		keys[band] = h.Sum64()
+	}
+	return keys, nil
+}
+
+func putUint64(buf []byte, v uint64) {
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(v >> (8 * uint(i)))
+	}
+}
+
+// SparseShingles returns binary sparse vector of the shingles, hashed into dims dimensions,
+// so the texts can be indexed by the lsh.SparseLSHIndex: cosine similarity of such vectors
+// is the shingles overlap normalized by the sets sizes (up to hash collisions)
+func SparseShingles(shingles []string, dims int) (lsh.SparseVector, error) {
+	if dims <= 0 {
+		return lsh.SparseVector{}, dimsErr
+	}
+	set := make(map[int]bool, len(shingles))
+	indices := make([]int, 0, len(shingles))
+	for _, shingle := range shingles {
+		idx := int(hashShingle(shingle) % uint64(dims))
+		if !set[idx] {
+			set[idx] = true
+			indices = append(indices, idx)
+		}
+	}
+	values := make([]float64, len(indices))
+	for i := range values {
+		values[i] = 1
+	}
+	return lsh.NewSparseVector(indices, values)
+}
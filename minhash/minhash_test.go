@@ -0,0 +1,97 @@
+package minhash
+
+import (
+	"math"
+	"testing"
+)
+
+func TestShingles(t *testing.T) {
+	normalized := Normalize("  The quick, BROWN fox!  ")
+	if normalized != "the quick brown fox" {
+		t.Fatalf("Unexpected normalized text: %q", normalized)
+	}
+	shingles, err := WordShingles("a b c a b", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shingles) != 3 || shingles[0] != "a b" || shingles[2] != "c a" {
+		t.Fatalf("Unexpected word shingles: %v", shingles)
+	}
+	shingles, _ = WordShingles("short", 3)
+	if len(shingles) != 1 || shingles[0] != "short" {
+		t.Fatalf("Short text must give a single shingle, got %v", shingles)
+	}
+	shingles, _ = CharShingles("abab", 2)
+	if len(shingles) != 2 {
+		t.Fatalf("Unexpected char shingles: %v", shingles)
+	}
+	_, err = WordShingles("text", 0)
+	if err != shingleSizeErr {
+		t.Fatalf("Expected error %v, got %v", shingleSizeErr, err)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	hasher, err := NewHasher(128, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := "Locality sensitive hashing reduces the dimensionality of high dimensional data, " +
+		"mapping similar items to the same buckets with high probability"
+	nearDup := doc + ", as usual"
+	other := "Completely unrelated sentence about the weather in the mountains this week"
+
+	sig, _ := hasher.TextSignature(doc, 2)
+	nearSig, _ := hasher.TextSignature(nearDup, 2)
+	otherSig, _ := hasher.TextSignature(other, 2)
+	same, _ := hasher.TextSignature(doc, 2)
+	if sim, _ := Similarity(sig, same); sim != 1 {
+		t.Fatalf("Signatures of the same text must be equal, similarity %v", sim)
+	}
+	// NOTE: exact Jaccard similarity of the near duplicate is 18/20
+	nearSim, _ := Similarity(sig, nearSig)
+	if math.Abs(nearSim-0.9) > 0.15 {
+		t.Fatalf("Expected similarity about 0.9, got %v", nearSim)
+	}
+	if otherSim, _ := Similarity(sig, otherSig); otherSim > 0.2 {
+		t.Fatalf("Expected low similarity of the different texts, got %v", otherSim)
+	}
+
+	keys, err := Bands(sig, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nearKeys, _ := Bands(nearSig, 4)
+	otherKeys, _ := Bands(otherSig, 4)
+	shared := func(l, r []uint64) bool {
+		for i := range l {
+			if l[i] == r[i] {
+				return true
+			}
+		}
+		return false
+	}
+	if len(keys) != 32 || !shared(keys, nearKeys) || shared(keys, otherKeys) {
+		t.Fatal("Near duplicate only must share a band with the document")
+	}
+	_, err = Bands(sig, 3)
+	if err != bandsErr {
+		t.Fatalf("Expected error %v, got %v", bandsErr, err)
+	}
+}
+
+func TestSparseShingles(t *testing.T) {
+	shingles, _ := WordShingles("a b c d", 1)
+	vec, err := SparseShingles(shingles, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vec.Len() != 4 || vec.Values[0] != 1 {
+		t.Fatalf("Unexpected sparse vector %+v", vec)
+	}
+	for i := 1; i < vec.Len(); i++ {
+		if vec.Indices[i-1] >= vec.Indices[i] {
+			t.Fatal("Indices must be sorted")
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package snapcrypt encrypts data written to disk (e.g. training checkpoints, which hold
+// the raw vectors) with AES-GCM, using keys of the rotatable keyring
+package snapcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrKeyNotFound is returned when the keyring doesn't hold the key data was encrypted with
+	ErrKeyNotFound = errors.New("encryption key not found")
+	// ErrNotSealed is returned when opening data which isn't encrypted
+	ErrNotSealed = errors.New("data is not encrypted")
+	// ErrMalformed is returned when encrypted data is truncated or corrupted
+	ErrMalformed = errors.New("malformed encrypted data")
+
+	keySizeErr = errors.New("key must be 16, 24 or 32 bytes long")
+	keyIDErr   = errors.New("key id must be 1 to 255 bytes long")
+	noKeyErr   = errors.New("keyring is empty")
+)
+
+// magic precedes the sealed data, the last byte is a format version
+var magic = []byte("LSHE\x01")
+
+// Keyring holds encryption keys by id: new data is sealed with the current key,
+// while the previous ones are kept to open data sealed before the rotation
+type Keyring interface {
+	Current() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+// MemoryKeyring keeps keys in memory
+type MemoryKeyring struct {
+	mx      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewMemoryKeyring() *MemoryKeyring {
+	return &MemoryKeyring{keys: make(map[string][]byte)}
+}
+
+func validateKey(id string, key []byte) error {
+	if len(id) == 0 || len(id) > 255 {
+		return keyIDErr
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return keySizeErr
+}
+
+// Rotate adds the key and makes it current, previous keys are kept
+func (k *MemoryKeyring) Rotate(id string, key []byte) error {
+	err := validateKey(id, key)
+	if err != nil {
+		return err
+	}
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.keys[id] = append([]byte(nil), key...)
+	k.current = id
+	return nil
+}
+
+// Remove drops the retired key, data sealed with it can't be opened anymore
+func (k *MemoryKeyring) Remove(id string) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	delete(k.keys, id)
+	if k.current == id {
+		k.current = ""
+	}
+}
+
+func (k *MemoryKeyring) Current() (string, []byte, error) {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+	if k.current == "" {
+		return "", nil, noKeyErr
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *MemoryKeyring) Key(id string) ([]byte, error) {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts data with the current key of the keyring; the result holds the key id,
+// which is authenticated along with the data, the random nonce and the ciphertext
+func Seal(keyring Keyring, data []byte) ([]byte, error) {
+	id, key, err := keyring.Current()
+	if err != nil {
+		return nil, err
+	}
+	err = validateKey(id, key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(magic)+1+len(id))
+	header = append(header, magic...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(header)+len(nonce)+len(data)+gcm.Overhead())
+	sealed = append(sealed, header...)
+	sealed = append(sealed, nonce...)
+	return gcm.Seal(sealed, nonce, data, header), nil
+}
+
+// IsSealed checks whether data starts with the header of the sealed data
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// KeyID returns id of the key data was sealed with
+func KeyID(data []byte) (string, error) {
+	if !IsSealed(data) {
+		return "", ErrNotSealed
+	}
+	if len(data) <= len(magic) {
+		return "", ErrMalformed
+	}
+	idLen := int(data[len(magic)])
+	if len(data) < len(magic)+1+idLen {
+		return "", ErrMalformed
+	}
+	return string(data[len(magic)+1 : len(magic)+1+idLen]), nil
+}
+
+// Open decrypts data sealed with any of the keyring keys
+func Open(keyring Keyring, data []byte) ([]byte, error) {
+	id, err := KeyID(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keyring.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := len(magic) + 1 + len(id)
+	if len(data) < headerLen+gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrMalformed
+	}
+	nonce := data[headerLen : headerLen+gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[headerLen+gcm.NonceSize():], data[:headerLen])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return plain, nil
+}
+
+// Reseal re-encrypts data with the current key, if it's sealed with another one,
+// so the old key can be removed after all the data is resealed
+func Reseal(keyring Keyring, data []byte) ([]byte, error) {
+	id, err := KeyID(data)
+	if err != nil {
+		return nil, err
+	}
+	current, _, err := keyring.Current()
+	if err != nil {
+		return nil, err
+	}
+	if id == current {
+		return data, nil
+	}
+	plain, err := Open(keyring, data)
+	if err != nil {
+		return nil, err
+	}
+	return Seal(keyring, plain)
+}
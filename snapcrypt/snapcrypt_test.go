@@ -0,0 +1,71 @@
+package snapcrypt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	keyring := NewMemoryKeyring()
+	_, err := Seal(keyring, []byte("data"))
+	if err != noKeyErr {
+		t.Fatalf("Expected error %v, got %v", noKeyErr, err)
+	}
+	err = keyring.Rotate("k1", []byte("short"))
+	if err != keySizeErr {
+		t.Fatalf("Expected error %v, got %v", keySizeErr, err)
+	}
+	keyring.Rotate("k1", bytes.Repeat([]byte{1}, 32))
+	plain := []byte("vectors derived from personal data")
+	sealed, err := Seal(keyring, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, plain) {
+		t.Fatal("Data must be encrypted")
+	}
+	opened, err := Open(keyring, sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("Expected %q, got %q, %v", plain, opened, err)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = Open(keyring, tampered)
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Expected error %v, got %v", ErrMalformed, err)
+	}
+	_, err = Open(keyring, plain)
+	if err != ErrNotSealed {
+		t.Fatalf("Expected error %v, got %v", ErrNotSealed, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keyring := NewMemoryKeyring()
+	keyring.Rotate("k1", bytes.Repeat([]byte{1}, 16))
+	plain := []byte("data")
+	sealed, _ := Seal(keyring, plain)
+	keyring.Rotate("k2", bytes.Repeat([]byte{2}, 16))
+	opened, err := Open(keyring, sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("Data sealed before the rotation must be opened, got %q, %v", opened, err)
+	}
+	resealed, err := Reseal(keyring, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := KeyID(resealed); id != "k2" {
+		t.Fatalf("Data must be resealed with the current key, got %v", id)
+	}
+	keyring.Remove("k1")
+	_, err = Open(keyring, sealed)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Expected error %v, got %v", ErrKeyNotFound, err)
+	}
+	opened, err = Open(keyring, resealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("Resealed data must be opened, got %q, %v", opened, err)
+	}
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"fmt"
+)
+
+// StringKeyedStore is the previous version of the Store interface,
+// which names buckets with strings
+type StringKeyedStore interface {
+	SetVector(id string, vec []float64) error
+	GetVector(id string) ([]float64, error)
+	SetHash(bucketName, vecId string) error
+	GetHashIterator(bucketName string) (Iterator, error)
+	DeleteVector(id string) error
+	DeleteHash(bucketName, vecId string) error
+	Clear() error
+}
+
+// StringKeyedScanner is the previous version of the Scanner interface
+type StringKeyedScanner interface {
+	GetVectorsIds() (Iterator, error)
+	GetBucketsNames() (Iterator, error)
+}
+
+// BucketName returns bucket name in the "perm_hash" format used by string keyed stores
+func BucketName(bucket uint64) string {
+	perm, hash := UnpackBucketKey(bucket)
+	return fmt.Sprintf("%v_%v", perm, hash)
+}
+
+// ParseBucketName returns bucket key encoded in the "perm_hash" bucket name
+func ParseBucketName(bucketName string) (uint64, error) {
+	var perm int
+	var hash uint64
+	_, err := fmt.Sscanf(bucketName, "%d_%d", &perm, &hash)
+	if err != nil {
+		return 0, fmt.Errorf("malformed bucket name %v: %w", bucketName, err)
+	}
+	return PackBucketKey(perm, hash), nil
+}
+
+// stringKeyedAdapter allows to use string keyed stores with the current Store interface,
+// buckets keep their names, so the already filled stores stay readable
+type stringKeyedAdapter struct {
+	StringKeyedStore
+}
+
+func NewStringKeyedAdapter(s StringKeyedStore) Store {
+	return &stringKeyedAdapter{StringKeyedStore: s}
+}
+
+func (s *stringKeyedAdapter) SetHash(bucket uint64, vecId string) error {
+	return s.StringKeyedStore.SetHash(BucketName(bucket), vecId)
+}
+
+func (s *stringKeyedAdapter) GetHashIterator(bucket uint64) (Iterator, error) {
+	return s.StringKeyedStore.GetHashIterator(BucketName(bucket))
+}
+
+func (s *stringKeyedAdapter) DeleteHash(bucket uint64, vecId string) error {
+	return s.StringKeyedStore.DeleteHash(BucketName(bucket), vecId)
+}
+
+func (s *stringKeyedAdapter) GetVectorsIds() (Iterator, error) {
+	scanner, ok := s.StringKeyedStore.(StringKeyedScanner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return scanner.GetVectorsIds()
+}
+
+// bucketNamesIterator parses bucket names of the string keyed store
+type bucketNamesIterator struct {
+	names Iterator
+}
+
+func (it *bucketNamesIterator) Next() (uint64, bool) {
+	for {
+		name, ok := it.names.Next()
+		if !ok {
+			return 0, false
+		}
+		bucket, err := ParseBucketName(name)
+		if err == nil {
+			return bucket, true
+		}
+		// NOTE: skip keys which don't look like buckets (e.g. vectors storage)
+	}
+}
+
+func (s *stringKeyedAdapter) GetBuckets() (BucketIterator, error) {
+	scanner, ok := s.StringKeyedStore.(StringKeyedScanner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	names, err := scanner.GetBucketsNames()
+	if err != nil {
+		return nil, err
+	}
+	return &bucketNamesIterator{names: names}, nil
+}
+
+func (s *stringKeyedAdapter) SetMeta(id string, meta map[string]string) error {
+	metaStore, ok := s.StringKeyedStore.(MetaStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	return metaStore.SetMeta(id, meta)
+}
+
+func (s *stringKeyedAdapter) GetMeta(id string) (map[string]string, error) {
+	metaStore, ok := s.StringKeyedStore.(MetaStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return metaStore.GetMeta(id)
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+// namesIterator iterates over copied names
+type namesIterator struct {
+	names []string
+}
+
+func (it *namesIterator) Next() (string, bool) {
+	if len(it.names) == 0 {
+		return "", false
+	}
+	name := it.names[0]
+	it.names = it.names[1:]
+	return name, true
+}
+
+// stringKeyedStore stores only buckets, enough to check the adapter
+type stringKeyedStore struct {
+	buckets map[string][]string
+}
+
+func (s *stringKeyedStore) SetVector(id string, vec []float64) error { return nil }
+func (s *stringKeyedStore) GetVector(id string) ([]float64, error)   { return nil, ErrNotFound }
+func (s *stringKeyedStore) DeleteVector(id string) error             { return nil }
+func (s *stringKeyedStore) Clear() error                             { return nil }
+
+func (s *stringKeyedStore) SetHash(bucketName, vecId string) error {
+	s.buckets[bucketName] = append(s.buckets[bucketName], vecId)
+	return nil
+}
+
+func (s *stringKeyedStore) GetHashIterator(bucketName string) (Iterator, error) {
+	ids, ok := s.buckets[bucketName]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &namesIterator{names: append([]string{}, ids...)}, nil
+}
+
+func (s *stringKeyedStore) DeleteHash(bucketName, vecId string) error {
+	delete(s.buckets, bucketName)
+	return nil
+}
+
+func (s *stringKeyedStore) GetVectorsIds() (Iterator, error) {
+	return &namesIterator{}, nil
+}
+
+func (s *stringKeyedStore) GetBucketsNames() (Iterator, error) {
+	names := []string{"vec"}
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	return &namesIterator{names: names}, nil
+}
+
+func TestBucketKey(t *testing.T) {
+	bucket := PackBucketKey(3, 1<<(HashBits-1)|5)
+	perm, hash := UnpackBucketKey(bucket)
+	if perm != 3 || hash != 1<<(HashBits-1)|5 {
+		t.Fatalf("Wrong unpacked key: %v, %v", perm, hash)
+	}
+	parsed, err := ParseBucketName(BucketName(bucket))
+	if err != nil || parsed != bucket {
+		t.Fatalf("Bucket name must be parsed back, got %v, %v", parsed, err)
+	}
+}
+
+func TestStringKeyedAdapter(t *testing.T) {
+	inner := &stringKeyedStore{buckets: make(map[string][]string)}
+	s := NewStringKeyedAdapter(inner)
+	bucket := PackBucketKey(1, 42)
+	err := s.SetHash(bucket, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inner.buckets["1_42"]; !ok {
+		t.Fatalf("Bucket must keep the string name, got %v", inner.buckets)
+	}
+	iter, err := s.GetHashIterator(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := iter.Next()
+	if !ok || id != "0" {
+		t.Fatalf("Wrong id: %v", id)
+	}
+	buckets, err := s.(Scanner).GetBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := buckets.Next()
+	if !ok || key != bucket {
+		t.Fatalf("Wrong bucket key: %v", key)
+	}
+	_, ok = buckets.Next()
+	if ok {
+		t.Fatal("Non-bucket keys must be skipped")
+	}
+	_, err = s.(MetaStore).GetMeta("0")
+	if !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Expected ErrNotSupported, got %v", err)
+	}
+}
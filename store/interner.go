@@ -0,0 +1,71 @@
+package store
+
+import (
+	"sync"
+)
+
+// Interner assigns dense uint64 keys to string ids, so stores can keep each id
+// string only once and use the keys in postings
+type Interner struct {
+	mx   sync.RWMutex
+	keys map[string]uint64
+	ids  []string
+}
+
+func NewInterner() *Interner {
+	return &Interner{
+		keys: make(map[string]uint64),
+	}
+}
+
+// Intern returns key of the id, assigning the next one for the new ids
+func (in *Interner) Intern(id string) uint64 {
+	in.mx.RLock()
+	key, ok := in.keys[id]
+	in.mx.RUnlock()
+	if ok {
+		return key
+	}
+	in.mx.Lock()
+	defer in.mx.Unlock()
+	if key, ok := in.keys[id]; ok {
+		return key
+	}
+	key = uint64(len(in.ids))
+	in.keys[id] = key
+	in.ids = append(in.ids, id)
+	return key
+}
+
+// Key returns key of the already interned id
+func (in *Interner) Key(id string) (uint64, bool) {
+	in.mx.RLock()
+	defer in.mx.RUnlock()
+	key, ok := in.keys[id]
+	return key, ok
+}
+
+// ID returns id by its' key
+func (in *Interner) ID(key uint64) (string, bool) {
+	in.mx.RLock()
+	defer in.mx.RUnlock()
+	if key >= uint64(len(in.ids)) {
+		return "", false
+	}
+	return in.ids[key], true
+}
+
+// Len returns number of interned ids
+func (in *Interner) Len() int {
+	in.mx.RLock()
+	defer in.mx.RUnlock()
+	return len(in.ids)
+}
+
+// Reset forgets all interned ids
+func (in *Interner) Reset() {
+	in.mx.Lock()
+	defer in.mx.Unlock()
+	in.keys = make(map[string]uint64)
+	in.ids = nil
+}
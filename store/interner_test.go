@@ -0,0 +1,25 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestInterner(t *testing.T) {
+	in := NewInterner()
+	a := in.Intern("a")
+	b := in.Intern("b")
+	if in.Intern("a") != a || a == b || in.Len() != 2 {
+		t.Fatal("Ids must be interned once")
+	}
+	id, ok := in.ID(b)
+	if !ok || id != "b" {
+		t.Fatalf("Wrong id: %v", id)
+	}
+	if _, ok := in.Key("c"); ok {
+		t.Fatal("Unknown id must not have a key")
+	}
+	in.Reset()
+	if _, ok := in.ID(a); ok || in.Len() != 0 {
+		t.Fatal("Ids must be forgotten after reset")
+	}
+}
@@ -0,0 +1,47 @@
+package kv
+
+import (
+	"math"
+)
+
+// Encoding defines how vectors are kept in memory
+type Encoding int
+
+const (
+	// Float64Encoding keeps vectors as is
+	Float64Encoding Encoding = iota
+	// BFloat16Encoding keeps 16 upper bits of the float32 representation of each value,
+	// so vectors take 4 times less memory, but lose precision (~3 significant digits);
+	// values are converted back to float64 on read
+	BFloat16Encoding
+)
+
+// toBFloat16 converts value to bfloat16, rounding to the nearest even
+func toBFloat16(v float64) uint16 {
+	bits := math.Float32bits(float32(v))
+	if bits&0x7fffffff > 0x7f800000 { // NOTE: keep NaN a NaN, since rounding may turn it into Inf
+		return uint16(bits>>16) | 0x40
+	}
+	bits += 0x7fff + (bits>>16)&1
+	return uint16(bits >> 16)
+}
+
+func fromBFloat16(v uint16) float64 {
+	return float64(math.Float32frombits(uint32(v) << 16))
+}
+
+func encodeBFloat16(vec []float64) []uint16 {
+	encoded := make([]uint16, len(vec))
+	for i, v := range vec {
+		encoded[i] = toBFloat16(v)
+	}
+	return encoded
+}
+
+func decodeBFloat16(encoded []uint16) []float64 {
+	vec := make([]float64, len(encoded))
+	for i, v := range encoded {
+		vec[i] = fromBFloat16(v)
+	}
+	return vec
+}
@@ -0,0 +1,161 @@
+package kv
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// postingBlockSize is a max number of keys in the single block of the posting list
+	postingBlockSize = 128
+)
+
+// postingBlock holds sorted keys as the first key followed by delta-encoded varints;
+// blocks are never changed in place, but re-encoded, so they can be shared with iterators
+type postingBlock struct {
+	first uint64
+	last  uint64
+	size  int
+	data  []byte
+}
+
+func encodeBlock(keys []uint64) postingBlock {
+	block := postingBlock{
+		first: keys[0],
+		last:  keys[len(keys)-1],
+		size:  len(keys),
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	data := make([]byte, 0, len(keys))
+	for i := 1; i < len(keys); i++ {
+		n := binary.PutUvarint(buf, keys[i]-keys[i-1])
+		data = append(data, buf[:n]...)
+	}
+	block.data = data
+	return block
+}
+
+func (b postingBlock) decode() []uint64 {
+	keys := make([]uint64, 1, b.size)
+	keys[0] = b.first
+	data := b.data
+	for len(data) > 0 {
+		delta, n := binary.Uvarint(data)
+		keys = append(keys, keys[len(keys)-1]+delta)
+		data = data[n:]
+	}
+	return keys
+}
+
+// postingList holds keys of the vectors in the bucket, split into the sorted blocks
+type postingList struct {
+	blocks []postingBlock
+	size   int
+}
+
+// find returns index of the block which may hold the key
+func (l *postingList) find(key uint64) int {
+	idx := sort.Search(len(l.blocks), func(i int) bool {
+		return l.blocks[i].last >= key
+	})
+	if idx == len(l.blocks) {
+		idx--
+	}
+	return idx
+}
+
+// add inserts the key into the list, returns false if it's already there
+func (l *postingList) add(key uint64) bool {
+	if len(l.blocks) == 0 {
+		l.blocks = []postingBlock{encodeBlock([]uint64{key})}
+		l.size++
+		return true
+	}
+	idx := l.find(key)
+	keys := l.blocks[idx].decode()
+	pos := sort.Search(len(keys), func(i int) bool {
+		return keys[i] >= key
+	})
+	if pos < len(keys) && keys[pos] == key {
+		return false
+	}
+	keys = append(keys, 0)
+	copy(keys[pos+1:], keys[pos:])
+	keys[pos] = key
+	if len(keys) <= postingBlockSize {
+		l.blocks[idx] = encodeBlock(keys)
+	} else {
+		half := len(keys) / 2
+		blocks := make([]postingBlock, 0, len(l.blocks)+1)
+		blocks = append(blocks, l.blocks[:idx]...)
+		blocks = append(blocks, encodeBlock(keys[:half]), encodeBlock(keys[half:]))
+		blocks = append(blocks, l.blocks[idx+1:]...)
+		l.blocks = blocks
+	}
+	l.size++
+	return true
+}
+
+// remove deletes the key from the list, returns false if there is no such key
+func (l *postingList) remove(key uint64) bool {
+	if len(l.blocks) == 0 {
+		return false
+	}
+	idx := l.find(key)
+	if key < l.blocks[idx].first || key > l.blocks[idx].last {
+		return false
+	}
+	keys := l.blocks[idx].decode()
+	pos := sort.Search(len(keys), func(i int) bool {
+		return keys[i] >= key
+	})
+	if pos == len(keys) || keys[pos] != key {
+		return false
+	}
+	keys = append(keys[:pos], keys[pos+1:]...)
+	if len(keys) > 0 {
+		l.blocks[idx] = encodeBlock(keys)
+	} else {
+		blocks := make([]postingBlock, 0, len(l.blocks)-1)
+		blocks = append(blocks, l.blocks[:idx]...)
+		l.blocks = append(blocks, l.blocks[idx+1:]...)
+	}
+	l.size--
+	return true
+}
+
+func (l *postingList) len() int {
+	return l.size
+}
+
+// snapshot returns blocks, which stay unchanged on the list updates
+func (l *postingList) snapshot() []postingBlock {
+	blocks := make([]postingBlock, len(l.blocks))
+	copy(blocks, l.blocks)
+	return blocks
+}
+
+// postingsIterator decodes blocks one by one while iterating
+type postingsIterator struct {
+	getID  func(key uint64) (string, bool)
+	blocks []postingBlock
+	keys   []uint64
+	pos    int
+}
+
+func (it *postingsIterator) Next() (string, bool) {
+	for {
+		for it.pos < len(it.keys) {
+			it.pos++
+			if id, ok := it.getID(it.keys[it.pos-1]); ok {
+				return id, true
+			}
+		}
+		if len(it.blocks) == 0 {
+			return "", false
+		}
+		it.keys = it.blocks[0].decode()
+		it.blocks = it.blocks[1:]
+		it.pos = 0
+	}
+}
@@ -4,98 +4,373 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gasparian/lsh-search-go/store"
-	guuid "github.com/google/uuid"
+	"strconv"
 	"sync"
 )
 
 var (
-	bucketNotFoundErr = errors.New("Bucket not found")
-	keyNotFoundErr    = errors.New("Key not found")
+	bucketNotFoundErr = fmt.Errorf("Bucket %w", store.ErrNotFound)
+	keyNotFoundErr    = fmt.Errorf("Key %w", store.ErrNotFound)
+	numericIDErr      = errors.New("id must be a decimal uint64")
 )
 
+// Config holds store options
+type Config struct {
+	// NumericIDs makes store parse ids as decimal uint64 numbers instead of interning them,
+	// so no ids table is kept at all; non-numeric ids are rejected
+	NumericIDs bool
+	// Encoding of the stored vectors, Float64Encoding by default
+	Encoding Encoding
+}
+
+// KVStore keeps vectors and postings keyed by uint64, string ids are interned
+// and stay in the ids table until Clear; postings are kept as delta-encoded blocks
 type KVStore struct {
-	mx sync.RWMutex
-	m  map[string]map[string]interface{}
+	mx       sync.RWMutex
+	config   Config
+	interner *store.Interner
+	vecs     map[uint64][]float64
+	halfVecs map[uint64][]uint16
+	buckets  map[uint64]*postingList
+	meta     map[uint64]map[string]string
+	deleted  map[uint64]bool
 }
 
 func NewKVStore() *KVStore {
+	return NewKVStoreWithConfig(Config{})
+}
+
+func NewKVStoreWithConfig(config Config) *KVStore {
 	return &KVStore{
-		m: make(map[string]map[string]interface{}),
+		config:   config,
+		interner: store.NewInterner(),
+		vecs:     make(map[uint64][]float64),
+		halfVecs: make(map[uint64][]uint16),
+		buckets:  make(map[uint64]*postingList),
+		meta:     make(map[uint64]map[string]string),
+		deleted:  make(map[uint64]bool),
+	}
+}
+
+// internKey returns key of the id, interning the new ones
+func (s *KVStore) internKey(id string) (uint64, error) {
+	if s.config.NumericIDs {
+		return s.numericKey(id)
+	}
+	return s.interner.Intern(id), nil
+}
+
+// lookupKey returns key of the id, if it's known
+func (s *KVStore) lookupKey(id string) (uint64, bool) {
+	if s.config.NumericIDs {
+		key, err := s.numericKey(id)
+		return key, err == nil
+	}
+	return s.interner.Key(id)
+}
+
+func (s *KVStore) numericKey(id string) (uint64, error) {
+	key, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", numericIDErr, id)
 	}
+	return key, nil
+}
+
+func (s *KVStore) getID(key uint64) string {
+	id, _ := s.lookupID(key)
+	return id
 }
 
-type KeysIterator struct {
-	vecIds chan string
+// lookupID returns id by its' key, doesn't need the store lock
+func (s *KVStore) lookupID(key uint64) (string, bool) {
+	if s.config.NumericIDs {
+		return strconv.FormatUint(key, 10), true
+	}
+	return s.interner.ID(key)
+}
+
+func (s *KVStore) setVec(key uint64, vec []float64) {
+	if s.config.Encoding == BFloat16Encoding {
+		s.halfVecs[key] = encodeBFloat16(vec)
+		return
+	}
+	s.vecs[key] = vec
+}
+
+func (s *KVStore) getVec(key uint64) ([]float64, bool) {
+	if s.config.Encoding == BFloat16Encoding {
+		encoded, ok := s.halfVecs[key]
+		if !ok {
+			return nil, false
+		}
+		return decodeBFloat16(encoded), true
+	}
+	vec, ok := s.vecs[key]
+	return vec, ok
+}
+
+func (s *KVStore) hasVec(key uint64) bool {
+	if s.config.Encoding == BFloat16Encoding {
+		_, ok := s.halfVecs[key]
+		return ok
+	}
+	_, ok := s.vecs[key]
+	return ok
+}
+
+// Quantized reports whether vectors are kept with reduced precision
+func (s *KVStore) Quantized() bool {
+	return s.config.Encoding == BFloat16Encoding
+}
+
+// Quantize returns the vector as it would be read back from the store
+func (s *KVStore) Quantize(vec []float64) []float64 {
+	if s.config.Encoding == BFloat16Encoding {
+		return decodeBFloat16(encodeBFloat16(vec))
+	}
+	return vec
 }
 
-func (it *KeysIterator) Next() (string, bool) {
-	vecId, opened := <-it.vecIds
-	if !opened {
+// sliceIterator iterates over keys copied from the store
+type sliceIterator struct {
+	keys []string
+	pos  int
+}
+
+func (it *sliceIterator) Next() (string, bool) {
+	if it.pos >= len(it.keys) {
 		return "", false
 	}
-	return vecId, true
+	it.pos++
+	return it.keys[it.pos-1], true
+}
+
+// bucketsIterator iterates over bucket keys copied from the store
+type bucketsIterator struct {
+	keys []uint64
+	pos  int
 }
 
-func getBucketName(perm int, hash uint64) string {
-	return fmt.Sprintf("%v_%v", perm, hash)
+func (it *bucketsIterator) Next() (uint64, bool) {
+	if it.pos >= len(it.keys) {
+		return 0, false
+	}
+	it.pos++
+	return it.keys[it.pos-1], true
 }
 
 func (s *KVStore) SetVector(id string, vec []float64) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	if _, ok := s.m["vec"]; !ok {
-		s.m["vec"] = make(map[string]interface{})
+	return s.setVector(id, vec)
+}
+
+func (s *KVStore) setVector(id string, vec []float64) error {
+	key, err := s.internKey(id)
+	if err != nil {
+		return err
 	}
-	s.m["vec"][id] = vec
+	s.setVec(key, vec)
 	return nil
 }
 
 func (s *KVStore) GetVector(id string) ([]float64, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	vecTmp, ok := s.m["vec"][id]
+	key, ok := s.lookupKey(id)
+	if !ok {
+		return nil, keyNotFoundErr
+	}
+	vec, ok := s.getVec(key)
 	if !ok {
 		return nil, keyNotFoundErr
 	}
-	vec := vecTmp.([]float64)
 	return vec, nil
 }
 
-func (s *KVStore) SetHash(bucketName, vecId string) error {
+func (s *KVStore) SetHash(bucket uint64, vecId string) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	if _, ok := s.m[bucketName]; !ok {
-		s.m[bucketName] = make(map[string]interface{})
+	return s.setHash(bucket, vecId)
+}
+
+func (s *KVStore) setHash(bucket uint64, vecId string) error {
+	key, err := s.internKey(vecId)
+	if err != nil {
+		return err
 	}
-	uid := guuid.NewString()
-	s.m[bucketName][uid] = vecId
+	postings, ok := s.buckets[bucket]
+	if !ok {
+		postings = &postingList{}
+		s.buckets[bucket] = postings
+	}
+	postings.add(key)
 	return nil
 }
 
-func (s *KVStore) GetHashIterator(bucketName string) (store.Iterator, error) {
+func (s *KVStore) GetHashIterator(bucket uint64) (store.Iterator, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-
-	bucket, ok := s.m[bucketName]
+	postings, ok := s.buckets[bucket]
 	if !ok {
 		return nil, bucketNotFoundErr
 	}
-	hashCh := make(chan string)
-	go func() {
-		for _, v := range bucket {
-			hashCh <- v.(string)
-		}
-		close(hashCh)
-	}()
-	it := &KeysIterator{
-		vecIds: hashCh,
+	return &postingsIterator{getID: s.lookupID, blocks: postings.snapshot()}, nil
+}
+
+func (s *KVStore) DeleteVector(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.deleteVector(id)
+}
+
+func (s *KVStore) deleteVector(id string) error {
+	key, ok := s.lookupKey(id)
+	if !ok {
+		return keyNotFoundErr
+	}
+	if !s.hasVec(key) {
+		return keyNotFoundErr
+	}
+	delete(s.vecs, key)
+	delete(s.halfVecs, key)
+	delete(s.meta, key)
+	return nil
+}
+
+func (s *KVStore) DeleteHash(bucket uint64, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.deleteHash(bucket, vecId)
+}
+
+func (s *KVStore) deleteHash(bucket uint64, vecId string) error {
+	postings, ok := s.buckets[bucket]
+	if !ok {
+		return bucketNotFoundErr
+	}
+	if key, ok := s.lookupKey(vecId); ok {
+		postings.remove(key)
+	}
+	if postings.len() == 0 {
+		delete(s.buckets, bucket)
+	}
+	return nil
+}
+
+// Key returns key of the id, if it has been stored since the last Clear
+func (s *KVStore) Key(id string) (uint64, bool) {
+	return s.lookupKey(id)
+}
+
+func (s *KVStore) GetVectorsIds() (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	ids := make([]string, 0, len(s.vecs)+len(s.halfVecs))
+	for key := range s.vecs {
+		ids = append(ids, s.getID(key))
+	}
+	for key := range s.halfVecs {
+		ids = append(ids, s.getID(key))
 	}
-	return it, nil
+	return &sliceIterator{keys: ids}, nil
+}
+
+func (s *KVStore) GetBuckets() (store.BucketIterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	keys := make([]uint64, 0, len(s.buckets))
+	for bucket := range s.buckets {
+		keys = append(keys, bucket)
+	}
+	return &bucketsIterator{keys: keys}, nil
+}
+
+func (s *KVStore) SetMeta(id string, meta map[string]string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	key, err := s.internKey(id)
+	if err != nil {
+		return err
+	}
+	cpy := make(map[string]string, len(meta))
+	for k, v := range meta {
+		cpy[k] = v
+	}
+	s.meta[key] = cpy
+	return nil
+}
+
+func (s *KVStore) GetMeta(id string) (map[string]string, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	key, ok := s.lookupKey(id)
+	if !ok {
+		return nil, keyNotFoundErr
+	}
+	meta, ok := s.meta[key]
+	if !ok {
+		return nil, keyNotFoundErr
+	}
+	cpy := make(map[string]string, len(meta))
+	for k, v := range meta {
+		cpy[k] = v
+	}
+	return cpy, nil
+}
+
+// SetTombstone marks id as deleted, until the tombstone is removed
+func (s *KVStore) SetTombstone(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	key, err := s.internKey(id)
+	if err != nil {
+		return err
+	}
+	s.deleted[key] = true
+	return nil
+}
+
+func (s *KVStore) DeleteTombstone(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if key, ok := s.lookupKey(id); ok {
+		delete(s.deleted, key)
+	}
+	return nil
+}
+
+func (s *KVStore) IsTombstone(id string) (bool, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	key, ok := s.lookupKey(id)
+	return ok && s.deleted[key], nil
+}
+
+func (s *KVStore) GetTombstones() (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	ids := make([]string, 0, len(s.deleted))
+	for key := range s.deleted {
+		ids = append(ids, s.getID(key))
+	}
+	return &sliceIterator{keys: ids}, nil
+}
+
+// Ping always succeeds, since the store is kept in memory
+func (s *KVStore) Ping() error {
+	return nil
 }
 
 func (s *KVStore) Clear() error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	s.m = make(map[string]map[string]interface{})
+	s.interner.Reset()
+	s.vecs = make(map[uint64][]float64)
+	s.halfVecs = make(map[uint64][]uint16)
+	s.buckets = make(map[uint64]*postingList)
+	s.meta = make(map[uint64]map[string]string)
+	s.deleted = make(map[uint64]bool)
 	return nil
 }
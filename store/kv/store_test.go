@@ -2,7 +2,11 @@ package kv
 
 import (
 	"errors"
+	lshStore "github.com/gasparian/lsh-search-go/store"
+	"math"
+	"math/rand"
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -12,6 +16,7 @@ var (
 	wrongKeyErr             = errors.New("Returned wrong vector uid")
 	iteratorNotClosedErr    = errors.New("Iterator not closed, but it should")
 	vectorShouldNotExistErr = errors.New("Vector should not exist in a store")
+	bucketShouldNotExistErr = errors.New("Bucket should not exist in a store")
 )
 
 func TestKvStore(t *testing.T) {
@@ -40,13 +45,13 @@ func TestKvStore(t *testing.T) {
 
 	t.Run("SetHash", func(t *testing.T) {
 		for k := range vecIds {
-			err := store.SetHash("0", k)
+			err := store.SetHash(0, k)
 			if err != nil {
 				t.Fatal(err)
 			}
 		}
 
-		it, err := store.GetHashIterator("0")
+		it, err := store.GetHashIterator(0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -69,8 +74,338 @@ func TestKvStore(t *testing.T) {
 	t.Run("Clear", func(t *testing.T) {
 		store.Clear()
 		_, err := store.GetVector("0")
-		if err == nil {
+		if !errors.Is(err, lshStore.ErrNotFound) {
 			t.Error(vectorShouldNotExistErr)
 		}
+		_, err = store.GetHashIterator(0)
+		if !errors.Is(err, lshStore.ErrNotFound) {
+			t.Error(bucketShouldNotExistErr)
+		}
+	})
+}
+
+func TestKvStoreDelete(t *testing.T) {
+	store := NewKVStore()
+	store.SetVector("0", []float64{1, 2})
+	store.SetHash(1, "0")
+	store.SetHash(1, "1")
+
+	err := store.DeleteHash(1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := store.GetHashIterator(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := it.Next()
+	if !ok || id != "1" {
+		t.Error(wrongKeyErr)
+	}
+	_, ok = it.Next()
+	if ok {
+		t.Error(iteratorNotClosedErr)
+	}
+	store.DeleteHash(1, "1")
+	_, err = store.GetHashIterator(1)
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Error(bucketShouldNotExistErr)
+	}
+
+	err = store.DeleteVector("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetVector("0")
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Error(vectorShouldNotExistErr)
+	}
+	err = store.DeleteVector("0")
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Error(vectorShouldNotExistErr)
+	}
+}
+
+func TestKvStoreScan(t *testing.T) {
+	store := NewKVStore()
+	store.SetVector("0", []float64{1, 2})
+	store.SetVector("1", []float64{1, 2})
+	store.SetHash(1, "0")
+
+	it, err := store.GetVectorsIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for {
+		id, ok := it.Next()
+		if !ok {
+			break
+		}
+		ids[id] = true
+	}
+	if len(ids) != 2 || !ids["0"] || !ids["1"] {
+		t.Error(wrongKeyErr)
+	}
+
+	buckets, err := store.GetBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, ok := buckets.Next()
+	if !ok || bucket != 1 {
+		t.Error(wrongKeyErr)
+	}
+	_, ok = buckets.Next()
+	if ok {
+		t.Error(iteratorNotClosedErr)
+	}
+}
+
+func TestKvStoreMeta(t *testing.T) {
+	store := NewKVStore()
+	store.SetVector("0", []float64{1, 2})
+	meta := map[string]string{"seller": "a"}
+	err := store.SetMeta("0", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta["seller"] = "b"
+	stored, err := store.GetMeta("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored["seller"] != "a" {
+		t.Errorf("Wrong metadata value: %v", stored["seller"])
+	}
+	store.DeleteVector("0")
+	_, err = store.GetMeta("0")
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Errorf("Metadata should be deleted along with the vector, got %v", err)
+	}
+}
+
+func TestKvStoreIDs(t *testing.T) {
+	store := NewKVStore()
+	store.SetVector("a", []float64{1, 2})
+	store.SetHash(1, "a")
+	store.SetHash(1, "a")
+	store.SetHash(1, "b")
+	if store.interner.Len() != 2 {
+		t.Fatalf("Each id must be interned once, got %v ids", store.interner.Len())
+	}
+	keyA, okA := store.Key("a")
+	keyB, okB := store.Key("b")
+	if !okA || !okB || keyA == keyB {
+		t.Fatalf("Stored ids must have distinct keys, got %v, %v", keyA, keyB)
+	}
+	if _, ok := store.Key("c"); ok {
+		t.Fatal("Unknown id must have no key")
+	}
+	it, _ := store.GetHashIterator(1)
+	ids := make(map[string]bool)
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids[id] = true
+	}
+	if len(ids) != 2 || !ids["a"] || !ids["b"] {
+		t.Errorf("Wrong bucket ids: %v", ids)
+	}
+
+	numeric := NewKVStoreWithConfig(Config{NumericIDs: true})
+	err := numeric.SetVector("42", []float64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numeric.SetHash(1, "42")
+	it, _ = numeric.GetHashIterator(1)
+	id, ok := it.Next()
+	if !ok || id != "42" {
+		t.Error(wrongKeyErr)
+	}
+	if numeric.interner.Len() != 0 {
+		t.Error("Numeric ids must not be interned")
+	}
+	err = numeric.SetVector("a", []float64{1, 2})
+	if err == nil {
+		t.Error("Non-numeric id must be rejected")
+	}
+	_, err = numeric.GetVector("a")
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Error(vectorShouldNotExistErr)
+	}
+}
+
+func TestKvStoreBFloat16(t *testing.T) {
+	store := NewKVStoreWithConfig(Config{Encoding: BFloat16Encoding})
+	vec := []float64{1, -2.5, 0.1, 3.14159, 1e10, 0}
+	err := store.SetVector("0", vec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecReturned, err := store.GetVector("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vecReturned) != len(vec) {
+		t.Fatal(vectorsAreNotEqualErr)
+	}
+	for i := range vec {
+		if math.Abs(vecReturned[i]-vec[i]) > math.Abs(vec[i])/128 {
+			t.Fatalf("Value %v is too far from %v", vecReturned[i], vec[i])
+		}
+	}
+	if vecReturned[0] != 1 || vecReturned[1] != -2.5 || vecReturned[5] != 0 {
+		t.Fatalf("Exactly representable values must not change: %v", vecReturned)
+	}
+	if !store.Quantized() || NewKVStore().Quantized() {
+		t.Fatal("Only bfloat16 store must report quantized vectors")
+	}
+	for i, val := range store.Quantize(vec) {
+		if val != vecReturned[i] && !(math.IsNaN(val) && math.IsNaN(vecReturned[i])) {
+			t.Fatalf("Quantized vector must match the stored one: %v != %v", val, vecReturned[i])
+		}
+	}
+	if !math.IsNaN(fromBFloat16(toBFloat16(math.NaN()))) {
+		t.Fatal("NaN must stay NaN")
+	}
+	if !math.IsInf(fromBFloat16(toBFloat16(math.Inf(-1))), -1) {
+		t.Fatal("-Inf must stay -Inf")
+	}
+	err = store.DeleteVector("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetVector("0")
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Fatal(vectorShouldNotExistErr)
+	}
+}
+
+func TestKvStoreUpdate(t *testing.T) {
+	store := NewKVStore()
+	store.SetVector("0", []float64{1, 2})
+	store.SetHash(1, "0")
+
+	failErr := errors.New("fail")
+	err := store.Update(func(tx lshStore.Store) error {
+		tx.SetVector("1", []float64{3, 4})
+		tx.SetHash(1, "1")
+		tx.(lshStore.Deleter).DeleteHash(1, "0")
+		vec, err := tx.GetVector("1")
+		if err != nil || vec[0] != 3 {
+			t.Fatalf("Transaction must see its' own vectors, got %v, %v", vec, err)
+		}
+		return failErr
 	})
+	if err != failErr {
+		t.Fatalf("Expected error %v, got %v", failErr, err)
+	}
+	_, err = store.GetVector("1")
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Fatal(vectorShouldNotExistErr)
+	}
+	if ids := collectIds(t, store, 1); len(ids) != 1 || ids[0] != "0" {
+		t.Fatalf("Failed transaction must not change the bucket, got %v", ids)
+	}
+
+	err = store.Update(func(tx lshStore.Store) error {
+		err := tx.(lshStore.Deleter).DeleteVector("0")
+		if err != nil {
+			return err
+		}
+		if _, err := tx.GetVector("0"); !errors.Is(err, lshStore.ErrNotFound) {
+			t.Fatal(vectorShouldNotExistErr)
+		}
+		tx.(lshStore.Deleter).DeleteHash(1, "0")
+		tx.SetVector("1", []float64{3, 4})
+		return tx.SetHash(2, "1")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetVector("0")
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Fatal(vectorShouldNotExistErr)
+	}
+	_, err = store.GetHashIterator(1)
+	if !errors.Is(err, lshStore.ErrNotFound) {
+		t.Fatal(bucketShouldNotExistErr)
+	}
+	if ids := collectIds(t, store, 2); len(ids) != 1 || ids[0] != "1" {
+		t.Fatalf("Committed transaction must fill the bucket, got %v", ids)
+	}
+
+	numeric := NewKVStoreWithConfig(Config{NumericIDs: true})
+	err = numeric.Update(func(tx lshStore.Store) error {
+		return tx.SetVector("a", []float64{1})
+	})
+	if !errors.Is(err, numericIDErr) {
+		t.Fatalf("Expected error %v, got %v", numericIDErr, err)
+	}
+}
+
+func collectIds(t *testing.T, store *KVStore, bucket uint64) []string {
+	iter, err := store.GetHashIterator(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for id, ok := iter.Next(); ok; id, ok = iter.Next() {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestPostingList(t *testing.T) {
+	postings := &postingList{}
+	expected := make(map[uint64]bool)
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 5000; i++ {
+		key := uint64(rnd.Intn(3000))
+		if rnd.Intn(3) == 0 {
+			if postings.remove(key) != expected[key] {
+				t.Fatalf("Wrong remove result for key %v", key)
+			}
+			delete(expected, key)
+			continue
+		}
+		if postings.add(key) == expected[key] {
+			t.Fatalf("Wrong add result for key %v", key)
+		}
+		expected[key] = true
+	}
+	if postings.len() != len(expected) {
+		t.Fatalf("Expected %v keys, got %v", len(expected), postings.len())
+	}
+	it := &postingsIterator{
+		getID: func(key uint64) (string, bool) {
+			return strconv.FormatUint(key, 10), true
+		},
+		blocks: postings.snapshot(),
+	}
+	prev := int64(-1)
+	count := 0
+	for {
+		id, ok := it.Next()
+		if !ok {
+			break
+		}
+		key, _ := strconv.ParseInt(id, 10, 64)
+		if key <= prev {
+			t.Fatalf("Keys must be sorted: %v after %v", key, prev)
+		}
+		if !expected[uint64(key)] {
+			t.Fatalf("Unexpected key %v", key)
+		}
+		prev = key
+		count++
+	}
+	if count != len(expected) {
+		t.Fatalf("Expected %v keys while iterating, got %v", len(expected), count)
+	}
+	for _, block := range postings.blocks {
+		if block.size > postingBlockSize {
+			t.Fatalf("Block holds %v keys, max is %v", block.size, postingBlockSize)
+		}
+	}
 }
@@ -0,0 +1,107 @@
+package kv
+
+import (
+	"github.com/gasparian/lsh-search-go/store"
+)
+
+// txn buffers writes until the transaction is committed, reads see the buffered
+// vectors, but buckets are read from the committed state
+type txn struct {
+	s       *KVStore
+	vecs    map[string][]float64
+	deleted map[string]bool
+	ops     []func()
+}
+
+// Update runs fn in a transaction: writes are buffered and applied under a single lock
+// only if fn succeeds, so concurrent readers never see the partial state
+func (s *KVStore) Update(fn func(tx store.Store) error) error {
+	tx := &txn{
+		s:       s,
+		vecs:    make(map[string][]float64),
+		deleted: make(map[string]bool),
+	}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, op := range tx.ops {
+		op()
+	}
+	return nil
+}
+
+// validate rejects ids the store can't hold, so applying the buffered writes can't fail
+func (tx *txn) validate(id string) error {
+	if tx.s.config.NumericIDs {
+		_, err := tx.s.numericKey(id)
+		return err
+	}
+	return nil
+}
+
+func (tx *txn) SetVector(id string, vec []float64) error {
+	err := tx.validate(id)
+	if err != nil {
+		return err
+	}
+	tx.vecs[id] = vec
+	delete(tx.deleted, id)
+	tx.ops = append(tx.ops, func() {
+		tx.s.setVector(id, vec)
+	})
+	return nil
+}
+
+func (tx *txn) GetVector(id string) ([]float64, error) {
+	if tx.deleted[id] {
+		return nil, keyNotFoundErr
+	}
+	if vec, ok := tx.vecs[id]; ok {
+		return vec, nil
+	}
+	return tx.s.GetVector(id)
+}
+
+func (tx *txn) SetHash(bucket uint64, vecId string) error {
+	err := tx.validate(vecId)
+	if err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, func() {
+		tx.s.setHash(bucket, vecId)
+	})
+	return nil
+}
+
+func (tx *txn) GetHashIterator(bucket uint64) (store.Iterator, error) {
+	return tx.s.GetHashIterator(bucket)
+}
+
+// DeleteVector fails if the vector doesn't exist at the moment, the missing one is skipped on commit
+func (tx *txn) DeleteVector(id string) error {
+	_, err := tx.GetVector(id)
+	if err != nil {
+		return err
+	}
+	delete(tx.vecs, id)
+	tx.deleted[id] = true
+	tx.ops = append(tx.ops, func() {
+		tx.s.deleteVector(id)
+	})
+	return nil
+}
+
+// DeleteHash is always buffered, the missing bucket is skipped on commit
+func (tx *txn) DeleteHash(bucket uint64, vecId string) error {
+	tx.ops = append(tx.ops, func() {
+		tx.s.deleteHash(bucket, vecId)
+	})
+	return nil
+}
+
+func (tx *txn) Clear() error {
+	return store.ErrNotSupported
+}
@@ -1,10 +1,47 @@
 package store
 
+import (
+	"errors"
+)
+
+var (
+	// ErrNotFound is returned when requested vector or bucket doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrStoreUnavailable is returned by backends which can't reach their storage
+	ErrStoreUnavailable = errors.New("store is unavailable")
+	// ErrNotSupported is returned when the store doesn't implement an optional operation
+	ErrNotSupported = errors.New("operation is not supported by the store")
+)
+
+const (
+	// HashBits is a number of the bucket key bits holding the hash
+	HashBits = 56
+	// MaxPerms is a max number of permutations which can be packed into the bucket key
+	MaxPerms = 1 << (64 - HashBits)
+	hashMask = 1<<HashBits - 1
+)
+
+// PackBucketKey packs permutation index into the highest bits of the bucket key and
+// hash into the rest of them; hash must fit into HashBits
+func PackBucketKey(perm int, hash uint64) uint64 {
+	return uint64(perm)<<HashBits | hash&hashMask
+}
+
+// UnpackBucketKey returns permutation index and hash packed into the bucket key
+func UnpackBucketKey(bucket uint64) (int, uint64) {
+	return int(bucket >> HashBits), bucket & hashMask
+}
+
 // Iterator consists from only one method which returns uid of the next vector
 type Iterator interface {
 	Next() (string, bool)
 }
 
+// BucketIterator returns keys of the stored buckets one by one
+type BucketIterator interface {
+	Next() (uint64, bool)
+}
+
 // Store methods to be able to hold and use search index
 // It implies storage vectors at one place, and
 // LSH hashes with vectors uid in other places
@@ -12,7 +49,82 @@ type Iterator interface {
 type Store interface {
 	SetVector(id string, vec []float64) error
 	GetVector(id string) ([]float64, error)
-	SetHash(bucketName, vecId string) error
-	GetHashIterator(bucketName string) (Iterator, error)
+	SetHash(bucket uint64, vecId string) error
+	GetHashIterator(bucket uint64) (Iterator, error)
 	Clear() error
 }
+
+// Deleter is an optional interface of stores which can remove single vectors and bucket entries,
+// it's needed to delete, compact and replace vectors
+type Deleter interface {
+	DeleteVector(id string) error
+	DeleteHash(bucket uint64, vecId string) error
+}
+
+// Tombstoner is an optional interface of stores which can keep tombstones of the deleted
+// vectors until compaction, so deletes survive restarts and are seen by every index over the store
+type Tombstoner interface {
+	SetTombstone(id string) error
+	DeleteTombstone(id string) error
+	IsTombstone(id string) (bool, error)
+	GetTombstones() (Iterator, error)
+}
+
+// Scanner is an optional interface of stores which can enumerate their content
+type Scanner interface {
+	GetVectorsIds() (Iterator, error)
+	GetBuckets() (BucketIterator, error)
+}
+
+// Keyer is an optional interface of stores which assign unique uint64 keys to the stored ids,
+// e.g. by interning them, so the ids can be tracked in bitsets
+type Keyer interface {
+	Key(id string) (uint64, bool)
+}
+
+// Quantizer is an optional interface of stores which keep vectors with reduced precision;
+// Quantize returns the vector rounded the same way GetVector would return it after SetVector,
+// so the index can hash exactly what is stored
+type Quantizer interface {
+	Quantized() bool
+	Quantize(vec []float64) []float64
+}
+
+// MetaStore is an optional interface of stores which can hold vectors' metadata
+type MetaStore interface {
+	SetMeta(id string, meta map[string]string) error
+	GetMeta(id string) (map[string]string, error)
+}
+
+// Txn is an optional interface of stores which can apply several writes atomically:
+// either all the writes made by fn through tx are applied, or none of them, if fn returns error
+type Txn interface {
+	Update(fn func(tx Store) error) error
+}
+
+// Update runs fn in a transaction if the store implements Txn,
+// otherwise fn writes to the store directly
+func Update(s Store, fn func(tx Store) error) error {
+	if txn, ok := s.(Txn); ok {
+		return txn.Update(fn)
+	}
+	return fn(s)
+}
+
+// Durable is an optional interface of stores which keep written vectors and buckets across
+// restarts, so e.g. the interrupted training is resumed without writing them again;
+// stores which don't implement it, or return false, are considered volatile
+type Durable interface {
+	Durable() bool
+}
+
+// HealthChecker is an optional interface of stores which can check the connection to their storage,
+// stores which don't implement it are considered always healthy
+type HealthChecker interface {
+	Ping() error
+}
+
+// Reconnecter is an optional interface of stores which can re-establish the lost connection
+type Reconnecter interface {
+	Reconnect() error
+}